@@ -90,6 +90,46 @@ func SplitAt(substring string) func(data []byte, atEOF bool) (advance int, token
 	}
 }
 
+// readSnmpTrapD reads snmptrapd output from r and sends each trap to out
+func readSnmpTrapD(cancel context.CancelFunc, conf snmp.Config, r io.Reader, out chan<- []byte) {
+	bufferSize, err := conf.GetBufferSize()
+	if err != nil {
+		log.Warn().Err(err).Msg("failed parsing snmptrapd.buffer_size")
+		bufferSize = snmp.DefaultBufferSize
+	}
+	buf := make([]byte, bufferSize)
+	scanner := bufio.NewScanner(r)
+	scanner.Split(SplitAt(conf.MagicEnd))
+	scanner.Buffer(buf, bufferSize)
+	magicBegin := []byte(conf.MagicBegin)
+	magicBeginLen := len(magicBegin)
+	log.Info().Msg("trap2json started")
+	// Scan() will stop when snmptrapd is successfully terminated since it will
+	// close os.Stdin stream
+	for scanner.Scan() {
+		metrics.SnmpTrapDProcessed.Inc()
+		line := scanner.Bytes()
+		metrics.SnmpTrapDProcessedBytes.Add(float64(len(line)))
+		log.Trace().Bytes("data", line).Msg("received data")
+		idx := bytes.LastIndex(line, magicBegin)
+		if idx < 0 {
+			log.Debug().Bytes("data", line).Msg("dropping data")
+			metrics.SnmpTrapDDropped.Inc()
+			continue
+		}
+		msg := make([]byte, len(line)-magicBeginLen-idx)
+		copy(msg, line[idx+magicBeginLen:])
+		log.Trace().Bytes("data", msg).Msg("sending data")
+		out <- msg
+		metrics.SnmpTrapDSucceeded.Inc()
+	}
+	if err := scanner.Err(); err != nil {
+		log.Error().Err(err).Msg("scanner error")
+		// in case of scanner error, cancel should be called manually
+		cancel()
+	}
+}
+
 func Run(ctx context.Context, c config, r io.Reader, noSnmpTrapD bool) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -137,7 +177,7 @@ func Run(ctx context.Context, c config, r io.Reader, noSnmpTrapD bool) {
 		case <-ctx.Done():
 		}
 	}()
-	if !noSnmpTrapD {
+	if !noSnmpTrapD && c.SnmpTrapD.Mode == snmp.ModeSnmpTrapD {
 		topWg.Add(1)
 		// terminate snmptrapd when we receive terminate signal
 		go func() {
@@ -176,46 +216,46 @@ func Run(ctx context.Context, c config, r io.Reader, noSnmpTrapD bool) {
 	}
 	for i := 0; i < c.ParseWorkers; i++ {
 		parseWg.Add(1)
-		go snmp.ParserWorker(i+1, parseWg, parseChan, parseSendChan)
+		go snmp.ParserWorker(i+1, parseWg, parseChan, parseSendChan, c.SnmpTrapD.UseRecordTime)
 	}
+	forwarderReloadChan := make(chan []forwarder.Config)
 	forwarderWg.Add(1)
-	go forwarder.StartForwarders(forwarderWg, c.Forwarders, forwarderChan)
-
-	bufferSize, err := c.SnmpTrapD.GetBufferSize()
-	if err != nil {
-		log.Warn().Err(err).Msg("failed parsing snmptrapd.buffer_size")
-		bufferSize = snmp.DefaultBufferSize
+	go forwarder.StartForwarders(forwarderWg, c.Forwarders, forwarderChan, forwarderReloadChan)
+	if c.path != "" {
+		topWg.Add(1)
+		go func() {
+			defer topWg.Done()
+			newReloader(c, corr, forwarderReloadChan).Run(ctx)
+		}()
 	}
-	buf := make([]byte, bufferSize)
-	scanner := bufio.NewScanner(r)
-	scanner.Split(SplitAt(c.SnmpTrapD.MagicEnd))
-	scanner.Buffer(buf, bufferSize)
-	magicBegin := []byte(c.SnmpTrapD.MagicBegin)
-	magicBeginLen := len(magicBegin)
-	log.Info().Msg("trap2json started")
-	// Scan() will stop when snmptrapd is successfully terminated since it will
-	// close os.Stdin stream
-	for scanner.Scan() {
-		metrics.SnmpTrapDProcessed.Inc()
-		line := scanner.Bytes()
-		metrics.SnmpTrapDProcessedBytes.Add(float64(len(line)))
-		log.Trace().Bytes("data", line).Msg("received data")
-		idx := bytes.LastIndex(line, magicBegin)
-		if idx < 0 {
-			log.Debug().Bytes("data", line).Msg("dropping data")
-			metrics.SnmpTrapDDropped.Inc()
-			continue
+
+	if c.SnmpTrapD.Mode == snmp.ModeNative {
+		listener, err := snmp.NewListener(c.SnmpTrapD, parseSendChan)
+		if err != nil {
+			log.Fatal().Err(err).Msg("listener failed to start")
 		}
-		msg := make([]byte, len(line)-magicBeginLen-idx)
-		copy(msg, line[idx+magicBeginLen:])
-		log.Trace().Bytes("data", msg).Msg("sending data")
-		parseChan <- msg
-		metrics.SnmpTrapDSucceeded.Inc()
-	}
-	if err := scanner.Err(); err != nil {
-		log.Error().Err(err).Msg("scanner error")
-		// in case of scanner error, cancel should be called manually
-		cancel()
+		log.Info().Msg("trap2json started")
+		// Run() blocks until we receive terminate signal
+		if err = listener.Run(ctx); err != nil {
+			log.Error().Err(err).Msg("listener error")
+			cancel()
+		}
+	} else {
+		if c.SnmpTrapD.Mode == snmp.ModeSupervised {
+			supervisor := snmp.NewSupervisor(c.SnmpTrapD)
+			topWg.Add(1)
+			go func() {
+				defer topWg.Done()
+				if err := supervisor.Run(ctx); err != nil {
+					log.Error().Err(err).Msg("snmptrapd supervisor error")
+					cancel()
+				}
+			}()
+			r = supervisor.Reader()
+		}
+		// Scan() stops when snmptrapd is terminated, on supervised mode
+		// it's when ctx is done
+		readSnmpTrapD(cancel, c.SnmpTrapD, r, parseChan)
 	}
 	// drain all channels
 	close(parseChan)
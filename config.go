@@ -22,18 +22,32 @@ type config struct {
 	ParseWorkers int `mapstructure:"parse_workers"`
 	Prometheus   metrics.Config
 	Correlate    correlate.Config
+	// WatchConfig reloads the config whenever the config file changes,
+	// reload is always triggered on SIGHUP regardless of this config
+	WatchConfig bool `mapstructure:"watch_config"`
+	// path is the config file location, used for reloading
+	path string
 }
 
 func parseConfig(path string) (config, error) {
 	v := viper.New()
 	v.SetDefault("logger.level", zerolog.InfoLevel)
 	v.SetDefault("snmptrapd.listening", []string{"udp:10162", "udp6:10162"})
+	v.SetDefault("snmptrapd.mode", "snmptrapd")
 	v.SetDefault("parse_workers", runtime.NumCPU())
 	v.SetDefault("prometheus.path", "/metrics")
 	v.SetDefault("prometheus.port", 9285)
 	v.SetDefault("snmptrapd.magic_begin", "--TFWDBEGIN--")
 	v.SetDefault("snmptrapd.magic_end", "--TFWDEND--")
 	v.SetDefault("snmptrapd.buffer_size", "64k")
+	v.SetDefault("snmptrapd.supervisor.command", "snmptrapd")
+	v.SetDefault("snmptrapd.supervisor.args", []string{
+		"-M", "+/etc/trap2json/mibs", "-m", "ALL", "-Lo", "-OnUx", "-f", "-C",
+	})
+	v.SetDefault("snmptrapd.supervisor.config_path", "/etc/trap2json/snmptrapd.conf")
+	v.SetDefault("snmptrapd.supervisor.min_restart_delay", helper.Duration{Duration: time.Second})
+	v.SetDefault("snmptrapd.supervisor.max_restart_delay", helper.Duration{Duration: time.Minute})
+	v.SetDefault("snmptrapd.supervisor.stop_timeout", helper.Duration{Duration: 5 * time.Second})
 	v.SetDefault("correlate.backend_url", "badger://")
 	v.SetDefault("correlate.cleanup_interval", helper.Duration{Duration: time.Hour})
 	v.SetDefault("correlate.ttl", helper.Duration{Duration: 30 * 24 * time.Hour})
@@ -49,5 +63,6 @@ func parseConfig(path string) (config, error) {
 	if err != nil {
 		return config{}, errors.Wrap(err, "failed unmarshalling configuration")
 	}
+	c.path = path
 	return c, nil
 }
@@ -33,12 +33,26 @@ type Backend interface {
 	Close() error
 }
 
-func NewBackend(backendUrl string, ttl, timeout time.Duration) (Backend, error) {
+// ParseURL parses and checks the backend url without connecting to it
+func ParseURL(backendUrl string) (*url.URL, error) {
 	urlParsed, err := url.Parse(backendUrl)
 	if err != nil {
 		return nil, errors.Wrap(err, "invalid url syntax")
 	}
 	switch urlParsed.Scheme {
+	case "badger", "redis", "postgres", "mysql":
+		return urlParsed, nil
+	default:
+		return nil, errors.Errorf("invalid backend scheme: %s", urlParsed.Scheme)
+	}
+}
+
+func NewBackend(backendUrl string, ttl, timeout time.Duration) (Backend, error) {
+	urlParsed, err := ParseURL(backendUrl)
+	if err != nil {
+		return nil, err
+	}
+	switch urlParsed.Scheme {
 	case "badger":
 		return newBadger(urlParsed, ttl)
 	case "redis":
@@ -15,22 +15,30 @@ type Condition struct {
 	Clear      *vm.Program
 }
 
+func compileCondition(condition string) (*vm.Program, error) {
+	opts := []expr.Option{expr.Env(snmp.Payload{}), expr.AsBool()}
+	opts = append(opts, snmp.Functions...)
+	return expr.Compile(condition, opts...)
+}
+
+func compileIdentifiers(identifiers []string) (*vm.Program, error) {
+	opts := []expr.Option{expr.Env(snmp.Payload{}), expr.AsKind(reflect.String)}
+	opts = append(opts, snmp.Functions...)
+	return expr.Compile("SHA256("+strings.Join(identifiers, ",")+")", opts...)
+}
+
 func parseCondition(conf ConditionConfig) (*Condition, error) {
 	var cond Condition
 	var err error
-	opts := []expr.Option{expr.Env(snmp.Payload{})}
-	opts = append(opts, snmp.Functions...)
-	boolOpts := append(opts, expr.AsBool())
-	cond.Match, err = expr.Compile(conf.Match, boolOpts...)
+	cond.Match, err = compileCondition(conf.Match)
 	if err != nil {
 		return nil, errors.Wrap(err, "match condition failed to compile")
 	}
-	cond.Clear, err = expr.Compile(conf.Clear, boolOpts...)
+	cond.Clear, err = compileCondition(conf.Clear)
 	if err != nil {
 		return nil, errors.Wrap(err, "clear condition failed to compile")
 	}
-	stringOpts := append(opts, expr.AsKind(reflect.String))
-	cond.Identifier, err = expr.Compile("SHA256("+strings.Join(conf.Identifiers, ",")+")", stringOpts...)
+	cond.Identifier, err = compileIdentifiers(conf.Identifiers)
 	if err != nil {
 		return nil, errors.Wrap(err, "identifiers condition failed to compile")
 	}
@@ -1,7 +1,11 @@
 package correlate
 
 import (
+	"fmt"
+	"github.com/bangunindo/trap2json/correlate/backend"
 	"github.com/bangunindo/trap2json/helper"
+	"github.com/bangunindo/trap2json/queue"
+	"github.com/pkg/errors"
 )
 
 type Config struct {
@@ -10,8 +14,11 @@ type Config struct {
 	TTL              helper.Duration
 	CleanupInterval  helper.Duration `mapstructure:"cleanup_interval"`
 	Timeout          helper.Duration
-	ShutdownWaitTime helper.Duration `mapstructure:"shutdown_wait_time"`
-	QueueSize        int             `mapstructure:"queue_size"`
+	ShutdownWaitTime helper.Duration      `mapstructure:"shutdown_wait_time"`
+	QueueSize        int                  `mapstructure:"queue_size"`
+	QueueType        queue.Type           `mapstructure:"queue_type"`
+	QueueDisk        queue.DiskConfig     `mapstructure:"queue_disk"`
+	OverflowPolicy   queue.OverflowPolicy `mapstructure:"overflow_policy"`
 	Workers          int
 	Conditions       []ConditionConfig
 	AutoRetry        helper.AutoRetry `mapstructure:"auto_retry"`
@@ -22,3 +29,42 @@ type ConditionConfig struct {
 	Identifiers []string
 	Clear       string
 }
+
+func (c *Config) queueConfig() queue.Config {
+	return queue.Config{
+		Size:           c.QueueSize,
+		FlushTimeout:   c.ShutdownWaitTime.Duration,
+		Type:           c.QueueType,
+		Disk:           c.QueueDisk,
+		OverflowPolicy: c.OverflowPolicy,
+	}
+}
+
+// Validate checks the config without connecting to the backend, the error path
+// is relative to the correlate config
+func (c *Config) Validate() []helper.ConfigError {
+	var errs []helper.ConfigError
+	if _, err := backend.ParseURL(c.BackendURL); err != nil {
+		errs = append(errs, helper.ConfigError{Path: "backend_url", Err: err})
+	}
+	queueConf := c.queueConfig()
+	errs = append(errs, queueConf.Validate()...)
+	for i, cond := range c.Conditions {
+		path := fmt.Sprintf("conditions[%d]", i)
+		if _, err := compileCondition(cond.Match); err != nil {
+			errs = append(errs, helper.ConfigError{Path: path + ".match", Err: err})
+		}
+		if _, err := compileCondition(cond.Clear); err != nil {
+			errs = append(errs, helper.ConfigError{Path: path + ".clear", Err: err})
+		}
+		if len(cond.Identifiers) == 0 {
+			errs = append(errs, helper.ConfigError{
+				Path: path + ".identifiers",
+				Err:  errors.New("at least one identifier is required"),
+			})
+		} else if _, err := compileIdentifiers(cond.Identifiers); err != nil {
+			errs = append(errs, helper.ConfigError{Path: path + ".identifiers", Err: err})
+		}
+	}
+	return errs
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -29,7 +30,7 @@ type Correlate struct {
 	wg      *sync.WaitGroup
 	queue   *queue.Queue[*snmp.Message]
 	out     chan<- *snmp.Message
-	conds   []*Condition
+	conds   *atomic.Pointer[[]*Condition]
 	retry   helper.AutoRetry
 	logger  zerolog.Logger
 	ctr     counter
@@ -47,7 +48,9 @@ func (c *Correlate) Retry(m *snmp.Message, err error) {
 		m.Metadata.Eta = eta
 		c.ctr.retried.Inc()
 		c.logger.Debug().Err(err).Msg("retrying to correlate message")
-		c.queue.SendChannel() <- m
+		if qErr := c.queue.Retry(m); qErr != nil {
+			c.failed(m, qErr)
+		}
 	} else {
 		c.failed(m, err)
 	}
@@ -73,85 +76,119 @@ func (c *Correlate) SendChannel() chan<- *snmp.Message {
 
 func (c *Correlate) CorrelateWorker() {
 	defer c.wg.Done()
-outer:
 	for m := range c.queue.ReceiveChannel() {
-	inner:
-		for _, cond := range c.conds {
-			matchRaw, err := expr.Run(cond.Match, m.Payload)
-			if err != nil {
-				c.failed(m, errors.Wrap(err, "failed evaluating match"))
-				continue outer
-			}
-			match, ok := matchRaw.(bool)
-			if !ok {
-				c.failed(m, errors.New("failed casting match result"))
-				continue outer
-			}
-			if !match {
-				continue inner
-			}
-			keyRaw, err := expr.Run(cond.Identifier, m.Payload)
+		key := m.QueueKey()
+		c.correlate(m)
+		// it's either forwarded or put back by Retry
+		c.queue.Ack(key)
+	}
+}
+
+func (c *Correlate) correlate(m *snmp.Message) {
+	for _, cond := range *c.conds.Load() {
+		matchRaw, err := expr.Run(cond.Match, m.Payload)
+		if err != nil {
+			c.failed(m, errors.Wrap(err, "failed evaluating match"))
+			return
+		}
+		match, ok := matchRaw.(bool)
+		if !ok {
+			c.failed(m, errors.New("failed casting match result"))
+			return
+		}
+		if !match {
+			continue
+		}
+		keyRaw, err := expr.Run(cond.Identifier, m.Payload)
+		if err != nil {
+			c.failed(m, errors.Wrap(err, "failed evaluating identifier"))
+			return
+		}
+		key, ok := keyRaw.(string)
+		if !ok {
+			c.failed(m, errors.New("failed casting key result"))
+			return
+		}
+		isClearRaw, err := expr.Run(cond.Clear, m.Payload)
+		if err != nil {
+			c.failed(m, errors.Wrap(err, "failed evaluating clear"))
+			return
+		}
+		isClear, ok := isClearRaw.(bool)
+		if !ok {
+			c.failed(m, errors.New("failed casting clear result"))
+			return
+		}
+		if isClear {
+			payload, exists, err := c.backend.Pop(key)
 			if err != nil {
-				c.failed(m, errors.Wrap(err, "failed evaluating identifier"))
-				continue outer
+				c.Retry(m, err)
+				return
 			}
-			key, ok := keyRaw.(string)
-			if !ok {
-				c.failed(m, errors.New("failed casting key result"))
-				continue outer
+			if !exists {
+				c.failed(m, errors.New("raise event doesn't exists"))
+				return
+			} else {
+				c.ctr.succeeded.Inc()
+				t := payload.Time()
+				d := m.Payload.Time.Sub(t)
+				m.Payload.Correlate = &snmp.Correlate{
+					ID:              payload.ID,
+					Key:             key,
+					RaisedTime:      t,
+					Duration:        helper.Duration{Duration: d},
+					DurationSeconds: d.Seconds(),
+				}
 			}
-			isClearRaw, err := expr.Run(cond.Clear, m.Payload)
+		} else {
+			id := uuid.NewString()
+			err = c.backend.Set(
+				key,
+				backend.Data{
+					RaisedTimeSeconds: m.Payload.Time.Unix(),
+					RaisedTimeNanos:   int64(m.Payload.Time.Nanosecond()),
+					ID:                id,
+				},
+			)
 			if err != nil {
-				c.failed(m, errors.Wrap(err, "failed evaluating clear"))
-				continue outer
-			}
-			isClear, ok := isClearRaw.(bool)
-			if !ok {
-				c.failed(m, errors.New("failed casting clear result"))
-				continue outer
-			}
-			if isClear {
-				payload, exists, err := c.backend.Pop(key)
-				if err != nil {
-					c.Retry(m, err)
-					continue outer
-				}
-				if !exists {
-					c.failed(m, errors.New("raise event doesn't exists"))
-					continue outer
-				} else {
-					c.ctr.succeeded.Inc()
-					t := payload.Time()
-					d := m.Payload.Time.Sub(t)
-					m.Payload.Correlate = &snmp.Correlate{
-						ID:              payload.ID,
-						RaisedTime:      t,
-						Duration:        helper.Duration{Duration: d},
-						DurationSeconds: d.Seconds(),
-					}
-				}
+				c.Retry(m, err)
+				return
 			} else {
-				id := uuid.NewString()
-				err = c.backend.Set(
-					key,
-					backend.Data{
-						RaisedTimeSeconds: m.Payload.Time.Unix(),
-						RaisedTimeNanos:   int64(m.Payload.Time.Nanosecond()),
-						ID:                id,
-					},
-				)
-				if err != nil {
-					c.Retry(m, err)
-					continue outer
-				} else {
-					c.ctr.succeeded.Inc()
+				c.ctr.succeeded.Inc()
+				m.Payload.Raise = &snmp.Correlate{
+					ID:         id,
+					Key:        key,
+					RaisedTime: m.Payload.Time,
 				}
 			}
-			c.out <- m
-			continue outer
 		}
-		c.ctr.skipped.Inc()
+		c.out <- m
+		return
+	}
+	c.ctr.skipped.Inc()
+}
+
+func parseConditions(c []ConditionConfig) ([]*Condition, error) {
+	var conds []*Condition
+	for i, condConf := range c {
+		cond, err := parseCondition(condConf)
+		if err != nil {
+			return nil, errors.Wrapf(err, "condition index %d", i)
+		}
+		conds = append(conds, cond)
+	}
+	return conds, nil
+}
+
+// UpdateConditions replaces the conditions used by correlate workers,
+// the old conditions are kept if any of the new conditions fails to compile
+func (c *Correlate) UpdateConditions(conf []ConditionConfig) error {
+	conds, err := parseConditions(conf)
+	if err != nil {
+		return err
 	}
+	c.conds.Store(&conds)
+	return nil
 }
 
 func NewCorrelate(c Config, wg *sync.WaitGroup, fwdChan chan<- *snmp.Message) (*Correlate, error) {
@@ -163,37 +200,44 @@ func NewCorrelate(c Config, wg *sync.WaitGroup, fwdChan chan<- *snmp.Message) (*
 	if err != nil {
 		return nil, err
 	}
-	var conds []*Condition
-	for i, condConf := range c.Conditions {
-		cond, err := parseCondition(condConf)
-		if err != nil {
-			return nil, errors.Wrapf(err, "condition index %d", i)
-		}
-		conds = append(conds, cond)
+	conds, err := parseConditions(c.Conditions)
+	if err != nil {
+		return nil, err
 	}
 	logger := log.
 		With().
 		Str("module", "correlate").
 		Logger()
-	q := queue.NewQueue(
+	queueCounter := queue.Counter{
+		Processed:   metrics.CorrelateProcessed,
+		Drop:        metrics.CorrelateFailed,
+		Passthrough: metrics.CorrelateSkipped,
+		QueueCap:    metrics.CorrelateQueueCapacity,
+		QueueLen:    metrics.CorrelateQueueFilled,
+		Overflow:    metrics.CorrelateQueueOverflow,
+	}
+	queueConf := c.queueConfig()
+	if queueConf.UsesDisk() {
+		queueCounter.QueueBytes = metrics.CorrelateQueueBytes
+		queueCounter.DiskUsage = metrics.CorrelateQueueDiskUsage
+	}
+	q, err := queue.New[*snmp.Message](
 		logger,
-		c.QueueSize,
-		c.ShutdownWaitTime.Duration,
+		queueConf,
+		snmp.MessageCodec{},
 		fwdChan,
-		queue.Counter{
-			Processed:   metrics.CorrelateProcessed,
-			Drop:        metrics.CorrelateFailed,
-			Passthrough: metrics.CorrelateSkipped,
-			QueueCap:    metrics.CorrelateQueueCapacity,
-			QueueLen:    metrics.CorrelateQueueFilled,
-		},
+		queueCounter,
 	)
+	if err != nil {
+		_ = be.Close()
+		return nil, err
+	}
 	cor := &Correlate{
 		backend: be,
 		wg:      wg,
 		queue:   q,
 		out:     fwdChan,
-		conds:   conds,
+		conds:   new(atomic.Pointer[[]*Condition]),
 		retry:   c.AutoRetry,
 		logger:  logger,
 		ctr: counter{
@@ -203,6 +247,7 @@ func NewCorrelate(c Config, wg *sync.WaitGroup, fwdChan chan<- *snmp.Message) (*
 			retried:   metrics.CorrelateRetried,
 		},
 	}
+	cor.conds.Store(&conds)
 	cor.ctx, cor.cancel = context.WithCancel(context.Background())
 	go func() {
 		for {
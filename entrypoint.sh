@@ -1,5 +1,10 @@
 #!/usr/bin/bash
 set -e
+case "$(trap2json -print-mode)" in
+  native|supervised)
+    exec trap2json
+    ;;
+esac
 trap2json -generate /etc/trap2json/snmptrapd.conf
 shopt -s lastpipe
 snmptrapd -M +/etc/trap2json/mibs -m ALL -Lo -OnUx -f -C -c /etc/trap2json/snmptrapd.conf $@ | pv -q -B "${T2J_BUFFERSIZE:-32M}" | exec trap2json
@@ -0,0 +1,147 @@
+package forwarder
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/bangunindo/trap2json/helper"
+	"github.com/bangunindo/trap2json/snmp"
+	"github.com/go-json-experiment/json"
+	"github.com/pkg/errors"
+)
+
+// AlertmanagerConfig sends alerts to alertmanager api v2. Every http option is
+// available, url is the base url of alertmanager and the method is always POST
+type AlertmanagerConfig struct {
+	HTTPConfig `mapstructure:",squash"`
+	// Labels identify the alert, a clear trap must render the same labels as its raise trap
+	Labels       map[string]string
+	Annotations  map[string]string
+	GeneratorURL string `mapstructure:"generator_url"`
+	// EndsAfter sets endsAt of raised alerts, otherwise alertmanager
+	// resolves them after its resolve_timeout
+	EndsAfter helper.Duration `mapstructure:"ends_after"`
+}
+
+func (c *AlertmanagerConfig) validate() []helper.ConfigError {
+	errs := c.HTTPConfig.validate()
+	if len(c.Labels) == 0 {
+		errs = append(errs, helper.ConfigError{Path: "labels", Err: errors.New("at least one label is required")})
+	}
+	for key, value := range c.Labels {
+		if _, err := compileTemplate(value); err != nil {
+			errs = append(errs, helper.ConfigError{Path: fmt.Sprintf("labels.%s", key), Err: err})
+		}
+	}
+	for key, value := range c.Annotations {
+		if _, err := compileTemplate(value); err != nil {
+			errs = append(errs, helper.ConfigError{Path: fmt.Sprintf("annotations.%s", key), Err: err})
+		}
+	}
+	if _, err := compileTemplate(c.GeneratorURL); err != nil {
+		errs = append(errs, helper.ConfigError{Path: "generator_url", Err: err})
+	}
+	if c.EndsAfter.Duration < 0 {
+		errs = append(errs, helper.ConfigError{Path: "ends_after", Err: errors.New("ends_after can't be negative")})
+	}
+	return errs
+}
+
+type alertmanagerAlert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt,omitzero"`
+	GeneratorURL string            `json:"generatorURL,omitempty"`
+}
+
+type Alertmanager struct {
+	*HTTP
+
+	conf         *AlertmanagerConfig
+	labels       map[string]*exprTemplate
+	annotations  map[string]*exprTemplate
+	generatorURL *exprTemplate
+}
+
+func renderTemplates(templates map[string]*exprTemplate, p *snmp.Payload) (map[string]string, error) {
+	if len(templates) == 0 {
+		return nil, nil
+	}
+	rendered := make(map[string]string, len(templates))
+	for key, t := range templates {
+		value, err := t.render(p, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed rendering %s", key)
+		}
+		rendered[key] = value
+	}
+	return rendered, nil
+}
+
+// alert converts the message to an alert. A clear trap is recognized
+// by correlate result, it resolves the alert raised at correlate.raised_time
+func (a *Alertmanager) alert(m *snmp.Message) ([]byte, error) {
+	var alert alertmanagerAlert
+	var err error
+	if alert.Labels, err = renderTemplates(a.labels, m.Payload); err != nil {
+		return nil, errors.Wrap(err, "failed rendering labels")
+	}
+	if alert.Annotations, err = renderTemplates(a.annotations, m.Payload); err != nil {
+		return nil, errors.Wrap(err, "failed rendering annotations")
+	}
+	if alert.GeneratorURL, err = a.generatorURL.render(m.Payload, nil); err != nil {
+		return nil, errors.Wrap(err, "failed rendering generator_url")
+	}
+	if m.Payload.Correlate != nil {
+		alert.StartsAt = m.Payload.Correlate.RaisedTime
+		alert.EndsAt = m.Payload.Time
+	} else {
+		alert.StartsAt = m.Payload.Time
+		if a.conf.EndsAfter.Duration > 0 {
+			alert.EndsAt = m.Payload.Time.Add(a.conf.EndsAfter.Duration)
+		}
+	}
+	return json.Marshal(alert)
+}
+
+func compileTemplates(templates map[string]string) (map[string]*exprTemplate, error) {
+	compiled := make(map[string]*exprTemplate, len(templates))
+	for key, value := range templates {
+		t, err := compileTemplate(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed compiling %s", key)
+		}
+		compiled[key] = t
+	}
+	return compiled, nil
+}
+
+func NewAlertmanager(c Config, idx int) Forwarder {
+	conf := c.Alertmanager
+	httpConf := conf.HTTPConfig
+	httpConf.URL = strings.TrimRight(conf.URL, "/") + "/api/v2/alerts"
+	httpConf.Method = HTTPMethodPost
+	httpConf.MethodTemplate = ""
+	httpConf.BatchFormat = HTTPBatchJSONArray
+	fwd := &Alertmanager{
+		HTTP: newHTTP(c, idx, &httpConf),
+		conf: conf,
+	}
+	var err error
+	if fwd.labels, err = compileTemplates(conf.Labels); err != nil {
+		fwd.logger.Fatal().Err(err).Msg("failed compiling labels template")
+	}
+	if fwd.annotations, err = compileTemplates(conf.Annotations); err != nil {
+		fwd.logger.Fatal().Err(err).Msg("failed compiling annotations template")
+	}
+	if fwd.generatorURL, err = compileTemplate(conf.GeneratorURL); err != nil {
+		fwd.logger.Fatal().Err(err).Msg("failed compiling generator_url template")
+	}
+	// alertmanager api only accepts a list of alerts
+	fwd.encode = fwd.alert
+	fwd.alwaysBatch = true
+	go fwd.Run()
+	return fwd
+}
@@ -0,0 +1,110 @@
+package forwarder
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/bangunindo/trap2json/helper"
+	"github.com/bangunindo/trap2json/snmp"
+	"github.com/go-json-experiment/json"
+	"github.com/stretchr/testify/assert"
+)
+
+// receiveAlert decodes the single alert of an alertmanager request
+func receiveAlert(t *testing.T, requests chan capturedRequest) alertmanagerAlert {
+	req := receive(t, requests)
+	assert.Equal(t, http.MethodPost, req.method)
+	assert.Equal(t, "/api/v2/alerts", req.uri)
+	var alerts []alertmanagerAlert
+	assert.NoError(t, json.Unmarshal(req.body, &alerts))
+	if !assert.Len(t, alerts, 1) {
+		t.FailNow()
+	}
+	return alerts[0]
+}
+
+func TestAlertmanager(t *testing.T) {
+	url, requests := captureRequests(t, http.StatusOK)
+	fwd := startForwarder(t, Config{
+		Alertmanager: &AlertmanagerConfig{
+			HTTPConfig: HTTPConfig{URL: url + "/"},
+			Labels: map[string]string{
+				"alertname": "{enterprise_mib_name}",
+				"instance":  "{src_address}",
+			},
+			Annotations:  map[string]string{"summary": "trap from {agent_address}"},
+			GeneratorURL: "http://trap2json/{src_address}",
+		},
+	})
+	raise := testMessage()
+	fwd.Send(raise)
+	alert := receiveAlert(t, requests)
+	labels := map[string]string{"alertname": "IF-MIB::linkDown", "instance": "10.0.0.1"}
+	assert.Equal(t, labels, alert.Labels)
+	assert.Equal(t, map[string]string{"summary": "trap from 10.0.0.2"}, alert.Annotations)
+	assert.Equal(t, "http://trap2json/10.0.0.1", alert.GeneratorURL)
+	assert.Equal(t, raise.Payload.Time, alert.StartsAt)
+	// resolved by alertmanager after its resolve_timeout
+	assert.True(t, alert.EndsAt.IsZero())
+
+	clear := testMessage()
+	raisedTime := raise.Payload.Time
+	clear.Payload.Time = raisedTime.Add(5 * time.Minute)
+	clear.Payload.Correlate = &snmp.Correlate{
+		ID:         "raise-1",
+		RaisedTime: raisedTime,
+		Duration:   helper.Duration{Duration: 5 * time.Minute},
+	}
+	fwd.Send(clear)
+	alert = receiveAlert(t, requests)
+	assert.Equal(t, labels, alert.Labels)
+	assert.Equal(t, raisedTime, alert.StartsAt)
+	assert.Equal(t, clear.Payload.Time, alert.EndsAt)
+}
+
+func TestAlertmanagerEndsAfter(t *testing.T) {
+	url, requests := captureRequests(t, http.StatusOK)
+	fwd := startForwarder(t, Config{
+		Alertmanager: &AlertmanagerConfig{
+			HTTPConfig: HTTPConfig{URL: url},
+			Labels:     map[string]string{"instance": "{src_address}"},
+			EndsAfter:  helper.Duration{Duration: time.Hour},
+		},
+	})
+	raise := testMessage()
+	fwd.Send(raise)
+	alert := receiveAlert(t, requests)
+	assert.Equal(t, raise.Payload.Time, alert.StartsAt)
+	assert.Equal(t, raise.Payload.Time.Add(time.Hour), alert.EndsAt)
+	assert.Empty(t, alert.Annotations)
+	assert.Empty(t, alert.GeneratorURL)
+
+	// ends_after doesn't apply to clear traps
+	clear := testMessage()
+	clear.Payload.Time = raise.Payload.Time.Add(time.Minute)
+	clear.Payload.Correlate = &snmp.Correlate{ID: "raise-1", RaisedTime: raise.Payload.Time}
+	fwd.Send(clear)
+	alert = receiveAlert(t, requests)
+	assert.Equal(t, raise.Payload.Time, alert.StartsAt)
+	assert.Equal(t, clear.Payload.Time, alert.EndsAt)
+}
+
+func TestAlertmanagerValidate(t *testing.T) {
+	c := AlertmanagerConfig{
+		HTTPConfig: HTTPConfig{URL: "http://localhost:9093"},
+		Labels:     map[string]string{"instance": "{src_address"},
+		EndsAfter:  helper.Duration{Duration: -time.Second},
+	}
+	var paths []string
+	for _, err := range c.validate() {
+		paths = append(paths, err.Path)
+	}
+	assert.ElementsMatch(t, []string{"labels.instance", "ends_after"}, paths)
+	c.Labels = nil
+	c.EndsAfter = helper.Duration{}
+	errs := c.validate()
+	if assert.Len(t, errs, 1) {
+		assert.Equal(t, "labels", errs[0].Path)
+	}
+}
@@ -0,0 +1,218 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/bangunindo/trap2json/helper"
+	"github.com/bangunindo/trap2json/snmp"
+	"github.com/pkg/errors"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type AMQPConfig struct {
+	// URL is amqp:// or amqps:// url, including the credentials and vhost
+	URL      string `mapstructure:"url"`
+	Tls      *Tls
+	Exchange string
+	// RoutingKey is a template
+	RoutingKey  string `mapstructure:"routing_key"`
+	ContentType string `mapstructure:"content_type"`
+	Persistent  *bool
+	// Headers are message headers, the values are templates
+	Headers        map[string]string
+	ConfirmTimeout helper.Duration `mapstructure:"confirm_timeout"`
+	Timeout        helper.Duration
+}
+
+func (c *AMQPConfig) validate() []helper.ConfigError {
+	var errs []helper.ConfigError
+	if c.URL == "" {
+		errs = append(errs, helper.ConfigError{Path: "url", Err: errors.New("url is required")})
+	} else if u, err := url.Parse(c.URL); err != nil {
+		errs = append(errs, helper.ConfigError{Path: "url", Err: err})
+	} else if u.Scheme != "amqp" && u.Scheme != "amqps" {
+		errs = append(errs, helper.ConfigError{Path: "url", Err: errors.Errorf("unsupported scheme: %s", u.Scheme)})
+	}
+	if _, err := compileTemplate(c.RoutingKey); err != nil {
+		errs = append(errs, helper.ConfigError{Path: "routing_key", Err: err})
+	}
+	for key, value := range c.Headers {
+		if _, err := compileTemplate(value); err != nil {
+			errs = append(errs, helper.ConfigError{Path: fmt.Sprintf("headers.%s", key), Err: err})
+		}
+	}
+	return errs
+}
+
+type AMQP struct {
+	Base
+
+	routingKey *exprTemplate
+	headers    map[string]*exprTemplate
+	tlsConf    *tls.Config
+
+	// conn and channel are shared by the workers, they're
+	// opened again on the next publish after a failure
+	mutex   sync.Mutex
+	conn    *amqp.Connection
+	channel *amqp.Channel
+}
+
+// getChannel returns the open channel in confirm mode, it connects if needed
+func (a *AMQP) getChannel() (*amqp.Channel, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.channel != nil && !a.channel.IsClosed() {
+		return a.channel, nil
+	}
+	conf := a.config.AMQP
+	if a.conn == nil || a.conn.IsClosed() {
+		props := amqp.NewConnectionProperties()
+		props.SetClientConnectionName("trap2json")
+		conn, err := amqp.DialConfig(conf.URL, amqp.Config{
+			TLSClientConfig: a.tlsConf,
+			Dial:            amqp.DefaultDial(conf.Timeout.Duration),
+			Properties:      props,
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "failed connecting to amqp server")
+		}
+		a.conn = conn
+		a.logger.Info().Msg("connected to amqp server")
+	}
+	ch, err := a.conn.Channel()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed opening amqp channel")
+	}
+	if err = ch.Confirm(false); err != nil {
+		_ = ch.Close()
+		return nil, errors.Wrap(err, "failed enabling publisher confirms")
+	}
+	a.channel = ch
+	return ch, nil
+}
+
+// reset closes ch after a failure, unless another worker already replaced it
+func (a *AMQP) reset(ch *amqp.Channel) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.channel == ch {
+		_ = ch.Close()
+		a.channel = nil
+	}
+}
+
+func (a *AMQP) close() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.channel != nil {
+		_ = a.channel.Close()
+	}
+	if a.conn != nil {
+		_ = a.conn.Close()
+	}
+}
+
+func (a *AMQP) publishing(m *snmp.Message) (amqp.Publishing, error) {
+	conf := a.config.AMQP
+	msg := amqp.Publishing{
+		ContentType:  conf.ContentType,
+		DeliveryMode: amqp.Transient,
+		Timestamp:    m.Payload.Time,
+		Body:         m.Metadata.MessageJSON,
+	}
+	if *conf.Persistent {
+		msg.DeliveryMode = amqp.Persistent
+	}
+	if len(a.headers) > 0 {
+		msg.Headers = make(amqp.Table, len(a.headers))
+		for key, t := range a.headers {
+			value, err := t.render(m.Payload, nil)
+			if err != nil {
+				return msg, errors.Wrapf(err, "failed rendering header %s", key)
+			}
+			msg.Headers[key] = value
+		}
+	}
+	return msg, nil
+}
+
+// publish waits for the confirmation of the broker
+func (a *AMQP) publish(routingKey string, msg amqp.Publishing) error {
+	ch, err := a.getChannel()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), a.config.AMQP.ConfirmTimeout.Duration)
+	defer cancel()
+	confirm, err := ch.PublishWithDeferredConfirmWithContext(ctx, a.config.AMQP.Exchange, routingKey, false, false, msg)
+	if err != nil {
+		a.reset(ch)
+		return errors.Wrap(err, "failed publishing to amqp server")
+	}
+	acked, err := confirm.WaitContext(ctx)
+	if err != nil {
+		// the confirmation may never come on this channel
+		a.reset(ch)
+		return errors.Wrap(err, "failed waiting for publisher confirm")
+	}
+	if !acked {
+		return errors.New("message is nacked by the broker")
+	}
+	return nil
+}
+
+func (a *AMQP) Run() {
+	defer a.cancel()
+	defer a.logger.Info().Msg("forwarder exited")
+	a.logger.Info().Msg("starting forwarder")
+	conf := a.config.AMQP
+	if conf.Tls != nil {
+		var err error
+		if a.tlsConf, err = conf.Tls.config(); err != nil {
+			a.logger.Fatal().Err(err).Msg("failed setting up tls")
+		}
+	}
+	defer a.close()
+	a.consume(func(m *snmp.Message) {
+		m.Compile(a.CompilerConf)
+		if m.Metadata.Skip {
+			a.ctrFiltered.Inc()
+			return
+		}
+		routingKey, err := a.routingKey.render(m.Payload, nil)
+		if err != nil {
+			a.Retry(m, permanent(errors.Wrap(err, "failed rendering routing_key")))
+			return
+		}
+		msg, err := a.publishing(m)
+		if err != nil {
+			a.Retry(m, permanent(err))
+			return
+		}
+		if err = a.publish(routingKey, msg); err != nil {
+			a.Retry(m, err)
+		} else {
+			a.ctrSucceeded.Inc()
+		}
+	})
+}
+
+func NewAMQP(c Config, idx int) Forwarder {
+	fwd := &AMQP{
+		Base: NewBase(c, idx),
+	}
+	var err error
+	if fwd.routingKey, err = compileTemplate(c.AMQP.RoutingKey); err != nil {
+		fwd.logger.Fatal().Err(err).Msg("failed compiling routing_key template")
+	}
+	if fwd.headers, err = compileTemplates(c.AMQP.Headers); err != nil {
+		fwd.logger.Fatal().Err(err).Msg("failed compiling headers template")
+	}
+	go fwd.Run()
+	return fwd
+}
@@ -0,0 +1,252 @@
+package forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bangunindo/trap2json/helper"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// amqpPub is a message published to fakeAMQP
+type amqpPub struct {
+	channel      uint16
+	exchange     string
+	routingKey   string
+	contentType  string
+	deliveryMode uint8
+	// headers is the encoded field table
+	headers []byte
+	body    []byte
+}
+
+type amqpConfirm int
+
+const (
+	amqpAck amqpConfirm = iota
+	amqpNack
+	// amqpNone never confirms the message
+	amqpNone
+)
+
+// amqpMethod encodes a method frame payload
+func amqpMethod(class, method uint16, args ...any) []byte {
+	var b bytes.Buffer
+	_ = binary.Write(&b, binary.BigEndian, class)
+	_ = binary.Write(&b, binary.BigEndian, method)
+	for _, arg := range args {
+		_ = binary.Write(&b, binary.BigEndian, arg)
+	}
+	return b.Bytes()
+}
+
+// amqpShortstr reads a short string of b, it returns the rest of b
+func amqpShortstr(b []byte) (string, []byte) {
+	n := int(b[0])
+	return string(b[1 : 1+n]), b[1+n:]
+}
+
+// fakeAMQP speaks enough of amqp 0-9-1 for a client to publish with confirms. Every
+// published message is sent to the channel, confirm decides how the broker replies
+func fakeAMQP(t *testing.T, confirm func(n int, pub amqpPub) amqpConfirm) (string, chan amqpPub) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	pubs := make(chan amqpPub, 10)
+	go func() {
+		published := 0
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			serveAMQP(conn, func(pub amqpPub) amqpConfirm {
+				published++
+				pubs <- pub
+				return confirm(published, pub)
+			})
+		}
+	}()
+	return "amqp://guest:guest@" + ln.Addr().String() + "/", pubs
+}
+
+func serveAMQP(conn net.Conn, publish func(pub amqpPub) amqpConfirm) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil || string(header) != "AMQP\x00\x00\x09\x01" {
+		return
+	}
+	write := func(typ byte, channel uint16, payload []byte) {
+		var b bytes.Buffer
+		b.WriteByte(typ)
+		_ = binary.Write(&b, binary.BigEndian, channel)
+		_ = binary.Write(&b, binary.BigEndian, uint32(len(payload)))
+		b.Write(payload)
+		b.WriteByte(0xCE)
+		_, _ = conn.Write(b.Bytes())
+	}
+	// version 0-9, no server properties, PLAIN mechanism and en_US locale
+	write(1, 0, amqpMethod(10, 10, uint8(0), uint8(9), uint32(0),
+		uint32(5), []byte("PLAIN"), uint32(5), []byte("en_US")))
+	// delivery tags of every channel
+	tags := make(map[uint16]uint64)
+	var pub *amqpPub
+	for {
+		frame := make([]byte, 7)
+		if _, err := io.ReadFull(r, frame); err != nil {
+			return
+		}
+		typ := frame[0]
+		channel := binary.BigEndian.Uint16(frame[1:3])
+		payload := make([]byte, binary.BigEndian.Uint32(frame[3:7])+1)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return
+		}
+		payload = payload[:len(payload)-1]
+		switch typ {
+		case 1:
+			class, method := binary.BigEndian.Uint16(payload), binary.BigEndian.Uint16(payload[2:])
+			args := payload[4:]
+			switch {
+			case class == 10 && method == 11:
+				// start-ok, tune with 128k frames and without heartbeat
+				write(1, 0, amqpMethod(10, 30, uint16(0), uint32(131072), uint16(0)))
+			case class == 10 && method == 40:
+				write(1, 0, amqpMethod(10, 41, uint8(0)))
+			case class == 10 && method == 50:
+				write(1, 0, amqpMethod(10, 51))
+				return
+			case class == 20 && method == 10:
+				tags[channel] = 0
+				write(1, channel, amqpMethod(20, 11, uint32(0)))
+			case class == 20 && method == 40:
+				write(1, channel, amqpMethod(20, 41))
+			case class == 85 && method == 10:
+				write(1, channel, amqpMethod(85, 11))
+			case class == 60 && method == 40:
+				pub = &amqpPub{channel: channel}
+				pub.exchange, args = amqpShortstr(args[2:])
+				pub.routingKey, _ = amqpShortstr(args)
+			}
+		case 2:
+			// class, weight and body size, then the property flags and properties
+			props := payload[14:]
+			flags := binary.BigEndian.Uint16(payload[12:])
+			if flags&0x8000 != 0 {
+				pub.contentType, props = amqpShortstr(props)
+			}
+			if flags&0x4000 != 0 {
+				_, props = amqpShortstr(props)
+			}
+			if flags&0x2000 != 0 {
+				n := binary.BigEndian.Uint32(props)
+				pub.headers, props = props[4:4+n], props[4+n:]
+			}
+			if flags&0x1000 != 0 {
+				pub.deliveryMode = props[0]
+			}
+		case 3:
+			pub.body = append(pub.body, payload...)
+			// the messages are smaller than a frame
+			tags[channel]++
+			switch publish(*pub) {
+			case amqpAck:
+				write(1, channel, amqpMethod(60, 80, tags[channel], uint8(0)))
+			case amqpNack:
+				write(1, channel, amqpMethod(60, 120, tags[channel], uint8(0)))
+			}
+		}
+	}
+}
+
+func TestAMQP(t *testing.T) {
+	url, pubs := fakeAMQP(t, func(int, amqpPub) amqpConfirm { return amqpAck })
+	fwd := startForwarder(t, Config{
+		AMQP: &AMQPConfig{
+			URL:        url,
+			Exchange:   "traps",
+			RoutingKey: "trap.{src_address}",
+			Headers:    map[string]string{"x-community": "{community}"},
+		},
+	})
+	a := fwd.(*AMQP)
+	succeeded := testutil.ToFloat64(a.ctrSucceeded)
+	fwd.Send(testMessage())
+	pub := receive(t, pubs)
+	assert.Equal(t, "traps", pub.exchange)
+	assert.Equal(t, "trap.10.0.0.1", pub.routingKey)
+	assert.Equal(t, "application/json", pub.contentType)
+	// persistent by default
+	assert.Equal(t, uint8(2), pub.deliveryMode)
+	assert.Contains(t, string(pub.headers), "x-community")
+	assert.Contains(t, string(pub.headers), "public")
+	assert.Contains(t, string(pub.body), `"src_address":"10.0.0.1"`)
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(a.ctrSucceeded)-succeeded == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestAMQPConfirms(t *testing.T) {
+	persistent := false
+	url, pubs := fakeAMQP(t, func(n int, _ amqpPub) amqpConfirm {
+		switch n {
+		case 1:
+			return amqpNack
+		case 2:
+			return amqpNone
+		default:
+			return amqpAck
+		}
+	})
+	conf, deadLetterPath := httpRetryConfig(t, nil)
+	conf.HTTP = nil
+	conf.AMQP = &AMQPConfig{
+		URL:            url,
+		RoutingKey:     "trap",
+		Persistent:     &persistent,
+		ConfirmTimeout: helper.Duration{Duration: 100 * time.Millisecond},
+	}
+	conf.AutoRetry.MaxRetries = 2
+	fwd := startForwarder(t, conf)
+	a := fwd.(*AMQP)
+	succeeded := testutil.ToFloat64(a.ctrSucceeded)
+	retried := testutil.ToFloat64(a.ctrRetried)
+	fwd.Send(testMessage())
+	// a nack is retried on the same channel
+	first := receive(t, pubs)
+	assert.Equal(t, uint8(1), first.deliveryMode)
+	second := receive(t, pubs)
+	assert.Equal(t, first.channel, second.channel)
+	// the channel is replaced when the confirmation doesn't come
+	third := receive(t, pubs)
+	assert.NotEqual(t, second.channel, third.channel)
+	assert.Equal(t, first.body, third.body)
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(a.ctrSucceeded)-succeeded == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, float64(2), testutil.ToFloat64(a.ctrRetried)-retried)
+	assert.NoFileExists(t, deadLetterPath)
+}
+
+func TestAMQPNackDeadLetter(t *testing.T) {
+	url, pubs := fakeAMQP(t, func(int, amqpPub) amqpConfirm { return amqpNack })
+	conf, deadLetterPath := httpRetryConfig(t, nil)
+	conf.HTTP = nil
+	conf.AMQP = &AMQPConfig{URL: url, RoutingKey: "trap"}
+	fwd := startForwarder(t, conf)
+	fwd.Send(testMessage())
+	receive(t, pubs)
+	receive(t, pubs)
+	record := waitDeadLetter(t, deadLetterPath)
+	assert.Equal(t, 1, record.Retries)
+	assert.Contains(t, record.Error, "nacked")
+}
@@ -0,0 +1,356 @@
+package forwarder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bangunindo/trap2json/helper"
+	"github.com/bangunindo/trap2json/queue"
+	"github.com/bangunindo/trap2json/snmp"
+	"github.com/go-json-experiment/json"
+	"github.com/go-json-experiment/json/jsontext"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+type DeadLetterConfig struct {
+	// Forwarder is the id of another forwarder, the dead letter record
+	// is sent as its message json
+	Forwarder string
+	// Path of NDJSON file to append the dead letter records to
+	Path string
+}
+
+func (c *DeadLetterConfig) validate() []helper.ConfigError {
+	var errs []helper.ConfigError
+	if c.Forwarder == "" && c.Path == "" {
+		errs = append(errs, helper.ConfigError{Path: "path", Err: errors.New("either forwarder or path is required")})
+	} else if c.Forwarder != "" && c.Path != "" {
+		errs = append(errs, helper.ConfigError{Path: "forwarder", Err: errors.New("forwarder and path can't be used together")})
+	}
+	return errs
+}
+
+// DeadLetter is a message that exhausted its retries
+type DeadLetter struct {
+	Time        time.Time      `json:"time"`
+	ForwarderID string         `json:"forwarder_id"`
+	Error       string         `json:"error"`
+	Retries     int            `json:"retries"`
+	MessageJSON jsontext.Value `json:"message_json"`
+	// Message is the encoded message, it's used to re-inject the message
+	Message []byte `json:"message"`
+}
+
+// deadLetterFiles serializes writes to the same dead letter file across forwarders
+var deadLetterFiles sync.Mutex
+
+func appendDeadLetter(path string, record []byte) error {
+	deadLetterFiles.Lock()
+	defer deadLetterFiles.Unlock()
+	// the file is reopened for every record, so it can be moved away for re-injection
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.Wrap(err, "failed opening dead letter file")
+	}
+	if _, err = f.Write(append(record, '\n')); err != nil {
+		_ = f.Close()
+		return errors.Wrap(err, "failed writing dead letter file")
+	}
+	return f.Close()
+}
+
+// deadLetter sends a message that exhausted its retries to dead_letter. Messages
+// that already came from another dead letter are dropped to avoid loops
+func (b *Base) deadLetter(m *snmp.Message, err error) {
+	conf := b.config.DeadLetter
+	if conf == nil || m.Metadata.DeadLettered {
+		b.logger.Warn().Err(err).Msg("failed forwarding trap")
+		b.ctrDropped.Inc()
+		return
+	}
+	record, encErr := b.deadLetterRecord(m, err)
+	if encErr != nil {
+		b.logger.Warn().Err(err).AnErr("dead_letter_error", encErr).Msg("failed forwarding trap")
+		b.ctrDropped.Inc()
+		return
+	}
+	if conf.Path != "" {
+		if wErr := appendDeadLetter(conf.Path, record); wErr != nil {
+			b.logger.Warn().Err(err).AnErr("dead_letter_error", wErr).Msg("failed forwarding trap")
+			b.ctrDropped.Inc()
+			return
+		}
+	} else {
+		b.sendMutex.RLock()
+		to := b.deadLetterTo
+		b.sendMutex.RUnlock()
+		if to == nil {
+			b.logger.Warn().Err(err).Str("dead_letter", conf.Forwarder).Msg("failed forwarding trap, dead letter forwarder is not running")
+			b.ctrDropped.Inc()
+			return
+		}
+		toConf := to.Config()
+		m.Metadata = snmp.Metadata{
+			DeadLettered:   true,
+			Compiled:       true,
+			MessageJSON:    record,
+			TimeAsTimezone: toConf.TimeAsTimezone,
+			TimeFormat:     toConf.TimeFormat,
+		}
+		to.Send(m)
+	}
+	b.logger.Warn().Err(err).Msg("failed forwarding trap, sent to dead letter")
+	b.ctrDeadLettered.Inc()
+}
+
+func (b *Base) deadLetterRecord(m *snmp.Message, err error) ([]byte, error) {
+	encoded, encErr := snmp.MessageCodec{}.Encode(m)
+	if encErr != nil {
+		return nil, encErr
+	}
+	messageJSON := jsontext.Value(m.Metadata.MessageJSON)
+	if len(messageJSON) == 0 {
+		messageJSON = jsontext.Value("null")
+	}
+	record := DeadLetter{
+		Time:        time.Now(),
+		ForwarderID: b.config.ID,
+		Retries:     m.Metadata.Retries,
+		MessageJSON: messageJSON,
+		Message:     encoded,
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	return json.Marshal(record)
+}
+
+// SetDeadLetter sets the destination of dead_letter.forwarder
+func (b *Base) SetDeadLetter(to Forwarder) {
+	b.sendMutex.Lock()
+	defer b.sendMutex.Unlock()
+	b.deadLetterTo = to
+}
+
+// linkDeadLetters connects forwarders to their dead_letter.forwarder
+func linkDeadLetters(forwarders []Forwarder) {
+	byID := make(map[string]Forwarder)
+	for _, fwd := range forwarders {
+		if id := fwd.Config().ID; id != "" {
+			byID[id] = fwd
+		}
+	}
+	for _, fwd := range forwarders {
+		conf := fwd.Config()
+		if conf.DeadLetter == nil || conf.DeadLetter.Forwarder == "" {
+			continue
+		}
+		to, ok := byID[conf.DeadLetter.Forwarder]
+		if !ok {
+			log.Warn().
+				Str("module", "forwarder").
+				Str("id", conf.ID).
+				Str("dead_letter", conf.DeadLetter.Forwarder).
+				Msg("dead letter forwarder is not found")
+		}
+		fwd.SetDeadLetter(to)
+	}
+}
+
+// ReadDeadLetters reads NDJSON dead letter records from r
+func ReadDeadLetters(r io.Reader) ([]DeadLetter, error) {
+	var records []DeadLetter
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var record DeadLetter
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return records, errors.Wrapf(err, "failed reading dead letter line %d", line)
+		}
+		records = append(records, record)
+	}
+	return records, errors.Wrap(scanner.Err(), "failed reading dead letter records")
+}
+
+// reinjectTracker counts re-injected messages by their outcome, done is
+// closed once every message has one
+type reinjectTracker struct {
+	delivered  atomic.Int64
+	failed     atomic.Int64
+	dropped    atomic.Int64
+	pending    atomic.Int64
+	done       chan struct{}
+	doneOnce   sync.Once
+	mutex      sync.Mutex
+	forwarders []Base
+}
+
+func newReinjectTracker(n int) *reinjectTracker {
+	t := &reinjectTracker{done: make(chan struct{})}
+	t.pending.Store(int64(n))
+	if n == 0 {
+		close(t.done)
+	}
+	return t
+}
+
+// finish marks n messages as finished
+func (t *reinjectTracker) finish(n int64) {
+	if t.pending.Add(-n) <= 0 {
+		t.doneOnce.Do(func() { close(t.done) })
+	}
+}
+
+// register keeps the forwarder so giveUp can reach its queue
+func (t *reinjectTracker) register(b Base) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.forwarders = append(t.forwarders, b)
+}
+
+// giveUp sends the queued and retried messages to dead_letter right away,
+// the messages that are being forwarded finish on their own
+func (t *reinjectTracker) giveUp(err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, b := range t.forwarders {
+		b.queue.Redirect(func(m *snmp.Message) {
+			b.deadLetter(m, err)
+		})
+	}
+}
+
+// trackedCounter adds to n as well and tells the tracker the messages are finished
+type trackedCounter struct {
+	prometheus.Counter
+	n       *atomic.Int64
+	tracker *reinjectTracker
+}
+
+func (c trackedCounter) Inc() {
+	c.Counter.Inc()
+	c.n.Add(1)
+	c.tracker.finish(1)
+}
+
+func (c trackedCounter) Add(v float64) {
+	c.Counter.Add(v)
+	c.n.Add(int64(v))
+	c.tracker.finish(int64(v))
+}
+
+// ReinjectResult counts the re-injected records by their outcome
+type ReinjectResult struct {
+	// Delivered records are forwarded or skipped by filter
+	Delivered int
+	// Failed records are written to the dead letter file again
+	Failed int
+	// Dropped records are lost, e.g. the dead letter file can't be written
+	Dropped int
+}
+
+// Reinject sends dead letter records to the forwarder they failed on, or to the
+// forwarder with id if it's not empty. Forwarders use memory queue that blocks
+// when it's full, so nothing is dropped. Records that fail again are appended
+// to failedPath instead of the dead_letter of the forwarder. It returns after
+// every record is either delivered or failed again, and the forwarders are closed.
+// Once ctx is done, the records that aren't forwarded yet are counted as failed
+// and appended to failedPath without waiting for their retries
+func Reinject(ctx context.Context, c []Config, records []DeadLetter, id string, failedPath string) (ReinjectResult, error) {
+	logger := log.With().Str("module", "reinject").Logger()
+	indexes := make(map[string]int)
+	for i, conf := range c {
+		if conf.ID != "" {
+			indexes[conf.ID] = i
+		}
+	}
+	// everything is checked before starting the forwarders
+	messages := make([]*snmp.Message, len(records))
+	fwdIDs := make([]string, len(records))
+	for i, record := range records {
+		fwdIDs[i] = id
+		if fwdIDs[i] == "" {
+			fwdIDs[i] = record.ForwarderID
+		}
+		if _, ok := indexes[fwdIDs[i]]; !ok {
+			return ReinjectResult{}, errors.Errorf("forwarder %q of dead letter record %d is not found", fwdIDs[i], i+1)
+		}
+		var err error
+		messages[i], err = snmp.MessageCodec{}.Decode(record.Message)
+		if err != nil {
+			return ReinjectResult{}, errors.Wrapf(err, "failed decoding dead letter record %d", i+1)
+		}
+	}
+	tracker := newReinjectTracker(len(messages))
+	started := make(map[string]Forwarder)
+	var targets []Forwarder
+	destinations := make([]Forwarder, len(records))
+	for i, fwdID := range fwdIDs {
+		fwd, ok := started[fwdID]
+		if !ok {
+			idx := indexes[fwdID]
+			conf := c[idx]
+			conf.QueueType = queue.TypeMemory
+			conf.OverflowPolicy = queue.OverflowBlock
+			conf.DeadLetter = &DeadLetterConfig{Path: failedPath}
+			conf.reinject = tracker
+			if fwd = newForwarder(conf, idx); fwd == nil {
+				return ReinjectResult{}, errors.Errorf("failed starting forwarder %q", fwdID)
+			}
+			started[fwdID] = fwd
+			targets = append(targets, fwd)
+		}
+		destinations[i] = fwd
+	}
+	// Send blocks while the queue is full, giveUp releases it once ctx is done
+	go func() {
+		for i, m := range messages {
+			conf := destinations[i].Config()
+			m.Metadata = snmp.Metadata{
+				Eta:            time.Now(),
+				TimeAsTimezone: conf.TimeAsTimezone,
+				TimeFormat:     conf.TimeFormat,
+			}
+			destinations[i].Send(m)
+		}
+		logger.Info().Int("records", len(messages)).Msg("dead letter records are queued")
+	}()
+	// retries are limited by auto_retry.max_retries, every message finishes eventually
+	select {
+	case <-tracker.done:
+	case <-ctx.Done():
+		logger.Warn().Msg("reinject is cancelled, writing back the records that aren't forwarded yet")
+		tracker.giveUp(errors.Wrap(ctx.Err(), "reinject is cancelled"))
+		<-tracker.done
+	}
+	for _, fwd := range targets {
+		fwd.Close()
+	}
+	for _, fwd := range targets {
+		<-fwd.Done()
+	}
+	res := ReinjectResult{
+		Delivered: int(tracker.delivered.Load()),
+		Failed:    int(tracker.failed.Load()),
+		Dropped:   int(tracker.dropped.Load()),
+	}
+	logger.Info().
+		Int("delivered", res.Delivered).
+		Int("failed", res.Failed).
+		Int("dropped", res.Dropped).
+		Msg("dead letter records are re-injected")
+	return res, nil
+}
@@ -0,0 +1,57 @@
+package forwarder
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bangunindo/trap2json/helper"
+	"github.com/bangunindo/trap2json/snmp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReinjectCancel(t *testing.T) {
+	encoded, err := snmp.MessageCodec{}.Encode(testMessage())
+	if !assert.NoError(t, err) {
+		return
+	}
+	records := []DeadLetter{
+		{ForwarderID: "mock", Message: encoded},
+		{ForwarderID: "mock", Message: encoded},
+	}
+	conf := Config{
+		ID: "mock",
+		AutoRetry: helper.AutoRetry{
+			Enable:     true,
+			MaxRetries: 10,
+			MinDelay:   helper.Duration{Duration: time.Hour},
+			MaxDelay:   helper.Duration{Duration: time.Hour},
+		},
+		Mock: &MockConfig{
+			OutChannel: make(chan *snmp.Message),
+			Timeout:    helper.Duration{Duration: 10 * time.Millisecond},
+		},
+	}
+	failedPath := filepath.Join(t.TempDir(), "failed.ndjson")
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	// the retries are an hour away, the records are written back once ctx is done
+	res, err := Reinject(ctx, []Config{conf}, records, "", failedPath)
+	assert.NoError(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Equal(t, ReinjectResult{Failed: 2}, res)
+	f, err := os.Open(failedPath)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer f.Close()
+	failed, err := ReadDeadLetters(f)
+	assert.NoError(t, err)
+	if assert.Len(t, failed, 2) {
+		assert.Contains(t, failed[0].Error, "reinject is cancelled")
+		assert.Equal(t, "mock", failed[0].ForwarderID)
+	}
+}
@@ -0,0 +1,207 @@
+package forwarder
+
+import (
+	"bytes"
+	"strings"
+	"time"
+
+	"github.com/bangunindo/trap2json/helper"
+	"github.com/bangunindo/trap2json/snmp"
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+	"github.com/go-json-experiment/json"
+	"github.com/go-json-experiment/json/jsontext"
+	"github.com/pkg/errors"
+)
+
+// ElasticsearchConfig indexes traps with the _bulk api of elasticsearch or opensearch. Every
+// http option is available, url is the base url of the cluster and the method is always POST
+type ElasticsearchConfig struct {
+	HTTPConfig `mapstructure:",squash"`
+	// Index is the target index, %Y, %m, %d and %H are replaced with the trap time in time_as_timezone
+	Index string
+	// DocumentID is an expression of the document _id, a trap that's sent again overwrites its document
+	DocumentID string `mapstructure:"document_id"`
+	// APIKey is the encoded api key, it's sent as Authorization: ApiKey header
+	APIKey string `mapstructure:"api_key"`
+}
+
+func (c *ElasticsearchConfig) validate() []helper.ConfigError {
+	errs := c.HTTPConfig.validate()
+	if err := validateIndexPattern(c.Index); err != nil {
+		errs = append(errs, helper.ConfigError{Path: "index", Err: err})
+	}
+	if c.DocumentID != "" {
+		if _, err := compileKeyField(c.DocumentID); err != nil {
+			errs = append(errs, helper.ConfigError{Path: "document_id", Err: err})
+		}
+	}
+	if c.APIKey != "" && c.BasicAuth != nil {
+		errs = append(errs, helper.ConfigError{Path: "api_key", Err: errors.New("api_key and basic_auth can't be used together")})
+	}
+	return errs
+}
+
+func validateIndexPattern(pattern string) error {
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' {
+			continue
+		}
+		i++
+		if i == len(pattern) || !strings.ContainsRune("YmdH%", rune(pattern[i])) {
+			return errors.Errorf("unsupported index pattern at position %d, use %%Y, %%m, %%d, %%H or %%%%", i-1)
+		}
+	}
+	return nil
+}
+
+// formatIndex replaces the date directives of pattern with t
+func formatIndex(pattern string, t time.Time) string {
+	if !strings.Contains(pattern, "%") {
+		return pattern
+	}
+	var sb strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' || i+1 == len(pattern) {
+			sb.WriteByte(pattern[i])
+			continue
+		}
+		i++
+		switch pattern[i] {
+		case 'Y':
+			sb.WriteString(t.Format("2006"))
+		case 'm':
+			sb.WriteString(t.Format("01"))
+		case 'd':
+			sb.WriteString(t.Format("02"))
+		case 'H':
+			sb.WriteString(t.Format("15"))
+		default:
+			sb.WriteByte(pattern[i])
+		}
+	}
+	return sb.String()
+}
+
+type elasticsearchAction struct {
+	Index struct {
+		Index string `json:"_index"`
+		ID    string `json:"_id,omitempty"`
+	} `json:"index"`
+}
+
+type elasticsearchBulkResponse struct {
+	Errors bool `json:"errors"`
+	// every item has a single key, the action of the document
+	Items []map[string]struct {
+		Status int            `json:"status"`
+		Error  jsontext.Value `json:"error"`
+	} `json:"items"`
+}
+
+type Elasticsearch struct {
+	*HTTP
+
+	conf       *ElasticsearchConfig
+	location   *time.Location
+	documentID *vm.Program
+}
+
+// action returns the bulk action line and the document of the message
+func (e *Elasticsearch) action(m *snmp.Message) ([]byte, error) {
+	t := m.Payload.Time
+	if e.location != nil {
+		t = t.In(e.location)
+	}
+	var action elasticsearchAction
+	action.Index.Index = formatIndex(e.conf.Index, t)
+	if e.documentID != nil {
+		res, err := expr.Run(e.documentID, *m.Payload)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed evaluating document_id")
+		}
+		switch v := res.(type) {
+		case nil:
+		case string:
+			action.Index.ID = v
+		default:
+			id, err := json.Marshal(v, json.Deterministic(true))
+			if err != nil {
+				return nil, errors.Wrap(err, "failed marshalling document_id")
+			}
+			action.Index.ID = string(id)
+		}
+	}
+	line, err := json.Marshal(action)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Join([][]byte{line, m.Metadata.MessageJSON}, []byte{'\n'}), nil
+}
+
+// itemErrors checks the result of every document, the bulk request
+// succeeds even when some of its documents are rejected
+func (e *Elasticsearch) itemErrors(batch []httpItem, response []byte) ([]error, error) {
+	var res elasticsearchBulkResponse
+	if err := json.Unmarshal(response, &res); err != nil {
+		return nil, errors.Wrap(err, "failed parsing bulk response")
+	}
+	errs := make([]error, len(batch))
+	if !res.Errors {
+		return errs, nil
+	}
+	if len(res.Items) != len(batch) {
+		return nil, errors.Errorf("bulk response has %d items, expected %d", len(res.Items), len(batch))
+	}
+	for i, item := range res.Items {
+		for _, result := range item {
+			if result.Status >= 200 && result.Status <= 299 {
+				continue
+			}
+			err := errors.Errorf("document rejected with status %d: %s", result.Status, result.Error)
+			if !e.retryable(result.Status) {
+				err = permanent(err)
+			}
+			errs[i] = err
+		}
+	}
+	return errs, nil
+}
+
+func NewElasticsearch(c Config, idx int) Forwarder {
+	conf := c.Elasticsearch
+	httpConf := conf.HTTPConfig
+	httpConf.URL = strings.TrimRight(conf.URL, "/") + "/_bulk"
+	httpConf.Method = HTTPMethodPost
+	httpConf.MethodTemplate = ""
+	httpConf.BatchFormat = HTTPBatchNDJSON
+	// the response is parsed by itemErrors
+	httpConf.Response.SuccessCondition = ""
+	if conf.APIKey != "" {
+		httpConf.Headers = make(map[string][]string, len(conf.Headers)+1)
+		for key, values := range conf.Headers {
+			httpConf.Headers[key] = values
+		}
+		httpConf.Headers["Authorization"] = []string{"ApiKey " + conf.APIKey}
+	}
+	fwd := &Elasticsearch{
+		HTTP: newHTTP(c, idx, &httpConf),
+		conf: conf,
+	}
+	var err error
+	if c.TimeAsTimezone != "" {
+		if fwd.location, err = time.LoadLocation(c.TimeAsTimezone); err != nil {
+			fwd.logger.Fatal().Err(err).Msg("failed loading time_as_timezone")
+		}
+	}
+	if conf.DocumentID != "" {
+		if fwd.documentID, err = compileKeyField(conf.DocumentID); err != nil {
+			fwd.logger.Fatal().Err(err).Msg("failed compiling document_id expression")
+		}
+	}
+	fwd.encode = fwd.action
+	fwd.HTTP.itemErrors = fwd.itemErrors
+	fwd.alwaysBatch = true
+	go fwd.Run()
+	return fwd
+}
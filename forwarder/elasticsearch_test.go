@@ -0,0 +1,152 @@
+package forwarder
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bangunindo/trap2json/helper"
+	"github.com/go-json-experiment/json"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// bulkRequest is a received bulk request, the documents are identified by src_port
+type bulkRequest struct {
+	header  http.Header
+	actions []elasticsearchAction
+	ports   []int
+}
+
+// bulkServer replies every bulk request with the item status of the document's src_port.
+// The status of a port is its first element of statuses, it's removed once replied
+func bulkServer(t *testing.T, statuses map[int][]int) (string, chan bulkRequest) {
+	requests := make(chan bulkRequest, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_bulk", r.URL.Path)
+		var buf bytes.Buffer
+		_, _ = buf.ReadFrom(r.Body)
+		lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+		req := bulkRequest{header: r.Header}
+		type item struct {
+			Status int            `json:"status"`
+			Error  map[string]any `json:"error,omitempty"`
+		}
+		var items []map[string]item
+		hasErrors := false
+		for i := 0; i+1 < len(lines); i += 2 {
+			var action elasticsearchAction
+			assert.NoError(t, json.Unmarshal(lines[i], &action))
+			var doc struct {
+				SrcPort int `json:"src_port"`
+			}
+			assert.NoError(t, json.Unmarshal(lines[i+1], &doc, json.RejectUnknownMembers(false)))
+			req.actions = append(req.actions, action)
+			req.ports = append(req.ports, doc.SrcPort)
+			res := item{Status: http.StatusCreated}
+			if s := statuses[doc.SrcPort]; len(s) > 0 {
+				res.Status = s[0]
+				statuses[doc.SrcPort] = s[1:]
+			}
+			if res.Status > 299 {
+				hasErrors = true
+				res.Error = map[string]any{"type": "rejected", "reason": "test"}
+			}
+			items = append(items, map[string]item{"index": res})
+		}
+		requests <- req
+		_ = json.MarshalWrite(w, map[string]any{"took": 1, "errors": hasErrors, "items": items})
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, requests
+}
+
+func TestElasticsearch(t *testing.T) {
+	url, requests := bulkServer(t, nil)
+	fwd := startForwarder(t, Config{
+		TimeAsTimezone: "Asia/Jakarta",
+		Elasticsearch: &ElasticsearchConfig{
+			HTTPConfig: HTTPConfig{URL: url, BatchSize: 1},
+			Index:      "trap-%Y.%m.%d-%H",
+			DocumentID: "src_address",
+			APIKey:     "key",
+		},
+	})
+	fwd.Send(testMessage())
+	req := receive(t, requests)
+	assert.Equal(t, "ApiKey key", req.header.Get("Authorization"))
+	assert.Equal(t, "application/x-ndjson", req.header.Get("Content-Type"))
+	if assert.Len(t, req.actions, 1) {
+		// 03:04 UTC is 10:04 in Jakarta
+		assert.Equal(t, "trap-2024.01.02-10", req.actions[0].Index.Index)
+		assert.Equal(t, "10.0.0.1", req.actions[0].Index.ID)
+	}
+	assert.Equal(t, []int{162}, req.ports)
+}
+
+func TestElasticsearchPartialErrors(t *testing.T) {
+	url, requests := bulkServer(t, map[int][]int{
+		// rejected once and retried
+		2: {http.StatusTooManyRequests},
+		// rejected for good
+		3: {http.StatusBadRequest},
+	})
+	conf, deadLetterPath := httpRetryConfig(t, nil)
+	conf.HTTP = nil
+	conf.Elasticsearch = &ElasticsearchConfig{
+		HTTPConfig: HTTPConfig{
+			URL:          url,
+			BatchSize:    3,
+			BatchTimeout: helper.Duration{Duration: 50 * time.Millisecond},
+		},
+		Index: "trap",
+	}
+	fwd := startForwarder(t, conf)
+	e := fwd.(*Elasticsearch)
+	succeeded := testutil.ToFloat64(e.ctrSucceeded)
+	for port := 1; port <= 3; port++ {
+		m := testMessage()
+		m.Payload.SrcPort = port
+		fwd.Send(m)
+	}
+	assert.Equal(t, []int{1, 2, 3}, receive(t, requests).ports)
+	// only the document with a retryable status is sent again
+	assert.Equal(t, []int{2}, receive(t, requests).ports)
+	record := waitDeadLetter(t, deadLetterPath)
+	assert.Equal(t, 0, record.Retries)
+	assert.Contains(t, record.Error, "document rejected with status 400")
+	var doc struct {
+		SrcPort int `json:"src_port"`
+	}
+	assert.NoError(t, json.Unmarshal(record.MessageJSON, &doc, json.RejectUnknownMembers(false)))
+	assert.Equal(t, 3, doc.SrcPort)
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(e.ctrSucceeded)-succeeded == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Len(t, requests, 0)
+}
+
+func TestElasticsearchItemErrors(t *testing.T) {
+	e := &Elasticsearch{HTTP: &HTTP{}}
+	batch := make([]httpItem, 2)
+	errs, err := e.itemErrors(batch, []byte(`{"errors":false,"items":[]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, []error{nil, nil}, errs)
+	// every document must have its result when some of them failed
+	_, err = e.itemErrors(batch, []byte(`{"errors":true,"items":[{"index":{"status":400}}]}`))
+	assert.Error(t, err)
+	_, err = e.itemErrors(batch, []byte(`not json`))
+	assert.Error(t, err)
+}
+
+func TestFormatIndex(t *testing.T) {
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.Equal(t, "trap-2024.01.02", formatIndex("trap-%Y.%m.%d", ts))
+	assert.Equal(t, "trap-03-%", formatIndex("trap-%H-%%", ts))
+	assert.Equal(t, "trap", formatIndex("trap", ts))
+	assert.NoError(t, validateIndexPattern("trap-%Y.%m.%d-%H%%"))
+	assert.Error(t, validateIndexPattern("trap-%y"))
+	assert.Error(t, validateIndexPattern("trap-%"))
+}
@@ -1,6 +1,7 @@
 package forwarder
 
 import (
+	"github.com/bangunindo/trap2json/snmp"
 	"io"
 	"os"
 )
@@ -34,19 +35,19 @@ func (f *File) Run() {
 		return
 	}
 	defer fOut.Close()
-	for m := range f.ReceiveChannel() {
+	f.consume(func(m *snmp.Message) {
 		m.Compile(f.CompilerConf)
 		if m.Metadata.Skip {
 			f.ctrFiltered.Inc()
-			continue
+			return
 		}
 		mJson := append(m.Metadata.MessageJSON, []byte("\n")...)
-		if _, err = fOut.Write(mJson); err != nil {
+		if _, err := fOut.Write(mJson); err != nil {
 			f.Retry(m, err)
 		} else {
 			f.ctrSucceeded.Inc()
 		}
-	}
+	})
 }
 
 func NewFile(c Config, idx int) Forwarder {
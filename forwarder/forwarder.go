@@ -2,15 +2,22 @@ package forwarder
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"github.com/bangunindo/trap2json/helper"
 	"github.com/bangunindo/trap2json/metrics"
 	"github.com/bangunindo/trap2json/queue"
 	"github.com/bangunindo/trap2json/snmp"
 	"github.com/expr-lang/expr"
 	"github.com/expr-lang/expr/vm"
+	"github.com/go-json-experiment/json"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"os"
 	"reflect"
 	"strconv"
 	"sync"
@@ -21,17 +28,27 @@ type Config struct {
 	// ID identifies forwarder name, also used for prometheus labelling
 	ID string
 	// QueueSize defines the size of queue of each forwarder, when queue is full (might be caused
-	// by slow forwarder) the message is dropped
+	// by slow forwarder) OverflowPolicy decides what happens to the message
 	QueueSize int `mapstructure:"queue_size"`
+	// QueueType disk keeps queued and retried messages in QueueDisk.Path across restarts
+	QueueType      queue.Type           `mapstructure:"queue_type"`
+	QueueDisk      queue.DiskConfig     `mapstructure:"queue_disk"`
+	OverflowPolicy queue.OverflowPolicy `mapstructure:"overflow_policy"`
 	// TimeFormat specifies golang time format for casting time related fields to string
 	TimeFormat string `mapstructure:"time_format"`
 	// TimeAsTimezone will cast any time field to specified timezone
 	TimeAsTimezone   string          `mapstructure:"time_as_timezone"`
 	ShutdownWaitTime helper.Duration `mapstructure:"shutdown_wait_time"`
+	// Workers is the number of messages sent concurrently
+	Workers int
+	// OrderingKey keeps the order of messages with the same key when Workers > 1
+	OrderingKey string `mapstructure:"ordering_key"`
 	// Filter, JSONFormat utilizes antonmedv/expr expressions
-	Filter        string
-	JSONFormat    string           `mapstructure:"json_format"`
-	AutoRetry     helper.AutoRetry `mapstructure:"auto_retry"`
+	Filter     string
+	JSONFormat string           `mapstructure:"json_format"`
+	AutoRetry  helper.AutoRetry `mapstructure:"auto_retry"`
+	// DeadLetter receives messages that exhausted their retries instead of dropping them
+	DeadLetter    *DeadLetterConfig `mapstructure:"dead_letter"`
 	Mock          *MockConfig
 	File          *FileConfig
 	Kafka         *KafkaConfig
@@ -39,6 +56,17 @@ type Config struct {
 	Trap          *SNMPTrapConfig
 	HTTP          *HTTPConfig
 	ZabbixTrapper *ZabbixTrapperConfig `mapstructure:"zabbix_trapper"`
+	Alertmanager  *AlertmanagerConfig
+	Incident      *IncidentConfig
+	Elasticsearch *ElasticsearchConfig
+	Loki          *LokiConfig
+	SplunkHEC     *SplunkHECConfig `mapstructure:"splunk_hec"`
+	Syslog        *SyslogConfig
+	NATS          *NATSConfig `mapstructure:"nats"`
+	AMQP          *AMQPConfig `mapstructure:"amqp"`
+	Redis         *RedisConfig
+	// reinject counts the outcome of the messages, it's set by Reinject
+	reinject *reinjectTracker
 }
 
 func (c *Config) Type() string {
@@ -54,6 +82,24 @@ func (c *Config) Type() string {
 		return "trap"
 	} else if c.ZabbixTrapper != nil {
 		return "zabbix_trapper"
+	} else if c.Alertmanager != nil {
+		return "alertmanager"
+	} else if c.Incident != nil {
+		return "incident"
+	} else if c.Elasticsearch != nil {
+		return "elasticsearch"
+	} else if c.Loki != nil {
+		return "loki"
+	} else if c.SplunkHEC != nil {
+		return "splunk_hec"
+	} else if c.Syslog != nil {
+		return "syslog"
+	} else if c.NATS != nil {
+		return "nats"
+	} else if c.AMQP != nil {
+		return "amqp"
+	} else if c.Redis != nil {
+		return "redis"
 	} else if c.Mock != nil {
 		return "mock"
 	} else {
@@ -61,6 +107,80 @@ func (c *Config) Type() string {
 	}
 }
 
+func (c *Config) queueConfig() queue.Config {
+	return queue.Config{
+		Size:           c.QueueSize,
+		FlushTimeout:   c.ShutdownWaitTime.Duration,
+		Type:           c.QueueType,
+		Disk:           c.QueueDisk,
+		OverflowPolicy: c.OverflowPolicy,
+	}
+}
+
+// Validate checks the config without starting the forwarder, the error path
+// is relative to the forwarder config
+func (c *Config) Validate() []helper.ConfigError {
+	var errs []helper.ConfigError
+	if c.Filter != "" {
+		if _, err := compileFilter(c.Filter); err != nil {
+			errs = append(errs, helper.ConfigError{Path: "filter", Err: err})
+		}
+	}
+	queueConf := c.queueConfig()
+	errs = append(errs, queueConf.Validate()...)
+	if c.JSONFormat != "" {
+		if _, err := compileJSONFormat(c.JSONFormat); err != nil {
+			errs = append(errs, helper.ConfigError{Path: "json_format", Err: err})
+		}
+	}
+	if c.TimeAsTimezone != "" {
+		if _, err := time.LoadLocation(c.TimeAsTimezone); err != nil {
+			errs = append(errs, helper.ConfigError{Path: "time_as_timezone", Err: err})
+		}
+	}
+	if c.OrderingKey != "" {
+		if _, err := compileExpr(c.OrderingKey); err != nil {
+			errs = append(errs, helper.ConfigError{Path: "ordering_key", Err: err})
+		}
+	}
+	if c.DeadLetter != nil {
+		errs = append(errs, helper.PrefixConfigErrors("dead_letter", c.DeadLetter.validate())...)
+	}
+	switch c.Type() {
+	case "kafka":
+		errs = append(errs, helper.PrefixConfigErrors("kafka", c.Kafka.validate())...)
+	case "http":
+		errs = append(errs, helper.PrefixConfigErrors("http", c.HTTP.validate())...)
+	case "mqtt":
+		errs = append(errs, helper.PrefixConfigErrors("mqtt", c.MQTT.validate())...)
+	case "trap":
+		errs = append(errs, helper.PrefixConfigErrors("trap", c.Trap.validate())...)
+	case "zabbix_trapper":
+		errs = append(errs, helper.PrefixConfigErrors("zabbix_trapper", c.ZabbixTrapper.validate())...)
+	case "alertmanager":
+		errs = append(errs, helper.PrefixConfigErrors("alertmanager", c.Alertmanager.validate())...)
+	case "incident":
+		errs = append(errs, helper.PrefixConfigErrors("incident", c.Incident.validate())...)
+	case "elasticsearch":
+		errs = append(errs, helper.PrefixConfigErrors("elasticsearch", c.Elasticsearch.validate())...)
+	case "loki":
+		errs = append(errs, helper.PrefixConfigErrors("loki", c.Loki.validate())...)
+	case "splunk_hec":
+		errs = append(errs, helper.PrefixConfigErrors("splunk_hec", c.SplunkHEC.validate())...)
+	case "syslog":
+		errs = append(errs, helper.PrefixConfigErrors("syslog", c.Syslog.validate())...)
+	case "nats":
+		errs = append(errs, helper.PrefixConfigErrors("nats", c.NATS.validate())...)
+	case "amqp":
+		errs = append(errs, helper.PrefixConfigErrors("amqp", c.AMQP.validate())...)
+	case "redis":
+		errs = append(errs, helper.PrefixConfigErrors("redis", c.Redis.validate())...)
+	case "unknown":
+		errs = append(errs, helper.ConfigError{Path: "id", Err: errors.New("forwarder destination is not defined")})
+	}
+	return errs
+}
+
 type Tls struct {
 	InsecureSkipVerify bool   `mapstructure:"insecure_skip_verify"`
 	CaCert             string `mapstructure:"ca_cert"`
@@ -68,6 +188,32 @@ type Tls struct {
 	ClientKey          string `mapstructure:"client_key"`
 }
 
+// config loads the ca and client certificates, the client certificate
+// is only used when both cert and key are set
+func (t *Tls) config() (*tls.Config, error) {
+	tlsConf := &tls.Config{
+		InsecureSkipVerify: t.InsecureSkipVerify,
+	}
+	if t.CaCert != "" {
+		ca, err := os.ReadFile(t.CaCert)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed reading ca certificate")
+		}
+		caCerts := x509.NewCertPool()
+		caCerts.AppendCertsFromPEM(ca)
+		tlsConf.RootCAs = caCerts
+	}
+	if t.ClientCert != "" &&
+		t.ClientKey != "" {
+		cert, err := tls.LoadX509KeyPair(t.ClientCert, t.ClientKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed reading client certificate")
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConf, nil
+}
+
 type Forwarder interface {
 	// Send will send the trap message to its corresponding forwarder.
 	// Does nothing if the queue buffer is full or forwarder is already closed
@@ -81,25 +227,48 @@ type Forwarder interface {
 	Done() <-chan struct{}
 	// Config returns the forwarder config
 	Config() Config
+	// Redirect moves queued and retried messages to another forwarder,
+	// Close still needs to be called afterward
+	Redirect(Forwarder)
+	// SetDeadLetter sets the forwarder of dead_letter.forwarder
+	SetDeadLetter(Forwarder)
 }
 
 type Base struct {
-	idx             string
-	fwdType         string
-	config          Config
-	queue           *queue.Queue[*snmp.Message]
-	ctx             context.Context
-	cancel          context.CancelFunc
+	idx     string
+	fwdType string
+	config  Config
+	queue   *queue.Queue[*snmp.Message]
+	ctx     context.Context
+	cancel  context.CancelFunc
+	// done is closed after the forwarder exited and its queue is released
+	done            chan struct{}
 	ctrProcessed    prometheus.Counter
 	ctrSucceeded    prometheus.Counter
 	ctrDropped      prometheus.Counter
 	ctrRetried      prometheus.Counter
 	ctrFiltered     prometheus.Counter
 	ctrLookupFailed prometheus.Counter
-	ctrQueueCap     prometheus.Gauge
-	ctrQueueLen     prometheus.Gauge
-	logger          zerolog.Logger
-	CompilerConf    snmp.MessageCompiler
+	ctrDeadLettered prometheus.Counter
+	// ctrFailedPermanent and ctrFailedTransient count failures by whether they can be retried
+	ctrFailedPermanent prometheus.Counter
+	ctrFailedTransient prometheus.Counter
+	ctrBatchSize       prometheus.Observer
+	ctrQueueCap        prometheus.Gauge
+	ctrQueueLen        prometheus.Gauge
+	logger             zerolog.Logger
+	CompilerConf       snmp.MessageCompiler
+	orderingKey        *vm.Program
+	sendMutex          *sync.RWMutex
+	closed             bool
+	// closing is closed at the start of Close, it releases Send
+	// that is blocked on a full queue with overflow_policy block
+	closing   chan struct{}
+	closeOnce *sync.Once
+	// heldAcks are the queue keys that consume doesn't ack, see holdAck
+	heldAcks     *sync.Map
+	redirectTo   Forwarder
+	deadLetterTo Forwarder
 }
 
 func (b *Base) Config() Config {
@@ -107,36 +276,191 @@ func (b *Base) Config() Config {
 }
 
 func (b *Base) Send(m *snmp.Message) {
-	b.queue.SendChannel() <- m
+	// the key belongs to the queue the message came from
+	m.SetQueueKey(nil)
+	b.sendMutex.RLock()
+	defer b.sendMutex.RUnlock()
+	// a replaced forwarder might still receive dead letters from the others
+	if b.redirectTo != nil {
+		b.redirectMessage(m)
+		return
+	}
+	if b.closed {
+		b.logger.Debug().Msg("forwarder is closed, dropping message")
+		b.ctrDropped.Inc()
+		return
+	}
+	select {
+	case b.queue.SendChannel() <- m:
+	case <-b.closing:
+		b.logger.Debug().Msg("forwarder is closing, dropping message")
+		b.ctrDropped.Inc()
+	}
+}
+
+// redirectMessage resets the compiled metadata since the destination might have
+// different filter and json_format. The retry count is kept, but the destination
+// is tried right away since the old delay was computed for the old destination.
+// Dead letter record is kept as is
+func (b *Base) redirectMessage(m *snmp.Message) {
+	conf := b.redirectTo.Config()
+	m.Metadata.Eta = time.Time{}
+	if !m.Metadata.DeadLettered {
+		m.Metadata.Compiled = false
+		m.Metadata.Skip = false
+		m.Metadata.MessageJSON = nil
+	}
+	m.Metadata.TimeAsTimezone = conf.TimeAsTimezone
+	m.Metadata.TimeFormat = conf.TimeFormat
+	b.redirectTo.Send(m)
+}
+
+func (b *Base) Redirect(to Forwarder) {
+	b.sendMutex.Lock()
+	b.redirectTo = to
+	b.sendMutex.Unlock()
+	b.queue.Redirect(b.redirectMessage)
 }
 
 func (b *Base) ReceiveChannel() <-chan *snmp.Message {
 	return b.queue.ReceiveChannel()
 }
 
+// permanentError is a failure that fails the same way on retry
+type permanentError struct {
+	error
+}
+
+func (e permanentError) Unwrap() error {
+	return e.error
+}
+
+// permanent marks err so Retry sends the message to dead_letter right away
+func permanent(err error) error {
+	return permanentError{err}
+}
+
+func isPermanent(err error) bool {
+	var p permanentError
+	return errors.As(err, &p)
+}
+
+// retryAfterError asks Retry to wait at least for after, e.g. from Retry-After header
+type retryAfterError struct {
+	error
+	after time.Duration
+}
+
+func (e retryAfterError) Unwrap() error {
+	return e.error
+}
+
+// Retry puts back the message with exponential backoff delay. Permanent
+// failures and messages that exhausted their retries go to dead_letter
 func (b *Base) Retry(message *snmp.Message, err error) {
+	if isPermanent(err) {
+		b.ctrFailedPermanent.Inc()
+		b.deadLetter(message, err)
+		return
+	}
+	b.ctrFailedTransient.Inc()
 	if b.config.AutoRetry.Enable && message.Metadata.Retries < b.config.AutoRetry.MaxRetries {
 		eta := message.ComputeEta(
 			b.config.AutoRetry.MinDelay.Duration,
 			b.config.AutoRetry.MaxDelay.Duration,
 		)
+		var retryAfter retryAfterError
+		if errors.As(err, &retryAfter) {
+			after := min(retryAfter.after, b.config.AutoRetry.MaxDelay.Duration)
+			if afterEta := time.Now().Add(after); afterEta.After(eta) {
+				eta = afterEta
+			}
+		}
 		message.Metadata.Retries++
 		message.Metadata.Eta = eta
 		b.ctrRetried.Inc()
 		b.logger.Debug().Err(err).Msg("retrying to forward trap")
-		b.Send(message)
+		b.requeue(message)
 	} else {
-		b.logger.Warn().Err(err).Msg("failed forwarding trap")
+		b.deadLetter(message, err)
+	}
+}
+
+// requeue puts back a retried message, unlike Send it's not subject to
+// overflow_policy since the message is already counted in the queue. It
+// still works after Close, until the workers are done
+func (b *Base) requeue(m *snmp.Message) {
+	b.sendMutex.RLock()
+	defer b.sendMutex.RUnlock()
+	if b.redirectTo != nil {
+		b.redirectMessage(m)
+		return
+	}
+	if err := b.queue.Retry(m); err != nil {
+		if errors.Is(err, queue.ErrClosed) && m.QueueKey() != nil {
+			// it's never acked, so it's received again on the next start
+			b.logger.Debug().Msg("queue is closed, retried trap is kept in disk queue")
+			return
+		}
+		b.logger.Warn().Err(err).Msg("failed putting back retried trap")
 		b.ctrDropped.Inc()
 	}
 }
 
 func (b *Base) Close() {
-	b.queue.Close()
+	b.closeOnce.Do(func() { close(b.closing) })
+	b.sendMutex.Lock()
+	defer b.sendMutex.Unlock()
+	if !b.closed {
+		b.closed = true
+		b.queue.Close()
+	}
 }
 
 func (b *Base) Done() <-chan struct{} {
-	return b.ctx.Done()
+	return b.done
+}
+
+func compileFilter(filter string) (*vm.Program, error) {
+	opts := []expr.Option{expr.AsBool(), expr.Env(snmp.Payload{})}
+	opts = append(opts, snmp.Functions...)
+	return expr.Compile(filter, opts...)
+}
+
+// compileExpr compiles an expression of any result type, like ordering_key and the syslog fields
+func compileExpr(expression string) (*vm.Program, error) {
+	opts := []expr.Option{expr.Env(snmp.Payload{})}
+	opts = append(opts, snmp.Functions...)
+	return expr.Compile(expression, opts...)
+}
+
+func compileJSONFormat(jsonFormat string) (*vm.Program, error) {
+	opts := []expr.Option{expr.AsKind(reflect.Map), expr.Env(snmp.Payload{})}
+	opts = append(opts, snmp.Functions...)
+	return expr.Compile(jsonFormat, opts...)
+}
+
+// NewMessageCompiler compiles filter and json_format expressions of a forwarder
+func NewMessageCompiler(c Config, logger zerolog.Logger) (snmp.MessageCompiler, error) {
+	var filterExpr, formatExpr *vm.Program
+	var err error
+	if c.Filter != "" {
+		filterExpr, err = compileFilter(c.Filter)
+		if err != nil {
+			return snmp.MessageCompiler{}, errors.Wrap(err, "failed compiling filter expression")
+		}
+	}
+	if c.JSONFormat != "" {
+		formatExpr, err = compileJSONFormat(c.JSONFormat)
+		if err != nil {
+			return snmp.MessageCompiler{}, errors.Wrap(err, "failed compiling json_format expression")
+		}
+	}
+	return snmp.MessageCompiler{
+		Filter:     filterExpr,
+		JSONFormat: formatExpr,
+		Logger:     logger,
+	}, nil
 }
 
 func NewBase(c Config, idx int) Base {
@@ -144,11 +468,15 @@ func NewBase(c Config, idx int) Base {
 	ctx, cancel := context.WithCancel(context.Background())
 	idxStr := strconv.Itoa(idx + 1)
 	base := Base{
-		idx:     idxStr,
-		fwdType: fwdType,
-		config:  c,
-		ctx:     ctx,
-		cancel:  cancel,
+		idx:       idxStr,
+		fwdType:   fwdType,
+		config:    c,
+		ctx:       ctx,
+		cancel:    cancel,
+		sendMutex: new(sync.RWMutex),
+		closing:   make(chan struct{}),
+		closeOnce: new(sync.Once),
+		heldAcks:  new(sync.Map),
 		ctrProcessed: metrics.ForwarderProcessed.With(prometheus.Labels{
 			"index": idxStr,
 			"type":  fwdType,
@@ -179,6 +507,28 @@ func NewBase(c Config, idx int) Base {
 			"type":  fwdType,
 			"id":    c.ID,
 		}),
+		ctrDeadLettered: metrics.ForwarderDeadLettered.With(prometheus.Labels{
+			"index": idxStr,
+			"type":  fwdType,
+			"id":    c.ID,
+		}),
+		ctrFailedPermanent: metrics.ForwarderFailed.With(prometheus.Labels{
+			"index":  idxStr,
+			"type":   fwdType,
+			"id":     c.ID,
+			"reason": "permanent",
+		}),
+		ctrFailedTransient: metrics.ForwarderFailed.With(prometheus.Labels{
+			"index":  idxStr,
+			"type":   fwdType,
+			"id":     c.ID,
+			"reason": "transient",
+		}),
+		ctrBatchSize: metrics.ForwarderBatchSize.With(prometheus.Labels{
+			"index": idxStr,
+			"type":  fwdType,
+			"id":    c.ID,
+		}),
 		ctrQueueCap: metrics.ForwarderQueueCapacity.With(prometheus.Labels{
 			"index": idxStr,
 			"type":  fwdType,
@@ -197,140 +547,400 @@ func NewBase(c Config, idx int) Base {
 			Str("id", c.ID).
 			Logger(),
 	}
-	base.queue = queue.NewQueue[*snmp.Message](
+	if t := c.reinject; t != nil {
+		base.ctrSucceeded = trackedCounter{base.ctrSucceeded, &t.delivered, t}
+		base.ctrFiltered = trackedCounter{base.ctrFiltered, &t.delivered, t}
+		base.ctrDeadLettered = trackedCounter{base.ctrDeadLettered, &t.failed, t}
+		base.ctrDropped = trackedCounter{base.ctrDropped, &t.dropped, t}
+	}
+	counter := queue.Counter{
+		Processed: base.ctrProcessed,
+		Drop:      base.ctrDropped,
+		QueueCap:  base.ctrQueueCap,
+		QueueLen:  base.ctrQueueLen,
+	}
+	queueConf := c.queueConfig()
+	if queueConf.UsesDisk() {
+		counter.QueueBytes = metrics.ForwarderQueueBytes.With(prometheus.Labels{
+			"index": idxStr,
+			"type":  fwdType,
+			"id":    c.ID,
+		})
+		counter.DiskUsage = metrics.ForwarderQueueDiskUsage.With(prometheus.Labels{
+			"index": idxStr,
+			"type":  fwdType,
+			"id":    c.ID,
+		})
+	}
+	counter.Overflow = metrics.ForwarderQueueOverflow.MustCurryWith(prometheus.Labels{
+		"index": idxStr,
+		"type":  fwdType,
+		"id":    c.ID,
+	})
+	var err error
+	base.queue, err = queue.New[*snmp.Message](
 		base.logger,
-		c.QueueSize,
-		c.ShutdownWaitTime.Duration,
+		queueConf,
+		snmp.MessageCodec{},
 		nil,
-		queue.Counter{
-			Processed: base.ctrProcessed,
-			Drop:      base.ctrDropped,
-			QueueCap:  base.ctrQueueCap,
-			QueueLen:  base.ctrQueueLen,
-		},
+		counter,
 	)
-	var filterExpr, formatExpr *vm.Program
-	var err error
-	if c.Filter != "" {
-		opts := []expr.Option{expr.AsBool(), expr.Env(snmp.Payload{})}
-		opts = append(opts, snmp.Functions...)
-		filterExpr, err = expr.Compile(
-			c.Filter,
-			opts...,
-		)
-		if err != nil {
-			base.logger.Fatal().Err(err).Msg("failed compiling filter expression")
-		}
+	if err != nil {
+		// a memory queue would lose the traps that are expected to survive restarts
+		base.logger.Fatal().Err(err).Msg("failed opening forwarder queue")
 	}
-	if c.JSONFormat != "" {
-		opts := []expr.Option{expr.AsKind(reflect.Map), expr.Env(snmp.Payload{})}
-		opts = append(opts, snmp.Functions...)
-		formatExpr, err = expr.Compile(
-			c.JSONFormat,
-			opts...,
-		)
+	base.done = make(chan struct{})
+	go func(q *queue.Queue[*snmp.Message], done chan struct{}) {
+		<-ctx.Done()
+		<-q.Done()
+		close(done)
+	}(base.queue, base.done)
+	base.CompilerConf, err = NewMessageCompiler(c, base.logger)
+	if err != nil {
+		base.logger.Fatal().Err(err).Msg("failed compiling forwarder expressions")
+	}
+	if c.OrderingKey != "" {
+		base.orderingKey, err = compileExpr(c.OrderingKey)
 		if err != nil {
-			base.logger.Fatal().Err(err).Msg("failed compiling json_format expression")
+			base.logger.Fatal().Err(err).Msg("failed compiling ordering_key expression")
 		}
 	}
-	base.CompilerConf = snmp.MessageCompiler{
-		Filter:     filterExpr,
-		JSONFormat: formatExpr,
-		Logger:     base.logger,
+	if t := c.reinject; t != nil {
+		t.register(base)
 	}
 	return base
 }
 
-func StartForwarders(wg *sync.WaitGroup, c []Config, messageChan <-chan *snmp.Message) {
-	defer wg.Done()
-	var forwarders []Forwarder
-	if len(c) == 0 {
-		log.Warn().
-			Str("module", "forwarder").
-			Msg("no forwarders configured")
+// newForwarder applies default values and starts the forwarder, returns nil
+// if the forwarder type is unknown
+func newForwarder(fwd Config, idx int) Forwarder {
+	modLogger := log.With().
+		Str("module", "forwarder").
+		Str("id", fwd.ID).
+		Int("index", idx+1).
+		Logger()
+	if fwd.QueueSize == 0 {
+		fwd.QueueSize = 10000
 	}
-	for i, fwd := range c {
-		modLogger := log.With().
-			Str("module", "forwarder").
-			Str("id", fwd.ID).
-			Int("index", i+1).
-			Logger()
-		if fwd.QueueSize == 0 {
-			fwd.QueueSize = 10000
+	if fwd.QueueSize < 0 {
+		fwd.QueueSize = 0
+	}
+	if fwd.AutoRetry.MaxRetries == 0 {
+		fwd.AutoRetry.MaxRetries = 10
+	}
+	if fwd.AutoRetry.MinDelay.Duration == 0 {
+		fwd.AutoRetry.MinDelay.Duration = time.Second
+	}
+	if fwd.AutoRetry.MaxDelay.Duration == 0 {
+		fwd.AutoRetry.MaxDelay.Duration = time.Hour
+	}
+	if fwd.AutoRetry.MinDelay.Duration > fwd.AutoRetry.MaxDelay.Duration {
+		if fwd.AutoRetry.Enable {
+			modLogger.Warn().Msg("min_delay is larger than max_delay, will set max_delay the same as min_delay")
 		}
-		if fwd.QueueSize < 0 {
-			fwd.QueueSize = 0
+		fwd.AutoRetry.MaxDelay = fwd.AutoRetry.MinDelay
+	}
+	if fwd.ShutdownWaitTime.Duration == 0 {
+		fwd.ShutdownWaitTime.Duration = 5 * time.Second
+	}
+	switch fwd.Type() {
+	case "mock":
+		return NewMock(fwd, idx)
+	case "file":
+		return NewFile(fwd, idx)
+	case "kafka":
+		if fwd.Kafka.BatchSize == 0 {
+			fwd.Kafka.BatchSize = 100
 		}
-		if fwd.AutoRetry.MaxRetries == 0 {
-			fwd.AutoRetry.MaxRetries = 10
+		if fwd.Kafka.BatchTimeout.Duration == 0 {
+			fwd.Kafka.BatchTimeout.Duration = time.Second
 		}
-		if fwd.AutoRetry.MinDelay.Duration == 0 {
-			fwd.AutoRetry.MinDelay.Duration = time.Second
+		return NewKafka(fwd, idx)
+	case "http":
+		setHTTPDefaults(fwd.HTTP)
+		return NewHTTP(fwd, idx)
+	case "mqtt":
+		if fwd.MQTT.Ordered == nil {
+			b := true
+			fwd.MQTT.Ordered = &b
 		}
-		if fwd.AutoRetry.MaxDelay.Duration == 0 {
-			fwd.AutoRetry.MaxDelay.Duration = time.Hour
+		return NewMQTT(fwd, idx)
+	case "trap":
+		// trap.workers is kept for older config
+		if fwd.Workers == 0 {
+			fwd.Workers = fwd.Trap.Workers
 		}
-		if fwd.AutoRetry.MinDelay.Duration > fwd.AutoRetry.MaxDelay.Duration {
-			if fwd.AutoRetry.Enable {
-				modLogger.Warn().Msg("min_delay is larger than max_delay, will set max_delay the same as min_delay")
-			}
-			fwd.AutoRetry.MaxDelay = fwd.AutoRetry.MinDelay
-		}
-		if fwd.ShutdownWaitTime.Duration == 0 {
-			fwd.ShutdownWaitTime.Duration = 5 * time.Second
-		}
-		switch fwd.Type() {
-		case "mock":
-			forwarders = append(forwarders, NewMock(fwd, i))
-		case "file":
-			forwarders = append(forwarders, NewFile(fwd, i))
-		case "kafka":
-			if fwd.Kafka.BatchSize == 0 {
-				fwd.Kafka.BatchSize = 100
-			}
-			if fwd.Kafka.BatchTimeout.Duration == 0 {
-				fwd.Kafka.BatchTimeout.Duration = time.Second
-			}
-			forwarders = append(forwarders, NewKafka(fwd, i))
-		case "http":
-			if fwd.HTTP.Timeout.Duration == 0 {
-				fwd.HTTP.Timeout.Duration = 5 * time.Second
-			}
-			forwarders = append(forwarders, NewHTTP(fwd, i))
-		case "mqtt":
-			if fwd.MQTT.Ordered == nil {
-				b := true
-				fwd.MQTT.Ordered = &b
-			}
-			forwarders = append(forwarders, NewMQTT(fwd, i))
-		case "trap":
-			if fwd.Trap.Workers == 0 {
-				fwd.Trap.Workers = 1
-			}
-			forwarders = append(forwarders, NewSNMPTrap(fwd, i))
-		case "zabbix_trapper":
-			if fwd.ZabbixTrapper.Advanced != nil && fwd.ZabbixTrapper.Advanced.DBRefreshInterval.Duration == 0 {
-				fwd.ZabbixTrapper.Advanced.DBRefreshInterval.Duration = 15 * time.Minute
-			}
-			if fwd.ZabbixTrapper.Advanced != nil && fwd.ZabbixTrapper.Advanced.DBQueryTimeout.Duration == 0 {
-				fwd.ZabbixTrapper.Advanced.DBQueryTimeout.Duration = 5 * time.Second
+		return NewSNMPTrap(fwd, idx)
+	case "zabbix_trapper":
+		if fwd.ZabbixTrapper.Advanced != nil && fwd.ZabbixTrapper.Advanced.DBRefreshInterval.Duration == 0 {
+			fwd.ZabbixTrapper.Advanced.DBRefreshInterval.Duration = 15 * time.Minute
+		}
+		if fwd.ZabbixTrapper.Advanced != nil && fwd.ZabbixTrapper.Advanced.DBQueryTimeout.Duration == 0 {
+			fwd.ZabbixTrapper.Advanced.DBQueryTimeout.Duration = 5 * time.Second
+		}
+		return NewZabbixTrapper(fwd, idx)
+	case "alertmanager":
+		setHTTPDefaults(&fwd.Alertmanager.HTTPConfig)
+		return NewAlertmanager(fwd, idx)
+	case "incident":
+		setHTTPDefaults(&fwd.Incident.HTTPConfig)
+		if fwd.Incident.Source == "" {
+			fwd.Incident.Source = "{src_address}"
+		}
+		if fwd.Incident.Severity == "" {
+			fwd.Incident.Severity = "error"
+		}
+		return NewIncident(fwd, idx)
+	case "elasticsearch":
+		setHTTPDefaults(&fwd.Elasticsearch.HTTPConfig)
+		if fwd.Elasticsearch.Index == "" {
+			fwd.Elasticsearch.Index = "trap2json-%Y.%m.%d"
+		}
+		if fwd.Elasticsearch.BatchSize == 0 {
+			fwd.Elasticsearch.BatchSize = 500
+		}
+		return NewElasticsearch(fwd, idx)
+	case "loki":
+		setHTTPDefaults(&fwd.Loki.HTTPConfig)
+		if fwd.Loki.BatchSize == 0 {
+			fwd.Loki.BatchSize = 500
+		}
+		if fwd.Loki.MaxLabelValues == 0 {
+			fwd.Loki.MaxLabelValues = 1000
+		}
+		return NewLoki(fwd, idx)
+	case "splunk_hec":
+		conf := fwd.SplunkHEC
+		setHTTPDefaults(&conf.HTTPConfig)
+		if conf.BatchSize == 0 {
+			conf.BatchSize = 100
+		}
+		if conf.Host == "" {
+			conf.Host = "{src_address}"
+		}
+		if conf.Source == "" {
+			conf.Source = "trap2json"
+		}
+		if conf.SourceType == "" {
+			conf.SourceType = "_json"
+		}
+		if conf.Ack.PollInterval.Duration == 0 {
+			conf.Ack.PollInterval.Duration = time.Second
+		}
+		if conf.Ack.Timeout.Duration == 0 {
+			conf.Ack.Timeout.Duration = time.Minute
+		}
+		return NewSplunkHEC(fwd, idx)
+	case "syslog":
+		conf := fwd.Syslog
+		if conf.Facility == "" {
+			conf.Facility = `"local0"`
+		}
+		if conf.Severity == "" {
+			conf.Severity = `"notice"`
+		}
+		if conf.Hostname == "" {
+			conf.Hostname = "agent_address ?? src_address"
+		}
+		if conf.AppName == "" {
+			conf.AppName = `"trap2json"`
+		}
+		if conf.SDID == "" {
+			conf.SDID = "trap2json@32473"
+		}
+		if conf.Timeout.Duration == 0 {
+			conf.Timeout.Duration = 5 * time.Second
+		}
+		return NewSyslog(fwd, idx)
+	case "nats":
+		if fwd.NATS.Timeout.Duration == 0 {
+			fwd.NATS.Timeout.Duration = 5 * time.Second
+		}
+		if fwd.NATS.JetStream.AckTimeout.Duration == 0 {
+			fwd.NATS.JetStream.AckTimeout.Duration = 5 * time.Second
+		}
+		return NewNATS(fwd, idx)
+	case "amqp":
+		conf := fwd.AMQP
+		if conf.ContentType == "" {
+			conf.ContentType = "application/json"
+		}
+		if conf.Persistent == nil {
+			b := true
+			conf.Persistent = &b
+		}
+		if conf.ConfirmTimeout.Duration == 0 {
+			conf.ConfirmTimeout.Duration = 5 * time.Second
+		}
+		if conf.Timeout.Duration == 0 {
+			conf.Timeout.Duration = 5 * time.Second
+		}
+		return NewAMQP(fwd, idx)
+	case "redis":
+		conf := fwd.Redis
+		if conf.Field == "" {
+			conf.Field = "message"
+		}
+		if conf.Timeout.Duration == 0 {
+			conf.Timeout.Duration = 5 * time.Second
+		}
+		return NewRedis(fwd, idx)
+	default:
+		modLogger.Warn().Msg("please define your forwarder destination")
+		return nil
+	}
+}
+
+// fingerprint is used to detect config changes between reloads, the config
+// needs to be fingerprinted before it's passed to the forwarder since some
+// forwarders modify their config
+func fingerprint(c Config) string {
+	data, err := json.Marshal(
+		c,
+		json.Deterministic(true),
+		json.WithMarshalers(json.MarshalFunc(func(ch chan *snmp.Message) ([]byte, error) {
+			return json.Marshal(fmt.Sprintf("%p", ch))
+		})),
+	)
+	if err != nil {
+		// treat it as a changed config
+		return uuid.NewString()
+	}
+	return string(data)
+}
+
+// forwarderKey identifies the same forwarder between reloads
+func forwarderKey(c Config, idx int) string {
+	if c.ID != "" {
+		return "id:" + c.ID
+	}
+	return "index:" + strconv.Itoa(idx)
+}
+
+type managedForwarder struct {
+	Forwarder
+	key         string
+	fingerprint string
+}
+
+// usesDisk reports whether the forwarder holds a disk queue directory
+func (m managedForwarder) usesDisk() bool {
+	conf := m.Config()
+	queueConf := conf.queueConfig()
+	return queueConf.UsesDisk()
+}
+
+// reloadForwarders keeps unchanged forwarders with their queue, changed forwarders
+// are replaced and their queued messages are moved to the replacement
+func reloadForwarders(current []managedForwarder, c []Config, drainWg *sync.WaitGroup) []managedForwarder {
+	logger := log.With().Str("module", "forwarder").Logger()
+	previous := make(map[string]managedForwarder)
+	for _, fwd := range current {
+		previous[fwd.key] = fwd
+	}
+	stop := func(fwd managedForwarder) {
+		fwd.Close()
+		drainWg.Add(1)
+		go func() {
+			defer drainWg.Done()
+			<-fwd.Done()
+		}()
+	}
+	keys := make([]string, len(c))
+	fingerprints := make([]string, len(c))
+	unchanged := make(map[string]bool)
+	for i, conf := range c {
+		keys[i] = forwarderKey(conf, i)
+		fingerprints[i] = fingerprint(conf)
+		if old, exists := previous[keys[i]]; exists && old.fingerprint == fingerprints[i] {
+			unchanged[keys[i]] = true
+		}
+	}
+	// disk queue can only be opened once, it has to be released before the
+	// new forwarders open it. Queued messages stay on disk for the new forwarder
+	for key, old := range previous {
+		if !unchanged[key] && old.usesDisk() {
+			old.Close()
+			<-old.Done()
+		}
+	}
+	var next []managedForwarder
+	for i, conf := range c {
+		key, fp := keys[i], fingerprints[i]
+		old, exists := previous[key]
+		delete(previous, key)
+		if unchanged[key] {
+			next = append(next, old)
+			continue
+		}
+		fwd := newForwarder(conf, i)
+		switch {
+		case fwd == nil && exists:
+			stop(old)
+		case fwd == nil:
+		case exists:
+			logger.Info().Str("id", conf.ID).Int("index", i+1).Msg("forwarder config changed, replacing forwarder")
+			if !old.usesDisk() {
+				old.Redirect(fwd)
 			}
-			forwarders = append(forwarders, NewZabbixTrapper(fwd, i))
+			stop(old)
 		default:
-			modLogger.Warn().Msg("please define your forwarder destination")
+			logger.Info().Str("id", conf.ID).Int("index", i+1).Msg("forwarder added")
+		}
+		if fwd != nil {
+			next = append(next, managedForwarder{fwd, key, fp})
 		}
 	}
-	for msg := range messageChan {
-		for _, fwd := range forwarders {
-			mCopy := msg.Copy()
-			mCopy.Metadata = snmp.Metadata{
-				Eta:            time.Now(),
-				TimeAsTimezone: fwd.Config().TimeAsTimezone,
-				TimeFormat:     fwd.Config().TimeFormat,
+	for _, old := range previous {
+		logger.Info().Str("id", old.Config().ID).Msg("forwarder removed")
+		stop(old)
+	}
+	running := make([]Forwarder, len(next))
+	for i, fwd := range next {
+		running[i] = fwd
+	}
+	linkDeadLetters(running)
+	return next
+}
+
+// StartForwarders sends every message to all forwarders, forwarders are replaced
+// whenever a new config is received from reloadChan
+func StartForwarders(
+	wg *sync.WaitGroup,
+	c []Config,
+	messageChan <-chan *snmp.Message,
+	reloadChan <-chan []Config,
+) {
+	defer wg.Done()
+	if len(c) == 0 {
+		log.Warn().
+			Str("module", "forwarder").
+			Msg("no forwarders configured")
+	}
+	drainWg := new(sync.WaitGroup)
+	forwarders := reloadForwarders(nil, c, drainWg)
+outer:
+	for {
+		select {
+		case msg, ok := <-messageChan:
+			if !ok {
+				break outer
+			}
+			for _, fwd := range forwarders {
+				mCopy := msg.Copy()
+				mCopy.Metadata = snmp.Metadata{
+					Eta:            time.Now(),
+					TimeAsTimezone: fwd.Config().TimeAsTimezone,
+					TimeFormat:     fwd.Config().TimeFormat,
+				}
+				fwd.Send(&mCopy)
 			}
-			fwd.Send(&mCopy)
+		case conf := <-reloadChan:
+			forwarders = reloadForwarders(forwarders, conf, drainWg)
 		}
 	}
+	// replaced forwarders might still move messages to the current ones
+	drainWg.Wait()
 	for _, fwd := range forwarders {
 		fwd.Close()
 	}
@@ -0,0 +1,171 @@
+package forwarder
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bangunindo/trap2json/helper"
+	"github.com/bangunindo/trap2json/queue"
+	"github.com/bangunindo/trap2json/snmp"
+	"github.com/stretchr/testify/assert"
+)
+
+// testMessage is a linkDown trap from 10.0.0.1
+func testMessage() *snmp.Message {
+	agent := "10.0.0.2"
+	community := "public"
+	enterprise := "IF-MIB::linkDown"
+	trapType := int64(2)
+	return &snmp.Message{
+		Payload: &snmp.Payload{
+			Time:              time.Date(2024, 1, 2, 3, 4, 5, 678_000_000, time.UTC),
+			SrcAddress:        "10.0.0.1",
+			SrcPort:           162,
+			AgentAddress:      &agent,
+			Community:         &community,
+			EnterpriseMIBName: &enterprise,
+			TrapType:          &trapType,
+			Values: []snmp.Value{
+				{
+					OID:        ".1.3.6.1.2.1.2.2.1.1.3",
+					MIBName:    "IF-MIB::ifIndex.3",
+					Type:       snmp.TypeInteger,
+					NativeType: "INTEGER",
+					Value:      3,
+				},
+			},
+		},
+	}
+}
+
+// startForwarder validates and starts c, it's closed at the end of the test
+func startForwarder(t *testing.T, c Config) Forwarder {
+	t.Helper()
+	if c.ID == "" {
+		c.ID = t.Name()
+	}
+	if !assert.Empty(t, c.Validate()) {
+		t.FailNow()
+	}
+	fwd := newForwarder(c, 0)
+	t.Cleanup(func() {
+		fwd.Close()
+		<-fwd.Done()
+	})
+	return fwd
+}
+
+// receive waits for a value of ch, the test fails after 5 seconds
+func receive[T any](t *testing.T, ch <-chan T) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for the forwarder")
+		var zero T
+		return zero
+	}
+}
+
+// capturedRequest is a request received by captureRequests
+type capturedRequest struct {
+	method string
+	// uri is the path with the query
+	uri    string
+	header http.Header
+	body   []byte
+}
+
+// captureRequests starts a server that replies every request with status
+// and an empty json object, the received requests are sent to the channel
+func captureRequests(t *testing.T, status int) (string, chan capturedRequest) {
+	requests := make(chan capturedRequest, 100)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		requests <- capturedRequest{
+			method: r.Method,
+			uri:    r.URL.RequestURI(),
+			header: r.Header,
+			body:   body,
+		}
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte("{}"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, requests
+}
+
+func TestDiskQueueKeepsInFlight(t *testing.T) {
+	conf := Config{
+		ID:        "disk",
+		QueueType: queue.TypeDisk,
+		QueueDisk: queue.DiskConfig{Path: t.TempDir()},
+		AutoRetry: helper.AutoRetry{
+			Enable:   true,
+			MinDelay: helper.Duration{Duration: 10 * time.Millisecond},
+			MaxDelay: helper.Duration{Duration: 10 * time.Millisecond},
+		},
+		Mock: &MockConfig{
+			OutChannel: make(chan *snmp.Message),
+			Timeout:    helper.Duration{Duration: 50 * time.Millisecond},
+		},
+	}
+	// nobody receives, so every trap is retried until the forwarder is closed
+	fwd := newForwarder(conf, 0)
+	for port := 1; port <= 3; port++ {
+		m := testMessage()
+		m.Payload.SrcPort = port
+		fwd.Send(m)
+	}
+	time.Sleep(100 * time.Millisecond)
+	fwd.Close()
+	<-fwd.Done()
+
+	conf.Mock.Timeout = helper.Duration{}
+	startForwarder(t, conf)
+	var ports []int
+	for range 3 {
+		ports = append(ports, receive(t, conf.Mock.OutChannel).Payload.SrcPort)
+	}
+	assert.ElementsMatch(t, []int{1, 2, 3}, ports)
+}
+
+func TestCloseReleasesBlockedSend(t *testing.T) {
+	out := make(chan *snmp.Message)
+	fwd := startForwarder(t, Config{
+		QueueSize:      1,
+		OverflowPolicy: queue.OverflowBlock,
+		Mock:           &MockConfig{OutChannel: out},
+	})
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		// more than the queue and its send buffer can take
+		for range 50 {
+			fwd.Send(testMessage())
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		fwd.Close()
+	}()
+	receive(t, closed)
+	receive(t, sent)
+	// lets the worker finish
+	go func() {
+		for {
+			select {
+			case <-out:
+			case <-fwd.Done():
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,158 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bangunindo/trap2json/helper"
+	"github.com/carlmjohnson/requests"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+type HTTPAuthConfig struct {
+	OAuth2 *HTTPOAuth2Config `mapstructure:"oauth2"`
+	HMAC   *HTTPHMACConfig   `mapstructure:"hmac"`
+}
+
+func (c *HTTPAuthConfig) validate() []helper.ConfigError {
+	var errs []helper.ConfigError
+	if c.OAuth2 != nil {
+		errs = append(errs, helper.PrefixConfigErrors("oauth2", c.OAuth2.validate())...)
+	}
+	if c.HMAC != nil {
+		errs = append(errs, helper.PrefixConfigErrors("hmac", c.HMAC.validate())...)
+	}
+	return errs
+}
+
+// HTTPOAuth2Config gets a token with client credentials grant, the token
+// is cached and refreshed RefreshBefore it expires
+type HTTPOAuth2Config struct {
+	TokenURL         string `mapstructure:"token_url"`
+	ClientID         string `mapstructure:"client_id"`
+	ClientSecret     string `mapstructure:"client_secret"`
+	ClientSecretFile string `mapstructure:"client_secret_file"`
+	Scopes           []string
+	EndpointParams   map[string][]string `mapstructure:"endpoint_params"`
+	RefreshBefore    helper.Duration     `mapstructure:"refresh_before"`
+}
+
+func (c *HTTPOAuth2Config) validate() []helper.ConfigError {
+	var errs []helper.ConfigError
+	if c.TokenURL == "" {
+		errs = append(errs, helper.ConfigError{Path: "token_url", Err: errors.New("token_url is required")})
+	} else if _, err := url.Parse(c.TokenURL); err != nil {
+		errs = append(errs, helper.ConfigError{Path: "token_url", Err: err})
+	}
+	if c.ClientID == "" {
+		errs = append(errs, helper.ConfigError{Path: "client_id", Err: errors.New("client_id is required")})
+	}
+	if c.ClientSecret == "" && c.ClientSecretFile == "" {
+		errs = append(errs, helper.ConfigError{Path: "client_secret", Err: errors.New("either client_secret or client_secret_file is required")})
+	} else if c.ClientSecret != "" && c.ClientSecretFile != "" {
+		errs = append(errs, helper.ConfigError{Path: "client_secret", Err: errors.New("client_secret and client_secret_file can't be used together")})
+	}
+	return errs
+}
+
+// HTTPHMACConfig signs the request body with HMAC-SHA256. When TimestampHeader
+// is set, the signed content is the unix timestamp, a dot and the body
+type HTTPHMACConfig struct {
+	SecretFile      string `mapstructure:"secret_file"`
+	Header          string
+	TimestampHeader string `mapstructure:"timestamp_header"`
+	// Prefix is prepended to the hex encoded signature, e.g. sha256=
+	Prefix string
+}
+
+func (c *HTTPHMACConfig) validate() []helper.ConfigError {
+	var errs []helper.ConfigError
+	if c.SecretFile == "" {
+		errs = append(errs, helper.ConfigError{Path: "secret_file", Err: errors.New("secret_file is required")})
+	}
+	return errs
+}
+
+// readSecretFile reads a secret without its trailing newline
+func readSecretFile(path string) (string, error) {
+	secret, err := os.ReadFile(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed reading secret file %s", path)
+	}
+	return strings.TrimRight(string(secret), "\r\n"), nil
+}
+
+// clientCredentials fetches a new token on every call, caching is done by oauth2.ReuseTokenSourceWithExpiry
+type clientCredentials struct {
+	ctx  context.Context
+	conf *clientcredentials.Config
+}
+
+func (c clientCredentials) Token() (*oauth2.Token, error) {
+	return c.conf.Token(c.ctx)
+}
+
+// oauth2Transport adds the token of client credentials grant to the requests, the token
+// is requested with base as well so it uses the same tls and proxy config
+func oauth2Transport(c *HTTPOAuth2Config, base http.RoundTripper, timeout time.Duration) (http.RoundTripper, error) {
+	secret := c.ClientSecret
+	if c.ClientSecretFile != "" {
+		var err error
+		if secret, err = readSecretFile(c.ClientSecretFile); err != nil {
+			return nil, err
+		}
+	}
+	ctx := context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{
+		Transport: base,
+		Timeout:   timeout,
+	})
+	source := clientCredentials{
+		ctx: ctx,
+		conf: &clientcredentials.Config{
+			ClientID:       c.ClientID,
+			ClientSecret:   secret,
+			TokenURL:       c.TokenURL,
+			Scopes:         c.Scopes,
+			EndpointParams: c.EndpointParams,
+		},
+	}
+	return &oauth2.Transport{
+		Source: oauth2.ReuseTokenSourceWithExpiry(nil, source, c.RefreshBefore.Duration),
+		Base:   base,
+	}, nil
+}
+
+type hmacSigner struct {
+	conf   *HTTPHMACConfig
+	secret []byte
+}
+
+func newHMACSigner(c *HTTPHMACConfig) (*hmacSigner, error) {
+	secret, err := readSecretFile(c.SecretFile)
+	if err != nil {
+		return nil, err
+	}
+	return &hmacSigner{conf: c, secret: []byte(secret)}, nil
+}
+
+// sign adds the signature headers of body to builder
+func (s *hmacSigner) sign(builder *requests.Builder, body []byte) *requests.Builder {
+	mac := hmac.New(sha256.New, s.secret)
+	if s.conf.TimestampHeader != "" {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		builder = builder.Header(s.conf.TimestampHeader, ts)
+		mac.Write([]byte(ts + "."))
+	}
+	mac.Write(body)
+	return builder.Header(s.conf.Header, s.conf.Prefix+hex.EncodeToString(mac.Sum(nil)))
+}
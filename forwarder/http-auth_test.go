@@ -0,0 +1,122 @@
+package forwarder
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bangunindo/trap2json/helper"
+	"github.com/go-json-experiment/json"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeSecret writes secret with a trailing newline to a temporary file
+func writeSecret(t *testing.T, secret string) string {
+	path := filepath.Join(t.TempDir(), "secret")
+	if !assert.NoError(t, os.WriteFile(path, []byte(secret+"\n"), 0600)) {
+		t.FailNow()
+	}
+	return path
+}
+
+func TestHTTPHMAC(t *testing.T) {
+	url, requests := captureRequests(t, http.StatusOK)
+	startTime := time.Now().Unix()
+	fwd := startForwarder(t, Config{
+		HTTP: &HTTPConfig{
+			URL: url,
+			Auth: HTTPAuthConfig{
+				HMAC: &HTTPHMACConfig{
+					SecretFile:      writeSecret(t, "s3cret"),
+					TimestampHeader: "X-Timestamp",
+					Prefix:          "sha256=",
+				},
+			},
+		},
+	})
+	fwd.Send(testMessage())
+	req := receive(t, requests)
+	ts := req.header.Get("X-Timestamp")
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, unix, startTime)
+	assert.LessOrEqual(t, unix, time.Now().Unix())
+	// the secret is read without its trailing newline
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(ts + "."))
+	mac.Write(req.body)
+	assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), req.header.Get("X-Signature"))
+}
+
+func TestHTTPHMACWithoutTimestamp(t *testing.T) {
+	url, requests := captureRequests(t, http.StatusOK)
+	fwd := startForwarder(t, Config{
+		HTTP: &HTTPConfig{
+			URL: url,
+			Auth: HTTPAuthConfig{
+				HMAC: &HTTPHMACConfig{
+					SecretFile: writeSecret(t, "s3cret"),
+					Header:     "X-Hub-Signature",
+				},
+			},
+		},
+	})
+	fwd.Send(testMessage())
+	req := receive(t, requests)
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(req.body)
+	assert.Equal(t, hex.EncodeToString(mac.Sum(nil)), req.header.Get("X-Hub-Signature"))
+	assert.Empty(t, req.header.Get("X-Signature"))
+}
+
+func TestHTTPOAuth2Refresh(t *testing.T) {
+	var issued atomic.Int64
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "client_credentials", r.PostForm.Get("grant_type"))
+		assert.Equal(t, "events:write", r.PostForm.Get("scope"))
+		id, secret, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "trap2json", id)
+		assert.Equal(t, "s3cret", secret)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.MarshalWrite(w, map[string]any{
+			"access_token": "token-" + strconv.FormatInt(issued.Add(1), 10),
+			"token_type":   "Bearer",
+			"expires_in":   2,
+		})
+	}))
+	defer tokenSrv.Close()
+	url, requests := captureRequests(t, http.StatusOK)
+	fwd := startForwarder(t, Config{
+		HTTP: &HTTPConfig{
+			URL: url,
+			Auth: HTTPAuthConfig{
+				OAuth2: &HTTPOAuth2Config{
+					TokenURL:     tokenSrv.URL,
+					ClientID:     "trap2json",
+					ClientSecret: "s3cret",
+					Scopes:       []string{"events:write"},
+					// the token is only used for a second
+					RefreshBefore: helper.Duration{Duration: time.Second},
+				},
+			},
+		},
+	})
+	fwd.Send(testMessage())
+	assert.Equal(t, "Bearer token-1", receive(t, requests).header.Get("Authorization"))
+	fwd.Send(testMessage())
+	assert.Equal(t, "Bearer token-1", receive(t, requests).header.Get("Authorization"))
+	time.Sleep(1100 * time.Millisecond)
+	fwd.Send(testMessage())
+	assert.Equal(t, "Bearer token-2", receive(t, requests).header.Get("Authorization"))
+	assert.Equal(t, int64(2), issued.Load())
+}
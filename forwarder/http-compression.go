@@ -0,0 +1,98 @@
+package forwarder
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+type HTTPCompression int
+
+const (
+	HTTPCompressionNone HTTPCompression = iota
+	HTTPCompressionGzip
+	HTTPCompressionZstd
+	// HTTPCompressionDeflate is zlib format, as Content-Encoding: deflate is defined
+	HTTPCompressionDeflate
+)
+
+func (h *HTTPCompression) String() string {
+	switch *h {
+	case HTTPCompressionNone:
+		return "none"
+	case HTTPCompressionGzip:
+		return "gzip"
+	case HTTPCompressionZstd:
+		return "zstd"
+	case HTTPCompressionDeflate:
+		return "deflate"
+	default:
+		return ""
+	}
+}
+
+func (h *HTTPCompression) UnmarshalText(text []byte) error {
+	switch strings.ToLower(string(text)) {
+	case "", "none":
+		*h = HTTPCompressionNone
+	case "gzip":
+		*h = HTTPCompressionGzip
+	case "zstd":
+		*h = HTTPCompressionZstd
+	case "deflate":
+		*h = HTTPCompressionDeflate
+	default:
+		return errors.Errorf("unsupported HTTPCompression: %s", string(text))
+	}
+	return nil
+}
+
+// the writers are pooled since they allocate large buffers
+var (
+	gzipWriters = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+	zlibWriters = sync.Pool{New: func() any { return zlib.NewWriter(nil) }}
+	// zstdEncoder is safe for concurrent EncodeAll
+	zstdEncoder, _ = zstd.NewWriter(nil)
+)
+
+type resetWriter interface {
+	io.WriteCloser
+	Reset(io.Writer)
+}
+
+func compressWith(pool *sync.Pool, body []byte) ([]byte, error) {
+	w := pool.Get().(resetWriter)
+	defer pool.Put(w)
+	var buf bytes.Buffer
+	w.Reset(&buf)
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// compress returns body encoded with the compression, it's returned as is for HTTPCompressionNone
+func (h *HTTPCompression) compress(body []byte) ([]byte, error) {
+	var compressed []byte
+	var err error
+	switch *h {
+	case HTTPCompressionGzip:
+		compressed, err = compressWith(&gzipWriters, body)
+	case HTTPCompressionZstd:
+		compressed = zstdEncoder.EncodeAll(body, nil)
+	case HTTPCompressionDeflate:
+		compressed, err = compressWith(&zlibWriters, body)
+	default:
+		return body, nil
+	}
+	return compressed, errors.Wrapf(err, "failed compressing body with %s", h.String())
+}
@@ -0,0 +1,76 @@
+package forwarder
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPCompression(t *testing.T) {
+	// the uncompressed body to compare with
+	url, requests := captureRequests(t, http.StatusOK)
+	fwd := startForwarder(t, Config{ID: "none", HTTP: &HTTPConfig{URL: url}})
+	fwd.Send(testMessage())
+	expected := receive(t, requests)
+	assert.Empty(t, expected.header.Get("Content-Encoding"))
+
+	decoders := map[HTTPCompression]func([]byte) ([]byte, error){
+		HTTPCompressionGzip: func(b []byte) ([]byte, error) {
+			r, err := gzip.NewReader(bytes.NewReader(b))
+			if err != nil {
+				return nil, err
+			}
+			return io.ReadAll(r)
+		},
+		HTTPCompressionZstd: func(b []byte) ([]byte, error) {
+			d, err := zstd.NewReader(nil)
+			if err != nil {
+				return nil, err
+			}
+			defer d.Close()
+			return d.DecodeAll(b, nil)
+		},
+		HTTPCompressionDeflate: func(b []byte) ([]byte, error) {
+			r, err := zlib.NewReader(bytes.NewReader(b))
+			if err != nil {
+				return nil, err
+			}
+			return io.ReadAll(r)
+		},
+	}
+	for compression, decode := range decoders {
+		t.Run(compression.String(), func(t *testing.T) {
+			url, requests := captureRequests(t, http.StatusOK)
+			fwd := startForwarder(t, Config{
+				HTTP: &HTTPConfig{URL: url, Compression: compression},
+			})
+			// the pooled writers are reused by the second request
+			for range 2 {
+				fwd.Send(testMessage())
+				req := receive(t, requests)
+				assert.Equal(t, compression.String(), req.header.Get("Content-Encoding"))
+				assert.NotEqual(t, expected.body, req.body)
+				body, err := decode(req.body)
+				assert.NoError(t, err)
+				assert.Equal(t, string(expected.body), string(body))
+			}
+		})
+	}
+}
+
+func TestHTTPCompressionUnmarshal(t *testing.T) {
+	var c HTTPCompression
+	for _, s := range []string{"none", "gzip", "zstd", "deflate"} {
+		assert.NoError(t, c.UnmarshalText([]byte(s)))
+		assert.Equal(t, s, c.String())
+	}
+	assert.NoError(t, c.UnmarshalText([]byte("GZIP")))
+	assert.Equal(t, HTTPCompressionGzip, c)
+	assert.Error(t, c.UnmarshalText([]byte("br")))
+}
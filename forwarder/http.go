@@ -1,16 +1,25 @@
 package forwarder
 
 import (
+	"bytes"
 	"context"
-	"crypto/tls"
-	"crypto/x509"
+	"fmt"
 	"github.com/bangunindo/trap2json/helper"
+	"github.com/bangunindo/trap2json/metrics"
+	"github.com/bangunindo/trap2json/snmp"
 	"github.com/carlmjohnson/requests"
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+	"github.com/go-json-experiment/json"
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
 	"net/http"
 	"net/url"
-	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type HTTPMethod int
@@ -19,6 +28,8 @@ const (
 	HTTPMethodPost HTTPMethod = iota
 	HTTPMethodGet
 	HTTPMethodPut
+	HTTPMethodPatch
+	HTTPMethodDelete
 )
 
 func (h *HTTPMethod) String() string {
@@ -29,6 +40,10 @@ func (h *HTTPMethod) String() string {
 		return "GET"
 	case HTTPMethodPut:
 		return "PUT"
+	case HTTPMethodPatch:
+		return "PATCH"
+	case HTTPMethodDelete:
+		return "DELETE"
 	default:
 		return ""
 	}
@@ -42,99 +57,770 @@ func (h *HTTPMethod) UnmarshalText(text []byte) error {
 		*h = HTTPMethodGet
 	case "put":
 		*h = HTTPMethodPut
+	case "patch":
+		*h = HTTPMethodPatch
+	case "delete":
+		*h = HTTPMethodDelete
 	default:
 		return errors.Errorf("unsupported HTTPMethod: %s", string(text))
 	}
 	return nil
 }
 
+type HTTPBatchFormat int
+
+const (
+	// HTTPBatchJSONArray sends the batch as a json array of messages
+	HTTPBatchJSONArray HTTPBatchFormat = iota
+	// HTTPBatchNDJSON sends the batch as newline delimited messages
+	HTTPBatchNDJSON
+)
+
+func (h *HTTPBatchFormat) String() string {
+	switch *h {
+	case HTTPBatchJSONArray:
+		return "json_array"
+	case HTTPBatchNDJSON:
+		return "ndjson"
+	default:
+		return ""
+	}
+}
+
+func (h *HTTPBatchFormat) UnmarshalText(text []byte) error {
+	switch strings.ToLower(string(text)) {
+	case "", "json_array":
+		*h = HTTPBatchJSONArray
+	case "ndjson":
+		*h = HTTPBatchNDJSON
+	default:
+		return errors.Errorf("unsupported HTTPBatchFormat: %s", string(text))
+	}
+	return nil
+}
+
+func (h *HTTPBatchFormat) contentType() string {
+	if *h == HTTPBatchNDJSON {
+		return "application/x-ndjson"
+	}
+	return "application/json"
+}
+
+// body joins the message json of a batch
+func (h *HTTPBatchFormat) body(batch []httpItem) []byte {
+	var buf bytes.Buffer
+	if *h == HTTPBatchJSONArray {
+		buf.WriteByte('[')
+	}
+	for i, item := range batch {
+		if i > 0 && *h == HTTPBatchJSONArray {
+			buf.WriteByte(',')
+		}
+		buf.Write(item.body)
+		if *h == HTTPBatchNDJSON {
+			buf.WriteByte('\n')
+		}
+	}
+	if *h == HTTPBatchJSONArray {
+		buf.WriteByte(']')
+	}
+	return buf.Bytes()
+}
+
+type HTTPBatchRetry int
+
+const (
+	// HTTPBatchRetryUnit requeues every message of a failed batch, they're
+	// usually batched together again since they share the same eta
+	HTTPBatchRetryUnit HTTPBatchRetry = iota
+	// HTTPBatchRetrySplit resends both halves of a failed batch right away until
+	// the failing messages are found, only those are requeued
+	HTTPBatchRetrySplit
+)
+
+func (h *HTTPBatchRetry) String() string {
+	switch *h {
+	case HTTPBatchRetryUnit:
+		return "unit"
+	case HTTPBatchRetrySplit:
+		return "split"
+	default:
+		return ""
+	}
+}
+
+func (h *HTTPBatchRetry) UnmarshalText(text []byte) error {
+	switch strings.ToLower(string(text)) {
+	case "", "unit":
+		*h = HTTPBatchRetryUnit
+	case "split":
+		*h = HTTPBatchRetrySplit
+	default:
+		return errors.Errorf("unsupported HTTPBatchRetry: %s", string(text))
+	}
+	return nil
+}
+
+// HTTPResponseConfig decides how a response is classified. A status in RetryStatus
+// is a transient failure, other non 2xx status is a permanent failure
+type HTTPResponseConfig struct {
+	// RetryStatus is a list of status codes, like 429 or 5xx
+	RetryStatus []string `mapstructure:"retry_status"`
+	// RetryAfter delays the retry of a transient failure by its Retry-After header
+	RetryAfter *bool `mapstructure:"retry_after"`
+	// SuccessCondition is evaluated on 2xx response, false is a permanent failure
+	SuccessCondition string `mapstructure:"success_condition"`
+}
+
+func (c *HTTPResponseConfig) validate() []helper.ConfigError {
+	var errs []helper.ConfigError
+	for i, status := range c.RetryStatus {
+		if _, err := parseStatusPattern(status); err != nil {
+			errs = append(errs, helper.ConfigError{Path: fmt.Sprintf("retry_status[%d]", i), Err: err})
+		}
+	}
+	if c.SuccessCondition != "" {
+		if _, err := compileSuccessCondition(c.SuccessCondition); err != nil {
+			errs = append(errs, helper.ConfigError{Path: "success_condition", Err: err})
+		}
+	}
+	return errs
+}
+
+// statusPattern matches a status code, digits of the pattern may be x
+type statusPattern string
+
+func parseStatusPattern(s string) (statusPattern, error) {
+	p := statusPattern(strings.ToLower(s))
+	if len(p) != 3 {
+		return "", errors.Errorf("invalid status code pattern: %s", s)
+	}
+	for _, c := range p {
+		if c != 'x' && (c < '0' || c > '9') {
+			return "", errors.Errorf("invalid status code pattern: %s", s)
+		}
+	}
+	return p, nil
+}
+
+func (p statusPattern) match(status int) bool {
+	code := strconv.Itoa(status)
+	if len(code) != len(p) {
+		return false
+	}
+	for i := range p {
+		if p[i] != 'x' && p[i] != code[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// httpResponseEnv is the environment of success_condition, body is
+// the decoded json response or nil if it's not a json
+type httpResponseEnv struct {
+	Status  int                 `expr:"status"`
+	Headers map[string][]string `expr:"headers"`
+	Text    string              `expr:"text"`
+	Body    any                 `expr:"body"`
+}
+
+// maxResponseBody limits the response read for success_condition
+const maxResponseBody = 1 << 20
+
+func compileSuccessCondition(condition string) (*vm.Program, error) {
+	opts := []expr.Option{expr.AsBool(), expr.Env(httpResponseEnv{})}
+	opts = append(opts, snmp.Functions...)
+	return expr.Compile(condition, opts...)
+}
+
+// parseRetryAfter reads Retry-After header, which is either seconds or a date
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(time.Until(t), 0), true
+	}
+	return 0, false
+}
+
 type HTTPBasicAuth struct {
 	Username string
 	Password string
 }
 
 type HTTPConfig struct {
-	URL       string `mapstructure:"url"`
-	Method    HTTPMethod
-	Headers   map[string][]string
-	BasicAuth *HTTPBasicAuth `mapstructure:"basic_auth"`
-	Tls       *Tls
-	Proxy     string
-	Timeout   helper.Duration
+	// URL and header values can have expressions in curly braces, see exprTemplate
+	URL     string `mapstructure:"url"`
+	Method  HTTPMethod
+	Headers map[string][]string
+	// MethodTemplate overrides Method, it should render to one of HTTPMethod
+	MethodTemplate string         `mapstructure:"method_template"`
+	BasicAuth      *HTTPBasicAuth `mapstructure:"basic_auth"`
+	Tls            *Tls
+	Proxy          string
+	Timeout        helper.Duration
+	// BatchSize > 1 sends up to this many messages in a single request
+	BatchSize    int             `mapstructure:"batch_size"`
+	BatchTimeout helper.Duration `mapstructure:"batch_timeout"`
+	BatchFormat  HTTPBatchFormat `mapstructure:"batch_format"`
+	BatchRetry   HTTPBatchRetry  `mapstructure:"batch_retry"`
+	Response     HTTPResponseConfig
+	Auth         HTTPAuthConfig
+	Compression  HTTPCompression
+}
+
+func (c *HTTPConfig) validate() []helper.ConfigError {
+	var errs []helper.ConfigError
+	if c.URL == "" {
+		errs = append(errs, helper.ConfigError{Path: "url", Err: errors.New("url is required")})
+	} else if t, err := compileLiteralTemplate(c.URL); err != nil {
+		errs = append(errs, helper.ConfigError{Path: "url", Err: err})
+	} else if t.static() {
+		if _, err = url.Parse(t.literal()); err != nil {
+			errs = append(errs, helper.ConfigError{Path: "url", Err: err})
+		}
+	}
+	for key, values := range c.Headers {
+		for i, value := range values {
+			if _, err := compileLiteralTemplate(value); err != nil {
+				errs = append(errs, helper.ConfigError{Path: fmt.Sprintf("headers.%s[%d]", key, i), Err: err})
+			}
+		}
+	}
+	if c.MethodTemplate != "" {
+		if _, err := compileTemplate(c.MethodTemplate); err != nil {
+			errs = append(errs, helper.ConfigError{Path: "method_template", Err: err})
+		}
+	}
+	if c.Proxy != "" {
+		if _, err := url.Parse(c.Proxy); err != nil {
+			errs = append(errs, helper.ConfigError{Path: "proxy", Err: err})
+		}
+	}
+	errs = append(errs, helper.PrefixConfigErrors("response", c.Response.validate())...)
+	errs = append(errs, helper.PrefixConfigErrors("auth", c.Auth.validate())...)
+	if c.BatchSize < 0 {
+		errs = append(errs, helper.ConfigError{Path: "batch_size", Err: errors.New("batch_size can't be negative")})
+	}
+	if c.BatchTimeout.Duration < 0 {
+		errs = append(errs, helper.ConfigError{Path: "batch_timeout", Err: errors.New("batch_timeout can't be negative")})
+	}
+	return errs
+}
+
+// compileLiteralTemplate compiles url and headers, they used to be taken as is so
+// a value with braces that isn't a template most likely misses the escaping
+func compileLiteralTemplate(value string) (*exprTemplate, error) {
+	t, err := compileTemplate(value)
+	if err != nil && strings.ContainsAny(value, "{}") {
+		return nil, errors.Wrap(err, "literal brace, use {{ and }}")
+	}
+	return t, err
+}
+
+// setHTTPDefaults is called by newForwarder
+func setHTTPDefaults(c *HTTPConfig) {
+	if c.Timeout.Duration == 0 {
+		c.Timeout.Duration = 5 * time.Second
+	}
+	if c.BatchTimeout.Duration == 0 {
+		c.BatchTimeout.Duration = time.Second
+	}
+	if c.Response.RetryStatus == nil {
+		c.Response.RetryStatus = []string{"429", "5xx"}
+	}
+	if c.Auth.OAuth2 != nil && c.Auth.OAuth2.RefreshBefore.Duration == 0 {
+		c.Auth.OAuth2.RefreshBefore.Duration = 30 * time.Second
+	}
+	if c.Auth.HMAC != nil && c.Auth.HMAC.Header == "" {
+		c.Auth.HMAC.Header = "X-Signature"
+	}
+	if c.Response.RetryAfter == nil {
+		b := true
+		c.Response.RetryAfter = &b
+	}
 }
 
 type HTTP struct {
 	Base
 
-	builder *requests.Builder
+	conf *HTTPConfig
+	// encode replaces the message json as the body of a message, it's
+	// used by forwarders that send something else than json_format
+	encode func(*snmp.Message) ([]byte, error)
+	// alwaysBatch sends messages as batch even when batch_size is 1
+	alwaysBatch bool
+	// route changes the rendered request of a message, e.g. when the url depends on the message
+	route func(*snmp.Message, *httpRequest) error
+	// itemErrors parses the response of a successful batch request into the result of every
+	// message, for apis that accept a batch partially. nil errors are succeeded messages
+	itemErrors func(batch []httpItem, response []byte) ([]error, error)
+	// acknowledge takes over a successful batch request until the api acknowledges it, the
+	// batch is then counted or retried by the forwarder. The request is already accepted, so
+	// the batch isn't retried by sendBatch. builder is the request of the batch without its body
+	acknowledge func(builder *requests.Builder, batch []httpItem, response []byte)
+	// afterConsume is called once the last message is sent, before the forwarder exits
+	afterConsume func()
+	// batchBody replaces batch_format, for apis that don't take a plain list of messages
+	batchBody func(batch []httpItem) ([]byte, error)
+
+	// urlTemplate, methodTemplate and headerTemplates are only set when they have expressions,
+	// otherwise url and staticHeaders have their literal values
+	urlTemplate      *exprTemplate
+	methodTemplate   *exprTemplate
+	headerTemplates  map[string][]*exprTemplate
+	url              string
+	staticHeaders    map[string][]string
+	retryStatus      []statusPattern
+	successCondition *vm.Program
+	signer           *hmacSigner
+	// ctrCompressionSaved counts the bytes saved by compression
+	ctrCompressionSaved prometheus.Counter
+}
+
+// retryable reports whether the status matches response.retry_status
+func (h *HTTP) retryable(status int) bool {
+	for _, p := range h.retryStatus {
+		if p.match(status) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkResponse classifies the response according to response config,
+// it replaces the default validator of requests
+func (h *HTTP) checkResponse(res *http.Response) error {
+	conf := h.conf.Response
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		err := errors.Errorf("unexpected response status: %s", res.Status)
+		if !h.retryable(res.StatusCode) {
+			return permanent(err)
+		}
+		if *conf.RetryAfter {
+			if after, ok := parseRetryAfter(res.Header.Get("Retry-After")); ok {
+				return retryAfterError{error: err, after: after}
+			}
+		}
+		return err
+	}
+	if h.successCondition == nil {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, maxResponseBody))
+	if err != nil {
+		return errors.Wrap(err, "failed reading response")
+	}
+	// the body is read again by the response handler, e.g. the ack id of splunk
+	res.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), res.Body), res.Body}
+	env := httpResponseEnv{
+		Status:  res.StatusCode,
+		Headers: res.Header,
+		Text:    string(body),
+	}
+	if json.Unmarshal(body, &env.Body) != nil {
+		env.Body = nil
+	}
+	ok, err := expr.Run(h.successCondition, env)
+	if err != nil {
+		return permanent(errors.Wrap(err, "failed evaluating success_condition"))
+	}
+	if !ok.(bool) {
+		text := env.Text
+		if len(text) > 256 {
+			text = text[:256] + "..."
+		}
+		return permanent(errors.Errorf("success_condition is false, response: %s", text))
+	}
+	return nil
+}
+
+// httpRequest is the part of a request that's rendered from templates
+type httpRequest struct {
+	method  string
+	url     string
+	headers map[string][]string
+}
+
+// key is the same for requests that can be sent together in a batch
+func (r httpRequest) key() string {
+	var sb strings.Builder
+	sb.WriteString(r.method)
+	sb.WriteByte(0)
+	sb.WriteString(r.url)
+	keys := make([]string, 0, len(r.headers))
+	for k := range r.headers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		sb.WriteByte(0)
+		sb.WriteString(k)
+		for _, v := range r.headers[k] {
+			sb.WriteByte(0)
+			sb.WriteString(v)
+		}
+	}
+	return sb.String()
+}
+
+// escapeURLValue escapes an expression result of url template
+// depending on whether it's in the path or query
+func escapeURLValue(prefix, value string) string {
+	if strings.Contains(prefix, "?") {
+		return url.QueryEscape(value)
+	}
+	return url.PathEscape(value)
+}
+
+func (h *HTTP) render(m *snmp.Message) (httpRequest, error) {
+	var req httpRequest
+	var err error
+	if h.urlTemplate != nil {
+		if req.url, err = h.urlTemplate.render(m.Payload, escapeURLValue); err != nil {
+			return req, errors.Wrap(err, "failed rendering url")
+		}
+	}
+	if h.methodTemplate != nil {
+		method, err := h.methodTemplate.render(m.Payload, nil)
+		if err != nil {
+			return req, errors.Wrap(err, "failed rendering method_template")
+		}
+		var parsed HTTPMethod
+		if err = parsed.UnmarshalText([]byte(method)); err != nil {
+			return req, err
+		}
+		req.method = parsed.String()
+	}
+	for key, templates := range h.headerTemplates {
+		values := make([]string, len(templates))
+		for i, t := range templates {
+			if values[i], err = t.render(m.Payload, nil); err != nil {
+				return req, errors.Wrapf(err, "failed rendering header %s", key)
+			}
+		}
+		if req.headers == nil {
+			req.headers = make(map[string][]string)
+		}
+		req.headers[key] = values
+	}
+	if h.route != nil {
+		if err = h.route(m, &req); err != nil {
+			return req, err
+		}
+	}
+	return req, nil
+}
+
+// request clones builder with the rendered parts of req
+func (h *HTTP) request(builder *requests.Builder, req httpRequest) *requests.Builder {
+	rb := builder.Clone()
+	if req.url != "" {
+		rb = rb.BaseURL(req.url)
+	}
+	if req.method != "" {
+		rb = rb.Method(req.method)
+	}
+	for key, values := range req.headers {
+		rb = rb.Header(key, values...)
+	}
+	return rb
 }
 
 func (h *HTTP) Run() {
 	defer h.cancel()
 	defer h.logger.Info().Msg("forwarder exited")
+	defer func() {
+		if h.afterConsume != nil {
+			h.afterConsume()
+		}
+	}()
 	h.logger.Info().Msg("starting forwarder")
 
 	builder := requests.
-		URL(h.config.HTTP.URL).
-		Method(h.config.HTTP.Method.String()).
-		Headers(h.config.HTTP.Headers)
+		URL(h.url).
+		Method(h.conf.Method.String()).
+		Headers(h.staticHeaders)
 	transport := &http.Transport{}
-	if h.config.HTTP.BasicAuth != nil {
-		builder = builder.BasicAuth(h.config.HTTP.BasicAuth.Username, h.config.HTTP.BasicAuth.Password)
+	if h.conf.BasicAuth != nil {
+		builder = builder.BasicAuth(h.conf.BasicAuth.Username, h.conf.BasicAuth.Password)
 	}
-	if h.config.HTTP.Tls != nil {
-		tlsConf := &tls.Config{
-			InsecureSkipVerify: h.config.HTTP.Tls.InsecureSkipVerify,
-		}
-		if h.config.HTTP.Tls.CaCert != "" {
-			ca, err := os.ReadFile(h.config.HTTP.Tls.CaCert)
-			if err != nil {
-				h.logger.Fatal().Err(err).Msg("failed reading ca certificate")
-			}
-			caCerts := x509.NewCertPool()
-			caCerts.AppendCertsFromPEM(ca)
-			tlsConf.RootCAs = caCerts
-		}
-		if h.config.HTTP.Tls.ClientCert != "" &&
-			h.config.HTTP.Tls.ClientKey != "" {
-			cert, err := tls.LoadX509KeyPair(h.config.HTTP.Tls.ClientCert, h.config.HTTP.Tls.ClientKey)
-			if err != nil {
-				h.logger.Fatal().Err(err).Msg("failed reading client certificate")
-			}
-			tlsConf.Certificates = []tls.Certificate{cert}
+	if h.conf.Tls != nil {
+		tlsConf, err := h.conf.Tls.config()
+		if err != nil {
+			h.logger.Fatal().Err(err).Msg("failed setting up tls")
 		}
 		transport.TLSClientConfig = tlsConf
 	}
-	if h.config.HTTP.Proxy != "" {
-		proxyUrl, err := url.Parse(h.config.HTTP.Proxy)
+	if h.conf.Proxy != "" {
+		proxyUrl, err := url.Parse(h.conf.Proxy)
 		if err != nil {
 			h.logger.Fatal().Err(err).Msg("proxy url is not in the correct format")
 		}
 		transport.Proxy = http.ProxyURL(proxyUrl)
 	}
-	builder = builder.Transport(transport)
+	var rt http.RoundTripper = transport
+	if h.conf.Auth.OAuth2 != nil {
+		var err error
+		rt, err = oauth2Transport(h.conf.Auth.OAuth2, transport, h.conf.Timeout.Duration)
+		if err != nil {
+			h.logger.Fatal().Err(err).Msg("failed setting up oauth2")
+		}
+	}
+	if h.conf.Auth.HMAC != nil {
+		var err error
+		h.signer, err = newHMACSigner(h.conf.Auth.HMAC)
+		if err != nil {
+			h.logger.Fatal().Err(err).Msg("failed setting up hmac")
+		}
+	}
+	builder = builder.Transport(rt).AddValidator(h.checkResponse)
 
-	for m := range h.ReceiveChannel() {
-		m.Compile(h.CompilerConf)
-		if m.Metadata.Skip {
-			h.ctrFiltered.Inc()
-			continue
+	if h.conf.BatchSize > 1 || h.alwaysBatch {
+		h.consumeBatch(
+			max(h.conf.BatchSize, 1),
+			h.conf.BatchTimeout.Duration,
+			h.prepare,
+			func(batch []*snmp.Message) {
+				// messages are grouped by their rendered request
+				var keys []string
+				groups := make(map[string][]httpItem)
+				builders := make(map[string]*requests.Builder)
+				for _, m := range batch {
+					req, err := h.render(m)
+					if err != nil {
+						h.Retry(m, permanent(err))
+						continue
+					}
+					body, err := h.body(m)
+					if err != nil {
+						h.Retry(m, permanent(err))
+						continue
+					}
+					key := req.key()
+					if _, ok := groups[key]; !ok {
+						keys = append(keys, key)
+						builders[key] = h.request(builder, req)
+					}
+					groups[key] = append(groups[key], httpItem{m: m, body: body})
+				}
+				for _, key := range keys {
+					h.sendBatch(builders[key], groups[key])
+				}
+			},
+		)
+		return
+	}
+	h.consume(func(m *snmp.Message) {
+		if !h.prepare(m) {
+			return
+		}
+		req, err := h.render(m)
+		if err != nil {
+			h.Retry(m, permanent(err))
+			return
+		}
+		body, err := h.body(m)
+		if err != nil {
+			h.Retry(m, permanent(err))
+			return
 		}
-		ctx, cancel := context.WithTimeout(context.Background(), h.config.HTTP.Timeout.Duration)
-		if err := builder.BodyBytes(m.Metadata.MessageJSON).Fetch(ctx); err != nil {
-			cancel()
+		if err = h.fetch(h.request(builder, req), body); err != nil {
 			h.Retry(m, err)
 		} else {
-			cancel()
 			h.ctrSucceeded.Inc()
 		}
+	})
+}
+
+// prepare compiles the message, it returns false if the message is filtered
+func (h *HTTP) prepare(m *snmp.Message) bool {
+	m.Compile(h.CompilerConf)
+	if m.Metadata.Skip {
+		h.ctrFiltered.Inc()
+		return false
 	}
+	return true
 }
 
-func NewHTTP(c Config, idx int) Forwarder {
+// httpItem is a message of a batch along with its request body
+type httpItem struct {
+	m    *snmp.Message
+	body []byte
+}
+
+func (h *HTTP) body(m *snmp.Message) ([]byte, error) {
+	if h.encode == nil {
+		return m.Metadata.MessageJSON, nil
+	}
+	return h.encode(m)
+}
+
+func (h *HTTP) fetch(builder *requests.Builder, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.conf.Timeout.Duration)
+	defer cancel()
+	if compression := h.conf.Compression; compression != HTTPCompressionNone {
+		compressed, err := compression.compress(body)
+		if err != nil {
+			return permanent(err)
+		}
+		h.ctrCompressionSaved.Add(float64(max(len(body)-len(compressed), 0)))
+		body = compressed
+		builder = builder.Header("Content-Encoding", compression.String())
+	}
+	// the signature covers the body as it's sent
+	if h.signer != nil {
+		builder = h.signer.sign(builder, body)
+	}
+	return builder.BodyBytes(body).Fetch(ctx)
+}
+
+// hasHeader checks the configured headers, the keys may be lowercased by the config loader
+func (h *HTTP) hasHeader(key string) bool {
+	for k := range h.conf.Headers {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// sendBatch sends the batch in a single request, how a failed batch
+// is retried depends on batch_retry
+func (h *HTTP) sendBatch(builder *requests.Builder, batch []httpItem) {
+	format := h.conf.BatchFormat
+	// the builder is cloned since it's reused when the batch is split
+	req := builder.Clone()
+	if !h.hasHeader("Content-Type") {
+		req = req.ContentType(format.contentType())
+	}
+	var res bytes.Buffer
+	if h.itemErrors != nil || h.acknowledge != nil {
+		req = req.ToBytesBuffer(&res)
+	}
+	var body []byte
+	if h.batchBody != nil {
+		var err error
+		if body, err = h.batchBody(batch); err != nil {
+			for _, item := range batch {
+				h.Retry(item.m, permanent(err))
+			}
+			return
+		}
+	} else {
+		body = format.body(batch)
+	}
+	err := h.fetch(req, body)
+	if err == nil && h.acknowledge != nil {
+		h.acknowledge(builder, batch, res.Bytes())
+		return
+	}
+	if err == nil && h.itemErrors != nil {
+		var errs []error
+		if errs, err = h.itemErrors(batch, res.Bytes()); err == nil {
+			for i, item := range batch {
+				if errs[i] != nil {
+					h.Retry(item.m, errs[i])
+				} else {
+					h.ctrSucceeded.Inc()
+				}
+			}
+			return
+		}
+	}
+	if err == nil {
+		h.ctrSucceeded.Add(float64(len(batch)))
+		return
+	}
+	// a transient failure is likely to fail the same way for both halves
+	if h.conf.BatchRetry == HTTPBatchRetrySplit && len(batch) > 1 && isPermanent(err) {
+		h.logger.Debug().Err(err).Int("batch_size", len(batch)).Msg("batch failed, splitting")
+		half := len(batch) / 2
+		h.sendBatch(builder, batch[:half])
+		h.sendBatch(builder, batch[half:])
+		return
+	}
+	for _, item := range batch {
+		h.Retry(item.m, err)
+	}
+}
+
+// newHTTP prepares the http forwarder without running it, it's
+// also used by forwarders that are based on http
+func newHTTP(c Config, idx int, conf *HTTPConfig) *HTTP {
 	fwd := &HTTP{
 		Base: NewBase(c, idx),
+		conf: conf,
+	}
+	fwd.ctrCompressionSaved = metrics.ForwarderCompressionSaved.With(prometheus.Labels{
+		"index": fwd.idx,
+		"type":  fwd.fwdType,
+		"id":    c.ID,
+	})
+	var err error
+	if fwd.urlTemplate, err = compileTemplate(conf.URL); err != nil {
+		fwd.logger.Fatal().Err(err).Msg("failed compiling url template")
+	} else if fwd.urlTemplate.static() {
+		fwd.url = fwd.urlTemplate.literal()
+		fwd.urlTemplate = nil
+	} else {
+		fwd.url = conf.URL
+	}
+	if conf.MethodTemplate != "" {
+		if fwd.methodTemplate, err = compileTemplate(conf.MethodTemplate); err != nil {
+			fwd.logger.Fatal().Err(err).Msg("failed compiling method_template template")
+		}
+	}
+	for _, status := range conf.Response.RetryStatus {
+		p, err := parseStatusPattern(status)
+		if err != nil {
+			fwd.logger.Fatal().Err(err).Msg("invalid response.retry_status")
+		}
+		fwd.retryStatus = append(fwd.retryStatus, p)
+	}
+	if conf.Response.SuccessCondition != "" {
+		if fwd.successCondition, err = compileSuccessCondition(conf.Response.SuccessCondition); err != nil {
+			fwd.logger.Fatal().Err(err).Msg("failed compiling response.success_condition expression")
+		}
 	}
+	for key, values := range conf.Headers {
+		templates := make([]*exprTemplate, len(values))
+		dynamic := false
+		for i, value := range values {
+			if templates[i], err = compileTemplate(value); err != nil {
+				fwd.logger.Fatal().Err(err).Str("header", key).Msg("failed compiling headers template")
+			}
+			dynamic = dynamic || !templates[i].static()
+		}
+		if dynamic {
+			if fwd.headerTemplates == nil {
+				fwd.headerTemplates = make(map[string][]*exprTemplate)
+			}
+			fwd.headerTemplates[key] = templates
+			continue
+		}
+		if fwd.staticHeaders == nil {
+			fwd.staticHeaders = make(map[string][]string)
+		}
+		literals := make([]string, len(templates))
+		for i, t := range templates {
+			literals[i] = t.literal()
+		}
+		fwd.staticHeaders[key] = literals
+	}
+	return fwd
+}
+
+func NewHTTP(c Config, idx int) Forwarder {
+	fwd := newHTTP(c, idx, c.HTTP)
 	go fwd.Run()
 	return fwd
 }
@@ -0,0 +1,297 @@
+package forwarder
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bangunindo/trap2json/helper"
+	"github.com/go-json-experiment/json"
+	"github.com/stretchr/testify/assert"
+)
+
+// batchPorts reads src_port of every message in a json array or ndjson batch
+func batchPorts(t *testing.T, body []byte) []int {
+	type message struct {
+		SrcPort int `json:"src_port"`
+	}
+	var ports []int
+	if bytes.HasPrefix(body, []byte("[")) {
+		var messages []message
+		assert.NoError(t, json.Unmarshal(body, &messages, json.RejectUnknownMembers(false)))
+		for _, m := range messages {
+			ports = append(ports, m.SrcPort)
+		}
+		return ports
+	}
+	for _, line := range bytes.Split(bytes.TrimSpace(body), []byte("\n")) {
+		var m message
+		assert.NoError(t, json.Unmarshal(line, &m))
+		ports = append(ports, m.SrcPort)
+	}
+	return ports
+}
+
+func TestHTTPBatch(t *testing.T) {
+	for _, format := range []HTTPBatchFormat{HTTPBatchJSONArray, HTTPBatchNDJSON} {
+		t.Run(format.String(), func(t *testing.T) {
+			url, requests := captureRequests(t, http.StatusOK)
+			fwd := startForwarder(t, Config{
+				HTTP: &HTTPConfig{
+					URL:          url,
+					BatchSize:    3,
+					BatchTimeout: helper.Duration{Duration: 50 * time.Millisecond},
+					BatchFormat:  format,
+				},
+			})
+			for port := 1; port <= 4; port++ {
+				m := testMessage()
+				m.Payload.SrcPort = port
+				fwd.Send(m)
+			}
+			req := receive(t, requests)
+			assert.Equal(t, format.contentType(), req.header.Get("Content-Type"))
+			assert.Equal(t, []int{1, 2, 3}, batchPorts(t, req.body))
+			// the rest is sent after batch_timeout
+			start := time.Now()
+			assert.Equal(t, []int{4}, batchPorts(t, receive(t, requests).body))
+			assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+		})
+	}
+}
+
+func TestHTTPBatchRetrySplit(t *testing.T) {
+	type result struct {
+		ports  []int
+		status int
+	}
+	results := make(chan result, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf bytes.Buffer
+		_, _ = buf.ReadFrom(r.Body)
+		status := http.StatusOK
+		// the trap from port 2 is rejected
+		if strings.Contains(buf.String(), `"src_port":2,`) {
+			status = http.StatusBadRequest
+		}
+		results <- result{batchPorts(t, buf.Bytes()), status}
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	deadLetterPath := filepath.Join(t.TempDir(), "dead.ndjson")
+	fwd := startForwarder(t, Config{
+		DeadLetter: &DeadLetterConfig{Path: deadLetterPath},
+		HTTP: &HTTPConfig{
+			URL:        srv.URL,
+			BatchSize:  4,
+			BatchRetry: HTTPBatchRetrySplit,
+		},
+	})
+	for port := 1; port <= 4; port++ {
+		m := testMessage()
+		m.Payload.SrcPort = port
+		fwd.Send(m)
+	}
+	// the failed batch is halved until the rejected trap is found
+	expected := []result{
+		{[]int{1, 2, 3, 4}, http.StatusBadRequest},
+		{[]int{1, 2}, http.StatusBadRequest},
+		{[]int{1}, http.StatusOK},
+		{[]int{2}, http.StatusBadRequest},
+		{[]int{3, 4}, http.StatusOK},
+	}
+	for _, e := range expected {
+		assert.Equal(t, e, receive(t, results))
+	}
+	assert.Eventually(t, func() bool {
+		data, _ := os.ReadFile(deadLetterPath)
+		return bytes.Count(data, []byte("\n")) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	f, err := os.Open(deadLetterPath)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer f.Close()
+	records, err := ReadDeadLetters(f)
+	if assert.NoError(t, err) && assert.Len(t, records, 1) {
+		assert.Equal(t, []int{2}, batchPorts(t, records[0].MessageJSON))
+	}
+}
+
+// scriptedServer replies the nth request with responses[n], the last one is repeated.
+// The arrival time of every request is sent to the channel
+func scriptedServer(t *testing.T, responses ...func(w http.ResponseWriter)) (string, chan time.Time) {
+	arrivals := make(chan time.Time, 100)
+	var mutex sync.Mutex
+	var n int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		arrivals <- time.Now()
+		responses[min(n, len(responses)-1)](w)
+		n++
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, arrivals
+}
+
+func respond(status int, header ...string) func(w http.ResponseWriter) {
+	return func(w http.ResponseWriter) {
+		for i := 0; i+1 < len(header); i += 2 {
+			w.Header().Set(header[i], header[i+1])
+		}
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(`{"ok": false}`))
+	}
+}
+
+// httpRetryConfig retries once after 10ms, the final failure goes to the dead letter file
+func httpRetryConfig(t *testing.T, conf *HTTPConfig) (Config, string) {
+	deadLetterPath := filepath.Join(t.TempDir(), "dead.ndjson")
+	return Config{
+		AutoRetry: helper.AutoRetry{
+			Enable:     true,
+			MaxRetries: 1,
+			MinDelay:   helper.Duration{Duration: 10 * time.Millisecond},
+			MaxDelay:   helper.Duration{Duration: 10 * time.Millisecond},
+		},
+		DeadLetter: &DeadLetterConfig{Path: deadLetterPath},
+		HTTP:       conf,
+	}, deadLetterPath
+}
+
+// waitDeadLetter waits for the only dead letter record of path
+func waitDeadLetter(t *testing.T, path string) DeadLetter {
+	t.Helper()
+	var records []DeadLetter
+	assert.Eventually(t, func() bool {
+		f, err := os.Open(path)
+		if err != nil {
+			return false
+		}
+		defer f.Close()
+		records, err = ReadDeadLetters(f)
+		return err == nil && len(records) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	if len(records) == 0 {
+		t.FailNow()
+	}
+	return records[0]
+}
+
+func TestHTTPResponseStatus(t *testing.T) {
+	cases := []struct {
+		status      int
+		retryStatus []string
+		retried     bool
+	}{
+		{status: http.StatusBadRequest},
+		{status: http.StatusNotFound},
+		{status: http.StatusTooManyRequests, retried: true},
+		{status: http.StatusInternalServerError, retried: true},
+		{status: http.StatusServiceUnavailable, retried: true},
+		{status: http.StatusConflict, retryStatus: []string{"409"}, retried: true},
+		{status: http.StatusServiceUnavailable, retryStatus: []string{"409"}},
+	}
+	for _, c := range cases {
+		name := strconv.Itoa(c.status)
+		if c.retryStatus != nil {
+			name += "_retry_" + strings.Join(c.retryStatus, ",")
+		}
+		t.Run(name, func(t *testing.T) {
+			url, arrivals := scriptedServer(t, respond(c.status), respond(http.StatusOK))
+			conf, deadLetterPath := httpRetryConfig(t, &HTTPConfig{
+				URL:      url,
+				Response: HTTPResponseConfig{RetryStatus: c.retryStatus},
+			})
+			fwd := startForwarder(t, conf)
+			fwd.Send(testMessage())
+			receive(t, arrivals)
+			if c.retried {
+				receive(t, arrivals)
+				assert.NoFileExists(t, deadLetterPath)
+				return
+			}
+			// a permanent failure isn't retried
+			record := waitDeadLetter(t, deadLetterPath)
+			assert.Equal(t, 0, record.Retries)
+			assert.Contains(t, record.Error, strconv.Itoa(c.status))
+			assert.Len(t, arrivals, 0)
+		})
+	}
+}
+
+func TestHTTPRetryAfter(t *testing.T) {
+	seconds := func(s string) func() string {
+		return func() string { return s }
+	}
+	cases := []struct {
+		name       string
+		retryAfter func() string
+		disabled   bool
+		maxDelay   time.Duration
+		min, max   time.Duration
+	}{
+		{name: "seconds", retryAfter: seconds("1"), maxDelay: 5 * time.Second, min: 900 * time.Millisecond, max: 3 * time.Second},
+		{name: "date", retryAfter: func() string {
+			// the date has no fraction, so it's 1 to 2 seconds away
+			return time.Now().Add(2 * time.Second).UTC().Format(http.TimeFormat)
+		}, maxDelay: 5 * time.Second, min: 900 * time.Millisecond, max: 3 * time.Second},
+		{name: "max_delay", retryAfter: seconds("10"), maxDelay: 100 * time.Millisecond, max: time.Second},
+		{name: "disabled", retryAfter: seconds("10"), disabled: true, maxDelay: 5 * time.Second, max: time.Second},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			url, arrivals := scriptedServer(t,
+				respond(http.StatusTooManyRequests, "Retry-After", c.retryAfter()),
+				respond(http.StatusOK),
+			)
+			retryAfter := !c.disabled
+			conf, _ := httpRetryConfig(t, &HTTPConfig{
+				URL:      url,
+				Response: HTTPResponseConfig{RetryAfter: &retryAfter},
+			})
+			conf.AutoRetry.MaxDelay.Duration = c.maxDelay
+			fwd := startForwarder(t, conf)
+			fwd.Send(testMessage())
+			first := receive(t, arrivals)
+			delay := receive(t, arrivals).Sub(first)
+			assert.GreaterOrEqual(t, delay, c.min)
+			assert.Less(t, delay, c.max)
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	after, ok := parseRetryAfter("120")
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Minute, after)
+	after, ok = parseRetryAfter(time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat))
+	assert.True(t, ok)
+	assert.Zero(t, after)
+	for _, value := range []string{"", "-1", "soon"} {
+		_, ok = parseRetryAfter(value)
+		assert.False(t, ok, value)
+	}
+}
+
+func TestHTTPSuccessCondition(t *testing.T) {
+	url, arrivals := scriptedServer(t, respond(http.StatusOK))
+	conf, deadLetterPath := httpRetryConfig(t, &HTTPConfig{
+		URL:      url,
+		Response: HTTPResponseConfig{SuccessCondition: "status == 200 && body.ok"},
+	})
+	fwd := startForwarder(t, conf)
+	fwd.Send(testMessage())
+	receive(t, arrivals)
+	record := waitDeadLetter(t, deadLetterPath)
+	assert.Contains(t, record.Error, "success_condition is false")
+	assert.Len(t, arrivals, 0)
+}
@@ -0,0 +1,311 @@
+package forwarder
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/bangunindo/trap2json/helper"
+	"github.com/bangunindo/trap2json/snmp"
+	"github.com/go-json-experiment/json"
+	"github.com/go-json-experiment/json/jsontext"
+	"github.com/pkg/errors"
+)
+
+type IncidentAPI int
+
+const (
+	// IncidentPagerDuty sends PagerDuty Events API v2 events
+	IncidentPagerDuty IncidentAPI = iota
+	// IncidentOpsgenie creates and closes Opsgenie alerts
+	IncidentOpsgenie
+)
+
+func (i *IncidentAPI) String() string {
+	switch *i {
+	case IncidentPagerDuty:
+		return "pagerduty"
+	case IncidentOpsgenie:
+		return "opsgenie"
+	default:
+		return ""
+	}
+}
+
+func (i *IncidentAPI) UnmarshalText(text []byte) error {
+	switch strings.ToLower(string(text)) {
+	case "", "pagerduty":
+		*i = IncidentPagerDuty
+	case "opsgenie":
+		*i = IncidentOpsgenie
+	default:
+		return errors.Errorf("unsupported IncidentAPI: %s", string(text))
+	}
+	return nil
+}
+
+func (i *IncidentAPI) defaultURL() string {
+	if *i == IncidentOpsgenie {
+		return "https://api.opsgenie.com"
+	}
+	return "https://events.pagerduty.com/v2/enqueue"
+}
+
+// IncidentConfig triggers an incident on raise trap and resolves it on clear trap. Every
+// http option is available, except method, method_template and batching. The incident
+// is identified by dedup key, which is derived from correlate result by default
+type IncidentConfig struct {
+	HTTPConfig `mapstructure:",squash"`
+	API        IncidentAPI
+	// RoutingKey is the integration key of PagerDuty
+	RoutingKey string `mapstructure:"routing_key"`
+	// APIKey is the api key of Opsgenie
+	APIKey string `mapstructure:"api_key"`
+	// Summary, Source, Severity and DedupKey are templates
+	Summary  string
+	Source   string
+	Severity string
+	DedupKey string `mapstructure:"dedup_key"`
+}
+
+func (c *IncidentConfig) validate() []helper.ConfigError {
+	httpConf := c.HTTPConfig
+	if httpConf.URL == "" {
+		httpConf.URL = c.API.defaultURL()
+	}
+	errs := httpConf.validate()
+	switch c.API {
+	case IncidentPagerDuty:
+		if c.RoutingKey == "" {
+			errs = append(errs, helper.ConfigError{Path: "routing_key", Err: errors.New("routing_key is required for pagerduty")})
+		}
+	case IncidentOpsgenie:
+		if c.APIKey == "" {
+			errs = append(errs, helper.ConfigError{Path: "api_key", Err: errors.New("api_key is required for opsgenie")})
+		}
+	}
+	if c.Summary == "" {
+		errs = append(errs, helper.ConfigError{Path: "summary", Err: errors.New("summary is required")})
+	}
+	templates := []struct{ path, template string }{
+		{"summary", c.Summary},
+		{"source", c.Source},
+		{"severity", c.Severity},
+		{"dedup_key", c.DedupKey},
+	}
+	for _, t := range templates {
+		if _, err := compileTemplate(t.template); err != nil {
+			errs = append(errs, helper.ConfigError{Path: t.path, Err: err})
+		}
+	}
+	return errs
+}
+
+type pagerDutyPayload struct {
+	Summary       string         `json:"summary"`
+	Source        string         `json:"source"`
+	Severity      string         `json:"severity"`
+	Timestamp     time.Time      `json:"timestamp"`
+	CustomDetails jsontext.Value `json:"custom_details,omitempty"`
+}
+
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key,omitempty"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+type opsgenieAlert struct {
+	Message     string `json:"message,omitempty"`
+	Alias       string `json:"alias,omitempty"`
+	Description string `json:"description,omitempty"`
+	Source      string `json:"source,omitempty"`
+	Priority    string `json:"priority,omitempty"`
+}
+
+// opsgeniePriority maps PagerDuty severities to Opsgenie priorities, P1 to P5 are kept as is
+func opsgeniePriority(severity string) string {
+	switch strings.ToLower(severity) {
+	case "critical":
+		return "P1"
+	case "error":
+		return "P2"
+	case "warning":
+		return "P3"
+	case "info":
+		return "P5"
+	case "p1", "p2", "p3", "p4", "p5":
+		return strings.ToUpper(severity)
+	default:
+		return "P3"
+	}
+}
+
+// truncate cuts s to at most n bytes without splitting a character
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+type Incident struct {
+	*HTTP
+
+	conf     *IncidentConfig
+	summary  *exprTemplate
+	source   *exprTemplate
+	severity *exprTemplate
+	dedupKey *exprTemplate
+}
+
+// correlateDedupKey derives the dedup key from the identifier hash and raise id, so a
+// clear trap resolves the incident of its own raise trap even when the alarm is repeated
+func correlateDedupKey(c *snmp.Correlate) string {
+	sum := sha256.Sum256([]byte(c.Key + "/" + c.ID))
+	return hex.EncodeToString(sum[:16])
+}
+
+// event returns the dedup key and whether the message resolves an incident
+func (i *Incident) event(m *snmp.Message) (string, bool, error) {
+	resolve := m.Payload.Correlate != nil
+	if i.dedupKey != nil {
+		key, err := i.dedupKey.render(m.Payload, nil)
+		return key, resolve, errors.Wrap(err, "failed rendering dedup_key")
+	}
+	if resolve {
+		return correlateDedupKey(m.Payload.Correlate), true, nil
+	}
+	if m.Payload.Raise != nil {
+		return correlateDedupKey(m.Payload.Raise), false, nil
+	}
+	// the incident can't be resolved without correlate
+	return "", false, nil
+}
+
+func (i *Incident) encode(m *snmp.Message) ([]byte, error) {
+	dedupKey, resolve, err := i.event(m)
+	if err != nil {
+		return nil, err
+	}
+	source, err := i.source.render(m.Payload, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed rendering source")
+	}
+	if i.conf.API == IncidentOpsgenie {
+		if resolve {
+			return json.Marshal(opsgenieAlert{Source: source})
+		}
+		alert := opsgenieAlert{
+			Alias:       dedupKey,
+			Source:      source,
+			Description: string(m.Metadata.MessageJSON),
+		}
+		if alert.Message, err = i.summary.render(m.Payload, nil); err != nil {
+			return nil, errors.Wrap(err, "failed rendering summary")
+		}
+		// opsgenie rejects longer message
+		alert.Message = truncate(alert.Message, 130)
+		severity, err := i.severity.render(m.Payload, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed rendering severity")
+		}
+		alert.Priority = opsgeniePriority(severity)
+		return json.Marshal(alert)
+	}
+	event := pagerDutyEvent{
+		RoutingKey:  i.conf.RoutingKey,
+		EventAction: "trigger",
+		DedupKey:    dedupKey,
+	}
+	if resolve {
+		event.EventAction = "resolve"
+		return json.Marshal(event)
+	}
+	payload := &pagerDutyPayload{
+		Source:        source,
+		Timestamp:     m.Payload.Time,
+		CustomDetails: m.Metadata.MessageJSON,
+	}
+	if payload.Summary, err = i.summary.render(m.Payload, nil); err != nil {
+		return nil, errors.Wrap(err, "failed rendering summary")
+	}
+	payload.Summary = truncate(payload.Summary, 1024)
+	if payload.Severity, err = i.severity.render(m.Payload, nil); err != nil {
+		return nil, errors.Wrap(err, "failed rendering severity")
+	}
+	event.Payload = payload
+	return json.Marshal(event)
+}
+
+// route sends opsgenie close requests to the alert of the dedup key
+func (i *Incident) route(m *snmp.Message, req *httpRequest) error {
+	if i.conf.API != IncidentOpsgenie {
+		return nil
+	}
+	base := strings.TrimRight(i.HTTP.conf.URL, "/")
+	if req.url != "" {
+		base = strings.TrimRight(req.url, "/")
+	}
+	dedupKey, resolve, err := i.event(m)
+	if err != nil {
+		return err
+	}
+	if !resolve {
+		req.url = base + "/v2/alerts"
+		return nil
+	}
+	if dedupKey == "" {
+		return errors.New("dedup key of clear trap is empty")
+	}
+	req.url = base + "/v2/alerts/" + url.PathEscape(dedupKey) + "/close?identifierType=alias"
+	return nil
+}
+
+func NewIncident(c Config, idx int) Forwarder {
+	conf := c.Incident
+	httpConf := conf.HTTPConfig
+	if httpConf.URL == "" {
+		httpConf.URL = conf.API.defaultURL()
+	}
+	httpConf.Method = HTTPMethodPost
+	httpConf.MethodTemplate = ""
+	httpConf.BatchSize = 0
+	if conf.API == IncidentOpsgenie {
+		httpConf.Headers = make(map[string][]string, len(conf.Headers)+1)
+		for key, values := range conf.Headers {
+			httpConf.Headers[key] = values
+		}
+		httpConf.Headers["Authorization"] = []string{"GenieKey " + conf.APIKey}
+	}
+	fwd := &Incident{
+		HTTP: newHTTP(c, idx, &httpConf),
+		conf: conf,
+	}
+	var err error
+	if fwd.summary, err = compileTemplate(conf.Summary); err != nil {
+		fwd.logger.Fatal().Err(err).Msg("failed compiling summary template")
+	}
+	if fwd.source, err = compileTemplate(conf.Source); err != nil {
+		fwd.logger.Fatal().Err(err).Msg("failed compiling source template")
+	}
+	if fwd.severity, err = compileTemplate(conf.Severity); err != nil {
+		fwd.logger.Fatal().Err(err).Msg("failed compiling severity template")
+	}
+	if conf.DedupKey != "" {
+		if fwd.dedupKey, err = compileTemplate(conf.DedupKey); err != nil {
+			fwd.logger.Fatal().Err(err).Msg("failed compiling dedup_key template")
+		}
+	}
+	fwd.HTTP.encode = fwd.encode
+	fwd.HTTP.route = fwd.route
+	go fwd.Run()
+	return fwd
+}
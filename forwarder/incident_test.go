@@ -0,0 +1,116 @@
+package forwarder
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/bangunindo/trap2json/snmp"
+	"github.com/go-json-experiment/json"
+	"github.com/stretchr/testify/assert"
+)
+
+// incidentTraps returns a raise trap, its clear trap and a repeated raise of the same alarm
+func incidentTraps() (*snmp.Message, *snmp.Message, *snmp.Message) {
+	raise := testMessage()
+	raise.Payload.Raise = &snmp.Correlate{ID: "raise-1", Key: "alarm"}
+	clear := testMessage()
+	clear.Payload.Correlate = &snmp.Correlate{ID: "raise-1", Key: "alarm"}
+	repeated := testMessage()
+	repeated.Payload.Raise = &snmp.Correlate{ID: "raise-2", Key: "alarm"}
+	return raise, clear, repeated
+}
+
+func TestIncidentPagerDuty(t *testing.T) {
+	url, requests := captureRequests(t, http.StatusAccepted)
+	fwd := startForwarder(t, Config{
+		Incident: &IncidentConfig{
+			HTTPConfig: HTTPConfig{URL: url},
+			RoutingKey: "routing",
+			Summary:    "{enterprise_mib_name} on {src_address}",
+			Severity:   "critical",
+		},
+	})
+	raise, clear, repeated := incidentTraps()
+	var events []pagerDutyEvent
+	for _, m := range []*snmp.Message{raise, clear, repeated} {
+		fwd.Send(m)
+		req := receive(t, requests)
+		assert.Equal(t, http.MethodPost, req.method)
+		assert.Equal(t, "/", req.uri)
+		var event pagerDutyEvent
+		assert.NoError(t, json.Unmarshal(req.body, &event))
+		assert.Equal(t, "routing", event.RoutingKey)
+		events = append(events, event)
+	}
+	assert.Equal(t, "trigger", events[0].EventAction)
+	if assert.NotNil(t, events[0].Payload) {
+		assert.Equal(t, "IF-MIB::linkDown on 10.0.0.1", events[0].Payload.Summary)
+		assert.Equal(t, "10.0.0.1", events[0].Payload.Source)
+		assert.Equal(t, "critical", events[0].Payload.Severity)
+		assert.Equal(t, raise.Payload.Time, events[0].Payload.Timestamp)
+	}
+	assert.NotEmpty(t, events[0].DedupKey)
+	// the clear trap resolves the incident of its raise trap
+	assert.Equal(t, "resolve", events[1].EventAction)
+	assert.Equal(t, events[0].DedupKey, events[1].DedupKey)
+	assert.Nil(t, events[1].Payload)
+	// a repeated alarm is a new incident
+	assert.Equal(t, "trigger", events[2].EventAction)
+	assert.NotEqual(t, events[0].DedupKey, events[2].DedupKey)
+}
+
+func TestIncidentOpsgenie(t *testing.T) {
+	url, requests := captureRequests(t, http.StatusAccepted)
+	fwd := startForwarder(t, Config{
+		Incident: &IncidentConfig{
+			HTTPConfig: HTTPConfig{URL: url},
+			API:        IncidentOpsgenie,
+			APIKey:     "secret",
+			Summary:    "{enterprise_mib_name} on {src_address}",
+			Severity:   "warning",
+		},
+	})
+	raise, clear, repeated := incidentTraps()
+	var alerts []opsgenieAlert
+	var uris []string
+	for _, m := range []*snmp.Message{raise, clear, repeated} {
+		fwd.Send(m)
+		req := receive(t, requests)
+		assert.Equal(t, http.MethodPost, req.method)
+		assert.Equal(t, "GenieKey secret", req.header.Get("Authorization"))
+		var alert opsgenieAlert
+		assert.NoError(t, json.Unmarshal(req.body, &alert))
+		alerts = append(alerts, alert)
+		uris = append(uris, req.uri)
+	}
+	assert.Equal(t, "/v2/alerts", uris[0])
+	assert.Equal(t, "IF-MIB::linkDown on 10.0.0.1", alerts[0].Message)
+	assert.Equal(t, "P3", alerts[0].Priority)
+	assert.Equal(t, "10.0.0.1", alerts[0].Source)
+	assert.NotEmpty(t, alerts[0].Alias)
+	// the clear trap closes the alert of its raise trap by alias
+	assert.Equal(t, "/v2/alerts/"+alerts[0].Alias+"/close?identifierType=alias", uris[1])
+	assert.Equal(t, "/v2/alerts", uris[2])
+	assert.NotEqual(t, alerts[0].Alias, alerts[2].Alias)
+}
+
+func TestIncidentDedupKeyTemplate(t *testing.T) {
+	url, requests := captureRequests(t, http.StatusAccepted)
+	fwd := startForwarder(t, Config{
+		Incident: &IncidentConfig{
+			HTTPConfig: HTTPConfig{URL: url},
+			RoutingKey: "routing",
+			Summary:    "link down",
+			DedupKey:   "{src_address}/{correlate?.key ?? raise?.key}",
+		},
+	})
+	raise, clear, _ := incidentTraps()
+	fwd.Send(raise)
+	fwd.Send(clear)
+	for _, action := range []string{"trigger", "resolve"} {
+		var event pagerDutyEvent
+		assert.NoError(t, json.Unmarshal(receive(t, requests).body, &event))
+		assert.Equal(t, action, event.EventAction)
+		assert.Equal(t, "10.0.0.1/alarm", event.DedupKey)
+	}
+}
@@ -2,8 +2,6 @@ package forwarder
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
 	"github.com/bangunindo/trap2json/helper"
 	"github.com/bangunindo/trap2json/snmp"
 	"github.com/expr-lang/expr"
@@ -14,7 +12,6 @@ import (
 	"github.com/segmentio/kafka-go/sasl/plain"
 	"github.com/segmentio/kafka-go/sasl/scram"
 	"net"
-	"os"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -94,25 +91,9 @@ func (k *Kafka) Run() {
 		}).DialContext,
 	}
 	if k.config.Kafka.Tls != nil {
-		tlsConf := &tls.Config{
-			InsecureSkipVerify: k.config.Kafka.Tls.InsecureSkipVerify,
-		}
-		if k.config.Kafka.Tls.CaCert != "" {
-			ca, err := os.ReadFile(k.config.Kafka.Tls.CaCert)
-			if err != nil {
-				k.logger.Fatal().Err(err).Msg("failed reading ca certificate")
-			}
-			caCerts := x509.NewCertPool()
-			caCerts.AppendCertsFromPEM(ca)
-			tlsConf.RootCAs = caCerts
-		}
-		if k.config.Kafka.Tls.ClientCert != "" &&
-			k.config.Kafka.Tls.ClientKey != "" {
-			cert, err := tls.LoadX509KeyPair(k.config.Kafka.Tls.ClientCert, k.config.Kafka.Tls.ClientKey)
-			if err != nil {
-				k.logger.Fatal().Err(err).Msg("failed reading client certificate")
-			}
-			tlsConf.Certificates = []tls.Certificate{cert}
+		tlsConf, err := k.config.Kafka.Tls.config()
+		if err != nil {
+			k.logger.Fatal().Err(err).Msg("failed setting up tls")
 		}
 		transport.TLS = tlsConf
 	}
@@ -156,9 +137,11 @@ func (k *Kafka) Run() {
 
 	for m := range k.ReceiveChannel() {
 		m := m
+		queueKey := m.QueueKey()
 		m.Compile(k.CompilerConf)
 		if m.Metadata.Skip {
 			k.ctrFiltered.Inc()
+			k.queue.Ack(queueKey)
 			continue
 		}
 		var key []byte
@@ -182,6 +165,7 @@ func (k *Kafka) Run() {
 		k.spawned.Add(1)
 		go func() {
 			defer func() {
+				k.queue.Ack(queueKey)
 				k.spawned.Add(-1)
 				k.wg.Done()
 			}()
@@ -198,6 +182,28 @@ func (k *Kafka) Run() {
 			}
 		}()
 	}
+	// the writes still in progress are acked or retried before the queue is released
+	k.wg.Wait()
+}
+
+func (c *KafkaConfig) validate() []helper.ConfigError {
+	var errs []helper.ConfigError
+	if len(c.Hosts) == 0 {
+		errs = append(errs, helper.ConfigError{Path: "hosts", Err: errors.New("at least one host is required")})
+	}
+	if c.Topic == "" {
+		errs = append(errs, helper.ConfigError{Path: "topic", Err: errors.New("topic is required")})
+	}
+	if c.KeyField != "" {
+		if _, err := compileKeyField(c.KeyField); err != nil {
+			errs = append(errs, helper.ConfigError{Path: "key_field", Err: err})
+		}
+	}
+	return errs
+}
+
+func compileKeyField(keyField string) (*vm.Program, error) {
+	return expr.Compile(keyField, expr.Env(snmp.Payload{}))
 }
 
 func NewKafka(c Config, idx int) Forwarder {
@@ -208,10 +214,7 @@ func NewKafka(c Config, idx int) Forwarder {
 	}
 	var err error
 	if fwd.config.Kafka.KeyField != "" {
-		fwd.keyFieldTemplate, err = expr.Compile(
-			fwd.config.Kafka.KeyField,
-			expr.Env(snmp.Payload{}),
-		)
+		fwd.keyFieldTemplate, err = compileKeyField(fwd.config.Kafka.KeyField)
 		if err != nil {
 			fwd.logger.Fatal().Err(err).Msg("failed compiling kafka.key_field expression")
 		}
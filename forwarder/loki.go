@@ -0,0 +1,263 @@
+package forwarder
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bangunindo/trap2json/helper"
+	"github.com/bangunindo/trap2json/snmp"
+	"github.com/go-json-experiment/json"
+	"github.com/go-json-experiment/json/jsontext"
+	"github.com/klauspost/compress/snappy"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+type LokiEncoding int
+
+const (
+	// LokiProtobuf is snappy compressed protobuf, the native format of loki push api
+	LokiProtobuf LokiEncoding = iota
+	LokiJSON
+)
+
+func (l *LokiEncoding) String() string {
+	switch *l {
+	case LokiProtobuf:
+		return "protobuf"
+	case LokiJSON:
+		return "json"
+	default:
+		return ""
+	}
+}
+
+func (l *LokiEncoding) UnmarshalText(text []byte) error {
+	switch strings.ToLower(string(text)) {
+	case "", "protobuf":
+		*l = LokiProtobuf
+	case "json":
+		*l = LokiJSON
+	default:
+		return errors.Errorf("unsupported LokiEncoding: %s", string(text))
+	}
+	return nil
+}
+
+// lokiOverflowValue replaces label values over max_label_values
+const lokiOverflowValue = "overflow"
+
+var lokiLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// LokiConfig pushes traps to loki, the line is the message json and the timestamp
+// is the trap time. Every http option is available, url is the base url of loki,
+// the method is always POST and batch_format is replaced by encoding
+type LokiConfig struct {
+	HTTPConfig `mapstructure:",squash"`
+	// Labels are the stream labels, the values are templates
+	Labels map[string]string
+	// MaxLabelValues limits the distinct values of every label, the values
+	// after that are replaced with lokiOverflowValue. Negative is unlimited
+	MaxLabelValues int `mapstructure:"max_label_values"`
+	Encoding       LokiEncoding
+	// TenantID is sent as X-Scope-OrgID header
+	TenantID string `mapstructure:"tenant_id"`
+}
+
+func (c *LokiConfig) validate() []helper.ConfigError {
+	errs := c.HTTPConfig.validate()
+	if len(c.Labels) == 0 {
+		errs = append(errs, helper.ConfigError{Path: "labels", Err: errors.New("at least one label is required")})
+	}
+	for key, value := range c.Labels {
+		if !lokiLabelName.MatchString(key) {
+			errs = append(errs, helper.ConfigError{Path: fmt.Sprintf("labels.%s", key), Err: errors.New("invalid label name")})
+		} else if _, err := compileTemplate(value); err != nil {
+			errs = append(errs, helper.ConfigError{Path: fmt.Sprintf("labels.%s", key), Err: err})
+		}
+	}
+	return errs
+}
+
+// lokiStream is a stream of the json push request
+type lokiStream struct {
+	Stream jsontext.Value `json:"stream"`
+	Values [][2]string    `json:"values"`
+}
+
+type Loki struct {
+	*HTTP
+
+	conf   *LokiConfig
+	labels map[string]*exprTemplate
+
+	// labelValues keeps the seen values of every label for max_label_values
+	labelValues sync.Map
+}
+
+type lokiLabelValues struct {
+	sync.Mutex
+	values map[string]struct{}
+}
+
+// guard returns value as is or lokiOverflowValue when the label has too many values
+func (l *Loki) guard(label, value string) string {
+	if l.conf.MaxLabelValues < 0 {
+		return value
+	}
+	v, _ := l.labelValues.LoadOrStore(label, &lokiLabelValues{values: make(map[string]struct{})})
+	seen := v.(*lokiLabelValues)
+	seen.Lock()
+	defer seen.Unlock()
+	if _, ok := seen.values[value]; ok {
+		return value
+	}
+	if len(seen.values) >= l.conf.MaxLabelValues {
+		return lokiOverflowValue
+	}
+	seen.values[value] = struct{}{}
+	if len(seen.values) == l.conf.MaxLabelValues {
+		l.logger.Warn().Str("label", label).Msg("label reached max_label_values, new values are replaced with " + lokiOverflowValue)
+	}
+	return value
+}
+
+// stream renders the stream labels of the message as json object, messages
+// with the same labels are pushed to the same stream
+func (l *Loki) stream(m *snmp.Message) ([]byte, error) {
+	labels, err := renderTemplates(l.labels, m.Payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed rendering labels")
+	}
+	for key, value := range labels {
+		labels[key] = l.guard(key, value)
+	}
+	return json.Marshal(labels, json.Deterministic(true))
+}
+
+// push builds the push request, the messages are grouped by their stream
+func (l *Loki) push(batch []httpItem) ([]byte, error) {
+	var keys []string
+	streams := make(map[string][]*snmp.Message)
+	for _, item := range batch {
+		key := string(item.body)
+		if _, ok := streams[key]; !ok {
+			keys = append(keys, key)
+		}
+		streams[key] = append(streams[key], item.m)
+	}
+	if l.conf.Encoding == LokiJSON {
+		req := struct {
+			Streams []lokiStream `json:"streams"`
+		}{}
+		for _, key := range keys {
+			s := lokiStream{Stream: jsontext.Value(key)}
+			for _, m := range streams[key] {
+				s.Values = append(s.Values, [2]string{
+					strconv.FormatInt(m.Payload.Time.UnixNano(), 10),
+					string(m.Metadata.MessageJSON),
+				})
+			}
+			req.Streams = append(req.Streams, s)
+		}
+		return json.Marshal(req)
+	}
+	// logproto.PushRequest
+	var req []byte
+	for _, key := range keys {
+		s, err := protobufStream(key, streams[key])
+		if err != nil {
+			return nil, err
+		}
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, s)
+	}
+	return snappy.Encode(nil, req), nil
+}
+
+// protobufStream encodes logproto.StreamAdapter, the labels are in prometheus format
+func protobufStream(stream string, messages []*snmp.Message) ([]byte, error) {
+	var labels map[string]string
+	if err := json.Unmarshal([]byte(stream), &labels); err != nil {
+		return nil, errors.Wrap(err, "failed decoding stream labels")
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(name)
+		sb.WriteByte('=')
+		sb.WriteString(strconv.Quote(labels[name]))
+	}
+	sb.WriteByte('}')
+
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, sb.String())
+	for _, m := range messages {
+		// google.protobuf.Timestamp
+		var ts []byte
+		ts = protowire.AppendTag(ts, 1, protowire.VarintType)
+		ts = protowire.AppendVarint(ts, uint64(m.Payload.Time.Unix()))
+		ts = protowire.AppendTag(ts, 2, protowire.VarintType)
+		ts = protowire.AppendVarint(ts, uint64(m.Payload.Time.Nanosecond()))
+		// logproto.EntryAdapter
+		var entry []byte
+		entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+		entry = protowire.AppendBytes(entry, ts)
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendBytes(entry, m.Metadata.MessageJSON)
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, entry)
+	}
+	return b, nil
+}
+
+func NewLoki(c Config, idx int) Forwarder {
+	conf := c.Loki
+	httpConf := conf.HTTPConfig
+	httpConf.URL = strings.TrimRight(conf.URL, "/") + "/loki/api/v1/push"
+	httpConf.Method = HTTPMethodPost
+	httpConf.MethodTemplate = ""
+	httpConf.Headers = make(map[string][]string, len(conf.Headers)+2)
+	for key, values := range conf.Headers {
+		// the content type depends on encoding
+		if !strings.EqualFold(key, "Content-Type") {
+			httpConf.Headers[key] = values
+		}
+	}
+	if conf.Encoding == LokiJSON {
+		httpConf.Headers["Content-Type"] = []string{"application/json"}
+	} else {
+		httpConf.Headers["Content-Type"] = []string{"application/x-protobuf"}
+		// the body is already compressed with snappy
+		httpConf.Compression = HTTPCompressionNone
+	}
+	if conf.TenantID != "" {
+		httpConf.Headers["X-Scope-OrgID"] = []string{conf.TenantID}
+	}
+	fwd := &Loki{
+		HTTP: newHTTP(c, idx, &httpConf),
+		conf: conf,
+	}
+	var err error
+	if fwd.labels, err = compileTemplates(conf.Labels); err != nil {
+		fwd.logger.Fatal().Err(err).Msg("failed compiling labels template")
+	}
+	fwd.encode = fwd.stream
+	fwd.batchBody = fwd.push
+	fwd.alwaysBatch = true
+	go fwd.Run()
+	return fwd
+}
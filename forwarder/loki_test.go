@@ -0,0 +1,213 @@
+package forwarder
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/bangunindo/trap2json/helper"
+	"github.com/go-json-experiment/json"
+	"github.com/klauspost/compress/snappy"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// lokiEntry is a decoded entry of a push request
+type lokiEntry struct {
+	time time.Time
+	line string
+}
+
+// consumeMessage calls field for every field of the protobuf message b
+func consumeMessage(t *testing.T, b []byte, field func(num protowire.Number, typ protowire.Type, value []byte, varint uint64)) {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if !assert.GreaterOrEqual(t, n, 0) {
+			t.FailNow()
+		}
+		b = b[n:]
+		switch typ {
+		case protowire.BytesType:
+			value, n := protowire.ConsumeBytes(b)
+			if !assert.GreaterOrEqual(t, n, 0) {
+				t.FailNow()
+			}
+			field(num, typ, value, 0)
+			b = b[n:]
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			if !assert.GreaterOrEqual(t, n, 0) {
+				t.FailNow()
+			}
+			field(num, typ, nil, v)
+			b = b[n:]
+		default:
+			t.Fatalf("unexpected wire type %d", typ)
+		}
+	}
+}
+
+// decodeLokiProtobuf decodes a snappy compressed logproto.PushRequest,
+// the entries are grouped by the labels of their stream
+func decodeLokiProtobuf(t *testing.T, body []byte) (map[string][]lokiEntry, []string) {
+	req, err := snappy.Decode(nil, body)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	streams := make(map[string][]lokiEntry)
+	var labels []string
+	consumeMessage(t, req, func(num protowire.Number, _ protowire.Type, stream []byte, _ uint64) {
+		assert.Equal(t, protowire.Number(1), num)
+		var streamLabels string
+		var entries []lokiEntry
+		consumeMessage(t, stream, func(num protowire.Number, _ protowire.Type, value []byte, _ uint64) {
+			switch num {
+			case 1:
+				streamLabels = string(value)
+			case 2:
+				var entry lokiEntry
+				consumeMessage(t, value, func(num protowire.Number, _ protowire.Type, value []byte, _ uint64) {
+					switch num {
+					case 1:
+						var sec, nsec uint64
+						consumeMessage(t, value, func(num protowire.Number, _ protowire.Type, _ []byte, v uint64) {
+							if num == 1 {
+								sec = v
+							} else {
+								nsec = v
+							}
+						})
+						entry.time = time.Unix(int64(sec), int64(nsec)).UTC()
+					case 2:
+						entry.line = string(value)
+					}
+				})
+				entries = append(entries, entry)
+			}
+		})
+		labels = append(labels, streamLabels)
+		streams[streamLabels] = entries
+	})
+	return streams, labels
+}
+
+func TestLokiProtobuf(t *testing.T) {
+	url, requests := captureRequests(t, http.StatusNoContent)
+	fwd := startForwarder(t, Config{
+		Loki: &LokiConfig{
+			HTTPConfig: HTTPConfig{
+				URL:         url,
+				BatchSize:   3,
+				Compression: HTTPCompressionGzip,
+			},
+			Labels: map[string]string{
+				"job":      "trap2json",
+				"instance": "{src_address}",
+			},
+			TenantID: "tenant",
+		},
+	})
+	for _, addr := range []string{"10.0.0.1", "10.0.0.3", "10.0.0.1"} {
+		m := testMessage()
+		m.Payload.SrcAddress = addr
+		fwd.Send(m)
+	}
+	req := receive(t, requests)
+	assert.Equal(t, "/loki/api/v1/push", req.uri)
+	assert.Equal(t, "application/x-protobuf", req.header.Get("Content-Type"))
+	assert.Equal(t, "tenant", req.header.Get("X-Scope-OrgID"))
+	// snappy replaces the configured compression
+	assert.Empty(t, req.header.Get("Content-Encoding"))
+	streams, labels := decodeLokiProtobuf(t, req.body)
+	assert.Equal(t, []string{
+		`{instance="10.0.0.1", job="trap2json"}`,
+		`{instance="10.0.0.3", job="trap2json"}`,
+	}, labels)
+	assert.Len(t, streams[labels[0]], 2)
+	assert.Len(t, streams[labels[1]], 1)
+	for _, entry := range streams[labels[0]] {
+		assert.Equal(t, testMessage().Payload.Time, entry.time)
+		assert.Contains(t, entry.line, `"src_address":"10.0.0.1"`)
+	}
+}
+
+func TestLokiJSON(t *testing.T) {
+	url, requests := captureRequests(t, http.StatusNoContent)
+	fwd := startForwarder(t, Config{
+		Loki: &LokiConfig{
+			HTTPConfig: HTTPConfig{URL: url, BatchSize: 1},
+			Labels:     map[string]string{"instance": "{src_address}"},
+			Encoding:   LokiJSON,
+		},
+	})
+	fwd.Send(testMessage())
+	req := receive(t, requests)
+	assert.Equal(t, "application/json", req.header.Get("Content-Type"))
+	var push struct {
+		Streams []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		} `json:"streams"`
+	}
+	assert.NoError(t, json.Unmarshal(req.body, &push))
+	if assert.Len(t, push.Streams, 1) {
+		assert.Equal(t, map[string]string{"instance": "10.0.0.1"}, push.Streams[0].Stream)
+		if assert.Len(t, push.Streams[0].Values, 1) {
+			assert.Equal(t, "1704164645678000000", push.Streams[0].Values[0][0])
+			assert.Contains(t, push.Streams[0].Values[0][1], `"src_address":"10.0.0.1"`)
+		}
+	}
+}
+
+func TestLokiMaxLabelValues(t *testing.T) {
+	url, requests := captureRequests(t, http.StatusNoContent)
+	fwd := startForwarder(t, Config{
+		Loki: &LokiConfig{
+			HTTPConfig: HTTPConfig{
+				URL:          url,
+				BatchSize:    5,
+				BatchTimeout: helper.Duration{Duration: 50 * time.Millisecond},
+			},
+			Labels: map[string]string{
+				"instance":  "{src_address}",
+				"community": "{community}",
+			},
+			MaxLabelValues: 2,
+		},
+	})
+	// the seen values keep their label, new ones after the second are replaced
+	for _, addr := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.1", "10.0.0.4"} {
+		m := testMessage()
+		m.Payload.SrcAddress = addr
+		fwd.Send(m)
+	}
+	streams, labels := decodeLokiProtobuf(t, receive(t, requests).body)
+	assert.Equal(t, []string{
+		`{community="public", instance="10.0.0.1"}`,
+		`{community="public", instance="10.0.0.2"}`,
+		`{community="public", instance="overflow"}`,
+	}, labels)
+	assert.Len(t, streams[labels[0]], 2)
+	assert.Len(t, streams[labels[1]], 1)
+	assert.Len(t, streams[labels[2]], 2)
+
+	// unlimited label values
+	l := &Loki{conf: &LokiConfig{MaxLabelValues: -1}}
+	assert.Equal(t, "10.0.0.5", l.guard("instance", "10.0.0.5"))
+}
+
+func TestLokiValidate(t *testing.T) {
+	c := LokiConfig{
+		HTTPConfig: HTTPConfig{URL: "http://localhost:3100"},
+		Labels: map[string]string{
+			"instance":  "{src_address}",
+			"bad-name":  "{src_address}",
+			"community": "{community",
+		},
+	}
+	var paths []string
+	for _, err := range c.validate() {
+		paths = append(paths, err.Path)
+	}
+	assert.ElementsMatch(t, []string{"labels.bad-name", "labels.community"}, paths)
+}
@@ -21,11 +21,11 @@ func (m *Mock) Run() {
 	defer m.logger.Info().Msg("forwarder exited")
 	m.logger.Info().Msg("starting forwarder")
 
-	for msg := range m.ReceiveChannel() {
+	m.consume(func(msg *snmp.Message) {
 		msg.Compile(m.CompilerConf)
 		if msg.Metadata.Skip {
 			m.ctrFiltered.Inc()
-			continue
+			return
 		}
 		if m.config.Mock.Timeout.Duration > 0 {
 			select {
@@ -36,8 +36,9 @@ func (m *Mock) Run() {
 			}
 		} else {
 			m.config.Mock.OutChannel <- msg
+			m.ctrSucceeded.Inc()
 		}
-	}
+	})
 }
 
 func NewMock(c Config, idx int) Forwarder {
@@ -2,7 +2,10 @@ package forwarder
 
 import (
 	"crypto/tls"
+	"github.com/bangunindo/trap2json/helper"
+	"github.com/bangunindo/trap2json/snmp"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/pkg/errors"
 )
 
 type TlsConfig struct {
@@ -20,6 +23,20 @@ type MQTTConfig struct {
 	Qos      uint8
 }
 
+func (c *MQTTConfig) validate() []helper.ConfigError {
+	var errs []helper.ConfigError
+	if len(c.Hosts) == 0 {
+		errs = append(errs, helper.ConfigError{Path: "hosts", Err: errors.New("at least one host is required")})
+	}
+	if c.Topic == "" {
+		errs = append(errs, helper.ConfigError{Path: "topic", Err: errors.New("topic is required")})
+	}
+	if c.Qos > 2 {
+		errs = append(errs, helper.ConfigError{Path: "qos", Err: errors.Errorf("invalid qos: %d", c.Qos)})
+	}
+	return errs
+}
+
 type MQTT struct {
 	Base
 }
@@ -51,11 +68,11 @@ func (m *MQTT) Run() {
 	token := client.Connect()
 	token.Wait()
 	defer client.Disconnect(10_000)
-	for msg := range m.ReceiveChannel() {
+	m.consume(func(msg *snmp.Message) {
 		msg.Compile(m.CompilerConf)
 		if msg.Metadata.Skip {
 			m.ctrFiltered.Inc()
-			continue
+			return
 		}
 		if t := client.Publish(m.config.MQTT.Topic, m.config.MQTT.Qos, false, msg.Metadata.MessageJSON); t.Wait() &&
 			t.Error() != nil {
@@ -63,7 +80,7 @@ func (m *MQTT) Run() {
 		} else {
 			m.ctrSucceeded.Inc()
 		}
-	}
+	})
 }
 
 func NewMQTT(c Config, idx int) Forwarder {
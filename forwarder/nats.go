@@ -0,0 +1,209 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/bangunindo/trap2json/helper"
+	"github.com/bangunindo/trap2json/snmp"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/pkg/errors"
+)
+
+type NATSConfig struct {
+	Servers []string
+	// Subject is a template, see natsSubjectToken for the escaping of its results
+	Subject string
+	// Credentials is the path of a .creds file
+	Credentials string
+	// NKey is the path of a nkey seed file
+	NKey      string `mapstructure:"nkey"`
+	Username  string
+	Password  string
+	Token     string
+	Tls       *Tls
+	Timeout   helper.Duration
+	JetStream NATSJetStreamConfig `mapstructure:"jetstream"`
+}
+
+// NATSJetStreamConfig publishes to jetstream, a trap is only succeeded when the stream acks it
+type NATSJetStreamConfig struct {
+	Enable     bool
+	AckTimeout helper.Duration `mapstructure:"ack_timeout"`
+	// MsgID is a template of Nats-Msg-Id header, the stream drops the messages with
+	// the same id in its duplicate window. Hash of the message json is used if it's empty
+	MsgID string `mapstructure:"msg_id"`
+	// Stream is the expected stream of the subject, it's not checked if it's empty
+	Stream string
+}
+
+func (c *NATSConfig) validate() []helper.ConfigError {
+	var errs []helper.ConfigError
+	if len(c.Servers) == 0 {
+		errs = append(errs, helper.ConfigError{Path: "servers", Err: errors.New("at least one server is required")})
+	}
+	if c.Subject == "" {
+		errs = append(errs, helper.ConfigError{Path: "subject", Err: errors.New("subject is required")})
+	} else if _, err := compileTemplate(c.Subject); err != nil {
+		errs = append(errs, helper.ConfigError{Path: "subject", Err: err})
+	}
+	auth := 0
+	for _, method := range []string{c.Credentials, c.NKey, c.Username, c.Token} {
+		if method != "" {
+			auth++
+		}
+	}
+	if auth > 1 {
+		errs = append(errs, helper.ConfigError{Path: "credentials", Err: errors.New("only one of credentials, nkey, username and token can be used")})
+	}
+	if _, err := compileTemplate(c.JetStream.MsgID); err != nil {
+		errs = append(errs, helper.ConfigError{Path: "jetstream.msg_id", Err: err})
+	}
+	return errs
+}
+
+// natsSubjectToken replaces whitespaces and wildcards in the results of subject
+// template, an empty result would make an empty token so it's replaced as well
+func natsSubjectToken(_, value string) string {
+	if value == "" {
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n', '*', '>':
+			return '_'
+		default:
+			return r
+		}
+	}, value)
+}
+
+type NATS struct {
+	Base
+
+	subject *exprTemplate
+	msgID   *exprTemplate
+}
+
+func (n *NATS) options() ([]nats.Option, error) {
+	conf := n.config.NATS
+	opts := []nats.Option{
+		nats.Name("trap2json"),
+		nats.Timeout(conf.Timeout.Duration),
+		// the traps are retried until the connection is up
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+	}
+	switch {
+	case conf.Credentials != "":
+		opts = append(opts, nats.UserCredentials(conf.Credentials))
+	case conf.NKey != "":
+		opt, err := nats.NkeyOptionFromSeed(conf.NKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed reading nkey seed")
+		}
+		opts = append(opts, opt)
+	case conf.Username != "":
+		opts = append(opts, nats.UserInfo(conf.Username, conf.Password))
+	case conf.Token != "":
+		opts = append(opts, nats.Token(conf.Token))
+	}
+	if conf.Tls != nil {
+		tlsConf, err := conf.Tls.config()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, nats.Secure(tlsConf))
+	}
+	return opts, nil
+}
+
+func (n *NATS) msgIDOf(m *snmp.Message) (string, error) {
+	if n.msgID == nil {
+		sum := sha256.Sum256(m.Metadata.MessageJSON)
+		return hex.EncodeToString(sum[:16]), nil
+	}
+	return n.msgID.render(m.Payload, nil)
+}
+
+func (n *NATS) Run() {
+	defer n.cancel()
+	defer n.logger.Info().Msg("forwarder exited")
+	n.logger.Info().Msg("starting forwarder")
+	conf := n.config.NATS
+	opts, err := n.options()
+	if err != nil {
+		n.logger.Fatal().Err(err).Msg("failed setting up nats connection")
+	}
+	nc, err := nats.Connect(strings.Join(conf.Servers, ","), opts...)
+	if err != nil {
+		n.logger.Fatal().Err(err).Msg("failed connecting to nats")
+	}
+	defer nc.Close()
+	var js jetstream.JetStream
+	if conf.JetStream.Enable {
+		if js, err = jetstream.New(nc); err != nil {
+			n.logger.Fatal().Err(err).Msg("failed setting up jetstream")
+		}
+	}
+	n.consume(func(m *snmp.Message) {
+		m.Compile(n.CompilerConf)
+		if m.Metadata.Skip {
+			n.ctrFiltered.Inc()
+			return
+		}
+		subject, err := n.subject.render(m.Payload, natsSubjectToken)
+		if err != nil {
+			n.Retry(m, permanent(errors.Wrap(err, "failed rendering subject")))
+			return
+		}
+		if js == nil {
+			if err = nc.Publish(subject, m.Metadata.MessageJSON); err != nil {
+				n.Retry(m, err)
+			} else {
+				n.ctrSucceeded.Inc()
+			}
+			return
+		}
+		msgID, err := n.msgIDOf(m)
+		if err != nil {
+			n.Retry(m, permanent(errors.Wrap(err, "failed rendering msg_id")))
+			return
+		}
+		pubOpts := []jetstream.PublishOpt{jetstream.WithMsgID(msgID)}
+		if conf.JetStream.Stream != "" {
+			pubOpts = append(pubOpts, jetstream.WithExpectStream(conf.JetStream.Stream))
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), conf.JetStream.AckTimeout.Duration)
+		defer cancel()
+		// a duplicate is acked as well, the stream already has it
+		if _, err = js.PublishMsg(ctx, &nats.Msg{Subject: subject, Data: m.Metadata.MessageJSON}, pubOpts...); err != nil {
+			n.Retry(m, errors.Wrap(err, "failed publishing to jetstream"))
+		} else {
+			n.ctrSucceeded.Inc()
+		}
+	})
+	if err = nc.Flush(); err != nil {
+		n.logger.Warn().Err(err).Msg("failed flushing nats connection")
+	}
+}
+
+func NewNATS(c Config, idx int) Forwarder {
+	fwd := &NATS{
+		Base: NewBase(c, idx),
+	}
+	var err error
+	if fwd.subject, err = compileTemplate(c.NATS.Subject); err != nil {
+		fwd.logger.Fatal().Err(err).Msg("failed compiling subject template")
+	}
+	if c.NATS.JetStream.MsgID != "" {
+		if fwd.msgID, err = compileTemplate(c.NATS.JetStream.MsgID); err != nil {
+			fwd.logger.Fatal().Err(err).Msg("failed compiling msg_id template")
+		}
+	}
+	go fwd.Run()
+	return fwd
+}
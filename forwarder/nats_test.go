@@ -0,0 +1,194 @@
+package forwarder
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bangunindo/trap2json/helper"
+	"github.com/go-json-experiment/json"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// natsPub is a message published to fakeNATS
+type natsPub struct {
+	subject string
+	header  nats.Header
+	data    []byte
+}
+
+// fakeNATS speaks enough of the nats protocol for a single client to publish. Every
+// published message is sent to the channel, ack returns the reply of a jetstream
+// publish, an empty reply isn't sent
+func fakeNATS(t *testing.T, ack func(n int, pub natsPub) string) (string, chan natsPub) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	pubs := make(chan natsPub, 10)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		port := ln.Addr().(*net.TCPAddr).Port
+		_, _ = fmt.Fprintf(conn, `INFO {"server_id":"fake","version":"2.10.0","proto":1,"headers":true,"max_payload":1048576,"port":%d}`+"\r\n", port)
+		r := bufio.NewReader(conn)
+		// the inbox subscription receives the replies of jetstream
+		inboxSID := ""
+		published := 0
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			args := strings.Fields(line)
+			if len(args) == 0 {
+				continue
+			}
+			switch strings.ToUpper(args[0]) {
+			case "PING":
+				_, _ = conn.Write([]byte("PONG\r\n"))
+			case "SUB":
+				if strings.HasPrefix(args[1], "_INBOX.") {
+					inboxSID = args[len(args)-1]
+				}
+			case "PUB", "HPUB":
+				// PUB <subject> [reply] <size> or HPUB <subject> [reply] <header size> <size>
+				sizes, hdrLen := 1, 0
+				if args[0] == "HPUB" {
+					sizes = 2
+					hdrLen, _ = strconv.Atoi(args[len(args)-2])
+				}
+				total, _ := strconv.Atoi(args[len(args)-1])
+				reply := ""
+				if len(args) == 3+sizes {
+					reply = args[2]
+				}
+				payload := make([]byte, total+2)
+				if _, err = io.ReadFull(r, payload); err != nil {
+					return
+				}
+				pub := natsPub{subject: args[1], header: nats.Header{}, data: payload[hdrLen:total]}
+				// NATS/1.0 line and then mime style headers
+				for _, h := range strings.Split(string(payload[:hdrLen]), "\r\n")[1:] {
+					if key, value, ok := strings.Cut(h, ":"); ok {
+						pub.header.Add(key, strings.TrimSpace(value))
+					}
+				}
+				published++
+				pubs <- pub
+				if reply == "" || inboxSID == "" || ack == nil {
+					continue
+				}
+				if res := ack(published, pub); res != "" {
+					_, _ = fmt.Fprintf(conn, "MSG %s %s %d\r\n%s\r\n", reply, inboxSID, len(res), res)
+				}
+			}
+		}
+	}()
+	return "nats://" + ln.Addr().String(), pubs
+}
+
+func TestNATSSubject(t *testing.T) {
+	url, pubs := fakeNATS(t, nil)
+	fwd := startForwarder(t, Config{
+		NATS: &NATSConfig{
+			Servers: []string{url},
+			Subject: "trap.{enterprise_mib_name}.{'a b*'}.{''}",
+		},
+	})
+	fwd.Send(testMessage())
+	pub := receive(t, pubs)
+	assert.Equal(t, "trap.IF-MIB::linkDown.a_b_._", pub.subject)
+	assert.Contains(t, string(pub.data), `"src_address":"10.0.0.1"`)
+}
+
+func TestNATSJetStreamAck(t *testing.T) {
+	url, pubs := fakeNATS(t, func(n int, pub natsPub) string {
+		switch n {
+		case 1:
+			// not acked in ack_timeout
+			return ""
+		case 2:
+			return `{"error":{"code":503,"err_code":10077,"description":"maximum messages exceeded"}}`
+		default:
+			ack, _ := json.Marshal(map[string]any{
+				"stream":    pub.header.Get(nats.ExpectedStreamHdr),
+				"seq":       n,
+				"duplicate": n > 3,
+			})
+			return string(ack)
+		}
+	})
+	fwd := startForwarder(t, Config{
+		AutoRetry: helper.AutoRetry{
+			Enable:   true,
+			MinDelay: helper.Duration{Duration: 10 * time.Millisecond},
+			MaxDelay: helper.Duration{Duration: 10 * time.Millisecond},
+		},
+		NATS: &NATSConfig{
+			Servers: []string{url},
+			Subject: "trap",
+			JetStream: NATSJetStreamConfig{
+				Enable:     true,
+				AckTimeout: helper.Duration{Duration: 100 * time.Millisecond},
+				Stream:     "TRAPS",
+			},
+		},
+	})
+	n := fwd.(*NATS)
+	succeeded := testutil.ToFloat64(n.ctrSucceeded)
+	retried := testutil.ToFloat64(n.ctrRetried)
+	fwd.Send(testMessage())
+	first := receive(t, pubs)
+	assert.Equal(t, "TRAPS", first.header.Get(nats.ExpectedStreamHdr))
+	msgID := first.header.Get(nats.MsgIdHdr)
+	assert.Len(t, msgID, 32)
+	// the trap isn't succeeded until the stream acks it, the retries keep the
+	// same msg id so the stream can drop the duplicates
+	for range 2 {
+		assert.Equal(t, msgID, receive(t, pubs).header.Get(nats.MsgIdHdr))
+	}
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(n.ctrSucceeded)-succeeded == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, float64(2), testutil.ToFloat64(n.ctrRetried)-retried)
+
+	// a duplicate is acked as well
+	fwd.Send(testMessage())
+	assert.Equal(t, msgID, receive(t, pubs).header.Get(nats.MsgIdHdr))
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(n.ctrSucceeded)-succeeded == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, float64(2), testutil.ToFloat64(n.ctrRetried)-retried)
+}
+
+func TestNATSJetStreamMsgID(t *testing.T) {
+	url, pubs := fakeNATS(t, func(n int, _ natsPub) string {
+		return `{"stream":"TRAPS","seq":` + strconv.Itoa(n) + `}`
+	})
+	fwd := startForwarder(t, Config{
+		NATS: &NATSConfig{
+			Servers: []string{url},
+			Subject: "trap",
+			JetStream: NATSJetStreamConfig{
+				Enable: true,
+				MsgID:  "{src_address}-{src_port}",
+			},
+		},
+	})
+	fwd.Send(testMessage())
+	pub := receive(t, pubs)
+	assert.Equal(t, "10.0.0.1-162", pub.header.Get(nats.MsgIdHdr))
+	assert.Empty(t, pub.header.Get(nats.ExpectedStreamHdr))
+}
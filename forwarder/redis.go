@@ -0,0 +1,265 @@
+package forwarder
+
+import (
+	"context"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bangunindo/trap2json/helper"
+	"github.com/bangunindo/trap2json/snmp"
+	"github.com/go-json-experiment/json"
+	"github.com/go-json-experiment/json/jsontext"
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+)
+
+type RedisMode int
+
+const (
+	// RedisStream appends every trap to a stream with XADD
+	RedisStream RedisMode = iota
+	// RedisPublish sends every trap to a pub/sub channel with PUBLISH
+	RedisPublish
+)
+
+func (r *RedisMode) String() string {
+	switch *r {
+	case RedisStream:
+		return "stream"
+	case RedisPublish:
+		return "publish"
+	default:
+		return ""
+	}
+}
+
+func (r *RedisMode) UnmarshalText(text []byte) error {
+	switch strings.ToLower(string(text)) {
+	case "", "stream":
+		*r = RedisStream
+	case "publish":
+		*r = RedisPublish
+	default:
+		return errors.Errorf("unsupported RedisMode: %s", string(text))
+	}
+	return nil
+}
+
+type RedisFields int
+
+const (
+	// RedisFieldsJSON puts the message json in a single field
+	RedisFieldsJSON RedisFields = iota
+	// RedisFieldsFlatten puts every value of the message json in its own field,
+	// nested keys are joined with dots and array items are keyed by their index.
+	// A message without any value falls back to RedisFieldsJSON
+	RedisFieldsFlatten
+)
+
+func (r *RedisFields) String() string {
+	switch *r {
+	case RedisFieldsJSON:
+		return "json"
+	case RedisFieldsFlatten:
+		return "flatten"
+	default:
+		return ""
+	}
+}
+
+func (r *RedisFields) UnmarshalText(text []byte) error {
+	switch strings.ToLower(string(text)) {
+	case "", "json":
+		*r = RedisFieldsJSON
+	case "flatten":
+		*r = RedisFieldsFlatten
+	default:
+		return errors.Errorf("unsupported RedisFields: %s", string(text))
+	}
+	return nil
+}
+
+type RedisConfig struct {
+	// URL is redis:// or rediss:// url, see redis.ParseURL
+	URL  string `mapstructure:"url"`
+	Tls  *Tls
+	Mode RedisMode
+	// Key is a template of the stream key, or the channel in publish mode
+	Key string
+	// MaxLen trims the stream to about this many entries with MAXLEN ~, 0 doesn't trim
+	MaxLen int64 `mapstructure:"max_len"`
+	// Fields is how the message is mapped to the stream entry fields
+	Fields RedisFields
+	// Field is the field name of RedisFieldsJSON
+	Field   string
+	Timeout helper.Duration
+}
+
+func (c *RedisConfig) validate() []helper.ConfigError {
+	var errs []helper.ConfigError
+	if c.URL == "" {
+		errs = append(errs, helper.ConfigError{Path: "url", Err: errors.New("url is required")})
+	} else if _, err := redis.ParseURL(c.URL); err != nil {
+		errs = append(errs, helper.ConfigError{Path: "url", Err: err})
+	}
+	if c.Key == "" {
+		errs = append(errs, helper.ConfigError{Path: "key", Err: errors.New("key is required")})
+	} else if _, err := compileTemplate(c.Key); err != nil {
+		errs = append(errs, helper.ConfigError{Path: "key", Err: err})
+	}
+	if c.MaxLen < 0 {
+		errs = append(errs, helper.ConfigError{Path: "max_len", Err: errors.New("max_len can't be negative")})
+	}
+	return errs
+}
+
+// flattenJSON appends the leaves of value as field and value pairs. strings
+// are unquoted, nulls are left out and the other values are kept as their json text
+func flattenJSON(fields []string, prefix string, value jsontext.Value) ([]string, error) {
+	switch value.Kind() {
+	case '{':
+		var object map[string]jsontext.Value
+		if err := json.Unmarshal(value, &object); err != nil {
+			return nil, err
+		}
+		keys := make([]string, 0, len(object))
+		for key := range object {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		var err error
+		for _, key := range keys {
+			name := key
+			if prefix != "" {
+				name = prefix + "." + key
+			}
+			if fields, err = flattenJSON(fields, name, object[key]); err != nil {
+				return nil, err
+			}
+		}
+	case '[':
+		var array []jsontext.Value
+		if err := json.Unmarshal(value, &array); err != nil {
+			return nil, err
+		}
+		var err error
+		for i, item := range array {
+			if fields, err = flattenJSON(fields, prefix+"."+strconv.Itoa(i), item); err != nil {
+				return nil, err
+			}
+		}
+	case '"':
+		var s string
+		if err := json.Unmarshal(value, &s); err != nil {
+			return nil, err
+		}
+		fields = append(fields, prefix, s)
+	case 'n':
+		// a null has nothing to store
+	default:
+		fields = append(fields, prefix, string(value))
+	}
+	return fields, nil
+}
+
+type Redis struct {
+	Base
+
+	key *exprTemplate
+}
+
+func (r *Redis) values(m *snmp.Message) ([]string, error) {
+	conf := r.config.Redis
+	if conf.Fields == RedisFieldsFlatten {
+		fields, err := flattenJSON(nil, "", m.Metadata.MessageJSON)
+		// XADD fails without any field, e.g. when every value is null
+		if err != nil || len(fields) > 0 {
+			return fields, err
+		}
+	}
+	return []string{conf.Field, string(m.Metadata.MessageJSON)}, nil
+}
+
+func (r *Redis) options() (*redis.Options, error) {
+	conf := r.config.Redis
+	opts, err := redis.ParseURL(conf.URL)
+	if err != nil {
+		return nil, err
+	}
+	opts.ClientName = "trap2json"
+	opts.DialTimeout = conf.Timeout.Duration
+	if conf.Tls != nil {
+		tlsConf, err := conf.Tls.config()
+		if err != nil {
+			return nil, err
+		}
+		// rediss:// already has the server name and minimum version
+		if opts.TLSConfig != nil {
+			tlsConf.ServerName = opts.TLSConfig.ServerName
+			tlsConf.MinVersion = opts.TLSConfig.MinVersion
+		}
+		opts.TLSConfig = tlsConf
+	}
+	return opts, nil
+}
+
+func (r *Redis) Run() {
+	defer r.cancel()
+	defer r.logger.Info().Msg("forwarder exited")
+	r.logger.Info().Msg("starting forwarder")
+	conf := r.config.Redis
+	opts, err := r.options()
+	if err != nil {
+		r.logger.Fatal().Err(err).Msg("failed setting up redis client")
+	}
+	// the client connects lazily and reconnects on its own
+	db := redis.NewClient(opts)
+	defer db.Close()
+	r.consume(func(m *snmp.Message) {
+		m.Compile(r.CompilerConf)
+		if m.Metadata.Skip {
+			r.ctrFiltered.Inc()
+			return
+		}
+		key, err := r.key.render(m.Payload, nil)
+		if err != nil {
+			r.Retry(m, permanent(errors.Wrap(err, "failed rendering key")))
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), conf.Timeout.Duration)
+		defer cancel()
+		if conf.Mode == RedisPublish {
+			err = db.Publish(ctx, key, m.Metadata.MessageJSON).Err()
+		} else {
+			values, vErr := r.values(m)
+			if vErr != nil {
+				r.Retry(m, permanent(errors.Wrap(vErr, "failed flattening message")))
+				return
+			}
+			err = db.XAdd(ctx, &redis.XAddArgs{
+				Stream: key,
+				MaxLen: conf.MaxLen,
+				Approx: true,
+				Values: values,
+			}).Err()
+		}
+		if err != nil {
+			r.Retry(m, err)
+		} else {
+			r.ctrSucceeded.Inc()
+		}
+	})
+}
+
+func NewRedis(c Config, idx int) Forwarder {
+	fwd := &Redis{
+		Base: NewBase(c, idx),
+	}
+	var err error
+	if fwd.key, err = compileTemplate(c.Redis.Key); err != nil {
+		fwd.logger.Fatal().Err(err).Msg("failed compiling key template")
+	}
+	go fwd.Run()
+	return fwd
+}
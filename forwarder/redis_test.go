@@ -0,0 +1,160 @@
+package forwarder
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/bangunindo/trap2json/snmp"
+	"github.com/go-json-experiment/json/jsontext"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRedis replies the commands of a redis client like a resp2 server, the
+// arguments of every XADD and PUBLISH are sent to the channel
+func fakeRedis(t *testing.T) (string, chan []string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	commands := make(chan []string, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveRedis(conn, commands)
+		}
+	}()
+	return "redis://" + ln.Addr().String(), commands
+}
+
+func serveRedis(conn net.Conn, commands chan []string) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		// *<count> and then $<size> followed by the argument for every argument
+		line, err := r.ReadString('\n')
+		if err != nil || !strings.HasPrefix(line, "*") {
+			return
+		}
+		count, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		args := make([]string, count)
+		for i := range args {
+			if line, err = r.ReadString('\n'); err != nil {
+				return
+			}
+			size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+			arg := make([]byte, size+2)
+			if _, err = io.ReadFull(r, arg); err != nil {
+				return
+			}
+			args[i] = string(arg[:size])
+		}
+		reply := "+OK\r\n"
+		switch strings.ToUpper(args[0]) {
+		case "HELLO":
+			// resp3 isn't supported
+			reply = "-ERR unknown command 'HELLO'\r\n"
+		case "CLIENT":
+			if !strings.EqualFold(args[1], "SETNAME") {
+				reply = "-ERR unknown subcommand\r\n"
+			}
+		case "XADD":
+			commands <- args
+			reply = "$3\r\n1-0\r\n"
+		case "PUBLISH":
+			commands <- args
+			reply = ":1\r\n"
+		}
+		if _, err = conn.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+func TestFlattenJSON(t *testing.T) {
+	fields, err := flattenJSON(nil, "", jsontext.Value(
+		`{"t":true,"b":{"c":[1.5,{"d":"x\"y"},null]},"a":"s","n":null,"e":{},"z":[]}`,
+	))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"a", "s",
+		"b.c.0", "1.5",
+		"b.c.1.d", `x"y`,
+		"t", "true",
+	}, fields)
+	_, err = flattenJSON(nil, "", jsontext.Value(`{"a":`))
+	assert.Error(t, err)
+}
+
+func TestRedisValues(t *testing.T) {
+	r := &Redis{Base: Base{config: Config{Redis: &RedisConfig{
+		Fields: RedisFieldsFlatten,
+		Field:  "message",
+	}}}}
+	m := &snmp.Message{Metadata: snmp.Metadata{MessageJSON: []byte(`{"a":{"b":"c"}}`)}}
+	values, err := r.values(m)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a.b", "c"}, values)
+	// a stream entry needs at least one field
+	for _, msg := range []string{`{}`, `{"a":null,"b":[]}`} {
+		m.Metadata.MessageJSON = []byte(msg)
+		values, err = r.values(m)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"message", msg}, values)
+	}
+	r.config.Redis.Fields = RedisFieldsJSON
+	m.Metadata.MessageJSON = []byte(`{"a":{"b":"c"}}`)
+	values, err = r.values(m)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"message", `{"a":{"b":"c"}}`}, values)
+}
+
+func TestRedisStream(t *testing.T) {
+	url, commands := fakeRedis(t)
+	fwd := startForwarder(t, Config{
+		Redis: &RedisConfig{
+			URL:    url,
+			Key:    "traps:{src_address}",
+			MaxLen: 1000,
+			Fields: RedisFieldsFlatten,
+		},
+	})
+	fwd.Send(testMessage())
+	args := receive(t, commands)
+	if !assert.GreaterOrEqual(t, len(args), 6) {
+		return
+	}
+	assert.Equal(t, []string{"xadd", "traps:10.0.0.1", "maxlen", "~", "1000", "*"}, args[:6])
+	fields := make(map[string]string)
+	for i := 6; i+1 < len(args); i += 2 {
+		fields[args[i]] = args[i+1]
+	}
+	assert.Equal(t, "10.0.0.1", fields["src_address"])
+	assert.Equal(t, "162", fields["src_port"])
+	assert.Equal(t, ".1.3.6.1.2.1.2.2.1.1.3", fields["values.0.oid"])
+	assert.Equal(t, "3", fields["values.0.value"])
+}
+
+func TestRedisPublish(t *testing.T) {
+	url, commands := fakeRedis(t)
+	fwd := startForwarder(t, Config{
+		Redis: &RedisConfig{
+			URL:  url,
+			Key:  "traps",
+			Mode: RedisPublish,
+		},
+	})
+	fwd.Send(testMessage())
+	args := receive(t, commands)
+	if assert.Len(t, args, 3) {
+		assert.Equal(t, []string{"publish", "traps"}, args[:2])
+		assert.Contains(t, args[2], `"src_address":"10.0.0.1"`)
+	}
+}
@@ -0,0 +1,312 @@
+package forwarder
+
+import (
+	"bytes"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bangunindo/trap2json/helper"
+	"github.com/bangunindo/trap2json/snmp"
+	"github.com/carlmjohnson/requests"
+	"github.com/go-json-experiment/json"
+	"github.com/go-json-experiment/json/jsontext"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// SplunkHECConfig sends traps to splunk http event collector. Every http option is
+// available, url is the base url of HEC and the method is always POST
+type SplunkHECConfig struct {
+	HTTPConfig `mapstructure:",squash"`
+	Token      string
+	// Host, Source and SourceType are templates
+	Host       string
+	Source     string
+	SourceType string `mapstructure:"sourcetype"`
+	Index      string
+	Ack        SplunkAckConfig
+}
+
+// SplunkAckConfig enables indexer acknowledgement, a batch is only
+// succeeded when splunk acknowledges that it's indexed
+type SplunkAckConfig struct {
+	Enable bool
+	// Channel identifies the client, a random uuid is used if it's empty
+	Channel      string
+	PollInterval helper.Duration `mapstructure:"poll_interval"`
+	// Timeout is how long to wait for the ack, the batch is retried after that
+	Timeout helper.Duration
+}
+
+func (c *SplunkHECConfig) validate() []helper.ConfigError {
+	errs := c.HTTPConfig.validate()
+	if c.Token == "" {
+		errs = append(errs, helper.ConfigError{Path: "token", Err: errors.New("token is required")})
+	}
+	templates := []struct{ path, template string }{
+		{"host", c.Host},
+		{"source", c.Source},
+		{"sourcetype", c.SourceType},
+	}
+	for _, t := range templates {
+		if _, err := compileTemplate(t.template); err != nil {
+			errs = append(errs, helper.ConfigError{Path: t.path, Err: err})
+		}
+	}
+	if c.Ack.Channel != "" {
+		if _, err := uuid.Parse(c.Ack.Channel); err != nil {
+			errs = append(errs, helper.ConfigError{Path: "ack.channel", Err: errors.Wrap(err, "channel must be a uuid")})
+		}
+	}
+	if c.Ack.PollInterval.Duration < 0 {
+		errs = append(errs, helper.ConfigError{Path: "ack.poll_interval", Err: errors.New("poll_interval can't be negative")})
+	}
+	if c.Ack.Timeout.Duration < 0 {
+		errs = append(errs, helper.ConfigError{Path: "ack.timeout", Err: errors.New("timeout can't be negative")})
+	}
+	return errs
+}
+
+type splunkEvent struct {
+	// Time is epoch seconds with milliseconds
+	Time       float64        `json:"time"`
+	Host       string         `json:"host,omitempty"`
+	Source     string         `json:"source,omitempty"`
+	SourceType string         `json:"sourcetype,omitempty"`
+	Index      string         `json:"index,omitempty"`
+	Event      jsontext.Value `json:"event"`
+}
+
+type SplunkHEC struct {
+	*HTTP
+
+	conf       *SplunkHECConfig
+	host       *exprTemplate
+	source     *exprTemplate
+	sourceType *exprTemplate
+
+	// acks are the batches that wait for indexer acknowledgement by HEC ack url
+	ackMutex sync.Mutex
+	acks     map[string]*splunkAcks
+	ackStop  chan struct{}
+	ackDone  chan struct{}
+}
+
+// event wraps the message json in HEC envelope
+func (s *SplunkHEC) event(m *snmp.Message) ([]byte, error) {
+	event := splunkEvent{
+		Time:  float64(m.Payload.Time.UnixMilli()) / 1000,
+		Index: s.conf.Index,
+		Event: m.Metadata.MessageJSON,
+	}
+	var err error
+	if event.Host, err = s.host.render(m.Payload, nil); err != nil {
+		return nil, errors.Wrap(err, "failed rendering host")
+	}
+	if event.Source, err = s.source.render(m.Payload, nil); err != nil {
+		return nil, errors.Wrap(err, "failed rendering source")
+	}
+	if event.SourceType, err = s.sourceType.render(m.Payload, nil); err != nil {
+		return nil, errors.Wrap(err, "failed rendering sourcetype")
+	}
+	return json.Marshal(event)
+}
+
+// splunkAck is a batch that waits for its indexer acknowledgement
+type splunkAck struct {
+	batch    []httpItem
+	keys     [][]byte
+	deadline time.Time
+}
+
+// splunkAcks are the pending batches of a HEC url by their ackId, the
+// ackId is only unique within the channel of a HEC instance
+type splunkAcks struct {
+	builder *requests.Builder
+	batches map[int64]splunkAck
+}
+
+// acknowledge adds the batch to the pending acks, pollAcks finishes it. A batch that
+// can't be acknowledged is counted as succeeded, HEC already accepted its events
+// and retrying them would index them twice
+func (s *SplunkHEC) acknowledge(builder *requests.Builder, batch []httpItem, response []byte) {
+	var res struct {
+		AckID *int64 `json:"ackId"`
+	}
+	var ackURL *url.URL
+	err := errors.Wrap(json.Unmarshal(response, &res), "failed parsing HEC response")
+	if err == nil && res.AckID == nil {
+		err = errors.New("HEC response has no ackId, indexer acknowledgement is not enabled for the token")
+	}
+	if err == nil {
+		ackURL, err = builder.Clone().Path("ack").URL()
+		err = errors.Wrap(err, "invalid HEC ack url")
+	}
+	if err != nil {
+		s.logger.Warn().Err(err).Int("batch_size", len(batch)).Msg("HEC accepted the batch but it can't be acknowledged, counting it as succeeded")
+		s.ctrSucceeded.Add(float64(len(batch)))
+		return
+	}
+	keys := make([][]byte, len(batch))
+	for i, item := range batch {
+		keys[i] = s.holdAck(item.m)
+	}
+	s.ackMutex.Lock()
+	defer s.ackMutex.Unlock()
+	acks, ok := s.acks[ackURL.String()]
+	if !ok {
+		acks = &splunkAcks{
+			builder: builder.Clone().Path("ack").ContentType("application/json"),
+			batches: make(map[int64]splunkAck),
+		}
+		s.acks[ackURL.String()] = acks
+	}
+	acks.batches[*res.AckID] = splunkAck{
+		batch:    batch,
+		keys:     keys,
+		deadline: time.Now().Add(s.conf.Ack.Timeout.Duration),
+	}
+}
+
+// pendingAcks counts the batches that wait for their ack
+func (s *SplunkHEC) pendingAcks() int {
+	s.ackMutex.Lock()
+	defer s.ackMutex.Unlock()
+	pending := 0
+	for _, acks := range s.acks {
+		pending += len(acks.batches)
+	}
+	return pending
+}
+
+// pollAcks checks every pending ackId of a HEC url in a single request. Acknowledged
+// batches are succeeded, the ones that aren't acknowledged before ack.timeout are retried
+func (s *SplunkHEC) pollAcks() {
+	s.ackMutex.Lock()
+	pending := make(map[*splunkAcks][]int64, len(s.acks))
+	for _, acks := range s.acks {
+		for id := range acks.batches {
+			pending[acks] = append(pending[acks], id)
+		}
+	}
+	s.ackMutex.Unlock()
+	for acks, ids := range pending {
+		var res struct {
+			Acks map[string]bool `json:"acks"`
+		}
+		body, err := json.Marshal(map[string][]int64{"acks": ids})
+		if err == nil {
+			var buf bytes.Buffer
+			if err = s.fetch(acks.builder.Clone().ToBytesBuffer(&buf), body); err == nil {
+				err = json.Unmarshal(buf.Bytes(), &res)
+			}
+		}
+		if err != nil {
+			s.logger.Debug().Err(err).Int("acks", len(ids)).Msg("failed polling HEC acks")
+		}
+		now := time.Now()
+		var acked, expired []splunkAck
+		s.ackMutex.Lock()
+		for _, id := range ids {
+			batch := acks.batches[id]
+			if res.Acks[strconv.FormatInt(id, 10)] {
+				acked = append(acked, batch)
+			} else if now.After(batch.deadline) {
+				expired = append(expired, batch)
+			} else {
+				continue
+			}
+			delete(acks.batches, id)
+		}
+		s.ackMutex.Unlock()
+		for _, batch := range acked {
+			s.ctrSucceeded.Add(float64(len(batch.batch)))
+			for _, key := range batch.keys {
+				s.queue.Ack(key)
+			}
+		}
+		for _, batch := range expired {
+			// the events may be indexed later, but a duplicate is better than a lost trap
+			err := errors.Errorf("HEC ack is not acknowledged after %s", s.conf.Ack.Timeout.Duration)
+			for i, item := range batch.batch {
+				s.Retry(item.m, err)
+				s.queue.Ack(batch.keys[i])
+			}
+		}
+	}
+}
+
+// runAcks polls the pending acks every ack.poll_interval, it returns once
+// ackStop is closed and every pending batch is finished
+func (s *SplunkHEC) runAcks() {
+	defer close(s.ackDone)
+	ticker := time.NewTicker(s.conf.Ack.PollInterval.Duration)
+	defer ticker.Stop()
+	stop := s.ackStop
+	for {
+		select {
+		case <-ticker.C:
+			s.pollAcks()
+		case <-stop:
+			stop = nil
+		}
+		if stop == nil && s.pendingAcks() == 0 {
+			return
+		}
+	}
+}
+
+func NewSplunkHEC(c Config, idx int) Forwarder {
+	conf := c.SplunkHEC
+	httpConf := conf.HTTPConfig
+	httpConf.URL = strings.TrimRight(conf.URL, "/") + "/services/collector/event"
+	httpConf.Method = HTTPMethodPost
+	httpConf.MethodTemplate = ""
+	// HEC takes events one after another
+	httpConf.BatchFormat = HTTPBatchNDJSON
+	httpConf.Headers = make(map[string][]string, len(conf.Headers)+2)
+	for key, values := range conf.Headers {
+		httpConf.Headers[key] = values
+	}
+	httpConf.Headers["Authorization"] = []string{"Splunk " + conf.Token}
+	if conf.Ack.Enable {
+		channel := conf.Ack.Channel
+		if channel == "" {
+			channel = uuid.NewString()
+		}
+		httpConf.Headers["X-Splunk-Request-Channel"] = []string{channel}
+	}
+	fwd := &SplunkHEC{
+		HTTP: newHTTP(c, idx, &httpConf),
+		conf: conf,
+	}
+	var err error
+	if fwd.host, err = compileTemplate(conf.Host); err != nil {
+		fwd.logger.Fatal().Err(err).Msg("failed compiling host template")
+	}
+	if fwd.source, err = compileTemplate(conf.Source); err != nil {
+		fwd.logger.Fatal().Err(err).Msg("failed compiling source template")
+	}
+	if fwd.sourceType, err = compileTemplate(conf.SourceType); err != nil {
+		fwd.logger.Fatal().Err(err).Msg("failed compiling sourcetype template")
+	}
+	fwd.encode = fwd.event
+	if conf.Ack.Enable {
+		fwd.acks = make(map[string]*splunkAcks)
+		fwd.ackStop = make(chan struct{})
+		fwd.ackDone = make(chan struct{})
+		fwd.HTTP.acknowledge = fwd.acknowledge
+		// the pending batches are finished before the forwarder exits
+		fwd.HTTP.afterConsume = func() {
+			close(fwd.ackStop)
+			<-fwd.ackDone
+		}
+		go fwd.runAcks()
+	}
+	fwd.alwaysBatch = true
+	go fwd.Run()
+	return fwd
+}
@@ -0,0 +1,239 @@
+package forwarder
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bangunindo/trap2json/helper"
+	"github.com/go-json-experiment/json"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplunkHEC(t *testing.T) {
+	url, requests := captureRequests(t, http.StatusOK)
+	fwd := startForwarder(t, Config{
+		SplunkHEC: &SplunkHECConfig{
+			HTTPConfig: HTTPConfig{URL: url + "/", BatchSize: 1},
+			Token:      "token",
+			Host:       "{agent_address}",
+			Source:     "trap2json",
+			SourceType: "snmp:{enterprise_mib_name}",
+			Index:      "traps",
+		},
+	})
+	fwd.Send(testMessage())
+	req := receive(t, requests)
+	assert.Equal(t, "/services/collector/event", req.uri)
+	assert.Equal(t, "Splunk token", req.header.Get("Authorization"))
+	assert.Empty(t, req.header.Get("X-Splunk-Request-Channel"))
+	var event struct {
+		splunkEvent
+		Event struct {
+			SrcAddress string `json:"src_address"`
+		} `json:"event"`
+	}
+	assert.NoError(t, json.Unmarshal(req.body, &event, json.RejectUnknownMembers(false)))
+	assert.Equal(t, 1704164645.678, event.Time)
+	assert.Equal(t, "10.0.0.2", event.Host)
+	assert.Equal(t, "trap2json", event.Source)
+	assert.Equal(t, "snmp:IF-MIB::linkDown", event.SourceType)
+	assert.Equal(t, "traps", event.Index)
+	assert.Equal(t, "10.0.0.1", event.Event.SrcAddress)
+}
+
+func TestSplunkHECAckPolling(t *testing.T) {
+	var polls atomic.Int64
+	channels := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		channels <- r.Header.Get("X-Splunk-Request-Channel")
+		switch r.URL.Path {
+		case "/services/collector/event":
+			_, _ = w.Write([]byte(`{"text":"Success","code":0,"ackId":7}`))
+		case "/services/collector/ack":
+			var req struct {
+				Acks []int `json:"acks"`
+			}
+			assert.NoError(t, json.UnmarshalRead(r.Body, &req))
+			assert.Equal(t, []int{7}, req.Acks)
+			// acknowledged on the second poll
+			_ = json.MarshalWrite(w, map[string]any{"acks": map[string]bool{"7": polls.Add(1) > 1}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	channel := "0b6bd0a5-4b70-4ba4-8c4a-31f2b1f37a13"
+	fwd := startForwarder(t, Config{
+		SplunkHEC: &SplunkHECConfig{
+			HTTPConfig: HTTPConfig{URL: srv.URL, BatchSize: 1},
+			Token:      "token",
+			Ack: SplunkAckConfig{
+				Enable:       true,
+				Channel:      channel,
+				PollInterval: helper.Duration{Duration: 10 * time.Millisecond},
+				Timeout:      helper.Duration{Duration: time.Second},
+			},
+		},
+	})
+	s := fwd.(*SplunkHEC)
+	succeeded := testutil.ToFloat64(s.ctrSucceeded)
+	fwd.Send(testMessage())
+	for range 3 {
+		assert.Equal(t, channel, receive(t, channels))
+	}
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(s.ctrSucceeded)-succeeded == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(2), polls.Load())
+}
+
+func TestSplunkHECAck(t *testing.T) {
+	var mutex sync.Mutex
+	var ports []int
+	events := make(chan int, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Splunk token", r.Header.Get("Authorization"))
+		mutex.Lock()
+		defer mutex.Unlock()
+		switch r.URL.Path {
+		case "/services/collector/event":
+			var event struct {
+				Event struct {
+					SrcPort int `json:"src_port"`
+				} `json:"event"`
+			}
+			assert.NoError(t, json.UnmarshalRead(r.Body, &event, json.RejectUnknownMembers(false)))
+			ports = append(ports, event.Event.SrcPort)
+			events <- event.Event.SrcPort
+			_, _ = w.Write([]byte(`{"text":"Success","code":0,"ackId":` + strconv.Itoa(len(ports)-1) + `}`))
+		case "/services/collector/ack":
+			var req struct {
+				Acks []int `json:"acks"`
+			}
+			assert.NoError(t, json.UnmarshalRead(r.Body, &req))
+			res := make(map[string]bool)
+			for _, id := range req.Acks {
+				// the first batch is only acked once both batches are pending, the
+				// second one is never acked and its retry is acked right away
+				res[strconv.Itoa(id)] = id == 0 && len(req.Acks) > 1 || id > 0 && ports[id] == 2 && id != 1
+			}
+			_ = json.MarshalWrite(w, map[string]any{"acks": res})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	fwd := startForwarder(t, Config{
+		AutoRetry: helper.AutoRetry{
+			Enable:     true,
+			MaxRetries: 1,
+			MinDelay:   helper.Duration{Duration: 10 * time.Millisecond},
+			MaxDelay:   helper.Duration{Duration: 10 * time.Millisecond},
+		},
+		SplunkHEC: &SplunkHECConfig{
+			HTTPConfig: HTTPConfig{URL: srv.URL, BatchSize: 1},
+			Token:      "token",
+			Ack: SplunkAckConfig{
+				Enable:       true,
+				PollInterval: helper.Duration{Duration: 20 * time.Millisecond},
+				Timeout:      helper.Duration{Duration: 200 * time.Millisecond},
+			},
+		},
+	})
+	s := fwd.(*SplunkHEC)
+	succeeded := testutil.ToFloat64(s.ctrSucceeded)
+	for port := 1; port <= 2; port++ {
+		m := testMessage()
+		m.Payload.SrcPort = port
+		fwd.Send(m)
+	}
+	// the worker doesn't wait for the first ack before sending the second batch
+	assert.Equal(t, 1, receive(t, events))
+	assert.Equal(t, 2, receive(t, events))
+	// only the batch that isn't acknowledged is retried
+	assert.Equal(t, 2, receive(t, events))
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(s.ctrSucceeded)-succeeded == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Zero(t, s.pendingAcks())
+	assert.Len(t, events, 0)
+}
+
+func TestSplunkHECSuccessCondition(t *testing.T) {
+	acks := make(chan []int, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/services/collector/event":
+			_, _ = w.Write([]byte(`{"text":"Success","code":0,"ackId":3}`))
+		case "/services/collector/ack":
+			var req struct {
+				Acks []int `json:"acks"`
+			}
+			assert.NoError(t, json.UnmarshalRead(r.Body, &req))
+			select {
+			case acks <- req.Acks:
+			default:
+			}
+			_ = json.MarshalWrite(w, map[string]any{"acks": map[string]bool{"3": true}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+	fwd := startForwarder(t, Config{
+		SplunkHEC: &SplunkHECConfig{
+			HTTPConfig: HTTPConfig{
+				URL:       srv.URL,
+				BatchSize: 1,
+				Response:  HTTPResponseConfig{SuccessCondition: "body != nil"},
+			},
+			Token: "token",
+			Ack: SplunkAckConfig{
+				Enable:       true,
+				PollInterval: helper.Duration{Duration: 10 * time.Millisecond},
+				Timeout:      helper.Duration{Duration: time.Second},
+			},
+		},
+	})
+	s := fwd.(*SplunkHEC)
+	succeeded := testutil.ToFloat64(s.ctrSucceeded)
+	fwd.Send(testMessage())
+	// the ack id is still read from the body after success_condition
+	assert.Equal(t, []int{3}, receive(t, acks))
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(s.ctrSucceeded)-succeeded == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSplunkHECWithoutAckID(t *testing.T) {
+	url, requests := captureRequests(t, http.StatusOK)
+	fwd := startForwarder(t, Config{
+		SplunkHEC: &SplunkHECConfig{
+			HTTPConfig: HTTPConfig{
+				URL:          url,
+				BatchSize:    2,
+				BatchTimeout: helper.Duration{Duration: 50 * time.Millisecond},
+				BatchRetry:   HTTPBatchRetrySplit,
+			},
+			Token: "token",
+			Ack:   SplunkAckConfig{Enable: true},
+		},
+	})
+	s := fwd.(*SplunkHEC)
+	succeeded := testutil.ToFloat64(s.ctrSucceeded)
+	fwd.Send(testMessage())
+	fwd.Send(testMessage())
+	assert.Equal(t, "/services/collector/event", receive(t, requests).uri)
+	// the accepted batch isn't split or retried
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(s.ctrSucceeded)-succeeded == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Zero(t, s.pendingAcks())
+	assert.Len(t, requests, 0)
+}
@@ -0,0 +1,520 @@
+package forwarder
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bangunindo/trap2json/helper"
+	"github.com/bangunindo/trap2json/snmp"
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+	"github.com/pkg/errors"
+)
+
+type SyslogNetwork int
+
+const (
+	SyslogUDP SyslogNetwork = iota
+	SyslogTCP
+	SyslogTLS
+)
+
+func (s *SyslogNetwork) String() string {
+	switch *s {
+	case SyslogUDP:
+		return "udp"
+	case SyslogTCP:
+		return "tcp"
+	case SyslogTLS:
+		return "tls"
+	default:
+		return ""
+	}
+}
+
+func (s *SyslogNetwork) UnmarshalText(text []byte) error {
+	switch strings.ToLower(string(text)) {
+	case "", "udp":
+		*s = SyslogUDP
+	case "tcp":
+		*s = SyslogTCP
+	case "tls":
+		*s = SyslogTLS
+	default:
+		return errors.Errorf("unsupported SyslogNetwork: %s", string(text))
+	}
+	return nil
+}
+
+type SyslogFormat int
+
+const (
+	SyslogRFC5424 SyslogFormat = iota
+	// SyslogRFC3164 is the legacy BSD syslog format
+	SyslogRFC3164
+)
+
+func (s *SyslogFormat) String() string {
+	switch *s {
+	case SyslogRFC5424:
+		return "rfc5424"
+	case SyslogRFC3164:
+		return "rfc3164"
+	default:
+		return ""
+	}
+}
+
+func (s *SyslogFormat) UnmarshalText(text []byte) error {
+	switch strings.ToLower(string(text)) {
+	case "", "rfc5424":
+		*s = SyslogRFC5424
+	case "rfc3164":
+		*s = SyslogRFC3164
+	default:
+		return errors.Errorf("unsupported SyslogFormat: %s", string(text))
+	}
+	return nil
+}
+
+// SyslogFraming separates the messages on tcp and tls, it's not used on udp
+type SyslogFraming int
+
+const (
+	// SyslogOctetCounting prefixes every message with its length, see RFC 6587
+	SyslogOctetCounting SyslogFraming = iota
+	// SyslogNewline terminates every message with a newline, newlines in the message are replaced with space
+	SyslogNewline
+)
+
+func (s *SyslogFraming) String() string {
+	switch *s {
+	case SyslogOctetCounting:
+		return "octet_counting"
+	case SyslogNewline:
+		return "newline"
+	default:
+		return ""
+	}
+}
+
+func (s *SyslogFraming) UnmarshalText(text []byte) error {
+	switch strings.ToLower(string(text)) {
+	case "", "octet_counting":
+		*s = SyslogOctetCounting
+	case "newline":
+		*s = SyslogNewline
+	default:
+		return errors.Errorf("unsupported SyslogFraming: %s", string(text))
+	}
+	return nil
+}
+
+type SyslogBody int
+
+const (
+	// SyslogBodyJSON sends the message json as the syslog message
+	SyslogBodyJSON SyslogBody = iota
+	// SyslogBodyStructuredData renders the varbinds as structured data
+	SyslogBodyStructuredData
+)
+
+func (s *SyslogBody) String() string {
+	switch *s {
+	case SyslogBodyJSON:
+		return "json"
+	case SyslogBodyStructuredData:
+		return "structured_data"
+	default:
+		return ""
+	}
+}
+
+func (s *SyslogBody) UnmarshalText(text []byte) error {
+	switch strings.ToLower(string(text)) {
+	case "", "json":
+		*s = SyslogBodyJSON
+	case "structured_data":
+		*s = SyslogBodyStructuredData
+	default:
+		return errors.Errorf("unsupported SyslogBody: %s", string(text))
+	}
+	return nil
+}
+
+type SyslogConfig struct {
+	Network SyslogNetwork
+	// Address is host:port of the syslog server
+	Address string
+	Tls     *Tls
+	Format  SyslogFormat
+	Framing SyslogFraming
+	// Facility, Severity, Hostname and AppName are expressions. Facility and severity
+	// can be the number or the name, e.g. local0 and warning
+	Facility string
+	Severity string
+	Hostname string
+	AppName  string `mapstructure:"app_name"`
+	Body     SyslogBody
+	// SDID is the SD-ID of structured_data body, it should have your private enterprise number
+	SDID    string `mapstructure:"sd_id"`
+	Timeout helper.Duration
+}
+
+func (c *SyslogConfig) validate() []helper.ConfigError {
+	var errs []helper.ConfigError
+	if c.Address == "" {
+		errs = append(errs, helper.ConfigError{Path: "address", Err: errors.New("address is required")})
+	} else if _, _, err := net.SplitHostPort(c.Address); err != nil {
+		errs = append(errs, helper.ConfigError{Path: "address", Err: err})
+	}
+	expressions := []struct{ path, expression string }{
+		{"facility", c.Facility},
+		{"severity", c.Severity},
+		{"hostname", c.Hostname},
+		{"app_name", c.AppName},
+	}
+	for _, e := range expressions {
+		if e.expression == "" {
+			continue
+		}
+		if _, err := compileExpr(e.expression); err != nil {
+			errs = append(errs, helper.ConfigError{Path: e.path, Err: err})
+		}
+	}
+	if c.SDID != "" && (len(c.SDID) > 32 || strings.ContainsAny(c.SDID, " =]\"")) {
+		errs = append(errs, helper.ConfigError{Path: "sd_id", Err: errors.New("sd_id must be at most 32 characters without space, =, ] and \"")})
+	}
+	return errs
+}
+
+var syslogFacilities = map[string]int{
+	"kern":         0,
+	"user":         1,
+	"mail":         2,
+	"daemon":       3,
+	"auth":         4,
+	"syslog":       5,
+	"lpr":          6,
+	"news":         7,
+	"uucp":         8,
+	"cron":         9,
+	"authpriv":     10,
+	"ftp":          11,
+	"ntp":          12,
+	"security":     13,
+	"console":      14,
+	"solaris-cron": 15,
+	"local0":       16,
+	"local1":       17,
+	"local2":       18,
+	"local3":       19,
+	"local4":       20,
+	"local5":       21,
+	"local6":       22,
+	"local7":       23,
+}
+
+var syslogSeverities = map[string]int{
+	"emerg":         0,
+	"emergency":     0,
+	"alert":         1,
+	"crit":          2,
+	"critical":      2,
+	"err":           3,
+	"error":         3,
+	"warning":       4,
+	"warn":          4,
+	"notice":        5,
+	"info":          6,
+	"informational": 6,
+	"debug":         7,
+}
+
+// syslogCode converts the result of facility or severity expression, which is the number or its name.
+// Pointers are dereferenced, so fields like trap_type can be used as is
+func syslogCode(res any, names map[string]int, maxCode int) (int, error) {
+	v := reflect.ValueOf(res)
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return 0, errors.New("value is nil")
+		}
+		v = v.Elem()
+	}
+	var code int
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		code = int(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		code = int(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		code = int(v.Float())
+	case reflect.String:
+		var ok bool
+		if code, ok = names[strings.ToLower(v.String())]; !ok {
+			var err error
+			if code, err = strconv.Atoi(v.String()); err != nil {
+				return 0, errors.Errorf("unknown name %q", v.String())
+			}
+		}
+	default:
+		return 0, errors.Errorf("unsupported type %T", res)
+	}
+	if code < 0 || code > maxCode {
+		return 0, errors.Errorf("%d is out of range", code)
+	}
+	return code, nil
+}
+
+// syslogHeaderField replaces the characters that aren't allowed in a header field and
+// truncates it to maxLen. The nil value is empty
+func syslogHeaderField(res any, maxLen int) string {
+	s := []byte(templateValue(res))
+	for i, c := range s {
+		if c < 33 || c > 126 {
+			s[i] = '_'
+		}
+	}
+	if len(s) > maxLen {
+		s = s[:maxLen]
+	}
+	return string(s)
+}
+
+var sdParamEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// structuredData renders the varbinds as a single SD-ELEMENT, every
+// varbind is an oid, name and value param in that order
+func structuredData(id string, p *snmp.Payload) string {
+	var sb strings.Builder
+	sb.WriteByte('[')
+	sb.WriteString(id)
+	param := func(name, value string) {
+		sb.WriteByte(' ')
+		sb.WriteString(name)
+		sb.WriteString(`="`)
+		sb.WriteString(sdParamEscaper.Replace(value))
+		sb.WriteByte('"')
+	}
+	if p.EnterpriseOID != nil {
+		param("enterprise", *p.EnterpriseOID)
+	}
+	for _, v := range p.Values {
+		param("oid", v.OID)
+		param("name", v.MIBName)
+		param("value", fmt.Sprint(v.Value))
+	}
+	sb.WriteByte(']')
+	return sb.String()
+}
+
+type Syslog struct {
+	Base
+
+	conf     *SyslogConfig
+	facility *vm.Program
+	severity *vm.Program
+	hostname *vm.Program
+	appName  *vm.Program
+	location *time.Location
+	tlsConf  *tls.Config
+
+	// conn is shared by the workers, it's dialed again after a failed write
+	connMutex sync.Mutex
+	conn      net.Conn
+}
+
+// message formats the trap without framing
+func (s *Syslog) message(m *snmp.Message) ([]byte, error) {
+	res, err := expr.Run(s.facility, *m.Payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed evaluating facility")
+	}
+	facility, err := syslogCode(res, syslogFacilities, 23)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid facility")
+	}
+	if res, err = expr.Run(s.severity, *m.Payload); err != nil {
+		return nil, errors.Wrap(err, "failed evaluating severity")
+	}
+	severity, err := syslogCode(res, syslogSeverities, 7)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid severity")
+	}
+	if res, err = expr.Run(s.hostname, *m.Payload); err != nil {
+		return nil, errors.Wrap(err, "failed evaluating hostname")
+	}
+	hostname := syslogHeaderField(res, 255)
+	appName, err := expr.Run(s.appName, *m.Payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed evaluating app_name")
+	}
+	t := m.Payload.Time
+	if s.location != nil {
+		t = t.In(s.location)
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<%d>", facility*8+severity)
+	if s.conf.Format == SyslogRFC3164 {
+		if hostname == "" {
+			hostname = "-"
+		}
+		// the tag is alphanumeric
+		tag := []byte(syslogHeaderField(appName, 32))
+		for i, c := range tag {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+				tag[i] = '_'
+			}
+		}
+		fmt.Fprintf(&buf, "%s %s %s: ", t.Format(time.Stamp), hostname, tag)
+		if s.conf.Body == SyslogBodyStructuredData {
+			buf.WriteString(structuredData(s.conf.SDID, m.Payload))
+		} else {
+			buf.Write(m.Metadata.MessageJSON)
+		}
+		return buf.Bytes(), nil
+	}
+	header := []string{
+		"1",
+		t.Format("2006-01-02T15:04:05.000000Z07:00"),
+		hostname,
+		syslogHeaderField(appName, 48),
+		// PROCID and MSGID
+		"",
+		"",
+	}
+	for _, field := range header {
+		if field == "" {
+			field = "-"
+		}
+		buf.WriteString(field)
+		buf.WriteByte(' ')
+	}
+	if s.conf.Body == SyslogBodyStructuredData {
+		buf.WriteString(structuredData(s.conf.SDID, m.Payload))
+	} else {
+		buf.WriteString("- ")
+		buf.Write(m.Metadata.MessageJSON)
+	}
+	return buf.Bytes(), nil
+}
+
+// frame adds the framing of tcp and tls
+func (s *Syslog) frame(msg []byte) []byte {
+	if s.conf.Network == SyslogUDP {
+		return msg
+	}
+	if s.conf.Framing == SyslogNewline {
+		msg = bytes.ReplaceAll(msg, []byte{'\n'}, []byte{' '})
+		return append(msg, '\n')
+	}
+	return append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+}
+
+func (s *Syslog) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: s.conf.Timeout.Duration}
+	switch s.conf.Network {
+	case SyslogTCP:
+		return dialer.Dial("tcp", s.conf.Address)
+	case SyslogTLS:
+		return tls.DialWithDialer(dialer, "tcp", s.conf.Address, s.tlsConf)
+	default:
+		return dialer.Dial("udp", s.conf.Address)
+	}
+}
+
+func (s *Syslog) write(msg []byte) error {
+	s.connMutex.Lock()
+	defer s.connMutex.Unlock()
+	if s.conn == nil {
+		conn, err := s.dial()
+		if err != nil {
+			return errors.Wrap(err, "failed connecting to syslog server")
+		}
+		s.conn = conn
+	}
+	_ = s.conn.SetWriteDeadline(time.Now().Add(s.conf.Timeout.Duration))
+	if _, err := s.conn.Write(msg); err != nil {
+		_ = s.conn.Close()
+		s.conn = nil
+		return errors.Wrap(err, "failed writing to syslog server")
+	}
+	return nil
+}
+
+func (s *Syslog) Run() {
+	defer s.cancel()
+	defer s.logger.Info().Msg("forwarder exited")
+	s.logger.Info().Msg("starting forwarder")
+
+	if s.conf.Network == SyslogTLS {
+		s.tlsConf = &tls.Config{}
+		if s.conf.Tls != nil {
+			var err error
+			if s.tlsConf, err = s.conf.Tls.config(); err != nil {
+				s.logger.Fatal().Err(err).Msg("failed setting up tls")
+			}
+		}
+		if host, _, err := net.SplitHostPort(s.conf.Address); err == nil {
+			s.tlsConf.ServerName = host
+		}
+	}
+	defer func() {
+		if s.conn != nil {
+			_ = s.conn.Close()
+		}
+	}()
+
+	s.consume(func(m *snmp.Message) {
+		m.Compile(s.CompilerConf)
+		if m.Metadata.Skip {
+			s.ctrFiltered.Inc()
+			return
+		}
+		msg, err := s.message(m)
+		if err != nil {
+			s.Retry(m, permanent(err))
+			return
+		}
+		if err = s.write(s.frame(msg)); err != nil {
+			s.Retry(m, err)
+		} else {
+			s.ctrSucceeded.Inc()
+		}
+	})
+}
+
+func NewSyslog(c Config, idx int) Forwarder {
+	fwd := &Syslog{
+		Base: NewBase(c, idx),
+		conf: c.Syslog,
+	}
+	var err error
+	if fwd.facility, err = compileExpr(fwd.conf.Facility); err != nil {
+		fwd.logger.Fatal().Err(err).Msg("failed compiling facility expression")
+	}
+	if fwd.severity, err = compileExpr(fwd.conf.Severity); err != nil {
+		fwd.logger.Fatal().Err(err).Msg("failed compiling severity expression")
+	}
+	if fwd.hostname, err = compileExpr(fwd.conf.Hostname); err != nil {
+		fwd.logger.Fatal().Err(err).Msg("failed compiling hostname expression")
+	}
+	if fwd.appName, err = compileExpr(fwd.conf.AppName); err != nil {
+		fwd.logger.Fatal().Err(err).Msg("failed compiling app_name expression")
+	}
+	if c.TimeAsTimezone != "" {
+		if fwd.location, err = time.LoadLocation(c.TimeAsTimezone); err != nil {
+			fwd.logger.Fatal().Err(err).Msg("failed loading time_as_timezone")
+		}
+	}
+	go fwd.Run()
+	return fwd
+}
@@ -0,0 +1,156 @@
+package forwarder
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyslogCode(t *testing.T) {
+	trapType := int64(2)
+	var nilTrapType *int64
+	cases := []struct {
+		res      any
+		expected int
+	}{
+		{3, 3},
+		{int64(4), 4},
+		{&trapType, 2},
+		{float64(5), 5},
+		{"Warning", 4},
+		{"crit", 2},
+		{"6", 6},
+	}
+	for _, c := range cases {
+		code, err := syslogCode(c.res, syslogSeverities, 7)
+		assert.NoError(t, err, c.res)
+		assert.Equal(t, c.expected, code, c.res)
+	}
+	code, err := syslogCode("LOCAL7", syslogFacilities, 23)
+	assert.NoError(t, err)
+	assert.Equal(t, 23, code)
+	for _, res := range []any{nil, nilTrapType, 8, -1, "loud", true} {
+		_, err = syslogCode(res, syslogSeverities, 7)
+		assert.Error(t, err, res)
+	}
+}
+
+// listenSyslogUDP returns the address of a udp listener and its received datagrams
+func listenSyslogUDP(t *testing.T) (string, chan string) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	messages := make(chan string, 10)
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			messages <- string(buf[:n])
+		}
+	}()
+	return conn.LocalAddr().String(), messages
+}
+
+// listenSyslogTCP returns the address of a tcp listener and the stream of its first connection
+func listenSyslogTCP(t *testing.T) (string, chan *bufio.Reader) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	conns := make(chan *bufio.Reader, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { _ = conn.Close() })
+		conns <- bufio.NewReader(conn)
+	}()
+	return ln.Addr().String(), conns
+}
+
+func TestSyslogRFC5424(t *testing.T) {
+	addr, messages := listenSyslogUDP(t)
+	fwd := startForwarder(t, Config{
+		Syslog: &SyslogConfig{
+			Address:  addr,
+			Severity: "trap_type",
+		},
+	})
+	fwd.Send(testMessage())
+	msg := receive(t, messages)
+	// local0 and critical
+	header := "<130>1 2024-01-02T03:04:05.678000Z 10.0.0.2 trap2json - - - "
+	if assert.True(t, strings.HasPrefix(msg, header), msg) {
+		assert.Contains(t, strings.TrimPrefix(msg, header), `"src_address":"10.0.0.1"`)
+	}
+}
+
+func TestSyslogRFC3164OctetCounting(t *testing.T) {
+	addr, conns := listenSyslogTCP(t)
+	fwd := startForwarder(t, Config{
+		Syslog: &SyslogConfig{
+			Network:  SyslogTCP,
+			Address:  addr,
+			Format:   SyslogRFC3164,
+			Facility: `"daemon"`,
+			Severity: `"warning"`,
+			AppName:  `"trap-2-json"`,
+		},
+	})
+	fwd.Send(testMessage())
+	fwd.Send(testMessage())
+	r := receive(t, conns)
+	for range 2 {
+		length, err := r.ReadString(' ')
+		if !assert.NoError(t, err) {
+			return
+		}
+		n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+		if !assert.NoError(t, err) {
+			return
+		}
+		msg := make([]byte, n)
+		if _, err = io.ReadFull(r, msg); !assert.NoError(t, err) {
+			return
+		}
+		header := "<28>Jan  2 03:04:05 10.0.0.2 trap_2_json: "
+		if assert.True(t, strings.HasPrefix(string(msg), header), string(msg)) {
+			body := strings.TrimPrefix(string(msg), header)
+			assert.True(t, strings.HasPrefix(body, "{") && strings.HasSuffix(body, "}"), body)
+		}
+	}
+}
+
+func TestSyslogNewlineStructuredData(t *testing.T) {
+	addr, conns := listenSyslogTCP(t)
+	fwd := startForwarder(t, Config{
+		Syslog: &SyslogConfig{
+			Network:  SyslogTCP,
+			Address:  addr,
+			Framing:  SyslogNewline,
+			Body:     SyslogBodyStructuredData,
+			Hostname: "src_address",
+		},
+	})
+	fwd.Send(testMessage())
+	line, err := receive(t, conns).ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(
+		t,
+		"<133>1 2024-01-02T03:04:05.678000Z 10.0.0.1 trap2json - - "+
+			`[trap2json@32473 oid=".1.3.6.1.2.1.2.2.1.1.3" name="IF-MIB::ifIndex.3" value="3"]`+"\n",
+		line,
+	)
+}
@@ -0,0 +1,125 @@
+package forwarder
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/bangunindo/trap2json/snmp"
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+	"github.com/pkg/errors"
+)
+
+// exprTemplate is a string with expressions in curly braces, e.g. /devices/{src_address}/events.
+// The expressions use the same variables as json_format and their results are formatted with fmt.Sprint,
+// pointers are dereferenced and nil is empty. {{ and }} outside the expressions are literal braces
+type exprTemplate struct {
+	// literals surround the programs, there's always one more literal than programs
+	literals []string
+	programs []*vm.Program
+}
+
+func compileTemplate(s string) (*exprTemplate, error) {
+	opts := []expr.Option{expr.Env(snmp.Payload{})}
+	opts = append(opts, snmp.Functions...)
+	t := new(exprTemplate)
+	var literal strings.Builder
+	for i := 0; i < len(s); i++ {
+		if (s[i] == '{' || s[i] == '}') && i+1 < len(s) && s[i+1] == s[i] {
+			literal.WriteByte(s[i])
+			i++
+			continue
+		}
+		if s[i] != '{' {
+			literal.WriteByte(s[i])
+			continue
+		}
+		end, err := closingBrace(s, i)
+		if err != nil {
+			return nil, err
+		}
+		program, err := expr.Compile(s[i+1:end], opts...)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed compiling template expression %q", s[i+1:end])
+		}
+		t.literals = append(t.literals, literal.String())
+		t.programs = append(t.programs, program)
+		literal.Reset()
+		i = end
+	}
+	t.literals = append(t.literals, literal.String())
+	return t, nil
+}
+
+// closingBrace finds the brace that closes the one at start, braces
+// inside nested maps and string literals are skipped
+func closingBrace(s string, start int) (int, error) {
+	depth := 0
+	var quote byte
+	for i := start; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote != '`' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'' || c == '`':
+			quote = c
+		case c == '{':
+			depth++
+		case c == '}':
+			depth--
+			if depth == 0 {
+				return i, nil
+			}
+		}
+	}
+	return 0, errors.Errorf("template expression at position %d is not closed", start)
+}
+
+// static reports whether the template has no expression
+func (t *exprTemplate) static() bool {
+	return len(t.programs) == 0
+}
+
+// literal is the text of a static template, with the escaped braces unescaped
+func (t *exprTemplate) literal() string {
+	return t.literals[0]
+}
+
+// render evaluates the template, escape is called with the text rendered so far
+// and the result of an expression. It can be nil to keep the results as they are
+func (t *exprTemplate) render(p *snmp.Payload, escape func(prefix, value string) string) (string, error) {
+	var sb strings.Builder
+	sb.WriteString(t.literals[0])
+	for i, program := range t.programs {
+		res, err := expr.Run(program, *p)
+		if err != nil {
+			return "", errors.Wrap(err, "failed evaluating template expression")
+		}
+		value := templateValue(res)
+		if escape != nil {
+			value = escape(sb.String(), value)
+		}
+		sb.WriteString(value)
+		sb.WriteString(t.literals[i+1])
+	}
+	return sb.String(), nil
+}
+
+func templateValue(res any) string {
+	v := reflect.ValueOf(res)
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return ""
+	}
+	return fmt.Sprint(v.Interface())
+}
@@ -0,0 +1,110 @@
+package forwarder
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemplate(t *testing.T) {
+	m := testMessage()
+	cases := []struct {
+		template string
+		expected string
+	}{
+		{"/devices/{src_address}/events", "/devices/10.0.0.1/events"},
+		{"{src_port + 1}", "163"},
+		{"{{\"source\": \"trap2json\"}}", "{\"source\": \"trap2json\"}"},
+		{"{{{src_address}}}", "{10.0.0.1}"},
+		{"a}b", "a}b"},
+		{"{ {\"a\": src_address}.a }", "10.0.0.1"},
+	}
+	for _, c := range cases {
+		tmpl, err := compileTemplate(c.template)
+		if !assert.NoError(t, err, c.template) {
+			continue
+		}
+		res, err := tmpl.render(m.Payload, nil)
+		assert.NoError(t, err, c.template)
+		assert.Equal(t, c.expected, res, c.template)
+	}
+	for _, s := range []string{"{src_address", "{{{src_address", "{src_address +}"} {
+		_, err := compileTemplate(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestTemplatePointers(t *testing.T) {
+	m := testMessage()
+	tmpl, err := compileTemplate("{agent_address}/{enterprise_mib_name}/{trap_type}/{user}/{community ?? 'none'}")
+	if !assert.NoError(t, err) {
+		return
+	}
+	res, err := tmpl.render(m.Payload, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.2/IF-MIB::linkDown/2//public", res)
+	m.Payload.Community = nil
+	res, err = tmpl.render(m.Payload, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.2/IF-MIB::linkDown/2//none", res)
+}
+
+func TestHTTPStaticHeaderBraces(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header
+	}))
+	defer srv.Close()
+	fwd := startForwarder(t, Config{
+		HTTP: &HTTPConfig{
+			URL: srv.URL,
+			Headers: map[string][]string{
+				"X-Meta": {`{{"source": "trap2json"}}`},
+				"X-Src":  {"{src_address}"},
+			},
+		},
+	})
+	fwd.Send(testMessage())
+	h := receive(t, headers)
+	assert.Equal(t, `{"source": "trap2json"}`, h.Get("X-Meta"))
+	assert.Equal(t, "10.0.0.1", h.Get("X-Src"))
+}
+
+func TestHTTPValidateBraces(t *testing.T) {
+	c := HTTPConfig{
+		URL: "http://localhost/{src_address",
+		Headers: map[string][]string{
+			"X-Meta": {`{"source": trap2json}`},
+			"X-Src":  {"{src_address}"},
+		},
+	}
+	errs := c.validate()
+	if assert.Len(t, errs, 2) {
+		for _, err := range errs {
+			assert.Contains(t, []string{"url", "headers.X-Meta[0]"}, err.Path)
+			assert.ErrorContains(t, err.Err, "literal brace, use {{ and }}")
+		}
+	}
+}
+
+func TestHTTPTemplates(t *testing.T) {
+	url, requests := captureRequests(t, http.StatusOK)
+	fwd := startForwarder(t, Config{
+		HTTP: &HTTPConfig{
+			URL:            url + "/devices/{src_address}?port={src_port}",
+			MethodTemplate: "{trap_type == 2 ? 'PUT' : 'POST'}",
+			Headers: map[string][]string{
+				"X-Src":    {"{src_address}"},
+				"X-Static": {"static"},
+			},
+		},
+	})
+	fwd.Send(testMessage())
+	req := receive(t, requests)
+	assert.Equal(t, http.MethodPut, req.method)
+	assert.Equal(t, "/devices/10.0.0.1?port=162", req.uri)
+	assert.Equal(t, "10.0.0.1", req.header.Get("X-Src"))
+	assert.Equal(t, "static", req.header.Get("X-Static"))
+}
@@ -1,14 +1,15 @@
 package forwarder
 
 import (
+	"github.com/bangunindo/trap2json/helper"
 	"github.com/bangunindo/trap2json/snmp"
 	"github.com/pkg/errors"
 	"os/exec"
 	"strconv"
-	"sync"
 )
 
 type SNMPTrapConfig struct {
+	// Workers is replaced by the forwarder workers, it's used when the latter isn't set
 	Workers      int
 	EnableInform bool `mapstructure:"enable_inform"`
 	Host         string
@@ -19,40 +20,41 @@ type SNMPTrapConfig struct {
 	// TODO support templating for these configs
 }
 
-type Cmd struct {
-	Commands []string
-	Message  *snmp.Message
-}
-
 type SNMPTrap struct {
 	Base
-	workerChan chan Cmd
-	workerWg   *sync.WaitGroup
 }
 
-func (s *SNMPTrap) configCheck() error {
-	if s.config.Trap.Host == "" {
-		return errors.New("host is not defined")
+func (c *SNMPTrapConfig) validate() []helper.ConfigError {
+	var errs []helper.ConfigError
+	if c.Host == "" {
+		errs = append(errs, helper.ConfigError{Path: "host", Err: errors.New("host is not defined")})
 	}
-	switch s.config.Trap.Version {
+	switch c.Version {
 	case "v1":
-		if s.config.Trap.Community == "" {
-			return errors.New("undefined community for snmp v1")
-		}
-		if s.config.Trap.EnableInform {
-			s.logger.Warn().Msg("using inform in snmp v1 is not supported")
-			s.config.Trap.EnableInform = false
+		if c.Community == "" {
+			errs = append(errs, helper.ConfigError{Path: "community", Err: errors.New("undefined community for snmp v1")})
 		}
 	case "v2c":
-		if s.config.Trap.Community == "" {
-			return errors.New("undefined community for snmp v2c")
+		if c.Community == "" {
+			errs = append(errs, helper.ConfigError{Path: "community", Err: errors.New("undefined community for snmp v2c")})
 		}
 	case "v3":
-		if s.config.Trap.User.Username == "" {
-			return errors.New("undefined user for snmp v3")
+		if c.User.Username == "" {
+			errs = append(errs, helper.ConfigError{Path: "user.username", Err: errors.New("undefined user for snmp v3")})
 		}
 	default:
-		return errors.Errorf("unknown snmp version: %s", s.config.Trap.Version)
+		errs = append(errs, helper.ConfigError{Path: "version", Err: errors.Errorf("unknown snmp version: %s", c.Version)})
+	}
+	return errs
+}
+
+func (s *SNMPTrap) configCheck() error {
+	if errs := s.config.Trap.validate(); len(errs) > 0 {
+		return errs[0].Err
+	}
+	if s.config.Trap.Version == "v1" && s.config.Trap.EnableInform {
+		s.logger.Warn().Msg("using inform in snmp v1 is not supported")
+		s.config.Trap.EnableInform = false
 	}
 	return nil
 }
@@ -92,7 +94,8 @@ func (s *SNMPTrap) baseBuilder() (cmd []string) {
 }
 
 func (s *SNMPTrap) commandBuilder(baseCmd []string, m *snmp.Message) (cmd []string) {
-	cmd = baseCmd[:]
+	// baseCmd is shared between workers, it must not be appended to
+	cmd = append([]string{}, baseCmd...)
 	values := m.Payload.Values[:]
 	var uptime int
 	if m.Payload.UptimeSeconds != nil {
@@ -146,18 +149,6 @@ func (s *SNMPTrap) commandBuilder(baseCmd []string, m *snmp.Message) (cmd []stri
 	return
 }
 
-func (s *SNMPTrap) runWorker() {
-	defer s.workerWg.Done()
-	for cmd := range s.workerChan {
-		cmdOut := exec.Command(cmd.Commands[0], cmd.Commands[1:]...)
-		if err := cmdOut.Run(); err != nil {
-			s.Retry(cmd.Message, err)
-		} else {
-			s.ctrSucceeded.Inc()
-		}
-	}
-}
-
 func (s *SNMPTrap) Run() {
 	defer s.cancel()
 	defer s.logger.Info().Msg("forwarder exited")
@@ -166,35 +157,26 @@ func (s *SNMPTrap) Run() {
 		s.logger.Fatal().Err(err).Msg("failed starting trap forwarder")
 		return
 	}
-	if s.config.Trap.Workers <= 0 {
-		s.config.Trap.Workers = 1
-	}
-	for i := 0; i < s.config.Trap.Workers; i++ {
-		s.workerWg.Add(1)
-		go s.runWorker()
-	}
 	baseCmd := s.baseBuilder()
-	for m := range s.ReceiveChannel() {
+	s.consume(func(m *snmp.Message) {
 		m.Compile(s.CompilerConf)
 		if m.Metadata.Skip {
 			s.ctrFiltered.Inc()
-			continue
+			return
 		}
 		cmd := s.commandBuilder(baseCmd, m)
-		s.workerChan <- Cmd{
-			Commands: cmd,
-			Message:  m,
+		cmdOut := exec.Command(cmd[0], cmd[1:]...)
+		if err := cmdOut.Run(); err != nil {
+			s.Retry(m, err)
+		} else {
+			s.ctrSucceeded.Inc()
 		}
-	}
-	close(s.workerChan)
-	s.workerWg.Wait()
+	})
 }
 
 func NewSNMPTrap(c Config, idx int) Forwarder {
 	fwd := &SNMPTrap{
 		NewBase(c, idx),
-		make(chan Cmd),
-		new(sync.WaitGroup),
 	}
 	go fwd.Run()
 	return fwd
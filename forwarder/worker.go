@@ -0,0 +1,150 @@
+package forwarder
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/bangunindo/trap2json/snmp"
+	"github.com/expr-lang/expr"
+)
+
+// workerIndex picks the worker of a message based on ordering_key, messages
+// with the same key always go to the same worker
+func (b *Base) workerIndex(m *snmp.Message, workers int) int {
+	res, err := expr.Run(b.orderingKey, *m.Payload)
+	if err != nil {
+		b.logger.Debug().Err(err).Msg("failed evaluating ordering_key expression")
+		return 0
+	}
+	h := fnv.New32a()
+	_, _ = fmt.Fprint(h, res)
+	return int(h.Sum32() % uint32(workers))
+}
+
+// consume calls fn for every received message. With more than one worker the
+// messages are processed concurrently, unless they have the same ordering_key.
+// Retried messages go back to the queue, so their order isn't kept.
+// It returns after every message is processed. A message is acked once
+// fn returns, fn has to be done with it by then or hold it with holdAck
+func (b *Base) consume(fn func(*snmp.Message)) {
+	b.dispatch(func(ch <-chan *snmp.Message) {
+		for m := range ch {
+			key := m.QueueKey()
+			fn(m)
+			b.ack(key)
+		}
+	})
+}
+
+// holdAck keeps consume and consumeBatch from acking m once fn returns,
+// the caller acks the returned key itself when it's done with m
+func (b *Base) holdAck(m *snmp.Message) []byte {
+	key := m.QueueKey()
+	if key != nil {
+		b.heldAcks.Store(string(key), struct{}{})
+	}
+	return key
+}
+
+// ack acks the key of a processed message, unless it's held by holdAck
+func (b *Base) ack(key []byte) {
+	if key == nil {
+		return
+	}
+	if _, held := b.heldAcks.LoadAndDelete(string(key)); !held {
+		b.queue.Ack(key)
+	}
+}
+
+// consumeBatch is like consume, but fn is called with up to size messages. A batch
+// is sent early when its first message has waited for timeout. Only messages
+// that pass accept are batched, it's usually used to compile and filter them
+func (b *Base) consumeBatch(
+	size int,
+	timeout time.Duration,
+	accept func(*snmp.Message) bool,
+	fn func([]*snmp.Message),
+) {
+	b.dispatch(func(ch <-chan *snmp.Message) {
+		timer := time.NewTimer(timeout)
+		timer.Stop()
+		var batch []*snmp.Message
+		var keys [][]byte
+		flush := func() {
+			timer.Stop()
+			if len(batch) > 0 {
+				b.ctrBatchSize.Observe(float64(len(batch)))
+				fn(batch)
+				for _, key := range keys {
+					b.ack(key)
+				}
+				batch, keys = nil, nil
+			}
+		}
+		for {
+			select {
+			case m, ok := <-ch:
+				if !ok {
+					flush()
+					return
+				}
+				key := m.QueueKey()
+				if !accept(m) {
+					b.queue.Ack(key)
+					continue
+				}
+				batch = append(batch, m)
+				keys = append(keys, key)
+				if len(batch) == 1 {
+					timer.Reset(timeout)
+				}
+				if len(batch) >= size {
+					flush()
+				}
+			case <-timer.C:
+				flush()
+			}
+		}
+	})
+}
+
+// dispatch runs worker for each of the configured workers, every worker
+// gets its own share of the received messages
+func (b *Base) dispatch(worker func(<-chan *snmp.Message)) {
+	workers := b.config.Workers
+	if workers <= 1 {
+		worker(b.ReceiveChannel())
+		return
+	}
+	wg := new(sync.WaitGroup)
+	chans := make([]chan *snmp.Message, workers)
+	shared := make(chan *snmp.Message)
+	for i := range chans {
+		chans[i] = shared
+		if b.orderingKey != nil {
+			chans[i] = make(chan *snmp.Message)
+		}
+		wg.Add(1)
+		go func(ch <-chan *snmp.Message) {
+			defer wg.Done()
+			worker(ch)
+		}(chans[i])
+	}
+	for m := range b.ReceiveChannel() {
+		if b.orderingKey == nil {
+			shared <- m
+		} else {
+			chans[b.workerIndex(m, workers)] <- m
+		}
+	}
+	if b.orderingKey == nil {
+		close(shared)
+	} else {
+		for _, ch := range chans {
+			close(ch)
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,71 @@
+package forwarder
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bangunindo/trap2json/snmp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkersConcurrent(t *testing.T) {
+	arrived := make(chan struct{}, 3)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+	fwd := startForwarder(t, Config{
+		Workers: 3,
+		HTTP:    &HTTPConfig{URL: srv.URL},
+	})
+	for range 3 {
+		fwd.Send(testMessage())
+	}
+	// every request is in flight before any of them is answered
+	for range 3 {
+		receive(t, arrived)
+	}
+}
+
+func TestWorkersOrderingKey(t *testing.T) {
+	out := make(chan *snmp.Message, 100)
+	fwd := startForwarder(t, Config{
+		Workers:     4,
+		OrderingKey: "src_port",
+		Mock:        &MockConfig{OutChannel: out},
+	})
+	for i := range 40 {
+		m := testMessage()
+		m.Payload.SrcPort = i%3 + 1
+		seq := int64(i)
+		m.Payload.TrapSubType = &seq
+		fwd.Send(m)
+	}
+	last := make(map[int]int64)
+	for range 40 {
+		m := receive(t, out)
+		if prev, ok := last[m.Payload.SrcPort]; ok {
+			assert.Greater(t, *m.Payload.TrapSubType, prev, "port %d", m.Payload.SrcPort)
+		}
+		last[m.Payload.SrcPort] = *m.Payload.TrapSubType
+	}
+	assert.Len(t, last, 3)
+}
+
+func TestWorkerIndex(t *testing.T) {
+	program, err := compileExpr("src_port")
+	if !assert.NoError(t, err) {
+		return
+	}
+	b := Base{orderingKey: program}
+	m := testMessage()
+	idx := b.workerIndex(m, 8)
+	assert.True(t, idx >= 0 && idx < 8)
+	for range 10 {
+		assert.Equal(t, idx, b.workerIndex(testMessage(), 8))
+	}
+}
@@ -3,6 +3,7 @@ package forwarder
 import (
 	"fmt"
 	"github.com/bangunindo/trap2json/helper"
+	"github.com/bangunindo/trap2json/snmp"
 	zsend "github.com/essentialkaos/go-zabbix"
 	"github.com/pkg/errors"
 	"strings"
@@ -100,6 +101,39 @@ type ZabbixTrapperConfig struct {
 	Advanced *ZSAdvancedConfig
 }
 
+func (c *ZabbixTrapperConfig) validate() []helper.ConfigError {
+	var errs []helper.ConfigError
+	if c.ItemKey == "" {
+		errs = append(errs, helper.ConfigError{Path: "item_key", Err: errors.New("item_key is required")})
+	}
+	if c.Advanced == nil {
+		// without advanced config, every trap is sent to the default address
+		if c.DefaultAddress == "" {
+			errs = append(errs, helper.ConfigError{
+				Path: "default_address",
+				Err:  errors.New("default_address is required when advanced config is not defined"),
+			})
+		}
+		if c.DefaultPort == 0 {
+			errs = append(errs, helper.ConfigError{
+				Path: "default_port",
+				Err:  errors.New("default_port is required when advanced config is not defined"),
+			})
+		}
+	} else if c.Advanced.DBUrl != "" {
+		if _, _, err := helper.ParseDSN(c.Advanced.DBUrl); err != nil {
+			errs = append(errs, helper.ConfigError{Path: "advanced.db_url", Err: err})
+		}
+	}
+	if c.HostnameLookupStrategy == LookupFromOID && c.OIDLookup == "" {
+		errs = append(errs, helper.ConfigError{
+			Path: "oid_lookup",
+			Err:  errors.New("oid_lookup is required for oid hostname_lookup_strategy"),
+		})
+	}
+	return errs
+}
+
 type ZabbixTrapper struct {
 	Base
 
@@ -110,11 +144,11 @@ func (z *ZabbixTrapper) Run() {
 	defer z.cancel()
 	defer z.logger.Info().Msg("forwarder exited")
 	z.logger.Info().Msg("starting forwarder")
-	for m := range z.ReceiveChannel() {
+	z.consume(func(m *snmp.Message) {
 		m.Compile(z.CompilerConf)
 		if m.Metadata.Skip {
 			z.ctrFiltered.Inc()
-			continue
+			return
 		}
 		address := fmt.Sprintf(
 			"%s:%d",
@@ -135,13 +169,13 @@ func (z *ZabbixTrapper) Run() {
 		}
 		if address == ":0" {
 			z.ctrDropped.Inc()
-			continue
+			return
 		}
 		c, err := zsend.NewClient(address, hostname)
 		if err != nil {
 			z.logger.Warn().Err(err).Msg("failed resolving address")
 			z.ctrDropped.Inc()
-			continue
+			return
 		}
 		item := c.Add(z.config.ZabbixTrapper.ItemKey, string(m.Metadata.MessageJSON))
 		item.Clock = m.Payload.Time.Unix()
@@ -152,7 +186,7 @@ func (z *ZabbixTrapper) Run() {
 		} else {
 			z.ctrSucceeded.Inc()
 		}
-	}
+	})
 }
 
 func NewZabbixTrapper(c Config, idx int) Forwarder {
@@ -0,0 +1,26 @@
+package helper
+
+import "fmt"
+
+// ConfigError describes an invalid configuration, Path follows the config file
+// structure, e.g. forwarders[0].kafka.topic
+type ConfigError struct {
+	Path string
+	Err  error
+}
+
+func (c ConfigError) Error() string {
+	return fmt.Sprintf("%s: %v", c.Path, c.Err)
+}
+
+func (c ConfigError) Unwrap() error {
+	return c.Err
+}
+
+// PrefixConfigErrors prepends prefix to the path of each error
+func PrefixConfigErrors(prefix string, errs []ConfigError) []ConfigError {
+	for i := range errs {
+		errs[i].Path = prefix + "." + errs[i].Path
+	}
+	return errs
+}
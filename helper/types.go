@@ -3,6 +3,8 @@ package helper
 import (
 	"github.com/go-json-experiment/json"
 	"github.com/pkg/errors"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -29,3 +31,37 @@ type AutoRetry struct {
 	MinDelay   Duration `mapstructure:"min_delay"`
 	MaxDelay   Duration `mapstructure:"max_delay"`
 }
+
+// ByteSize is a size in bytes, it can be written with k, m or g suffix, e.g. 512m
+type ByteSize int64
+
+func (b *ByteSize) UnmarshalText(text []byte) error {
+	if b == nil {
+		return errors.New("can't unmarshal a nil *ByteSize")
+	}
+	s := strings.TrimSpace(strings.ToLower(string(text)))
+	if s == "" {
+		*b = 0
+		return nil
+	}
+	multiplier := int64(1)
+	switch s[len(s)-1] {
+	case 'k':
+		multiplier = 1e3
+	case 'm':
+		multiplier = 1e6
+	case 'g':
+		multiplier = 1e9
+	case 't':
+		multiplier = 1e12
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+	size, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return errors.Wrapf(err, "invalid byte size %s", string(text))
+	}
+	*b = ByteSize(size * multiplier)
+	return nil
+}
@@ -3,16 +3,190 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"github.com/bangunindo/trap2json/logger"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"io"
 	"os"
+	"os/signal"
 	"path"
+	"syscall"
 )
 
 const defaultConfigPath = "/etc/trap2json"
 
+func loadConfig(configPath string) config {
+	logger.InitLogger(logger.Config{
+		Level:  zerolog.InfoLevel,
+		Format: logger.FormatConsole,
+	}, os.Stderr)
+	c, err := parseConfig(configPath)
+	if err != nil {
+		log.Fatal().
+			Str("module", "config").
+			Err(err).
+			Msg("failed reading environment/configuration file")
+	}
+	logger.InitLogger(c.Logger, os.Stderr)
+	return c
+}
+
+func replayCmd(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: trap2json replay [flags] [file ...]\n")
+		fmt.Fprintf(fs.Output(), "Replays raw snmptrapd records, reads from stdin if no file is given\n")
+		fs.PrintDefaults()
+	}
+	configPath := fs.String(
+		"config",
+		path.Join(defaultConfigPath, "config.yml"),
+		"path to config file",
+	)
+	maxSpeed := fs.Bool(
+		"max-speed",
+		false,
+		"send records as fast as possible instead of following the original rate",
+	)
+	timeOffset := fs.Duration(
+		"time-offset",
+		0,
+		"shift the recorded trap time, e.g. 1h or -30m",
+	)
+	_ = fs.Parse(args)
+	c := loadConfig(*configPath)
+
+	var r io.Reader = os.Stdin
+	if fs.NArg() > 0 {
+		var readers []io.Reader
+		for _, name := range fs.Args() {
+			f, err := os.Open(name)
+			if err != nil {
+				log.Fatal().Str("module", "replay").Err(err).Msg("failed opening replay file")
+			}
+			defer f.Close()
+			readers = append(readers, f)
+		}
+		r = io.MultiReader(readers...)
+	}
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	log.Info().Str("module", "replay").Msg("starting replay")
+	Replay(ctx, c, replayOptions{
+		MaxSpeed:   *maxSpeed,
+		TimeOffset: *timeOffset,
+	}, r)
+	log.Info().Str("module", "replay").Msg("replay exited")
+}
+
+func testCmd(args []string) {
+	fs := flag.NewFlagSet("test", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: trap2json test [flags] <dir>\n")
+		fmt.Fprintf(fs.Output(), "Runs NNNN_name.yml, NNNN_name.log and NNNN_name.ndjson test cases inside dir\n")
+		fs.PrintDefaults()
+	}
+	logLevel := fs.String(
+		"log-level",
+		zerolog.WarnLevel.String(),
+		"log level while running the test cases",
+	)
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	level, err := zerolog.ParseLevel(*logLevel)
+	if err != nil {
+		fmt.Fprintf(fs.Output(), "invalid -log-level: %v\n", err)
+		os.Exit(2)
+	}
+	logger.InitLogger(logger.Config{
+		Level:  level,
+		Format: logger.FormatConsole,
+	}, os.Stderr)
+	passed, err := RunTests(fs.Arg(0), os.Stdout)
+	if err != nil {
+		log.Fatal().Str("module", "test").Err(err).Msg("failed running test cases")
+	}
+	if !passed {
+		os.Exit(1)
+	}
+}
+
+func reinjectCmd(args []string) {
+	fs := flag.NewFlagSet("reinject", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: trap2json reinject [flags] <file ...>\n")
+		fmt.Fprintf(fs.Output(), "Sends dead letter records back to the forwarder they failed on\n")
+		fs.PrintDefaults()
+	}
+	configPath := fs.String(
+		"config",
+		path.Join(defaultConfigPath, "config.yml"),
+		"path to config file",
+	)
+	forwarderID := fs.String(
+		"forwarder",
+		"",
+		"send every record to this forwarder id instead",
+	)
+	_ = fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	c := loadConfig(*configPath)
+	// SIGINT writes back the records that aren't forwarded yet instead of waiting for their retries
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	if err := Reinject(ctx, c, fs.Args(), *forwarderID); err != nil {
+		log.Fatal().Str("module", "reinject").Err(err).Msg("failed re-injecting dead letter records")
+	}
+	log.Info().Str("module", "reinject").Msg("reinject exited")
+}
+
+func validateCmd(args []string) {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	configPath := fs.String(
+		"config",
+		path.Join(defaultConfigPath, "config.yml"),
+		"path to config file",
+	)
+	_ = fs.Parse(args)
+	c, err := parseConfig(*configPath)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	errs := validateConfig(c)
+	for _, err = range errs {
+		fmt.Println(err)
+	}
+	if len(errs) > 0 {
+		os.Exit(1)
+	}
+	fmt.Printf("%s is valid\n", *configPath)
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "replay":
+			replayCmd(os.Args[2:])
+			return
+		case "test":
+			testCmd(os.Args[2:])
+			return
+		case "validate":
+			validateCmd(os.Args[2:])
+			return
+		case "reinject":
+			reinjectCmd(os.Args[2:])
+			return
+		}
+	}
 	configPath := flag.String(
 		"config",
 		path.Join(defaultConfigPath, "config.yml"),
@@ -23,28 +197,30 @@ func main() {
 		"",
 		"generate snmptrapd.conf",
 	)
+	printMode := flag.Bool(
+		"print-mode",
+		false,
+		"print configured snmptrapd.mode and exit",
+	)
 	flag.Parse()
-	logger.InitLogger(logger.Config{
-		Level:  zerolog.InfoLevel,
-		Format: logger.FormatConsole,
-	}, os.Stderr)
-	c, err := parseConfig(*configPath)
-	if err != nil {
-		log.Fatal().
-			Str("module", "config").
-			Err(err).
-			Msg("failed reading environment/configuration file")
-	}
-	logger.InitLogger(c.Logger, os.Stderr)
-	if *snmptrapdConfPath != "" {
+	c := loadConfig(*configPath)
+	if *printMode {
+		fmt.Println(c.SnmpTrapD.Mode.String())
+	} else if *snmptrapdConfPath != "" {
 		log.Info().Str("module", "generate").Msg("generating snmptrapd.conf file")
-		if err = c.SnmpTrapD.Serialize(*snmptrapdConfPath); err != nil {
+		if err := c.SnmpTrapD.Serialize(*snmptrapdConfPath); err != nil {
 			log.Fatal().
 				Str("module", "generate").
 				Err(err).
 				Msg("failed generating snmptrapd.conf file")
 		}
 	} else {
+		if errs := validateConfig(c); len(errs) > 0 {
+			for _, err := range errs {
+				log.Error().Str("module", "config").Str("path", err.Path).Err(err.Err).Msg("invalid configuration")
+			}
+			log.Fatal().Str("module", "config").Msg("configuration has errors")
+		}
 		log.Info().Msg("starting trap2json")
 		Run(context.Background(), c, os.Stdin, false)
 		log.Info().Msg("trap2json exited")
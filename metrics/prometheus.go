@@ -32,6 +32,42 @@ var (
 			Name: "trap2json_snmptrapd_succeeded",
 		},
 	)
+	SnmpTrapDRestarts = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "trap2json_snmptrapd_restarts_total",
+		},
+	)
+	SnmpTrapDUp = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "trap2json_snmptrapd_up",
+		},
+	)
+	ListenerProcessedBytes = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "trap2json_listener_processed_bytes",
+		},
+	)
+	ListenerProcessed = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "trap2json_listener_processed",
+		},
+	)
+	ListenerDropped = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "trap2json_listener_dropped",
+		},
+	)
+	ListenerSucceeded = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "trap2json_listener_succeeded",
+		},
+	)
+	ConfigReloads = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "trap2json_config_reloads",
+		},
+		[]string{"result"},
+	)
 	ParserProcessed = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "trap2json_parser_processed",
@@ -85,6 +121,22 @@ var (
 			Name: "trap2json_correlate_queue_capacity",
 		},
 	)
+	CorrelateQueueBytes = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "trap2json_correlate_queue_bytes",
+		},
+	)
+	CorrelateQueueDiskUsage = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "trap2json_correlate_queue_disk_usage_bytes",
+		},
+	)
+	CorrelateQueueOverflow = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "trap2json_correlate_queue_overflow",
+		},
+		[]string{"reason"},
+	)
 	ForwarderProcessed = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "trap2json_forwarder_processed",
@@ -121,6 +173,31 @@ var (
 		},
 		[]string{"index", "type", "id"},
 	)
+	ForwarderDeadLettered = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "trap2json_forwarder_dead_lettered",
+		},
+		[]string{"index", "type", "id"},
+	)
+	ForwarderFailed = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "trap2json_forwarder_failed",
+		},
+		[]string{"index", "type", "id", "reason"},
+	)
+	ForwarderCompressionSaved = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "trap2json_forwarder_compression_saved_bytes",
+		},
+		[]string{"index", "type", "id"},
+	)
+	ForwarderBatchSize = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "trap2json_forwarder_batch_size",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+		},
+		[]string{"index", "type", "id"},
+	)
 	ForwarderQueueFilled = promauto.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "trap2json_forwarder_queue_filled",
@@ -133,4 +210,22 @@ var (
 		},
 		[]string{"index", "type", "id"},
 	)
+	ForwarderQueueBytes = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "trap2json_forwarder_queue_bytes",
+		},
+		[]string{"index", "type", "id"},
+	)
+	ForwarderQueueDiskUsage = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "trap2json_forwarder_queue_disk_usage_bytes",
+		},
+		[]string{"index", "type", "id"},
+	)
+	ForwarderQueueOverflow = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "trap2json_forwarder_queue_overflow",
+		},
+		[]string{"index", "type", "id", "reason"},
+	)
 )
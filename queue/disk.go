@@ -0,0 +1,411 @@
+package queue
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bangunindo/trap2json/helper"
+	"github.com/dgraph-io/badger/v4"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+type Type int8
+
+const (
+	// TypeMemory keeps queued messages in memory, they are lost on restart
+	TypeMemory Type = iota
+	// TypeDisk persists queued messages to a local directory
+	TypeDisk
+)
+
+func (t *Type) String() string {
+	switch *t {
+	case TypeMemory:
+		return "memory"
+	case TypeDisk:
+		return "disk"
+	default:
+		return ""
+	}
+}
+
+func (t *Type) UnmarshalText(text []byte) error {
+	if t == nil {
+		return errors.New("can't unmarshal a nil *Type")
+	}
+	switch strings.ToLower(string(text)) {
+	case "", "memory":
+		*t = TypeMemory
+	case "disk":
+		*t = TypeDisk
+	default:
+		return errors.Errorf("unsupported queue type: %s", string(text))
+	}
+	return nil
+}
+
+type DiskConfig struct {
+	// Path is the directory of the queue, it can't be shared with other queues
+	Path string
+	// MaxBytes limits the total size of queued messages, 0 means unlimited
+	MaxBytes helper.ByteSize `mapstructure:"max_bytes"`
+}
+
+// Validate checks the config without opening the queue, the error path
+// is relative to the disk queue config
+func (c *DiskConfig) Validate() []helper.ConfigError {
+	var errs []helper.ConfigError
+	if c.Path == "" {
+		errs = append(errs, helper.ConfigError{Path: "path", Err: errors.New("path is required for disk queue")})
+	}
+	if c.MaxBytes < 0 {
+		errs = append(errs, helper.ConfigError{Path: "max_bytes", Err: errors.New("max_bytes can't be negative")})
+	}
+	return errs
+}
+
+// Codec converts queued items from and to bytes for the disk queue,
+// every field that should survive a restart must be encoded
+type Codec[T Item] interface {
+	Encode(T) ([]byte, error)
+	Decode([]byte) (T, error)
+}
+
+// diskKeyLen is 8 bytes of eta followed by 8 bytes of sequence, so iterating
+// the keys returns items ordered by eta, then by insertion
+const diskKeyLen = 16
+
+func diskKey(eta time.Time, seq uint64) []byte {
+	var ts uint64
+	if nano := eta.UnixNano(); !eta.IsZero() && nano > 0 {
+		ts = uint64(nano)
+	}
+	key := make([]byte, diskKeyLen)
+	binary.BigEndian.PutUint64(key, ts)
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
+
+// diskStore keeps items in badger, the byte size is tracked in memory
+// and recomputed from the stored items on open. Received Keyed items stay
+// in badger until they're acked, count doesn't include them
+type diskStore[T Item] struct {
+	path     string
+	db       *badger.DB
+	codec    Codec[T]
+	logger   zerolog.Logger
+	size     int
+	maxBytes int64
+	mutex    *sync.Mutex
+	changed  notifier
+	freed    notifier
+	count    int
+	bytes    int64
+	seq      uint64
+	disposed bool
+	// inflight has the value size of received items that aren't acked
+	inflight map[string]int64
+	// cursor is where first starts looking, the keys before it are in flight or deleted
+	cursor []byte
+}
+
+func openDiskStore[T Item](logger zerolog.Logger, conf DiskConfig, size int, codec Codec[T]) (*diskStore[T], error) {
+	// badger preallocates its files, the defaults are meant for much larger databases
+	opts := badger.DefaultOptions(conf.Path).
+		WithLogger(nil).
+		WithMemTableSize(4 << 20).
+		WithValueThreshold(64 << 10).
+		WithValueLogFileSize(16 << 20).
+		WithNumMemtables(2)
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed opening disk queue at %s", conf.Path)
+	}
+	s := &diskStore[T]{
+		path:     conf.Path,
+		db:       db,
+		codec:    codec,
+		logger:   logger,
+		size:     size,
+		maxBytes: int64(conf.MaxBytes),
+		mutex:    new(sync.Mutex),
+		changed:  newNotifier(),
+		freed:    newNotifier(),
+		inflight: make(map[string]int64),
+	}
+	err = db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			i := it.Item()
+			if len(i.Key()) != diskKeyLen {
+				continue
+			}
+			s.count++
+			s.bytes += i.ValueSize()
+			if seq := binary.BigEndian.Uint64(i.Key()[8:]); seq >= s.seq {
+				s.seq = seq + 1
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, errors.Wrapf(err, "failed reading disk queue at %s", conf.Path)
+	}
+	return s, nil
+}
+
+func (s *diskStore[T]) put(i T, force bool) error {
+	data, err := s.codec.Encode(i)
+	if err != nil {
+		return errors.Wrap(err, "failed encoding message")
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.disposed {
+		return ErrClosed
+	}
+	if !force && s.size > 0 && s.count >= s.size {
+		return errFull
+	}
+	if !force && s.maxBytes > 0 && s.bytes+int64(len(data)) > s.maxBytes {
+		return errFull
+	}
+	key := diskKey(i.Eta(), s.seq)
+	err = s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(key, data)
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed writing to disk queue")
+	}
+	s.rewind(key)
+	s.seq++
+	s.count++
+	s.bytes += int64(len(data))
+	s.changed.notify()
+	return nil
+}
+
+func (s *diskStore[T]) Put(i T) error {
+	return s.put(i, false)
+}
+
+func (s *diskStore[T]) Requeue(i T) error {
+	return s.put(i, true)
+}
+
+// rewind moves the cursor back to key if it's earlier, caller must hold the lock
+func (s *diskStore[T]) rewind(key []byte) {
+	if bytes.Compare(key, s.cursor) < 0 {
+		s.cursor = key
+	}
+}
+
+// first returns the key of the earliest item that isn't in flight, caller must hold the lock.
+// It starts from the cursor, so the in-flight items don't have to be skipped on every call
+func (s *diskStore[T]) first(txn *badger.Txn) ([]byte, bool) {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	for it.Seek(s.cursor); it.Valid(); it.Next() {
+		if _, ok := s.inflight[string(it.Item().Key())]; !ok {
+			return it.Item().KeyCopy(nil), true
+		}
+	}
+	return nil, false
+}
+
+// pop reads the item with the earliest eta, it's in flight until it's
+// deleted, caller must hold the lock
+func (s *diskStore[T]) pop() ([]byte, []byte, error) {
+	var key, data []byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		var ok bool
+		if key, ok = s.first(txn); !ok {
+			return errors.New("disk queue is unexpectedly empty")
+		}
+		i, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		data, err = i.ValueCopy(nil)
+		return err
+	})
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed reading from disk queue")
+	}
+	s.count--
+	s.inflight[string(key)] = int64(len(data))
+	// the next key sorts right after this one
+	s.cursor = append(key[:len(key):len(key)], 0)
+	s.freed.notify()
+	return key, data, nil
+}
+
+// delete removes an item that was popped, caller must hold the lock
+func (s *diskStore[T]) delete(key []byte) error {
+	size, ok := s.inflight[string(key)]
+	if !ok {
+		return nil
+	}
+	delete(s.inflight, string(key))
+	err := s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(key)
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed deleting from disk queue")
+	}
+	s.bytes -= size
+	s.freed.notify()
+	return nil
+}
+
+// popDecoded pops until an item can be decoded, caller must hold the lock.
+// Keyed items are kept until they're acked, the others are deleted right away
+func (s *diskStore[T]) popDecoded() (T, bool, error) {
+	var zero T
+	for s.count > 0 {
+		key, data, err := s.pop()
+		if err != nil {
+			return zero, false, err
+		}
+		i, err := s.codec.Decode(data)
+		if err != nil {
+			s.logger.Error().Err(err).Msg("dropping corrupted message from disk queue")
+			if err = s.delete(key); err != nil {
+				return zero, false, err
+			}
+			continue
+		}
+		if keyed, ok := any(i).(Keyed); ok {
+			keyed.SetQueueKey(key)
+		} else if err = s.delete(key); err != nil {
+			return zero, false, err
+		}
+		return i, true, nil
+	}
+	return zero, false, nil
+}
+
+// Ack deletes a received item, it's kept for the next start if the store is already disposed
+func (s *diskStore[T]) Ack(key []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.disposed {
+		return
+	}
+	if err := s.delete(key); err != nil {
+		s.logger.Error().Err(err).Msg("failed acking message, it will be received again on the next start")
+	}
+}
+
+func (s *diskStore[T]) release(key []byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.inflight[string(key)]; ok {
+		delete(s.inflight, string(key))
+		s.rewind(key)
+		s.count++
+	}
+}
+
+func (s *diskStore[T]) inFlight() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.inflight)
+}
+
+func (s *diskStore[T]) Poll() (T, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.disposed {
+		var zero T
+		return zero, false
+	}
+	i, ok, err := s.popDecoded()
+	if err != nil {
+		s.logger.Error().Err(err).Msg("failed polling disk queue")
+	}
+	return i, ok
+}
+
+// peekEta returns eta of the earliest item, it's read from the key
+// so the value doesn't need to be decoded
+func (s *diskStore[T]) peekEta() (time.Time, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.count == 0 || s.disposed {
+		return time.Time{}, false
+	}
+	var eta time.Time
+	found := false
+	_ = s.db.View(func(txn *badger.Txn) error {
+		if key, ok := s.first(txn); ok {
+			if ts := binary.BigEndian.Uint64(key); ts > 0 {
+				eta = time.Unix(0, int64(ts))
+			}
+			found = true
+		}
+		return nil
+	})
+	return eta, found
+}
+
+func (s *diskStore[T]) Changed() <-chan struct{} {
+	return s.changed
+}
+
+func (s *diskStore[T]) Freed() <-chan struct{} {
+	return s.freed
+}
+
+func (s *diskStore[T]) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.count
+}
+
+func (s *diskStore[T]) Empty() bool {
+	return s.Len() == 0
+}
+
+// Usage returns the size of queued messages and the size of database files
+func (s *diskStore[T]) Usage() (int64, int64) {
+	s.mutex.Lock()
+	queued := s.bytes
+	s.mutex.Unlock()
+	// badger only refreshes its size periodically, so the files are checked directly
+	var usage int64
+	_ = filepath.WalkDir(s.path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			usage += info.Size()
+		}
+		return nil
+	})
+	return queued, usage
+}
+
+func (s *diskStore[T]) Dispose() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.disposed {
+		return
+	}
+	s.disposed = true
+	if err := s.db.Close(); err != nil {
+		s.logger.Warn().Err(err).Msg("failed closing disk queue")
+	}
+}
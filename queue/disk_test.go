@@ -0,0 +1,199 @@
+package queue
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/bangunindo/trap2json/helper"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+)
+
+type tCodec struct{}
+
+func (tCodec) Encode(t tType) ([]byte, error) {
+	data := make([]byte, 16)
+	binary.BigEndian.PutUint64(data, uint64(t.eta.UnixNano()))
+	binary.BigEndian.PutUint64(data[8:], uint64(t.d))
+	return data, nil
+}
+
+func (tCodec) Decode(data []byte) (tType, error) {
+	if len(data) != 16 {
+		return tType{}, errors.New("invalid length")
+	}
+	return tType{
+		eta: time.Unix(0, int64(binary.BigEndian.Uint64(data))),
+		d:   int(binary.BigEndian.Uint64(data[8:])),
+	}, nil
+}
+
+func closeQueue[T Item](t *testing.T, q *Queue[T]) {
+	q.Close()
+	select {
+	case <-q.Done():
+	case <-time.After(time.Second):
+		assert.Fail(t, "queue is not closed")
+	}
+}
+
+func TestDiskQueue(t *testing.T) {
+	conf := Config{Type: TypeDisk, Disk: DiskConfig{Path: t.TempDir()}}
+	q, err := New[tType](log.Logger, conf, tCodec{}, nil, Counter{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	eta := time.Now().Add(time.Hour)
+	q.SendChannel() <- tType{eta: time.Now(), d: 1}
+	q.SendChannel() <- tType{eta: eta, d: 2}
+	q.SendChannel() <- tType{eta: time.Now(), d: 3}
+	assert.Equal(t, 1, (<-q.ReceiveChannel()).d)
+	assert.Equal(t, 3, (<-q.ReceiveChannel()).d)
+	// only one instance can open the same directory
+	_, err = New[tType](log.Logger, conf, tCodec{}, nil, Counter{})
+	assert.Error(t, err)
+	closeQueue(t, q)
+
+	// pending message is kept along with its eta
+	q, err = New[tType](log.Logger, conf, tCodec{}, nil, Counter{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer closeQueue(t, q)
+	assert.Equal(t, 1, q.Len())
+	m, ok := q.store.Poll()
+	if assert.True(t, ok) {
+		assert.Equal(t, 2, m.d)
+		assert.True(t, eta.Equal(m.eta))
+	}
+}
+
+func TestDiskQueueMaxBytes(t *testing.T) {
+	drop := prometheus.NewCounter(prometheus.CounterOpts{Name: "drop"})
+	q, err := New[tType](
+		log.Logger,
+		Config{Type: TypeDisk, Disk: DiskConfig{Path: t.TempDir(), MaxBytes: helper.ByteSize(40)}},
+		tCodec{},
+		nil,
+		Counter{Drop: drop},
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer closeQueue(t, q)
+	for i := 0; i < 3; i++ {
+		q.SendChannel() <- tType{eta: time.Now().Add(time.Hour), d: i}
+	}
+	time.Sleep(10 * time.Millisecond)
+	// every message is 16 bytes
+	assert.Equal(t, 2, q.Len())
+	assert.Equal(t, float64(1), testutil.ToFloat64(drop))
+	queued, usage := q.store.(*diskStore[tType]).Usage()
+	assert.Equal(t, int64(32), queued)
+	assert.Greater(t, usage, int64(0))
+}
+
+// kType is a Keyed tType
+type kType struct {
+	tType
+	key []byte
+}
+
+func (k *kType) SetQueueKey(key []byte) {
+	k.key = key
+}
+
+func (k *kType) QueueKey() []byte {
+	return k.key
+}
+
+type kCodec struct{}
+
+func (kCodec) Encode(k *kType) ([]byte, error) {
+	return tCodec{}.Encode(k.tType)
+}
+
+func (kCodec) Decode(data []byte) (*kType, error) {
+	t, err := tCodec{}.Decode(data)
+	return &kType{tType: t}, err
+}
+
+func TestDiskQueueAck(t *testing.T) {
+	conf := Config{Type: TypeDisk, Disk: DiskConfig{Path: t.TempDir()}, FlushTimeout: 100 * time.Millisecond}
+	q, err := New[*kType](log.Logger, conf, kCodec{}, nil, Counter{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	for i := 1; i <= 4; i++ {
+		q.SendChannel() <- &kType{tType: tType{eta: time.Now(), d: i}}
+	}
+	acked := <-q.ReceiveChannel()
+	retried := <-q.ReceiveChannel()
+	unacked := <-q.ReceiveChannel()
+	assert.Equal(t, []int{1, 2, 3}, []int{acked.d, retried.d, unacked.d})
+	assert.NotNil(t, acked.QueueKey())
+	q.Ack(acked.QueueKey())
+	q.Close()
+	// retry after close goes back to disk before the queue is released
+	retried.eta = time.Now().Add(time.Hour)
+	assert.NoError(t, q.Retry(retried))
+	q.Ack(retried.QueueKey())
+	select {
+	case <-q.Done():
+	case <-time.After(time.Second):
+		assert.Fail(t, "queue is not closed")
+	}
+
+	// the unacked message, the retried one and the undelivered one are kept
+	q, err = New[*kType](log.Logger, conf, kCodec{}, nil, Counter{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer closeQueue(t, q)
+	assert.Equal(t, 3, q.Len())
+	var received []int
+	for i := 0; i < 2; i++ {
+		received = append(received, (<-q.ReceiveChannel()).d)
+	}
+	assert.ElementsMatch(t, []int{3, 4}, received)
+	m, ok := q.store.Poll()
+	if assert.True(t, ok) {
+		assert.Equal(t, 2, m.d)
+		assert.True(t, retried.eta.Equal(m.eta))
+	}
+}
+
+func TestDiskStoreCursor(t *testing.T) {
+	s, err := openDiskStore[*kType](log.Logger, DiskConfig{Path: t.TempDir()}, 0, kCodec{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer s.Dispose()
+	now := time.Now()
+	for i := 1; i <= 3; i++ {
+		assert.NoError(t, s.Put(&kType{tType: tType{eta: now.Add(time.Duration(i) * time.Second), d: i}}))
+	}
+	poll := func() int {
+		i, ok := s.Poll()
+		if !assert.True(t, ok) {
+			return 0
+		}
+		return i.d
+	}
+	first, _ := s.Poll()
+	assert.Equal(t, 1, first.d)
+	assert.Equal(t, 2, poll())
+	// an earlier item and a released one are found before the cursor
+	assert.NoError(t, s.Put(&kType{tType: tType{eta: now, d: 0}}))
+	assert.Equal(t, 0, poll())
+	s.release(first.QueueKey())
+	assert.Equal(t, 1, poll())
+	assert.Equal(t, 3, poll())
+	_, ok := s.Poll()
+	assert.False(t, ok)
+	assert.Equal(t, 4, s.inFlight())
+}
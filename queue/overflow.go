@@ -0,0 +1,203 @@
+package queue
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bangunindo/trap2json/helper"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type OverflowPolicy int8
+
+const (
+	// OverflowDropNewest drops the incoming message when the queue is full
+	OverflowDropNewest OverflowPolicy = iota
+	// OverflowDropOldest drops the earliest queued message to make room for the incoming one
+	OverflowDropOldest
+	// OverflowBlock waits until the queue has free space, it slows down the sender
+	OverflowBlock
+	// OverflowSpillToDisk keeps the incoming message on disk until the memory queue has free space
+	OverflowSpillToDisk
+)
+
+func (p *OverflowPolicy) String() string {
+	switch *p {
+	case OverflowDropNewest:
+		return "drop_newest"
+	case OverflowDropOldest:
+		return "drop_oldest"
+	case OverflowBlock:
+		return "block"
+	case OverflowSpillToDisk:
+		return "spill_to_disk"
+	default:
+		return ""
+	}
+}
+
+func (p *OverflowPolicy) UnmarshalText(text []byte) error {
+	if p == nil {
+		return errors.New("can't unmarshal a nil *OverflowPolicy")
+	}
+	switch strings.ToLower(string(text)) {
+	case "", "drop_newest":
+		*p = OverflowDropNewest
+	case "drop_oldest":
+		*p = OverflowDropOldest
+	case "block":
+		*p = OverflowBlock
+	case "spill_to_disk":
+		*p = OverflowSpillToDisk
+	default:
+		return errors.Errorf("unsupported overflow policy: %s", string(text))
+	}
+	return nil
+}
+
+// Validate checks the config without opening the queue, the error path uses
+// the same keys as forwarder and correlate config
+func (c *Config) Validate() []helper.ConfigError {
+	var errs []helper.ConfigError
+	if c.OverflowPolicy == OverflowSpillToDisk && c.Type == TypeDisk {
+		errs = append(errs, helper.ConfigError{
+			Path: "overflow_policy",
+			Err:  errors.New("spill_to_disk can only be used with memory queue"),
+		})
+	}
+	if c.UsesDisk() {
+		errs = append(errs, helper.PrefixConfigErrors("queue_disk", c.Disk.Validate())...)
+	}
+	return errs
+}
+
+// UsesDisk reports whether the queue keeps messages in Disk.Path
+func (c *Config) UsesDisk() bool {
+	return c.Type == TypeDisk || c.OverflowPolicy == OverflowSpillToDisk
+}
+
+// spillStore keeps items in memory and moves the overflow to disk,
+// items are taken from whichever store has the earliest eta
+type spillStore[T Item] struct {
+	memory   *memoryStore[T]
+	disk     *diskStore[T]
+	overflow *prometheus.CounterVec
+	mutex    *sync.Mutex
+	changed  notifier
+	freed    notifier
+}
+
+func newSpillStore[T Item](memory *memoryStore[T], disk *diskStore[T], overflow *prometheus.CounterVec) *spillStore[T] {
+	s := &spillStore[T]{
+		memory:   memory,
+		disk:     disk,
+		overflow: overflow,
+		mutex:    new(sync.Mutex),
+		changed:  newNotifier(),
+		freed:    newNotifier(),
+	}
+	return s
+}
+
+func (s *spillStore[T]) Put(i T) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	err := s.memory.Put(i)
+	if errors.Is(err, errFull) {
+		if err = s.disk.Put(i); err == nil && s.overflow != nil {
+			s.overflow.With(prometheus.Labels{"reason": "spill_to_disk"}).Inc()
+		}
+	}
+	if err == nil {
+		s.changed.notify()
+	}
+	return err
+}
+
+// Requeue puts the item back to memory while it has free space, the rest goes
+// to disk so retries don't grow the memory queue past its size
+func (s *spillStore[T]) Requeue(i T) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	err := s.memory.Put(i)
+	if errors.Is(err, errFull) {
+		err = s.disk.Requeue(i)
+	}
+	if err == nil {
+		s.changed.notify()
+	}
+	return err
+}
+
+// earliest returns the store holding the earliest item and its eta,
+// caller must hold the lock
+func (s *spillStore[T]) earliest() (store[T], time.Time) {
+	memEta, memOk := s.memory.peekEta()
+	diskEta, diskOk := s.disk.peekEta()
+	switch {
+	case diskOk && (!memOk || diskEta.Before(memEta)):
+		return s.disk, diskEta
+	case memOk:
+		return s.memory, memEta
+	default:
+		return nil, time.Time{}
+	}
+}
+
+func (s *spillStore[T]) Poll() (T, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if child, _ := s.earliest(); child != nil {
+		i, ok := child.Poll()
+		if ok {
+			s.freed.notify()
+		}
+		return i, ok
+	}
+	var zero T
+	return zero, false
+}
+
+// Ack only applies to spilled items, memory items have no key
+func (s *spillStore[T]) Ack(key []byte) {
+	s.disk.Ack(key)
+	s.freed.notify()
+}
+
+func (s *spillStore[T]) inFlight() int {
+	return s.disk.inFlight()
+}
+
+func (s *spillStore[T]) release(key []byte) {
+	s.disk.release(key)
+}
+
+func (s *spillStore[T]) peekEta() (time.Time, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	child, eta := s.earliest()
+	return eta, child != nil
+}
+
+func (s *spillStore[T]) Changed() <-chan struct{} {
+	return s.changed
+}
+
+func (s *spillStore[T]) Freed() <-chan struct{} {
+	return s.freed
+}
+
+func (s *spillStore[T]) Len() int {
+	return s.memory.Len() + s.disk.Len()
+}
+
+func (s *spillStore[T]) Empty() bool {
+	return s.Len() == 0
+}
+
+func (s *spillStore[T]) Dispose() {
+	s.memory.Dispose()
+	s.disk.Dispose()
+}
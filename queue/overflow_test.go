@@ -0,0 +1,163 @@
+package queue
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bangunindo/trap2json/helper"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func newOverflowCounter() Counter {
+	return Counter{
+		Drop: prometheus.NewCounter(prometheus.CounterOpts{Name: "drop"}),
+		Overflow: prometheus.NewCounterVec(
+			prometheus.CounterOpts{Name: "overflow"},
+			[]string{"reason"},
+		),
+	}
+}
+
+// fillQueue sends messages with increasing d, the first one is held by
+// receiveWorker so it doesn't count toward the size
+func fillQueue(q *Queue[tType], n int) {
+	for i := 1; i <= n; i++ {
+		q.SendChannel() <- tType{eta: time.Now(), d: i}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func receiveAll(t *testing.T, q *Queue[tType], n int) []int {
+	var ds []int
+	for i := 0; i < n; i++ {
+		select {
+		case m := <-q.ReceiveChannel():
+			ds = append(ds, m.d)
+		case <-time.After(time.Second):
+			assert.Fail(t, "message is not received")
+			return ds
+		}
+	}
+	return ds
+}
+
+func TestOverflowDropOldest(t *testing.T) {
+	counter := newOverflowCounter()
+	q, err := New[tType](log.Logger, Config{Size: 2, OverflowPolicy: OverflowDropOldest}, nil, nil, counter)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer q.Close()
+	fillQueue(q, 4)
+	assert.Equal(t, 2, q.Len())
+	assert.Equal(t, float64(1), testutil.ToFloat64(counter.Drop))
+	assert.Equal(t, float64(1), testutil.ToFloat64(counter.Overflow.WithLabelValues("drop_oldest")))
+	assert.Equal(t, []int{1, 3, 4}, receiveAll(t, q, 3))
+}
+
+func TestOverflowBlock(t *testing.T) {
+	counter := newOverflowCounter()
+	q, err := New[tType](log.Logger, Config{Size: 1, OverflowPolicy: OverflowBlock}, nil, nil, counter)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer q.Close()
+	fillQueue(q, 3)
+	assert.Equal(t, 1, q.Len())
+	assert.Equal(t, float64(0), testutil.ToFloat64(counter.Drop))
+	assert.Equal(t, float64(1), testutil.ToFloat64(counter.Overflow.WithLabelValues("block")))
+	assert.Equal(t, []int{1, 2, 3}, receiveAll(t, q, 3))
+}
+
+func TestOverflowBlockClose(t *testing.T) {
+	counter := newOverflowCounter()
+	q, err := New[tType](
+		log.Logger,
+		Config{Size: 1, FlushTimeout: 100 * time.Millisecond, OverflowPolicy: OverflowBlock},
+		nil,
+		nil,
+		counter,
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	fillQueue(q, 3)
+	// the blocked message is given up after flush_timeout
+	q.Close()
+	assert.Eventually(t, func() bool {
+		return testutil.ToFloat64(counter.Drop) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, float64(1), testutil.ToFloat64(counter.Overflow.WithLabelValues("drop_newest")))
+	assert.Equal(t, []int{1, 2}, receiveAll(t, q, 2))
+	select {
+	case <-q.Done():
+	case <-time.After(time.Second):
+		assert.Fail(t, "queue is not closed")
+	}
+}
+
+func TestOverflowSpillToDisk(t *testing.T) {
+	counter := newOverflowCounter()
+	q, err := New[tType](
+		log.Logger,
+		Config{
+			Size:           1,
+			FlushTimeout:   time.Second,
+			OverflowPolicy: OverflowSpillToDisk,
+			// only one message fits on disk
+			Disk: DiskConfig{Path: t.TempDir(), MaxBytes: helper.ByteSize(16)},
+		},
+		tCodec{},
+		nil,
+		counter,
+	)
+	if !assert.NoError(t, err) {
+		return
+	}
+	fillQueue(q, 4)
+	assert.Equal(t, 2, q.Len())
+	assert.Equal(t, float64(1), testutil.ToFloat64(counter.Drop))
+	assert.Equal(t, float64(1), testutil.ToFloat64(counter.Overflow.WithLabelValues("spill_to_disk")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(counter.Overflow.WithLabelValues("disk_full")))
+	assert.Equal(t, []int{1, 2, 3}, receiveAll(t, q, 3))
+	closeQueue(t, q)
+}
+
+func TestOverflowPolicyUnmarshal(t *testing.T) {
+	var p OverflowPolicy
+	for text, expected := range map[string]OverflowPolicy{
+		"":              OverflowDropNewest,
+		"drop_newest":   OverflowDropNewest,
+		"DROP_OLDEST":   OverflowDropOldest,
+		"block":         OverflowBlock,
+		"spill_to_disk": OverflowSpillToDisk,
+	} {
+		if assert.NoError(t, p.UnmarshalText([]byte(text)), text) {
+			assert.Equal(t, expected, p, text)
+		}
+	}
+	assert.Error(t, p.UnmarshalText([]byte("drop")))
+}
+
+func TestSpillStoreRequeue(t *testing.T) {
+	d, err := openDiskStore[tType](log.Logger, DiskConfig{Path: t.TempDir()}, 0, tCodec{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	s := newSpillStore[tType](newMemoryStore[tType](1), d, nil)
+	defer s.Dispose()
+	// retries fill memory up to its size, the rest goes to disk
+	assert.NoError(t, s.Requeue(tType{eta: time.Now(), d: 1}))
+	assert.NoError(t, s.Requeue(tType{eta: time.Now(), d: 2}))
+	assert.Equal(t, 1, s.memory.Len())
+	assert.Equal(t, 1, s.disk.Len())
+	for _, expected := range []int{1, 2} {
+		i, ok := s.Poll()
+		if assert.True(t, ok) {
+			assert.Equal(t, expected, i.d)
+		}
+	}
+}
@@ -1,10 +1,13 @@
 package queue
 
 import (
+	"container/heap"
 	"context"
-	qq "github.com/Workiva/go-datastructures/queue"
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -12,19 +15,12 @@ type Item interface {
 	Eta() time.Time
 }
 
-type item struct {
-	i Item
-}
-
-func (m *item) Compare(other qq.Item) int {
-	otherM := other.(*item)
-	if otherM.i.Eta().Equal(m.i.Eta()) {
-		return 0
-	} else if otherM.i.Eta().After(m.i.Eta()) {
-		return -1
-	} else {
-		return 1
-	}
+// Keyed items get their key when they're received from disk queue. Disk queue keeps
+// the received items until their key is acked, so they're received again after a
+// crash or shutdown. Items that aren't Keyed are deleted from disk once received
+type Keyed interface {
+	SetQueueKey([]byte)
+	QueueKey() []byte
 }
 
 type Counter struct {
@@ -33,101 +29,465 @@ type Counter struct {
 	Passthrough prometheus.Counter
 	QueueCap    prometheus.Gauge
 	QueueLen    prometheus.Gauge
+	// QueueBytes and DiskUsage are only reported by disk queue
+	QueueBytes prometheus.Gauge
+	DiskUsage  prometheus.Gauge
+	// Overflow counts messages handled by overflow policy, it only has "reason" label
+	Overflow *prometheus.CounterVec
+}
+
+type Config struct {
+	// Size limits number of queued messages, 0 means unlimited
+	Size int
+	// FlushTimeout is how long Close waits for memory queue to be empty
+	FlushTimeout   time.Duration
+	Type           Type
+	Disk           DiskConfig
+	OverflowPolicy OverflowPolicy
+}
+
+// store keeps queued items ordered by their Eta
+type store[T Item] interface {
+	// Put returns errFull if the item doesn't fit in the store
+	Put(T) error
+	// Requeue puts back an item that came from the store, it ignores the size limit
+	Requeue(T) error
+	// Poll removes the earliest item without blocking
+	Poll() (T, bool)
+	// Ack deletes a received item that's kept until it's processed
+	Ack(key []byte)
+	// inFlight is the number of received items that aren't acked
+	inFlight() int
+	// release puts back a received item that isn't delivered, it's not acked yet
+	release(key []byte)
+	// peekEta returns eta of the earliest item without removing it
+	peekEta() (time.Time, bool)
+	// Changed is signaled after an item is added
+	Changed() <-chan struct{}
+	// Freed is signaled after an item is removed, a full store may accept Put again
+	Freed() <-chan struct{}
+	Len() int
+	Empty() bool
+	Dispose()
+}
+
+// notifier wakes up a single waiter without blocking the sender,
+// multiple notifications are merged until the waiter receives them
+type notifier chan struct{}
+
+func newNotifier() notifier {
+	return make(notifier, 1)
+}
+
+func (n notifier) notify() {
+	select {
+	case n <- struct{}{}:
+	default:
+	}
+}
+
+var (
+	errFull = errors.New("queue is full")
+	// ErrClosed is returned by Retry once the store is released
+	ErrClosed = errors.New("queue is closed")
+)
+
+type memoryEntry[T Item] struct {
+	item T
+	seq  uint64
+}
+
+// memoryHeap orders entries by eta, then by insertion
+type memoryHeap[T Item] []memoryEntry[T]
+
+func (h memoryHeap[T]) Len() int {
+	return len(h)
+}
+
+func (h memoryHeap[T]) Less(i, j int) bool {
+	etaI, etaJ := h[i].item.Eta(), h[j].item.Eta()
+	if etaI.Equal(etaJ) {
+		return h[i].seq < h[j].seq
+	}
+	return etaI.Before(etaJ)
+}
+
+func (h memoryHeap[T]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *memoryHeap[T]) Push(x any) {
+	*h = append(*h, x.(memoryEntry[T]))
+}
+
+func (h *memoryHeap[T]) Pop() any {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	var zero memoryEntry[T]
+	old[n-1] = zero
+	*h = old[:n-1]
+	return e
+}
+
+// memoryStore is an in-memory store, items are lost on restart
+type memoryStore[T Item] struct {
+	size     int
+	mutex    *sync.Mutex
+	items    memoryHeap[T]
+	changed  notifier
+	freed    notifier
+	seq      uint64
+	disposed bool
+}
+
+func newMemoryStore[T Item](size int) *memoryStore[T] {
+	return &memoryStore[T]{
+		size:    size,
+		mutex:   new(sync.Mutex),
+		changed: newNotifier(),
+		freed:   newNotifier(),
+	}
+}
+
+func (m *memoryStore[T]) put(i T, force bool) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.disposed {
+		return ErrClosed
+	}
+	if !force && m.size > 0 && len(m.items) >= m.size {
+		return errFull
+	}
+	heap.Push(&m.items, memoryEntry[T]{item: i, seq: m.seq})
+	m.seq++
+	m.changed.notify()
+	return nil
+}
+
+func (m *memoryStore[T]) Put(i T) error {
+	return m.put(i, false)
+}
+
+func (m *memoryStore[T]) Requeue(i T) error {
+	return m.put(i, true)
+}
+
+func (m *memoryStore[T]) Changed() <-chan struct{} {
+	return m.changed
+}
+
+func (m *memoryStore[T]) Freed() <-chan struct{} {
+	return m.freed
+}
+
+func (m *memoryStore[T]) Poll() (T, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if len(m.items) == 0 || m.disposed {
+		var zero T
+		return zero, false
+	}
+	m.freed.notify()
+	return heap.Pop(&m.items).(memoryEntry[T]).item, true
+}
+
+func (m *memoryStore[T]) Ack([]byte) {}
+
+func (m *memoryStore[T]) inFlight() int {
+	return 0
+}
+
+func (m *memoryStore[T]) release([]byte) {}
+
+func (m *memoryStore[T]) peekEta() (time.Time, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if len(m.items) == 0 || m.disposed {
+		return time.Time{}, false
+	}
+	return m.items[0].item.Eta(), true
+}
+
+func (m *memoryStore[T]) Len() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return len(m.items)
+}
+
+func (m *memoryStore[T]) Empty() bool {
+	return m.Len() == 0
+}
+
+func (m *memoryStore[T]) Dispose() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.disposed {
+		return
+	}
+	m.disposed = true
+	m.items = nil
 }
 
 type Queue[T Item] struct {
 	ctx             context.Context
 	cancel          context.CancelFunc
-	q               *qq.PriorityQueue
+	store           store[T]
+	persistent      bool
+	policy          OverflowPolicy
 	logger          zerolog.Logger
 	size            int
 	sendChan        chan T
 	passthroughChan chan<- T
 	recvChan        chan T
-	minDelay        time.Duration
-	maxDelay        time.Duration
 	flushTimeout    time.Duration
 	counter         Counter
+	// ready hands a due message directly to receiveWorker while it's idle
+	ready chan T
+	// stop tells receiveWorker to stop delivering, the store is disposed
+	// once the received messages are acked
+	stop         chan struct{}
+	disposed     chan struct{}
+	redirect     atomic.Pointer[func(T)]
+	redirected   chan struct{}
+	redirectOnce sync.Once
+	// closed is closed by Close, a send blocked by overflow policy gives up after flushTimeout
+	closed chan struct{}
 }
 
 func (q *Queue[T]) SendChannel() chan<- T {
 	return q.sendChan
 }
 
+// Retry puts back a message that was received from this queue. It skips the
+// size limit and overflow policy since the message is already accounted for.
+// A Keyed message still has to be acked afterward
+func (q *Queue[T]) Retry(m T) error {
+	return q.store.Requeue(m)
+}
+
+// Ack tells disk queue that a Keyed message is processed, it's either delivered,
+// retried or given up. It can be called after Close until the queue is disposed
+func (q *Queue[T]) Ack(key []byte) {
+	if key != nil {
+		q.store.Ack(key)
+	}
+}
+
 func (q *Queue[T]) sendWorker() {
 	for m := range q.sendChan {
 		if q.counter.Processed != nil {
 			q.counter.Processed.Inc()
 		}
-		if q.size == 0 || q.q.Len() < q.size {
-			err := q.q.Put(&item{m})
-			if err != nil {
-				if q.passthroughChan == nil {
-					q.logger.Error().Msg("unexpected error, queue is closed")
-					if q.counter.Drop != nil {
-						q.counter.Drop.Inc()
-					}
-				} else {
-					q.logger.Warn().Msg("unexpected error, queue is closed")
-					if q.counter.Passthrough != nil {
-						q.counter.Passthrough.Inc()
-					}
-					q.passthroughChan <- m
-				}
+		// disk queue has to persist the message before it's delivered
+		if !q.persistent && !m.Eta().After(time.Now()) {
+			select {
+			case q.ready <- m:
+				continue
+			default:
 			}
-		} else {
-			q.logger.Warn().Msg("queue is full, consider increasing queue_size")
-			if q.passthroughChan == nil {
-				if q.counter.Drop != nil {
-					q.counter.Drop.Inc()
-				}
-			} else {
-				if q.counter.Passthrough != nil {
-					q.counter.Passthrough.Inc()
+		}
+		err := q.store.Put(m)
+		if errors.Is(err, errFull) {
+			err = q.handleOverflow(m)
+		}
+		if err != nil {
+			q.logger.Error().Err(err).Msg("failed putting message to queue")
+			q.overflow(m, "")
+		}
+	}
+	if !q.persistent {
+		timeout := time.After(q.flushTimeout)
+	outer:
+		for {
+			select {
+			case <-timeout:
+				break outer
+			default:
+				if q.flushed() {
+					break outer
 				}
-				q.passthroughChan <- m
 			}
+			time.Sleep(10 * time.Millisecond)
 		}
 	}
+	// disk queue keeps its messages for the next start, so it stops right away
+	close(q.stop)
+	q.waitAcks()
+	q.store.Dispose()
+	close(q.disposed)
+}
+
+// waitAcks waits until the received messages are acked, an unacked message
+// stays on disk and is received again on the next start
+func (q *Queue[T]) waitAcks() {
+	<-q.ctx.Done()
 	timeout := time.After(q.flushTimeout)
-outer:
-	for {
+	for q.store.inFlight() > 0 {
 		select {
 		case <-timeout:
-			break outer
-		default:
-			if q.q.Empty() {
-				break outer
+			q.logger.Warn().Int("in_flight", q.store.inFlight()).Msg("messages are still in flight, they're kept for the next start")
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// flushed reports whether messages that would be lost on Dispose are all processed,
+// spilled messages are kept for the next start
+func (q *Queue[T]) flushed() bool {
+	if s, ok := q.store.(*spillStore[T]); ok {
+		return s.memory.Empty()
+	}
+	return q.store.Empty()
+}
+
+// handleOverflow applies overflow policy to m when the queue is full
+func (q *Queue[T]) handleOverflow(m T) error {
+	switch q.policy {
+	case OverflowDropOldest:
+		if oldest, ok := q.store.Poll(); ok {
+			q.logger.Debug().Msg("queue is full, dropping the oldest message")
+			q.overflow(oldest, q.policy.String())
+		}
+		if err := q.store.Put(m); !errors.Is(err, errFull) {
+			return err
+		}
+	case OverflowBlock:
+		q.logger.Debug().Msg("queue is full, waiting for free space")
+		q.countOverflow(q.policy.String())
+		closed := q.closed
+		var timeout <-chan time.Time
+		for {
+			err := q.store.Put(m)
+			if !errors.Is(err, errFull) {
+				return err
+			}
+			select {
+			case <-q.store.Freed():
+			case <-closed:
+				closed = nil
+				timeout = time.After(q.flushTimeout)
+			case <-timeout:
+				q.logger.Warn().Msg("queue is still full after flush_timeout, dropping the blocked message")
+				q.overflow(m, "drop_newest")
+				return nil
 			}
 		}
-		time.Sleep(10 * time.Millisecond)
+	case OverflowSpillToDisk:
+		// memory and disk are both full
+		q.logger.Warn().Msg("queue and spill disk are full, consider increasing queue_disk.max_bytes")
+		q.overflow(m, "disk_full")
+		return nil
+	}
+	q.logger.Warn().Msg("queue is full, consider increasing queue_size")
+	q.overflow(m, "drop_newest")
+	return nil
+}
+
+func (q *Queue[T]) countOverflow(reason string) {
+	if q.counter.Overflow != nil && reason != "" {
+		q.counter.Overflow.With(prometheus.Labels{"reason": reason}).Inc()
+	}
+}
+
+// overflow handles messages that can't be queued
+func (q *Queue[T]) overflow(m T, reason string) {
+	q.countOverflow(reason)
+	if q.passthroughChan == nil {
+		if q.counter.Drop != nil {
+			q.counter.Drop.Inc()
+		}
+	} else {
+		if q.counter.Passthrough != nil {
+			q.counter.Passthrough.Inc()
+		}
+		q.passthroughChan <- m
 	}
-	q.q.Dispose()
 }
 
 func (q *Queue[T]) ReceiveChannel() <-chan T {
 	return q.recvChan
 }
 
+// receiveWorker sleeps until the earliest message is due, it's woken up
+// earlier when a message is added, so a new message doesn't wait behind
+// pending retries
 func (q *Queue[T]) receiveWorker() {
+	defer func() {
+		close(q.recvChan)
+		q.cancel()
+	}()
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+	redirected := q.redirected
 	for {
-		if m, err := q.q.Get(1); err == nil {
-			msg := m[0].(*item)
-			if msg.i.Eta().After(time.Now()) {
-				time.Sleep(10 * time.Millisecond)
-				err = q.q.Put(m[0])
-				if err != nil {
-					break
+		select {
+		case <-q.stop:
+			return
+		default:
+		}
+		var due <-chan time.Time
+		if eta, ok := q.store.peekEta(); ok {
+			// redirected messages go to a queue with its own schedule
+			if q.redirect.Load() != nil || !eta.After(time.Now()) {
+				if msg, ok := q.store.Poll(); ok {
+					q.deliver(msg)
 				}
 				continue
 			}
-			q.recvChan <- msg.i.(T)
-		} else {
-			break
+			timer.Reset(time.Until(eta))
+			due = timer.C
+		}
+		select {
+		case msg := <-q.ready:
+			q.deliver(msg)
+		case <-q.store.Changed():
+		case <-due:
+		case <-redirected:
+			redirected = nil
+		case <-q.stop:
+			return
+		}
+		if due != nil && !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+	}
+}
+
+func (q *Queue[T]) deliver(msg T) {
+	if redirect := q.redirect.Load(); redirect != nil {
+		(*redirect)(msg)
+		return
+	}
+	// disk queue stops without waiting for the consumer, the message stays on disk
+	var stop chan struct{}
+	if q.persistent {
+		stop = q.stop
+	}
+	select {
+	case q.recvChan <- msg:
+	case <-q.redirected:
+		(*q.redirect.Load())(msg)
+	case <-stop:
+		if keyed, ok := any(msg).(Keyed); ok && keyed.QueueKey() != nil {
+			q.store.release(keyed.QueueKey())
+		} else if err := q.store.Requeue(msg); err != nil {
+			q.logger.Error().Err(err).Msg("failed putting back undelivered message")
 		}
 	}
-	close(q.recvChan)
-	q.cancel()
+}
+
+// Redirect sends queued messages to fn instead of ReceiveChannel, it's used to
+// move messages to another queue. The caller should still call Close afterward
+func (q *Queue[T]) Redirect(fn func(T)) {
+	q.redirectOnce.Do(func() {
+		q.redirect.Store(&fn)
+		close(q.redirected)
+	})
 }
 
 func (q *Queue[T]) monitorWorker() {
@@ -139,24 +499,43 @@ func (q *Queue[T]) monitorWorker() {
 			case <-q.ctx.Done():
 				break outer
 			case <-time.After(time.Second):
-				q.counter.QueueLen.Set(float64(q.q.Len()))
+				q.counter.QueueLen.Set(float64(q.store.Len()))
+				var d *diskStore[T]
+				switch s := q.store.(type) {
+				case *diskStore[T]:
+					d = s
+				case *spillStore[T]:
+					d = s.disk
+				}
+				if d != nil {
+					queued, usage := d.Usage()
+					if q.counter.QueueBytes != nil {
+						q.counter.QueueBytes.Set(float64(queued))
+					}
+					if q.counter.DiskUsage != nil {
+						q.counter.DiskUsage.Set(float64(usage))
+					}
+				}
 			}
 		}
 	}
 }
 
 func (q *Queue[T]) Len() int {
-	return q.q.Len()
+	return q.store.Len()
 }
 
 func (q *Queue[T]) Close() {
+	close(q.closed)
 	close(q.sendChan)
 }
 
+// Done is closed once the store is released, disk queue can be opened again afterward
 func (q *Queue[T]) Done() <-chan struct{} {
-	return q.ctx.Done()
+	return q.disposed
 }
 
+// NewQueue creates a memory queue that drops the newest message when it's full
 func NewQueue[T Item](
 	logger zerolog.Logger,
 	size int,
@@ -164,15 +543,75 @@ func NewQueue[T Item](
 	passthroughChan chan<- T,
 	counter Counter,
 ) *Queue[T] {
+	return newQueue[T](
+		logger,
+		newMemoryStore[T](size),
+		Config{Size: size, FlushTimeout: flushTimeout},
+		passthroughChan,
+		counter,
+	)
+}
+
+// New creates a queue based on conf, codec is only used by disk queue and
+// spill_to_disk policy. Disk queue keeps its messages on Close, they are
+// continued on the next start
+func New[T Item](
+	logger zerolog.Logger,
+	conf Config,
+	codec Codec[T],
+	passthroughChan chan<- T,
+	counter Counter,
+) (*Queue[T], error) {
+	var s store[T]
+	switch {
+	case conf.Type == TypeDisk:
+		d, err := openDiskStore[T](logger, conf.Disk, conf.Size, codec)
+		if err != nil {
+			return nil, err
+		}
+		if d.Len() > 0 {
+			logger.Info().Int("length", d.Len()).Msg("resuming messages from disk queue")
+		}
+		s = d
+	case conf.OverflowPolicy == OverflowSpillToDisk:
+		d, err := openDiskStore[T](logger, conf.Disk, 0, codec)
+		if err != nil {
+			return nil, err
+		}
+		if d.Len() > 0 {
+			logger.Info().Int("length", d.Len()).Msg("resuming spilled messages")
+		}
+		s = newSpillStore[T](newMemoryStore[T](conf.Size), d, counter.Overflow)
+	default:
+		s = newMemoryStore[T](conf.Size)
+	}
+	return newQueue[T](logger, s, conf, passthroughChan, counter), nil
+}
+
+func newQueue[T Item](
+	logger zerolog.Logger,
+	s store[T],
+	conf Config,
+	passthroughChan chan<- T,
+	counter Counter,
+) *Queue[T] {
+	_, persistent := s.(*diskStore[T])
 	q := &Queue[T]{
-		q:               qq.NewPriorityQueue(size, true),
+		store:           s,
+		persistent:      persistent,
+		policy:          conf.OverflowPolicy,
 		logger:          logger,
-		size:            size,
+		size:            conf.Size,
 		sendChan:        make(chan T, 10),
+		closed:          make(chan struct{}),
 		recvChan:        make(chan T),
 		passthroughChan: passthroughChan,
-		flushTimeout:    flushTimeout,
+		flushTimeout:    conf.FlushTimeout,
 		counter:         counter,
+		ready:           make(chan T),
+		stop:            make(chan struct{}),
+		disposed:        make(chan struct{}),
+		redirected:      make(chan struct{}),
 	}
 	q.ctx, q.cancel = context.WithCancel(context.Background())
 	go q.sendWorker()
@@ -61,3 +61,69 @@ func TestQueue(t *testing.T) {
 	// 2 has later Eta(), that's why it has 3 first
 	assert.Equal(t, 3, val2.d)
 }
+
+func TestQueueRedirect(t *testing.T) {
+	q := NewQueue[tType](
+		log.Logger,
+		0,
+		time.Second,
+		nil,
+		Counter{},
+	)
+	qSend := q.SendChannel()
+	qRecv := q.ReceiveChannel()
+	qSend <- tType{
+		eta: time.Now(),
+		d:   1,
+	}
+	assert.Equal(t, 1, (<-qRecv).d)
+	// message waiting for its eta should be redirected immediately
+	qSend <- tType{
+		eta: time.Now().Add(time.Hour),
+		d:   2,
+	}
+	time.Sleep(10 * time.Millisecond)
+	redirected := make(chan tType, 2)
+	q.Redirect(func(m tType) {
+		redirected <- m
+	})
+	qSend <- tType{
+		eta: time.Now(),
+		d:   3,
+	}
+	q.Close()
+	select {
+	case <-q.Done():
+	case <-time.After(time.Second):
+		assert.Fail(t, "queue is not closed")
+	}
+	_, ok := <-qRecv
+	assert.False(t, ok)
+	close(redirected)
+	var ds []int
+	for m := range redirected {
+		ds = append(ds, m.d)
+	}
+	assert.ElementsMatch(t, []int{2, 3}, ds)
+}
+
+func TestQueueDelayed(t *testing.T) {
+	q := NewQueue[tType](
+		log.Logger,
+		0,
+		time.Second,
+		nil,
+		Counter{},
+	)
+	defer q.Close()
+	start := time.Now()
+	q.SendChannel() <- tType{eta: start.Add(50 * time.Millisecond), d: 1}
+	q.SendChannel() <- tType{eta: start.Add(time.Hour), d: 2}
+	q.SendChannel() <- tType{eta: start, d: 3}
+	// ready message doesn't wait behind the delayed ones
+	assert.Equal(t, 3, (<-q.ReceiveChannel()).d)
+	assert.Less(t, time.Since(start), 50*time.Millisecond)
+	assert.Equal(t, 1, (<-q.ReceiveChannel()).d)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	assert.Equal(t, 1, q.Len())
+}
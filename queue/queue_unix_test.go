@@ -0,0 +1,52 @@
+//go:build unix
+
+package queue
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const benchPendingRetries = 5000
+
+// newPendingQueue returns a queue with retries that are due in an hour
+func newPendingQueue(b *testing.B) *Queue[tType] {
+	q := NewQueue[tType](
+		log.Logger,
+		0,
+		0,
+		nil,
+		Counter{},
+	)
+	eta := time.Now().Add(time.Hour)
+	for i := 0; i < benchPendingRetries; i++ {
+		q.SendChannel() <- tType{eta: eta, d: i}
+	}
+	for q.Len() < benchPendingRetries {
+		time.Sleep(time.Millisecond)
+	}
+	return q
+}
+
+func cpuTime() time.Duration {
+	var usage syscall.Rusage
+	_ = syscall.Getrusage(syscall.RUSAGE_SELF, &usage)
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+// BenchmarkQueuePendingRetries measures how long a new message waits
+// while thousands of retries are pending
+func BenchmarkQueuePendingRetries(b *testing.B) {
+	q := newPendingQueue(b)
+	defer q.Close()
+	b.ResetTimer()
+	cpu := cpuTime()
+	for i := 0; i < b.N; i++ {
+		q.SendChannel() <- tType{eta: time.Now(), d: -1}
+		<-q.ReceiveChannel()
+	}
+	b.ReportMetric(float64(cpuTime()-cpu)/float64(b.N), "cpu-ns/op")
+}
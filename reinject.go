@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/bangunindo/trap2json/forwarder"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// takeDeadLetters moves the files to a private name in the same directory, so the
+// records that forwarders append meanwhile stay in the original path
+func takeDeadLetters(files []string) (map[string]string, error) {
+	taken := make(map[string]string)
+	for _, name := range files {
+		if _, ok := taken[name]; ok {
+			continue
+		}
+		private := filepath.Join(filepath.Dir(name), fmt.Sprintf(".%s.reinject-%d", filepath.Base(name), os.Getpid()))
+		if err := os.Rename(name, private); err != nil {
+			restoreDeadLetters(taken)
+			return nil, errors.Wrap(err, "failed moving dead letter file")
+		}
+		taken[name] = private
+	}
+	return taken, nil
+}
+
+// restoreDeadLetters appends the taken records back to their original path
+func restoreDeadLetters(taken map[string]string) {
+	for name, private := range taken {
+		if err := appendFile(name, private); err != nil {
+			log.Error().
+				Str("module", "reinject").
+				Err(err).
+				Str("path", name).
+				Str("kept_in", private).
+				Msg("failed restoring dead letter file")
+			continue
+		}
+		_ = os.Remove(private)
+	}
+}
+
+func appendFile(dst string, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// Reinject sends dead letter records inside files back to the forwarders, or to
+// the forwarder with forwarderID if it's not empty. The files are moved away
+// before they're read, the records that fail again are appended to the first
+// file once it's recreated. It returns an error if any record isn't delivered
+func Reinject(ctx context.Context, c config, files []string, forwarderID string) error {
+	taken, err := takeDeadLetters(files)
+	if err != nil {
+		return err
+	}
+	var records []forwarder.DeadLetter
+	for _, name := range files {
+		f, err := os.Open(taken[name])
+		if err != nil {
+			restoreDeadLetters(taken)
+			return errors.Wrap(err, "failed opening dead letter file")
+		}
+		fileRecords, err := forwarder.ReadDeadLetters(f)
+		_ = f.Close()
+		if err != nil {
+			restoreDeadLetters(taken)
+			return errors.Wrapf(err, "invalid dead letter file %s", name)
+		}
+		records = append(records, fileRecords...)
+	}
+	res, err := forwarder.Reinject(ctx, c.Forwarders, records, forwarderID, files[0])
+	if err != nil {
+		// nothing is sent yet
+		restoreDeadLetters(taken)
+		return err
+	}
+	if res.Dropped > 0 {
+		// some records are only left in the taken files, so they're kept as is
+		var kept []string
+		for _, private := range taken {
+			kept = append(kept, private)
+		}
+		return errors.Errorf(
+			"%d of %d records are dropped, the original records are kept in %v and the records that failed again are appended to %s",
+			res.Dropped, len(records), kept, files[0],
+		)
+	}
+	for _, private := range taken {
+		if err = os.Remove(private); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "failed removing dead letter file")
+		}
+	}
+	if res.Failed > 0 {
+		return errors.Errorf("%d of %d records failed again, they're appended to %s", res.Failed, len(records), files[0])
+	}
+	return nil
+}
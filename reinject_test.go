@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bangunindo/trap2json/forwarder"
+	"github.com/bangunindo/trap2json/helper"
+	"github.com/bangunindo/trap2json/snmp"
+	"github.com/go-json-experiment/json"
+	"github.com/stretchr/testify/assert"
+)
+
+func readDeadLetters(t *testing.T, path string) []forwarder.DeadLetter {
+	f, err := os.Open(path)
+	if !assert.NoError(t, err) {
+		return nil
+	}
+	defer f.Close()
+	records, err := forwarder.ReadDeadLetters(f)
+	assert.NoError(t, err)
+	return records
+}
+
+func TestReinject(t *testing.T) {
+	dir := t.TempDir()
+	deadLetterPath := filepath.Join(dir, "dead.ndjson")
+	outPath := filepath.Join(dir, "out.ndjson")
+	blocked := make(chan *snmp.Message)
+	failing := func(id string, dl forwarder.DeadLetterConfig) forwarder.Config {
+		return forwarder.Config{
+			ID:         id,
+			JSONFormat: `{"src": src_address}`,
+			DeadLetter: &dl,
+			Mock: &forwarder.MockConfig{
+				OutChannel: blocked,
+				Timeout:    helper.Duration{Duration: 10 * time.Millisecond},
+			},
+		}
+	}
+	confs := []forwarder.Config{
+		failing("to file", forwarder.DeadLetterConfig{Path: deadLetterPath}),
+		failing("to forwarder", forwarder.DeadLetterConfig{Forwarder: "out"}),
+		{ID: "out", File: &forwarder.FileConfig{Path: outPath}},
+	}
+	msgChan := make(chan *snmp.Message)
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go forwarder.StartForwarders(wg, confs, msgChan, nil)
+	msgChan <- &snmp.Message{Payload: &snmp.Payload{Time: time.Now(), SrcAddress: "10.0.0.1"}}
+	assert.Eventually(t, func() bool {
+		return countLines(t, deadLetterPath) == 1 && countLines(t, outPath) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	close(msgChan)
+	wg.Wait()
+
+	records := readDeadLetters(t, deadLetterPath)
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, "to file", records[0].ForwarderID)
+		assert.Equal(t, "timeout", records[0].Error)
+		assert.Equal(t, 0, records[0].Retries)
+		assert.JSONEq(t, `{"src": "10.0.0.1"}`, string(records[0].MessageJSON))
+	}
+	// the dead letter forwarder writes the record as its message, along
+	// with the message it forwarded itself
+	var ids []string
+	for _, record := range readDeadLetters(t, outPath) {
+		ids = append(ids, record.ForwarderID)
+	}
+	assert.Contains(t, ids, "to forwarder")
+
+	err := Reinject(context.Background(), config{Forwarders: confs}, []string{deadLetterPath}, "missing")
+	assert.Error(t, err)
+	assert.Equal(t, 1, countLines(t, deadLetterPath))
+
+	// a record that fails again is written back to the file it came from,
+	// not to the dead_letter of the forwarder
+	againPath := filepath.Join(dir, "again.ndjson")
+	data, err := os.ReadFile(deadLetterPath)
+	if assert.NoError(t, err) {
+		assert.NoError(t, os.WriteFile(againPath, data, 0644))
+	}
+	err = Reinject(context.Background(), config{Forwarders: confs}, []string{againPath}, "")
+	assert.ErrorContains(t, err, "1 of 1 records failed again")
+	records = readDeadLetters(t, againPath)
+	if assert.Len(t, records, 1) {
+		assert.Equal(t, "to file", records[0].ForwarderID)
+		assert.Equal(t, "timeout", records[0].Error)
+	}
+	assert.Equal(t, 1, countLines(t, deadLetterPath))
+
+	record, err := os.ReadFile(deadLetterPath)
+	assert.NoError(t, err)
+	out := make(chan *snmp.Message)
+	received := make(chan *snmp.Message, 2)
+	go func() {
+		for m := range out {
+			// a running trap2json keeps appending to the file that's being re-injected
+			f, err := os.OpenFile(deadLetterPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if assert.NoError(t, err) {
+				_, _ = f.Write(record)
+				_ = f.Close()
+			}
+			received <- m
+		}
+	}()
+	defer close(out)
+	confs[0].Mock = &forwarder.MockConfig{OutChannel: out}
+	err = Reinject(context.Background(), config{Forwarders: confs}, []string{deadLetterPath, againPath}, "")
+	if assert.NoError(t, err) {
+		assert.Len(t, received, 2)
+		for range len(received) {
+			m := <-received
+			assert.Equal(t, "10.0.0.1", m.Payload.SrcAddress)
+			var payload map[string]string
+			if assert.NoError(t, json.Unmarshal(m.Metadata.MessageJSON, &payload)) {
+				assert.Equal(t, "10.0.0.1", payload["src"])
+			}
+		}
+		// every record is delivered, only the ones appended meanwhile are left
+		assert.Equal(t, 2, countLines(t, deadLetterPath))
+		assert.NoFileExists(t, againPath)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"github.com/bangunindo/trap2json/correlate"
+	"github.com/bangunindo/trap2json/forwarder"
+	"github.com/bangunindo/trap2json/logger"
+	"github.com/bangunindo/trap2json/metrics"
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"time"
+)
+
+// reloadDebounce groups multiple file events, editors usually write a file in several steps
+const reloadDebounce = 500 * time.Millisecond
+
+// reloader applies config changes while trap2json is running. Only logger, forwarders
+// and correlate conditions can be reloaded, other changes need a restart
+type reloader struct {
+	current   config
+	corr      *correlate.Correlate
+	fwdReload chan<- []forwarder.Config
+	logger    zerolog.Logger
+}
+
+func newReloader(c config, corr *correlate.Correlate, fwdReload chan<- []forwarder.Config) *reloader {
+	return &reloader{
+		current:   c,
+		corr:      corr,
+		fwdReload: fwdReload,
+		logger:    log.With().Str("module", "reload").Logger(),
+	}
+}
+
+// warnRestartRequired logs config changes that can't be applied without restarting
+func (r *reloader) warnRestartRequired(c config) {
+	changed := func(name string, old, new any) {
+		if !reflect.DeepEqual(old, new) {
+			r.logger.Warn().Str("config", name).Msg("config changed, restart is required to apply it")
+		}
+	}
+	changed("snmptrapd", r.current.SnmpTrapD, c.SnmpTrapD)
+	changed("parse_workers", r.current.ParseWorkers, c.ParseWorkers)
+	changed("prometheus", r.current.Prometheus, c.Prometheus)
+	changed("watch_config", r.current.WatchConfig, c.WatchConfig)
+	oldCorrelate, newCorrelate := r.current.Correlate, c.Correlate
+	oldCorrelate.Conditions, newCorrelate.Conditions = nil, nil
+	changed("correlate", oldCorrelate, newCorrelate)
+}
+
+func (r *reloader) reload(ctx context.Context) {
+	r.logger.Info().Str("path", r.current.path).Msg("reloading config")
+	c, err := parseConfig(r.current.path)
+	if err != nil {
+		r.logger.Error().Err(err).Msg("failed reloading config, keeping the current config")
+		metrics.ConfigReloads.With(prometheus.Labels{"result": "failed"}).Inc()
+		return
+	}
+	if errs := validateConfig(c); len(errs) > 0 {
+		for _, err := range errs {
+			r.logger.Error().Str("path", err.Path).Err(err.Err).Msg("invalid configuration")
+		}
+		r.logger.Error().Msg("failed reloading config, keeping the current config")
+		metrics.ConfigReloads.With(prometheus.Labels{"result": "failed"}).Inc()
+		return
+	}
+	r.warnRestartRequired(c)
+	logger.InitLogger(c.Logger, os.Stderr)
+	if r.corr != nil {
+		// already validated, this shouldn't fail
+		if err = r.corr.UpdateConditions(c.Correlate.Conditions); err != nil {
+			r.logger.Error().Err(err).Msg("failed updating correlate conditions")
+		}
+	}
+	select {
+	case r.fwdReload <- c.Forwarders:
+	case <-ctx.Done():
+		return
+	}
+	// keep the values that are still in use
+	c.SnmpTrapD = r.current.SnmpTrapD
+	c.ParseWorkers = r.current.ParseWorkers
+	c.Prometheus = r.current.Prometheus
+	c.WatchConfig = r.current.WatchConfig
+	conditions := c.Correlate.Conditions
+	c.Correlate = r.current.Correlate
+	c.Correlate.Conditions = conditions
+	r.current = c
+	metrics.ConfigReloads.With(prometheus.Labels{"result": "succeeded"}).Inc()
+	r.logger.Info().Msg("config reloaded")
+}
+
+// Run waits for SIGHUP or config file changes until ctx is done
+func (r *reloader) Run(ctx context.Context) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	var events <-chan fsnotify.Event
+	var watchErrors <-chan error
+	if r.current.WatchConfig {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			r.logger.Error().Err(err).Msg("failed watching config file")
+		} else {
+			defer watcher.Close()
+			// watch the directory instead of the file since some editors
+			// replace the file instead of writing to it
+			if err = watcher.Add(filepath.Dir(r.current.path)); err != nil {
+				r.logger.Error().Err(err).Msg("failed watching config file")
+			} else {
+				events = watcher.Events
+				watchErrors = watcher.Errors
+			}
+		}
+	}
+	configName := filepath.Clean(r.current.path)
+	debounce := time.NewTimer(reloadDebounce)
+	debounce.Stop()
+	defer debounce.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sighup:
+			r.logger.Info().Msg("received SIGHUP")
+			r.reload(ctx)
+		case event := <-events:
+			if filepath.Clean(event.Name) == configName && !event.Has(fsnotify.Chmod) {
+				debounce.Reset(reloadDebounce)
+			}
+		case err := <-watchErrors:
+			r.logger.Warn().Err(err).Msg("config watcher error")
+		case <-debounce.C:
+			r.logger.Info().Msg("config file changed")
+			r.reload(ctx)
+		}
+	}
+}
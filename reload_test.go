@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/bangunindo/trap2json/forwarder"
+	"github.com/bangunindo/trap2json/helper"
+	"github.com/bangunindo/trap2json/queue"
+	"github.com/bangunindo/trap2json/snmp"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func countLines(t *testing.T, path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	return bytes.Count(data, []byte("\n"))
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	confPath := filepath.Join(dir, "config.yml")
+	outA := filepath.Join(dir, "a.ndjson")
+	outB := filepath.Join(dir, "b.ndjson")
+	outKeep := filepath.Join(dir, "keep.ndjson")
+	outRemoved := filepath.Join(dir, "removed.ndjson")
+	writeTestFile(t, confPath, `
+forwarders:
+  - id: changed
+    file:
+      path: `+outA+`
+  - id: unchanged
+    file:
+      path: `+outKeep+`
+  - id: removed
+    file:
+      path: `+outRemoved+`
+`)
+	c, err := parseConfig(confPath)
+	if !assert.NoError(t, err) {
+		return
+	}
+	msgChan := make(chan *snmp.Message)
+	reloadChan := make(chan []forwarder.Config)
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go forwarder.StartForwarders(wg, c.Forwarders, msgChan, reloadChan)
+	send := func() {
+		msgChan <- &snmp.Message{Payload: &snmp.Payload{Time: time.Now(), SrcAddress: "127.0.0.1"}}
+	}
+	send()
+	// otherwise the queued message is moved to the new forwarder
+	assert.Eventually(t, func() bool {
+		return countLines(t, outA) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	r := newReloader(c, nil, reloadChan)
+	// invalid config is not applied
+	writeTestFile(t, confPath, `
+forwarders:
+  - id: changed
+    filter: community ==
+    file:
+      path: `+outB+`
+`)
+	r.reload(context.Background())
+	assert.Len(t, r.current.Forwarders, 3)
+
+	writeTestFile(t, confPath, `
+forwarders:
+  - id: changed
+    file:
+      path: `+outB+`
+  - id: unchanged
+    file:
+      path: `+outKeep+`
+  - id: added
+    filter: src_address == "10.0.0.1"
+    file:
+      path: `+outRemoved+`
+`)
+	r.reload(context.Background())
+	assert.Len(t, r.current.Forwarders, 3)
+	send()
+	close(msgChan)
+	wg.Wait()
+
+	assert.Equal(t, 1, countLines(t, outA))
+	assert.Equal(t, 1, countLines(t, outB))
+	assert.Equal(t, 2, countLines(t, outKeep))
+	assert.Equal(t, 1, countLines(t, outRemoved))
+}
+
+func TestReloadDrainRetries(t *testing.T) {
+	blocked := make(chan *snmp.Message)
+	out := make(chan *snmp.Message, 1)
+	conf := forwarder.Config{
+		ID: "mock",
+		AutoRetry: helper.AutoRetry{
+			Enable:   true,
+			MinDelay: helper.Duration{Duration: time.Hour},
+		},
+		Mock: &forwarder.MockConfig{
+			OutChannel: blocked,
+			Timeout:    helper.Duration{Duration: 10 * time.Millisecond},
+		},
+	}
+	msgChan := make(chan *snmp.Message)
+	reloadChan := make(chan []forwarder.Config)
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go forwarder.StartForwarders(wg, []forwarder.Config{conf}, msgChan, reloadChan)
+	msgChan <- &snmp.Message{Payload: &snmp.Payload{Time: time.Now()}}
+	// wait until the message is scheduled for retry
+	time.Sleep(100 * time.Millisecond)
+
+	newConf := conf
+	newConf.Mock = &forwarder.MockConfig{OutChannel: out}
+	reloadChan <- []forwarder.Config{newConf}
+	select {
+	case m := <-out:
+		assert.Equal(t, 1, m.Metadata.Retries)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "retried message is not moved to the new forwarder")
+	}
+	close(msgChan)
+	wg.Wait()
+}
+
+func TestReloadDiskQueue(t *testing.T) {
+	blocked := make(chan *snmp.Message)
+	out := make(chan *snmp.Message, 1)
+	conf := forwarder.Config{
+		ID:        "mock",
+		QueueType: queue.TypeDisk,
+		QueueDisk: queue.DiskConfig{Path: t.TempDir()},
+		AutoRetry: helper.AutoRetry{
+			Enable:   true,
+			MinDelay: helper.Duration{Duration: 200 * time.Millisecond},
+		},
+		Mock: &forwarder.MockConfig{
+			OutChannel: blocked,
+			Timeout:    helper.Duration{Duration: 10 * time.Millisecond},
+		},
+	}
+	msgChan := make(chan *snmp.Message)
+	reloadChan := make(chan []forwarder.Config)
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go forwarder.StartForwarders(wg, []forwarder.Config{conf}, msgChan, reloadChan)
+	msgChan <- &snmp.Message{Payload: &snmp.Payload{Time: time.Now()}}
+	time.Sleep(100 * time.Millisecond)
+
+	// the new forwarder reopens the same disk queue
+	newConf := conf
+	newConf.Mock = &forwarder.MockConfig{OutChannel: out}
+	reloadChan <- []forwarder.Config{newConf}
+	select {
+	case m := <-out:
+		assert.Equal(t, 1, m.Metadata.Retries)
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "retried message is not continued by the new forwarder")
+	}
+	close(msgChan)
+	wg.Wait()
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/bangunindo/trap2json/forwarder"
+	"github.com/bangunindo/trap2json/queue"
+	"github.com/bangunindo/trap2json/snmp"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+type replayOptions struct {
+	// MaxSpeed sends the records as fast as possible instead of following
+	// the original rate
+	MaxSpeed bool
+	// TimeOffset is added to the recorded time of each trap
+	TimeOffset time.Duration
+}
+
+// recordTime returns the time field of a raw snmptrapd record and the position of the field
+func recordTime(record []byte) (time.Time, int, int, error) {
+	// time field is the third field, the first two fields never contain separator
+	start := 0
+	for i := 0; i < int(snmp.HeaderTime); i++ {
+		idx := bytes.IndexByte(record[start:], '|')
+		if idx < 0 {
+			return time.Time{}, 0, 0, errors.New("record has no time field")
+		}
+		start += idx + 1
+	}
+	end := bytes.IndexByte(record[start:], '|')
+	if end < 0 {
+		return time.Time{}, 0, 0, errors.New("record has no time field")
+	}
+	end += start
+	unix, err := strconv.ParseInt(string(record[start:end]), 10, 64)
+	if err != nil {
+		return time.Time{}, 0, 0, errors.Wrap(err, "invalid time field")
+	}
+	return time.Unix(unix, 0), start, end, nil
+}
+
+// replayRecords reads raw snmptrapd records from r and writes them to w,
+// paced according to the recorded time and with the time field shifted by offset
+func replayRecords(ctx context.Context, conf snmp.Config, opts replayOptions, r io.Reader, w io.Writer) error {
+	logger := log.With().Str("module", "replay").Logger()
+	bufferSize, err := conf.GetBufferSize()
+	if err != nil {
+		logger.Warn().Err(err).Msg("failed parsing snmptrapd.buffer_size")
+		bufferSize = snmp.DefaultBufferSize
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Split(SplitAt(conf.MagicEnd))
+	scanner.Buffer(make([]byte, bufferSize), bufferSize)
+	magicBegin := []byte(conf.MagicBegin)
+	magicEnd := []byte(conf.MagicEnd)
+	var firstRecord time.Time
+	var started time.Time
+	var count int
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		idx := bytes.LastIndex(line, magicBegin)
+		if idx < 0 {
+			continue
+		}
+		record := line[idx+len(magicBegin):]
+		ts, start, end, err := recordTime(record)
+		if err != nil {
+			logger.Warn().Err(err).Bytes("data", record).Msg("skipping record")
+			continue
+		}
+		if !opts.MaxSpeed {
+			if firstRecord.IsZero() {
+				firstRecord = ts
+				started = time.Now()
+			}
+			if wait := time.Until(started.Add(ts.Sub(firstRecord))); wait > 0 {
+				timer := time.NewTimer(wait)
+				select {
+				case <-ctx.Done():
+					timer.Stop()
+					return ctx.Err()
+				case <-timer.C:
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		var buf bytes.Buffer
+		buf.Write(magicBegin)
+		buf.Write(record[:start])
+		buf.WriteString(strconv.FormatInt(ts.Add(opts.TimeOffset).Unix(), 10))
+		buf.Write(record[end:])
+		buf.Write(magicEnd)
+		if _, err = w.Write(buf.Bytes()); err != nil {
+			return errors.Wrap(err, "failed writing record")
+		}
+		count++
+	}
+	if err = scanner.Err(); err != nil {
+		return errors.Wrap(err, "failed reading records")
+	}
+	logger.Info().Int("records", count).Msg("replay finished")
+	return nil
+}
+
+// memoryQueue keeps queue config in memory, spill_to_disk blocks instead
+func memoryQueue(queueType *queue.Type, policy *queue.OverflowPolicy) {
+	*queueType = queue.TypeMemory
+	if *policy == queue.OverflowSpillToDisk {
+		*policy = queue.OverflowBlock
+	}
+}
+
+// isolate keeps c from touching the state of a trap2json instance that runs with
+// the same config: metrics port, config reload, disk queues and correlate backend
+func isolate(c config) config {
+	c.Prometheus.Enable = false
+	c.path = ""
+	c.Correlate.BackendURL = "badger://"
+	memoryQueue(&c.Correlate.QueueType, &c.Correlate.OverflowPolicy)
+	forwarders := make([]forwarder.Config, len(c.Forwarders))
+	for i, fwd := range c.Forwarders {
+		memoryQueue(&fwd.QueueType, &fwd.OverflowPolicy)
+		forwarders[i] = fwd
+	}
+	c.Forwarders = forwarders
+	return c
+}
+
+// Replay sends raw snmptrapd records from r through the configured pipeline,
+// the replayed traps keep their recorded time. It runs beside the live instance,
+// so correlate starts empty and queues are kept in memory
+func Replay(ctx context.Context, c config, opts replayOptions, r io.Reader) {
+	c = isolate(c)
+	c.SnmpTrapD.Mode = snmp.ModeSnmpTrapD
+	c.SnmpTrapD.UseRecordTime = true
+	pr, pw := io.Pipe()
+	go func() {
+		err := replayRecords(ctx, c.SnmpTrapD, opts, r, pw)
+		if err != nil && !errors.Is(err, context.Canceled) {
+			log.Error().Str("module", "replay").Err(err).Msg("replay failed")
+		}
+		// closing the writer stops Run once everything is forwarded
+		_ = pw.Close()
+	}()
+	Run(ctx, c, pr, true)
+	// unblock the writer in case Run stopped early
+	_ = pr.Close()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/bangunindo/trap2json/forwarder"
+	"github.com/bangunindo/trap2json/logger"
+	"github.com/bangunindo/trap2json/queue"
+	"github.com/bangunindo/trap2json/snmp"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const replayRecord = "--TFWDBEGIN--0.0.0.0|UDP: [192.168.215.1]:56983->[192.168.215.2]:10162|%d|0|Cold Start|.|" +
+	"TRAP2, SNMP v2c, community public|0|0|.1.3.6.1.2.1.1.3.0 = Timeticks: (1000) 0:00:10.00\t" +
+	".1.3.6.1.6.3.1.1.4.1.0 = OID: .1.3.6.1.4.1.8072.2.3.0.1--TFWDEND--\n"
+
+func TestRecordTime(t *testing.T) {
+	record := []byte(strings.TrimSuffix(strings.TrimPrefix(fmt.Sprintf(replayRecord, 1689145835), "--TFWDBEGIN--"), "--TFWDEND--\n"))
+	ts, start, end, err := recordTime(record)
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(1689145835), ts.Unix())
+		assert.Equal(t, "1689145835", string(record[start:end]))
+	}
+	_, _, _, err = recordTime([]byte("0.0.0.0|UDP: [192.168.215.1]:56983->[192.168.215.2]:10162"))
+	assert.Error(t, err)
+	_, _, _, err = recordTime([]byte("0.0.0.0|UDP|abc|0"))
+	assert.Error(t, err)
+}
+
+func TestReplayRecords(t *testing.T) {
+	conf := snmp.Config{
+		MagicBegin: "--TFWDBEGIN--",
+		MagicEnd:   "--TFWDEND--",
+		BufferSize: "64k",
+	}
+	in := fmt.Sprintf(replayRecord, 1689145835) + fmt.Sprintf(replayRecord, 1689145836)
+
+	var out bytes.Buffer
+	started := time.Now()
+	err := replayRecords(context.Background(), conf, replayOptions{TimeOffset: time.Hour}, strings.NewReader(in), &out)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(started), time.Second)
+	expected := fmt.Sprintf(replayRecord, 1689145835+3600) + fmt.Sprintf(replayRecord, 1689145836+3600)
+	assert.Equal(t, strings.ReplaceAll(expected, "\n", ""), out.String())
+
+	out.Reset()
+	started = time.Now()
+	err = replayRecords(context.Background(), conf, replayOptions{MaxSpeed: true}, strings.NewReader(in), &out)
+	assert.NoError(t, err)
+	assert.Less(t, time.Since(started), time.Second)
+	assert.Equal(t, strings.ReplaceAll(in, "\n", ""), out.String())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = replayRecords(ctx, conf, replayOptions{}, strings.NewReader(in), &out)
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestReplay(t *testing.T) {
+	conf, err := parseConfig("test_files/0000_regular_message.yml")
+	if !assert.NoError(t, err) {
+		return
+	}
+	logger.InitLogger(conf.Logger, os.Stderr)
+	outChan := make(chan *snmp.Message, 5)
+	conf.Forwarders[0].Mock.OutChannel = outChan
+	conf.ParseWorkers = 1
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		Replay(ctx, conf, replayOptions{MaxSpeed: true, TimeOffset: -time.Minute}, strings.NewReader(fmt.Sprintf(replayRecord, 1689145835)))
+		cancel()
+	}()
+	select {
+	case <-ctx.Done():
+		close(outChan)
+	case <-time.After(60 * time.Second):
+		assert.Fail(t, "timeout")
+		cancel()
+		return
+	}
+	var count int
+	for msg := range outChan {
+		assert.Equal(t, int64(1689145835-60), msg.Payload.Time.Unix())
+		count++
+	}
+	assert.Equal(t, 1, count)
+}
+
+func TestIsolate(t *testing.T) {
+	c := config{path: "/etc/trap2json/config.yml"}
+	c.Prometheus.Enable = true
+	c.Correlate.BackendURL = "redis://localhost:6379/0"
+	c.Correlate.QueueType = queue.TypeDisk
+	c.Forwarders = []forwarder.Config{
+		{QueueType: queue.TypeDisk},
+		{OverflowPolicy: queue.OverflowSpillToDisk},
+		{OverflowPolicy: queue.OverflowDropOldest},
+	}
+	isolated := isolate(c)
+	assert.False(t, isolated.Prometheus.Enable)
+	assert.Empty(t, isolated.path)
+	assert.Equal(t, "badger://", isolated.Correlate.BackendURL)
+	assert.Equal(t, queue.TypeMemory, isolated.Correlate.QueueType)
+	for _, fwd := range isolated.Forwarders {
+		assert.Equal(t, queue.TypeMemory, fwd.QueueType)
+	}
+	assert.Equal(t, queue.OverflowBlock, isolated.Forwarders[1].OverflowPolicy)
+	assert.Equal(t, queue.OverflowDropOldest, isolated.Forwarders[2].OverflowPolicy)
+	// the original config is left as is
+	assert.Equal(t, queue.TypeDisk, c.Forwarders[0].QueueType)
+}
@@ -0,0 +1,36 @@
+package snmp
+
+import (
+	"bytes"
+	"encoding/gob"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	// types that might be stored inside Value.Value and ValueDetail.Raw
+	gob.Register(time.Time{})
+	gob.Register([]byte{})
+}
+
+// MessageCodec encodes the whole message including its metadata, so a message
+// can continue from the same retry state after being read from disk queue.
+// gob is used instead of json to keep the dynamic value types
+type MessageCodec struct{}
+
+func (MessageCodec) Encode(m *Message) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(m); err != nil {
+		return nil, errors.Wrap(err, "failed encoding message")
+	}
+	return buf.Bytes(), nil
+}
+
+func (MessageCodec) Decode(data []byte) (*Message, error) {
+	m := new(Message)
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(m); err != nil {
+		return nil, errors.Wrap(err, "failed decoding message")
+	}
+	return m, nil
+}
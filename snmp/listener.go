@@ -0,0 +1,505 @@
+package snmp
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bangunindo/trap2json/metrics"
+	"github.com/gosnmp/gosnmp"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	maxPacketSize            = 65535
+	usmStatsUnknownEngineIDs = ".1.3.6.1.6.3.15.1.1.4.0"
+	// defaultEngineID uses net-snmp enterprise number with text format
+	defaultEngineID = "0x80001f880474726170326a736f6e"
+)
+
+// parseEngineID converts engine id in hex format (with or without 0x prefix) to its raw bytes
+func parseEngineID(engineID string) (string, error) {
+	engineID = strings.TrimPrefix(strings.ToLower(engineID), "0x")
+	raw, err := hex.DecodeString(engineID)
+	if err != nil {
+		return "", errors.Wrap(err, "engine_id is not a valid hex string")
+	}
+	if len(raw) < 5 || len(raw) > 32 {
+		return "", errors.Errorf("engine_id length must be between 5 and 32 bytes, got %d", len(raw))
+	}
+	return string(raw), nil
+}
+
+// parseListenAddress converts snmptrapd's listening address format
+// ([transport:]address[:port]) to golang's network and address
+func parseListenAddress(addr string) (string, string, error) {
+	network := "udp"
+	if i := strings.Index(addr, ":"); i >= 0 {
+		switch strings.ToLower(addr[:i]) {
+		case "udp", "udp6", "tcp", "tcp6":
+			network = strings.ToLower(addr[:i])
+			addr = addr[i+1:]
+		}
+	}
+	if !strings.Contains(addr, ":") || (strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]")) {
+		// only port or only address is specified
+		if _, err := net.LookupPort(network, addr); err == nil {
+			addr = ":" + addr
+		} else {
+			addr = net.JoinHostPort(strings.Trim(addr, "[]"), "162")
+		}
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "invalid listening address %s", addr)
+	}
+	switch network {
+	case "udp", "tcp":
+		network += "4"
+		if host == "" {
+			host = "0.0.0.0"
+		}
+	case "udp6", "tcp6":
+		if host == "" {
+			host = "::"
+		}
+	}
+	return network, net.JoinHostPort(host, port), nil
+}
+
+// Listener receives trap and inform messages natively without relying on snmptrapd.
+// It uses the same AuthConfig as the generated snmptrapd.conf
+type Listener struct {
+	conf          Config
+	logger        zerolog.Logger
+	out           chan<- *Message
+	decoder       *gosnmp.GoSNMP
+	noAuthDecoder *gosnmp.GoSNMP
+	communities   map[string]bool
+	users         map[string]User
+	engineID      string
+	startTime     time.Time
+	unknownEngine *atomic.Uint32
+	wg            *sync.WaitGroup
+}
+
+func usmParameters(u User, engineID string) *gosnmp.UsmSecurityParameters {
+	sp := &gosnmp.UsmSecurityParameters{
+		AuthoritativeEngineID:  engineID,
+		UserName:               u.Username,
+		AuthenticationProtocol: gosnmp.NoAuth,
+		PrivacyProtocol:        gosnmp.NoPriv,
+	}
+	if u.AuthPassphrase == "" {
+		return sp
+	}
+	sp.AuthenticationPassphrase = u.AuthPassphrase
+	switch u.AuthType {
+	case AuthMD5:
+		sp.AuthenticationProtocol = gosnmp.MD5
+	case AuthSHA224:
+		sp.AuthenticationProtocol = gosnmp.SHA224
+	case AuthSHA256:
+		sp.AuthenticationProtocol = gosnmp.SHA256
+	case AuthSHA384:
+		sp.AuthenticationProtocol = gosnmp.SHA384
+	case AuthSHA512:
+		sp.AuthenticationProtocol = gosnmp.SHA512
+	default:
+		sp.AuthenticationProtocol = gosnmp.SHA
+	}
+	// same as snmptrapd, empty privacy_passphrase falls back to auth_passphrase
+	sp.PrivacyPassphrase = u.PrivacyPassphrase
+	if sp.PrivacyPassphrase == "" {
+		sp.PrivacyPassphrase = u.AuthPassphrase
+	}
+	switch u.PrivacyProtocol {
+	case PrivDES:
+		sp.PrivacyProtocol = gosnmp.DES
+	case PrivAES192:
+		sp.PrivacyProtocol = gosnmp.AES192
+	case PrivAES256:
+		sp.PrivacyProtocol = gosnmp.AES256
+	default:
+		sp.PrivacyProtocol = gosnmp.AES
+	}
+	return sp
+}
+
+func (l *Listener) decode(raw []byte) (*gosnmp.SnmpPacket, error) {
+	packet, err := l.decoder.UnmarshalTrap(raw, false)
+	if err == nil {
+		return packet, nil
+	}
+	// unknown v3 user or engine discovery, only valid for noAuthNoPriv messages
+	packet, errNoAuth := l.noAuthDecoder.UnmarshalTrap(raw, false)
+	if errNoAuth != nil || packet.Version != gosnmp.Version3 || packet.MsgFlags&gosnmp.AuthNoPriv > 0 {
+		return nil, err
+	}
+	return packet, nil
+}
+
+func (l *Listener) authorize(packet *gosnmp.SnmpPacket) error {
+	switch packet.Version {
+	case gosnmp.Version1, gosnmp.Version2c:
+		if l.conf.Auth.Enable && !l.communities[packet.Community] {
+			return errors.Errorf("unknown community %s", packet.Community)
+		}
+	case gosnmp.Version3:
+		sp, ok := packet.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+		if !ok {
+			return errors.New("unsupported security model")
+		}
+		noAuth := packet.MsgFlags&gosnmp.AuthNoPriv == 0
+		noPriv := packet.MsgFlags&gosnmp.AuthPriv <= gosnmp.AuthNoPriv
+		if !l.conf.Auth.Enable {
+			if _, ok = l.users[sp.UserName]; !ok && !noAuth {
+				return errors.Errorf("unknown user %s", sp.UserName)
+			}
+			return nil
+		}
+		user, ok := l.users[sp.UserName]
+		if !ok {
+			return errors.Errorf("unknown user %s", sp.UserName)
+		}
+		if user.RequirePrivacy && noPriv {
+			return errors.Errorf("user %s requires privacy", sp.UserName)
+		}
+		if !user.NoAuth && noAuth {
+			return errors.Errorf("user %s requires authentication", sp.UserName)
+		}
+	}
+	return nil
+}
+
+// report responds to v3 engine discovery so the sender can learn our engine id
+func (l *Listener) report(request *gosnmp.SnmpPacket) ([]byte, error) {
+	report := &gosnmp.SnmpPacket{
+		Version:       gosnmp.Version3,
+		MsgFlags:      gosnmp.NoAuthNoPriv,
+		SecurityModel: gosnmp.UserSecurityModel,
+		SecurityParameters: &gosnmp.UsmSecurityParameters{
+			AuthoritativeEngineID:    l.engineID,
+			AuthoritativeEngineBoots: 1,
+			AuthoritativeEngineTime:  uint32(time.Since(l.startTime).Seconds()),
+		},
+		ContextEngineID: l.engineID,
+		PDUType:         gosnmp.Report,
+		MsgID:           request.MsgID,
+		RequestID:       request.RequestID,
+		MsgMaxSize:      maxPacketSize,
+		Variables: []gosnmp.SnmpPDU{
+			{
+				Name:  usmStatsUnknownEngineIDs,
+				Type:  gosnmp.Counter32,
+				Value: uint(l.unknownEngine.Add(1)),
+			},
+		},
+	}
+	return report.MarshalMsg()
+}
+
+// acknowledge builds the response for inform request
+func (l *Listener) acknowledge(packet *gosnmp.SnmpPacket) ([]byte, error) {
+	packet.PDUType = gosnmp.GetResponse
+	packet.Error = gosnmp.NoError
+	packet.ErrorIndex = 0
+	packet.MsgFlags &^= gosnmp.Reportable
+	if packet.Version == gosnmp.Version3 && packet.SecurityParameters != nil {
+		if err := packet.SecurityParameters.InitPacket(packet); err != nil {
+			return nil, err
+		}
+	}
+	return packet.MarshalMsg()
+}
+
+// handle processes a single snmp message and returns the response to be sent back, if any
+func (l *Listener) handle(raw []byte, src, dst net.Addr) []byte {
+	metrics.ListenerProcessed.Inc()
+	metrics.ListenerProcessedBytes.Add(float64(len(raw)))
+	logger := l.logger.With().Str("source", src.String()).Logger()
+	packet, err := l.decode(raw)
+	if err != nil {
+		logger.Debug().Err(err).Msg("dropping undecodable message")
+		metrics.ListenerDropped.Inc()
+		return nil
+	}
+	if packet.Version == gosnmp.Version3 {
+		if sp, ok := packet.SecurityParameters.(*gosnmp.UsmSecurityParameters); ok &&
+			packet.PDUType == gosnmp.GetRequest &&
+			sp.AuthoritativeEngineID != l.engineID {
+			logger.Trace().Msg("responding to engine discovery")
+			resp, err := l.report(packet)
+			if err != nil {
+				logger.Warn().Err(err).Msg("failed building discovery report")
+			}
+			return resp
+		}
+	}
+	switch packet.PDUType {
+	case gosnmp.Trap, gosnmp.SNMPv2Trap, gosnmp.InformRequest:
+	default:
+		logger.Debug().Str("pdu_type", packet.PDUType.String()).Msg("dropping unsupported pdu")
+		metrics.ListenerDropped.Inc()
+		return nil
+	}
+	if err = l.authorize(packet); err != nil {
+		logger.Debug().Err(err).Msg("dropping unauthorized message")
+		metrics.ListenerDropped.Inc()
+		return nil
+	}
+	var msg Message
+	if err = msg.UnmarshalPacket(packet, src, dst); err != nil {
+		logger.Debug().Err(err).Msg("message parsing failed")
+		metrics.ListenerDropped.Inc()
+		return nil
+	}
+	msg.Metadata.Eta = time.Now()
+	l.out <- &msg
+	metrics.ListenerSucceeded.Inc()
+	if packet.PDUType == gosnmp.InformRequest {
+		resp, err := l.acknowledge(packet)
+		if err != nil {
+			logger.Warn().Err(err).Msg("failed building inform response")
+		}
+		return resp
+	}
+	return nil
+}
+
+func (l *Listener) serveUDP(conn *net.UDPConn) {
+	defer l.wg.Done()
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, src, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			l.logger.Warn().Err(err).Msg("failed reading packet")
+			continue
+		}
+		raw := make([]byte, n)
+		copy(raw, buf[:n])
+		if resp := l.handle(raw, src, conn.LocalAddr()); resp != nil {
+			if _, err = conn.WriteToUDP(resp, src); err != nil {
+				l.logger.Warn().Err(err).Msg("failed sending response")
+			}
+		}
+	}
+}
+
+// readBER reads a single BER encoded sequence, which is how snmp messages are framed over tcp
+func readBER(r *bufio.Reader) ([]byte, error) {
+	header := make([]byte, 2, 6)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := int(header[1])
+	if length&0x80 > 0 {
+		lenBytes := length & 0x7f
+		if lenBytes == 0 || lenBytes > 4 {
+			return nil, errors.New("unsupported BER length")
+		}
+		lenRaw := make([]byte, lenBytes)
+		if _, err := io.ReadFull(r, lenRaw); err != nil {
+			return nil, err
+		}
+		header = append(header, lenRaw...)
+		length = 0
+		for _, b := range lenRaw {
+			length = length<<8 | int(b)
+		}
+	}
+	if length > maxPacketSize {
+		return nil, errors.Errorf("message too large: %d", length)
+	}
+	msg := make([]byte, len(header)+length)
+	copy(msg, header)
+	if _, err := io.ReadFull(r, msg[len(header):]); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func (l *Listener) serveTCPConn(conn net.Conn) {
+	defer l.wg.Done()
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		raw, err := readBER(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				l.logger.Debug().Err(err).Str("source", conn.RemoteAddr().String()).Msg("closing connection")
+			}
+			return
+		}
+		if resp := l.handle(raw, conn.RemoteAddr(), conn.LocalAddr()); resp != nil {
+			if _, err = conn.Write(resp); err != nil {
+				l.logger.Warn().Err(err).Msg("failed sending response")
+				return
+			}
+		}
+	}
+}
+
+func (l *Listener) serveTCP(ctx context.Context, ln net.Listener) {
+	defer l.wg.Done()
+	connWg := new(sync.WaitGroup)
+	var mutex sync.Mutex
+	conns := make(map[net.Conn]struct{})
+	go func() {
+		<-ctx.Done()
+		mutex.Lock()
+		defer mutex.Unlock()
+		for conn := range conns {
+			_ = conn.Close()
+		}
+	}()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				break
+			}
+			l.logger.Warn().Err(err).Msg("failed accepting connection")
+			continue
+		}
+		mutex.Lock()
+		// accepted right before the listener is closed, the connections
+		// are already closed so nothing would close this one
+		if ctx.Err() != nil {
+			mutex.Unlock()
+			_ = conn.Close()
+			continue
+		}
+		conns[conn] = struct{}{}
+		mutex.Unlock()
+		connWg.Add(1)
+		l.wg.Add(1)
+		go func() {
+			defer connWg.Done()
+			defer func() {
+				mutex.Lock()
+				delete(conns, conn)
+				mutex.Unlock()
+			}()
+			l.serveTCPConn(conn)
+		}()
+	}
+	connWg.Wait()
+}
+
+// Run listens on all configured addresses and blocks until ctx is cancelled
+func (l *Listener) Run(ctx context.Context) error {
+	var closers []io.Closer
+	closeAll := func() {
+		for _, c := range closers {
+			_ = c.Close()
+		}
+	}
+	for _, listening := range l.conf.Listening {
+		network, addr, err := parseListenAddress(listening)
+		if err != nil {
+			closeAll()
+			return err
+		}
+		switch network {
+		case "udp4", "udp6":
+			udpAddr, err := net.ResolveUDPAddr(network, addr)
+			if err != nil {
+				closeAll()
+				return errors.Wrapf(err, "failed resolving %s", listening)
+			}
+			conn, err := net.ListenUDP(network, udpAddr)
+			if err != nil {
+				closeAll()
+				return errors.Wrapf(err, "failed listening on %s", listening)
+			}
+			closers = append(closers, conn)
+			l.wg.Add(1)
+			go l.serveUDP(conn)
+		case "tcp4", "tcp6":
+			ln, err := net.Listen(network, addr)
+			if err != nil {
+				closeAll()
+				return errors.Wrapf(err, "failed listening on %s", listening)
+			}
+			closers = append(closers, ln)
+			l.wg.Add(1)
+			go l.serveTCP(ctx, ln)
+		}
+		l.logger.Info().Str("address", listening).Msg("listening for traps")
+	}
+	<-ctx.Done()
+	closeAll()
+	l.wg.Wait()
+	return nil
+}
+
+func NewListener(c Config, out chan<- *Message) (*Listener, error) {
+	logger := log.With().Str("module", "listener").Logger()
+	l := &Listener{
+		conf:          c,
+		logger:        logger,
+		out:           out,
+		communities:   make(map[string]bool),
+		users:         make(map[string]User),
+		startTime:     time.Now(),
+		unknownEngine: new(atomic.Uint32),
+		wg:            new(sync.WaitGroup),
+	}
+	engineID := c.EngineID
+	if engineID == "" {
+		engineID = defaultEngineID
+	}
+	var err error
+	if l.engineID, err = parseEngineID(engineID); err != nil {
+		return nil, err
+	}
+	for _, comm := range c.Auth.Community {
+		l.communities[comm.Name] = true
+	}
+	table := gosnmp.NewSnmpV3SecurityParametersTable(gosnmp.Logger{})
+	for _, user := range c.Auth.User {
+		if user.Username == "" {
+			return nil, errors.New("empty username")
+		}
+		l.users[user.Username] = user
+		// traps are authenticated with the sender's engine id, while informs
+		// are authenticated with ours
+		engineIDs := []string{l.engineID}
+		if user.EngineID != "" {
+			userEngineID, err := parseEngineID(user.EngineID)
+			if err != nil {
+				return nil, errors.Wrapf(err, "user %s", user.Username)
+			}
+			engineIDs = append(engineIDs, userEngineID)
+		}
+		for _, e := range engineIDs {
+			if err = table.Add(user.Username, usmParameters(user, e)); err != nil {
+				return nil, errors.Wrapf(err, "failed adding user %s", user.Username)
+			}
+		}
+	}
+	l.decoder = &gosnmp.GoSNMP{
+		Version:                     gosnmp.Version3,
+		SecurityModel:               gosnmp.UserSecurityModel,
+		TrapSecurityParametersTable: table,
+	}
+	l.noAuthDecoder = &gosnmp.GoSNMP{
+		Version:            gosnmp.Version3,
+		SecurityModel:      gosnmp.UserSecurityModel,
+		MsgFlags:           gosnmp.NoAuthNoPriv,
+		SecurityParameters: &gosnmp.UsmSecurityParameters{},
+	}
+	return l, nil
+}
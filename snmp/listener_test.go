@@ -0,0 +1,189 @@
+package snmp
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseListenAddress(t *testing.T) {
+	cases := map[string][2]string{
+		"udp:10162":          {"udp4", "0.0.0.0:10162"},
+		"udp6:10162":         {"udp6", "[::]:10162"},
+		"tcp:127.0.0.1:162":  {"tcp4", "127.0.0.1:162"},
+		"udp6:[::1]:10162":   {"udp6", "[::1]:10162"},
+		"10162":              {"udp4", "0.0.0.0:10162"},
+		"udp:127.0.0.1":      {"udp4", "127.0.0.1:162"},
+		"tcp6:[2001:db8::1]": {"tcp6", "[2001:db8::1]:162"},
+	}
+	for in, expected := range cases {
+		network, addr, err := parseListenAddress(in)
+		if assert.NoError(t, err, in) {
+			assert.Equal(t, expected[0], network, in)
+			assert.Equal(t, expected[1], addr, in)
+		}
+	}
+}
+
+func freePort(t *testing.T) int {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+func TestListener(t *testing.T) {
+	port := freePort(t)
+	out := make(chan *Message, 10)
+	l, err := NewListener(Config{
+		Listening: []string{"udp:127.0.0.1:" + strconv.Itoa(port)},
+		Auth: AuthConfig{
+			Enable:    true,
+			Community: []Community{{Name: "public"}},
+			User: []User{
+				{
+					Username:          "traptest",
+					AuthType:          AuthSHA,
+					AuthPassphrase:    "testauth",
+					PrivacyProtocol:   PrivAES,
+					PrivacyPassphrase: "testpriv",
+				},
+			},
+		},
+	}, out)
+	if !assert.NoError(t, err) {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		assert.NoError(t, l.Run(ctx))
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	trap := gosnmp.SnmpTrap{
+		Variables: []gosnmp.SnmpPDU{
+			{Name: ".1.3.6.1.2.1.1.3.0", Type: gosnmp.TimeTicks, Value: uint32(1000)},
+			{Name: ".1.3.6.1.6.3.1.1.4.1.0", Type: gosnmp.ObjectIdentifier, Value: ".1.3.6.1.4.1.8072.2.3.0.1"},
+			{Name: ".1.3.6.1.4.1.8072.2.3.2.1", Type: gosnmp.Integer, Value: 123},
+			{Name: ".1.3.6.1.4.1.8072.2.3.2.2", Type: gosnmp.OctetString, Value: []byte("normal")},
+			{Name: ".1.3.6.1.4.1.8072.2.3.2.3", Type: gosnmp.OctetString, Value: []byte{0x00, 0xff, 0x10}},
+		},
+	}
+	client := &gosnmp.GoSNMP{
+		Target:    "127.0.0.1",
+		Port:      uint16(port),
+		Version:   gosnmp.Version2c,
+		Community: "public",
+		Timeout:   time.Second,
+		Retries:   1,
+	}
+	if !assert.NoError(t, client.Connect()) {
+		return
+	}
+	_, err = client.SendTrap(trap)
+	assert.NoError(t, err)
+	select {
+	case m := <-out:
+		assert.Equal(t, "TRAP2", m.Payload.PDUVersion)
+		assert.Equal(t, "v2c", m.Payload.SNMPVersion)
+		assert.Equal(t, "127.0.0.1", m.Payload.SrcAddress)
+		assert.Equal(t, port, m.Payload.DstPort)
+		if assert.NotNil(t, m.Payload.Community) {
+			assert.Equal(t, "public", *m.Payload.Community)
+		}
+		if assert.NotNil(t, m.Payload.UptimeSeconds) {
+			assert.Equal(t, 10.0, *m.Payload.UptimeSeconds)
+		}
+		if assert.NotNil(t, m.Payload.EnterpriseOID) {
+			assert.Equal(t, ".1.3.6.1.4.1.8072.2.3.0.1", *m.Payload.EnterpriseOID)
+		}
+		if assert.Len(t, m.Payload.Values, 5) {
+			assert.Equal(t, "10s", m.Payload.Values[0].Value)
+			assert.Equal(t, 123, m.Payload.Values[2].Value)
+			assert.Equal(t, "normal", m.Payload.Values[3].Value)
+			assert.Equal(t, TypeBytes, m.Payload.Values[4].Type)
+			assert.Equal(t, "00FF10", m.Payload.Values[4].ValueDetail.Hex)
+		}
+	case <-time.After(time.Second):
+		assert.Fail(t, "trap not received")
+	}
+	client.Conn.Close()
+
+	// unknown community is dropped
+	client.Community = "private"
+	if assert.NoError(t, client.Connect()) {
+		_, err = client.SendTrap(trap)
+		assert.NoError(t, err)
+		select {
+		case <-out:
+			assert.Fail(t, "unauthorized trap is forwarded")
+		case <-time.After(100 * time.Millisecond):
+		}
+		client.Conn.Close()
+	}
+
+	// inform is acknowledged
+	client.Community = "public"
+	trap.IsInform = true
+	if assert.NoError(t, client.Connect()) {
+		_, err = client.SendTrap(trap)
+		assert.NoError(t, err)
+		select {
+		case m := <-out:
+			assert.Equal(t, "INFORM", m.Payload.PDUVersion)
+		case <-time.After(time.Second):
+			assert.Fail(t, "inform not received")
+		}
+		client.Conn.Close()
+	}
+
+	// v3 inform goes through engine discovery
+	v3Client := &gosnmp.GoSNMP{
+		Target:        "127.0.0.1",
+		Port:          uint16(port),
+		Version:       gosnmp.Version3,
+		Timeout:       time.Second,
+		Retries:       1,
+		SecurityModel: gosnmp.UserSecurityModel,
+		MsgFlags:      gosnmp.AuthPriv,
+		SecurityParameters: &gosnmp.UsmSecurityParameters{
+			UserName:                 "traptest",
+			AuthenticationProtocol:   gosnmp.SHA,
+			AuthenticationPassphrase: "testauth",
+			PrivacyProtocol:          gosnmp.AES,
+			PrivacyPassphrase:        "testpriv",
+		},
+		ContextName: "ctx",
+	}
+	if assert.NoError(t, v3Client.Connect()) {
+		_, err = v3Client.SendTrap(trap)
+		assert.NoError(t, err)
+		select {
+		case m := <-out:
+			assert.Equal(t, "INFORM", m.Payload.PDUVersion)
+			assert.Equal(t, "v3", m.Payload.SNMPVersion)
+			if assert.NotNil(t, m.Payload.User) {
+				assert.Equal(t, "traptest", *m.Payload.User)
+			}
+			if assert.NotNil(t, m.Payload.Context) {
+				assert.Equal(t, "ctx", *m.Payload.Context)
+			}
+		case <-time.After(time.Second):
+			assert.Fail(t, "v3 inform not received")
+		}
+		v3Client.Conn.Close()
+	}
+}
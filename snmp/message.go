@@ -140,6 +140,14 @@ func (v *ValueType) parseDateTime(text string) (any, ValueDetail, error) {
 	}
 }
 
+// parseTimeTicks converts timeticks (hundredths of a second) to duration string,
+// the raw value is in seconds
+func parseTimeTicks(ticks int) (any, ValueDetail) {
+	durSecs := float64(ticks) / 100
+	durStr, _ := time.ParseDuration(fmt.Sprintf("%.2fs", durSecs))
+	return durStr.String(), ValueDetail{Raw: durSecs}
+}
+
 func (v *ValueType) Parse(text string) (any, ValueDetail, error) {
 	switch *v {
 	case TypeNull:
@@ -149,9 +157,8 @@ func (v *ValueType) Parse(text string) (any, ValueDetail, error) {
 	case TypeDuration:
 		if dur := durationPattern.FindStringSubmatch(text); len(dur) > 1 {
 			if durInt, err := strconv.Atoi(dur[1]); err == nil {
-				durSecs := float64(durInt) / 100
-				durStr, _ := time.ParseDuration(fmt.Sprintf("%.2fs", durSecs))
-				return durStr.String(), ValueDetail{Raw: float64(durInt) / 100}, nil
+				val, valDetail := parseTimeTicks(durInt)
+				return val, valDetail, nil
 			} else {
 				return text, ValueDetail{}, errors.Wrapf(err, "failed casting timeticks: %s", text)
 			}
@@ -263,7 +270,10 @@ type MessageCompiler struct {
 }
 
 type Correlate struct {
-	ID              string          `json:"id" expr:"id"`
+	ID string `json:"id" expr:"id"`
+	// Key is the hash of the condition identifiers, it's the same for raise and clear.
+	// It's only available in expressions, the json of correlate is kept as it was
+	Key             string          `json:"-" expr:"key"`
 	RaisedTime      time.Time       `json:"raised_time" expr:"raised_time"`
 	Duration        helper.Duration `json:"duration" expr:"duration"`
 	DurationSeconds float64         `json:"duration_seconds" expr:"duration_seconds"`
@@ -289,6 +299,9 @@ type Payload struct {
 	TrapSubType       *int64     `json:"trap_sub_type" expr:"trap_sub_type"`
 	Values            []Value    `json:"values" expr:"value_list"`
 	Correlate         *Correlate `json:"correlate" expr:"correlate"`
+	// Raise is set by correlate on raise traps, it's not part of the json so correlate
+	// is only filled on clear traps
+	Raise *Correlate `json:"-" expr:"raise"`
 }
 
 type Metadata struct {
@@ -299,17 +312,32 @@ type Metadata struct {
 	Compiled       bool
 	TimeAsTimezone string
 	TimeFormat     string
+	// DeadLettered marks a dead letter record, MessageJSON holds the record
+	DeadLettered bool
 }
 
 type Message struct {
 	Payload  *Payload
 	Metadata Metadata
+	// useRecordTime makes UnmarshalText take the time from snmptrapd record
+	useRecordTime bool
+	// queueKey is set by disk queue, it's not encoded since it's only valid for that queue
+	queueKey []byte
 }
 
 func (m *Message) Eta() time.Time {
 	return m.Metadata.Eta
 }
 
+func (m *Message) SetQueueKey(key []byte) {
+	m.queueKey = key
+}
+
+// QueueKey is the key of the disk queue the message is received from, see queue.Keyed
+func (m *Message) QueueKey() []byte {
+	return m.queueKey
+}
+
 // Copy is only a shallow copy, only the metadata is different between messages
 func (m *Message) Copy() Message {
 	var mCopy Message
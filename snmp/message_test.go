@@ -1,6 +1,7 @@
 package snmp
 
 import (
+	"github.com/bangunindo/trap2json/helper"
 	"github.com/stretchr/testify/assert"
 	"testing"
 	"time"
@@ -52,3 +53,51 @@ func TestValueType_Parse(t *testing.T) {
 	assert.True(t, ok)
 	assert.Equal(t, "10.0.0.1", valS)
 }
+
+func TestMessageCodec(t *testing.T) {
+	community := "public"
+	now := time.Now()
+	m := &Message{
+		Payload: &Payload{
+			Time:       now,
+			SrcAddress: "127.0.0.1",
+			Community:  &community,
+			Values: []Value{
+				{OID: ".1.3.6.1.2.1.1.3.0", Type: TypeDuration, Value: "2s", ValueDetail: ValueDetail{Raw: 2.0}},
+				{OID: ".1.3.6.1.2.1.2.2.1.8", Type: TypeEnum, Value: "down", ValueDetail: ValueDetail{Raw: 2}},
+				{OID: ".1.3.6.1.2.1.25.1.2.0", Type: TypeDateAndTime, Value: now},
+				{OID: ".1.3.6.1.6.3.1.1.4.3.0", Type: TypeNull},
+			},
+			Correlate: &Correlate{
+				ID:       "abc",
+				Key:      "alarm",
+				Duration: helper.Duration{Duration: time.Minute},
+			},
+		},
+		Metadata: Metadata{
+			Retries: 3,
+			Eta:     now.Add(time.Minute),
+		},
+	}
+	var codec MessageCodec
+	data, err := codec.Encode(m)
+	if !assert.NoError(t, err) {
+		return
+	}
+	decoded, err := codec.Decode(data)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 3, decoded.Metadata.Retries)
+	assert.True(t, m.Metadata.Eta.Equal(decoded.Metadata.Eta))
+	assert.True(t, m.Payload.Time.Equal(decoded.Payload.Time))
+	assert.Equal(t, "public", *decoded.Payload.Community)
+	// dynamic types are kept
+	assert.Equal(t, 2.0, decoded.Payload.Values[0].ValueDetail.Raw)
+	assert.Equal(t, 2, decoded.Payload.Values[1].ValueDetail.Raw)
+	assert.IsType(t, time.Time{}, decoded.Payload.Values[2].Value)
+	assert.Nil(t, decoded.Payload.Values[3].Value)
+	assert.Equal(t, time.Minute, decoded.Payload.Correlate.Duration.Duration)
+	// key isn't in the json, but it's kept in the queue
+	assert.Equal(t, "alarm", decoded.Payload.Correlate.Key)
+}
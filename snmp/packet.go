@@ -0,0 +1,257 @@
+package snmp
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+)
+
+// genericTrapNames follows snmptrapd's description of v1 generic trap types
+var genericTrapNames = map[int]string{
+	0: "Cold Start",
+	1: "Warm Start",
+	2: "Link Down",
+	3: "Link Up",
+	4: "Authentication Failure",
+	5: "EGP Neighbor Loss",
+	6: "Enterprise Specific",
+}
+
+func addrPort(addr net.Addr) (string, int) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP.String(), a.Port
+	case *net.TCPAddr:
+		return a.IP.String(), a.Port
+	default:
+		return "", 0
+	}
+}
+
+func isPrintable(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// formatDateAndTime renders DateAndTime octets the same way snmptrapd renders
+// them using the display hint 2d-1d-1d,1d:1d:1d.1d,1a1d:1d
+func formatDateAndTime(b []byte) (string, error) {
+	if len(b) != 8 && len(b) != 11 {
+		return "", errors.Errorf("invalid DateAndTime length %d", len(b))
+	}
+	text := fmt.Sprintf(
+		"%d-%d-%d,%d:%d:%d.%d",
+		int(b[0])<<8|int(b[1]),
+		b[2],
+		b[3],
+		b[4],
+		b[5],
+		b[6],
+		b[7],
+	)
+	if len(b) == 11 {
+		text += fmt.Sprintf(",%c%d:%d", b[8], b[9], b[10])
+	}
+	return text, nil
+}
+
+func toInt(val any) (int, bool) {
+	switch v := val.(type) {
+	case int:
+		return v, true
+	case uint:
+		if v <= math.MaxInt {
+			return int(v), true
+		}
+	case uint32:
+		return int(v), true
+	case uint64:
+		if v <= math.MaxInt {
+			return int(v), true
+		}
+	}
+	return 0, false
+}
+
+func valueFromPDU(pdu gosnmp.SnmpPDU) Value {
+	oid := pdu.Name
+	if !strings.HasPrefix(oid, ".") {
+		oid = "." + oid
+	}
+	mibName, node, _ := translateOID(oid)
+	value := Value{
+		OID:     oid,
+		MIBName: mibName,
+	}
+	var valType ValueType
+	var err error
+	switch pdu.Type {
+	case gosnmp.Integer:
+		value.NativeType = "integer"
+		valType = TypeInteger
+		v, _ := toInt(pdu.Value)
+		if node != nil && node.Type != nil && node.Type.Enum != nil {
+			valType = TypeEnum
+			value.Value = node.Type.Enum.Name(int64(v))
+			value.ValueDetail = ValueDetail{Raw: v}
+		} else {
+			value.Value = v
+		}
+	case gosnmp.Counter32, gosnmp.Counter64, gosnmp.Gauge32, gosnmp.Uinteger32:
+		switch pdu.Type {
+		case gosnmp.Counter32:
+			value.NativeType = "counter32"
+		case gosnmp.Counter64:
+			value.NativeType = "counter64"
+		case gosnmp.Gauge32:
+			value.NativeType = "gauge32"
+		default:
+			value.NativeType = "unsigned32"
+		}
+		valType = TypeInteger
+		if v, ok := toInt(pdu.Value); ok {
+			value.Value = v
+		} else {
+			value.Value = pdu.Value
+		}
+	case gosnmp.TimeTicks:
+		value.NativeType = "timeticks"
+		valType = TypeDuration
+		v, _ := toInt(pdu.Value)
+		value.Value, value.ValueDetail = parseTimeTicks(v)
+	case gosnmp.IPAddress:
+		value.NativeType = "ipaddress"
+		valType = TypeIpAddress
+		value.Value = fmt.Sprint(pdu.Value)
+	case gosnmp.ObjectIdentifier:
+		value.NativeType = "oid"
+		valType = TypeOID
+		value.Value, value.ValueDetail, err = valType.Parse(fmt.Sprint(pdu.Value))
+	case gosnmp.OctetString:
+		b, _ := pdu.Value.([]byte)
+		if node != nil && node.Type != nil && valType.FromMIB(node.Type.Name) == nil {
+			// DateAndTime
+			value.NativeType = "string"
+			var text string
+			if text, err = formatDateAndTime(b); err == nil {
+				value.Value, value.ValueDetail, err = valType.Parse(text)
+			}
+			if err != nil {
+				valType = TypeBytes
+				value.NativeType = "hex-string"
+				value.Value, value.ValueDetail, err = valType.Parse(strings.ToUpper(hex.EncodeToString(b)))
+			}
+		} else if isPrintable(b) {
+			value.NativeType = "string"
+			valType = TypeString
+			value.Value = string(b)
+		} else {
+			value.NativeType = "hex-string"
+			valType = TypeBytes
+			value.Value, value.ValueDetail, err = valType.Parse(strings.ToUpper(hex.EncodeToString(b)))
+		}
+	case gosnmp.Null, gosnmp.NoSuchObject, gosnmp.NoSuchInstance, gosnmp.EndOfMibView:
+		value.NativeType = "null"
+		valType = TypeNull
+	default:
+		value.NativeType = strings.ToLower(pdu.Type.String())
+		if b, ok := pdu.Value.([]byte); ok {
+			valType = TypeBytes
+			value.Value, value.ValueDetail, err = valType.Parse(strings.ToUpper(hex.EncodeToString(b)))
+		} else {
+			valType = TypeUnknown
+			value.Value = pdu.Value
+		}
+	}
+	if err != nil {
+		log.Debug().Err(err).Str("oid", oid).Msg("parsing surrender")
+	}
+	value.Type = valType
+	return value
+}
+
+// UnmarshalPacket fills the message from a decoded snmp packet. It's the native listener
+// counterpart of UnmarshalText, and produces the same payload as snmptrapd would
+func (m *Message) UnmarshalPacket(packet *gosnmp.SnmpPacket, src, dst net.Addr) error {
+	if m.Payload == nil {
+		m.Payload = new(Payload)
+	}
+	m.Payload.SrcAddress, m.Payload.SrcPort = addrPort(src)
+	m.Payload.DstAddress, m.Payload.DstPort = addrPort(dst)
+	// see UnmarshalText on why we're using system generated time
+	m.Payload.Time = time.Now()
+	switch packet.PDUType {
+	case gosnmp.Trap:
+		m.Payload.PDUVersion = "TRAP"
+	case gosnmp.SNMPv2Trap:
+		m.Payload.PDUVersion = "TRAP2"
+	case gosnmp.InformRequest:
+		m.Payload.PDUVersion = "INFORM"
+	default:
+		return errors.Errorf("unexpected pdu type %s", packet.PDUType)
+	}
+	switch packet.Version {
+	case gosnmp.Version1, gosnmp.Version2c:
+		m.Payload.SNMPVersion = "v" + packet.Version.String()
+		community := packet.Community
+		m.Payload.Community = &community
+	case gosnmp.Version3:
+		m.Payload.SNMPVersion = "v3"
+		if sp, ok := packet.SecurityParameters.(*gosnmp.UsmSecurityParameters); ok {
+			user := sp.UserName
+			m.Payload.User = &user
+		}
+		if packet.ContextName != "" {
+			context := packet.ContextName
+			m.Payload.Context = &context
+		}
+	}
+	var trapType, trapSubType int64
+	if packet.PDUType == gosnmp.Trap {
+		if packet.AgentAddress != "" && packet.AgentAddress != "0.0.0.0" {
+			agentAddr := packet.AgentAddress
+			m.Payload.AgentAddress = &agentAddr
+		}
+		if packet.Enterprise != "" && packet.Enterprise != "." {
+			enterprise := packet.Enterprise
+			if !strings.HasPrefix(enterprise, ".") {
+				enterprise = "." + enterprise
+			}
+			m.Payload.EnterpriseOID = &enterprise
+		}
+		if packet.Timestamp > 0 {
+			uptime := float64(packet.Timestamp) / 100
+			m.Payload.UptimeSeconds = &uptime
+		}
+		trapType = int64(packet.GenericTrap)
+		trapSubType = int64(packet.SpecificTrap)
+	}
+	// snmptrapd reports v2c/v3 notifications as generic trap 0, we do the same
+	// to keep the payload identical regardless of the listener
+	m.Payload.TrapType = &trapType
+	m.Payload.TrapSubType = &trapSubType
+	if description, ok := genericTrapNames[int(trapType)]; ok {
+		m.Payload.Description = &description
+	}
+	for _, pdu := range packet.Variables {
+		m.appendValue(valueFromPDU(pdu))
+	}
+	m.resolveEnterpriseMIBName()
+	return nil
+}
@@ -130,24 +130,34 @@ func (m *Message) parseValues(text string) {
 			value.Type = valType
 			value.Value = valueRaw
 			value.ValueDetail = valueDetail
-			if oidText == uptimeOID {
-				if v, ok := valueDetail.Raw.(float64); ok {
-					m.Payload.UptimeSeconds = &v
-				}
-			}
-			if oidText == agentOID || strings.HasPrefix(oidText, agentOID+".") {
-				if v, ok := valueRaw.(string); ok {
-					m.Payload.AgentAddress = &v
-				}
-			}
-			if oidText == enterpriseOID {
-				if v, ok := valueDetail.Raw.(string); ok {
-					m.Payload.EnterpriseOID = &v
-				}
-			}
-			m.Payload.Values = append(m.Payload.Values, value)
+			m.appendValue(value)
+		}
+	}
+	m.resolveEnterpriseMIBName()
+}
+
+// appendValue adds value to the payload and fills the payload fields
+// which are carried as well-known varbinds
+func (m *Message) appendValue(value Value) {
+	if value.OID == uptimeOID {
+		if v, ok := value.ValueDetail.Raw.(float64); ok {
+			m.Payload.UptimeSeconds = &v
+		}
+	}
+	if value.OID == agentOID || strings.HasPrefix(value.OID, agentOID+".") {
+		if v, ok := value.Value.(string); ok {
+			m.Payload.AgentAddress = &v
+		}
+	}
+	if value.OID == enterpriseOID {
+		if v, ok := value.ValueDetail.Raw.(string); ok {
+			m.Payload.EnterpriseOID = &v
 		}
 	}
+	m.Payload.Values = append(m.Payload.Values, value)
+}
+
+func (m *Message) resolveEnterpriseMIBName() {
 	if m.Payload.EnterpriseOID != nil {
 		if name, _, err := translateOID(*m.Payload.EnterpriseOID); err == nil {
 			m.Payload.EnterpriseMIBName = &name
@@ -186,6 +196,13 @@ func (m *Message) UnmarshalText(text []byte) error {
 	// because if trap message arrived at the same second mark, zabbix will reject
 	// the message and get marked as duplicate
 	m.Payload.Time = time.Now()
+	if m.useRecordTime {
+		// snmptrapd only has second precision, nanosecond is still taken from
+		// system time for the same reason as above
+		if recordTime, err := strconv.ParseInt(row[HeaderTime], 10, 64); err == nil && recordTime > 0 {
+			m.Payload.Time = time.Unix(recordTime, int64(m.Payload.Time.Nanosecond()))
+		}
+	}
 	if sysUptime, err := strconv.Atoi(row[HeaderUptime]); err == nil && sysUptime > 0 {
 		uptime := float64(sysUptime) / 100
 		m.Payload.UptimeSeconds = &uptime
@@ -218,6 +235,7 @@ func ParserWorker(
 	wg *sync.WaitGroup,
 	parseChan <-chan []byte,
 	messageChan chan<- *Message,
+	useRecordTime bool,
 ) {
 	defer wg.Done()
 	processed := metrics.ParserProcessed.With(prometheus.Labels{"worker": strconv.Itoa(i)})
@@ -225,7 +243,7 @@ func ParserWorker(
 	dropped := metrics.ParserDropped.With(prometheus.Labels{"worker": strconv.Itoa(i)})
 	for raw := range parseChan {
 		processed.Inc()
-		var msg Message
+		msg := Message{useRecordTime: useRecordTime}
 		if err := msg.UnmarshalText(raw); err != nil {
 			log.Debug().Err(err).Str("data", string(raw)).Msg("message parsing failed")
 			dropped.Inc()
@@ -140,13 +140,61 @@ type AuthConfig struct {
 	User []User
 }
 
+type ListenMode int8
+
+const (
+	// ModeSnmpTrapD reads snmptrapd output from stdin
+	ModeSnmpTrapD ListenMode = iota
+	// ModeNative listens to traps using the built-in listener, snmptrapd is not used
+	ModeNative
+	// ModeSupervised spawns snmptrapd and restarts it whenever it exits
+	ModeSupervised
+)
+
+func (l *ListenMode) String() string {
+	switch *l {
+	case ModeSnmpTrapD:
+		return "snmptrapd"
+	case ModeNative:
+		return "native"
+	case ModeSupervised:
+		return "supervised"
+	default:
+		return ""
+	}
+}
+
+func (l *ListenMode) UnmarshalText(text []byte) error {
+	if l == nil {
+		return errors.New("can't unmarshal a nil *ListenMode")
+	}
+	switch strings.ToLower(string(text)) {
+	case "snmptrapd":
+		*l = ModeSnmpTrapD
+	case "native":
+		*l = ModeNative
+	case "supervised":
+		*l = ModeSupervised
+	default:
+		return errors.Errorf("unsupported ListenMode: %s", string(text))
+	}
+	return nil
+}
+
 type Config struct {
-	Auth             AuthConfig
-	Listening        []string
+	Mode      ListenMode
+	Auth      AuthConfig
+	Listening []string
+	// EngineID is the local engine id used by the native listener to receive v3 informs
+	EngineID         string `mapstructure:"engine_id"`
 	AdditionalConfig string `mapstructure:"additional_config"`
 	MagicBegin       string `mapstructure:"magic_begin"`
 	MagicEnd         string `mapstructure:"magic_end"`
 	BufferSize       string `mapstructure:"buffer_size"`
+	// UseRecordTime uses the timestamp written by snmptrapd instead of the system time
+	UseRecordTime bool `mapstructure:"use_record_time"`
+	// Supervisor is only used on supervised mode
+	Supervisor SupervisorConfig
 }
 
 func (c *Config) GetBufferSize() (int, error) {
@@ -0,0 +1,170 @@
+package snmp
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/bangunindo/trap2json/helper"
+	"github.com/bangunindo/trap2json/metrics"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// SupervisorConfig defines how snmptrapd is spawned on supervised mode
+type SupervisorConfig struct {
+	// Command is the snmptrapd executable
+	Command string
+	// Args is passed to snmptrapd before -c ConfigPath, it must keep snmptrapd
+	// in the foreground and write traps to stdout
+	Args []string
+	// ConfigPath is where snmptrapd.conf is generated before spawning snmptrapd
+	ConfigPath string `mapstructure:"config_path"`
+	// MinRestartDelay is the delay before the first restart, it's doubled
+	// on every consecutive crash up to MaxRestartDelay
+	MinRestartDelay helper.Duration `mapstructure:"min_restart_delay"`
+	MaxRestartDelay helper.Duration `mapstructure:"max_restart_delay"`
+	// StopTimeout is how long to wait after SIGTERM before killing snmptrapd
+	StopTimeout helper.Duration `mapstructure:"stop_timeout"`
+}
+
+// Validate checks the config without spawning snmptrapd, the error path
+// is relative to the supervisor config
+func (c *SupervisorConfig) Validate() []helper.ConfigError {
+	var errs []helper.ConfigError
+	if c.Command == "" {
+		errs = append(errs, helper.ConfigError{Path: "command", Err: errors.New("command is required")})
+	}
+	if c.ConfigPath == "" {
+		errs = append(errs, helper.ConfigError{Path: "config_path", Err: errors.New("config_path is required")})
+	}
+	return errs
+}
+
+// Supervisor spawns snmptrapd and restarts it whenever it exits. Output of every
+// snmptrapd process is written to the same Reader, so the reader doesn't
+// see EOF until the supervisor stops
+type Supervisor struct {
+	conf   Config
+	logger zerolog.Logger
+	reader *io.PipeReader
+	writer *io.PipeWriter
+}
+
+func NewSupervisor(conf Config) *Supervisor {
+	if conf.Supervisor.MinRestartDelay.Duration <= 0 {
+		conf.Supervisor.MinRestartDelay.Duration = time.Second
+	}
+	if conf.Supervisor.MaxRestartDelay.Duration < conf.Supervisor.MinRestartDelay.Duration {
+		conf.Supervisor.MaxRestartDelay = conf.Supervisor.MinRestartDelay
+	}
+	if conf.Supervisor.StopTimeout.Duration <= 0 {
+		conf.Supervisor.StopTimeout.Duration = 5 * time.Second
+	}
+	r, w := io.Pipe()
+	return &Supervisor{
+		conf:   conf,
+		logger: log.With().Str("module", "snmptrapd_supervisor").Logger(),
+		reader: r,
+		writer: w,
+	}
+}
+
+// Reader returns snmptrapd stdout
+func (s *Supervisor) Reader() io.Reader {
+	return s.reader
+}
+
+// logStderr forwards snmptrapd stderr to the logger, line by line
+func (s *Supervisor) logStderr(r io.Reader) {
+	logger := log.With().Str("module", "snmptrapd").Logger()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			logger.Warn().Msg(line)
+		}
+	}
+}
+
+// runOnce runs snmptrapd until it exits or ctx is done
+func (s *Supervisor) runOnce(ctx context.Context) error {
+	args := append(append([]string{}, s.conf.Supervisor.Args...), "-c", s.conf.Supervisor.ConfigPath)
+	cmd := exec.Command(s.conf.Supervisor.Command, args...)
+	cmd.Stdout = s.writer
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return errors.Wrap(err, "failed opening snmptrapd stderr")
+	}
+	if err = cmd.Start(); err != nil {
+		return errors.Wrap(err, "failed starting snmptrapd")
+	}
+	s.logger.Info().Int("pid", cmd.Process.Pid).Msg("snmptrapd started")
+	metrics.SnmpTrapDUp.Set(1)
+	defer metrics.SnmpTrapDUp.Set(0)
+	stderrDone := make(chan struct{})
+	go func() {
+		defer close(stderrDone)
+		s.logStderr(stderr)
+	}()
+	exited := make(chan error, 1)
+	go func() {
+		// stderr must be fully read before calling Wait
+		<-stderrDone
+		exited <- cmd.Wait()
+	}()
+	select {
+	case err = <-exited:
+		if err == nil {
+			return errors.New("snmptrapd exited")
+		}
+		return errors.Wrap(err, "snmptrapd exited")
+	case <-ctx.Done():
+	}
+	s.logger.Info().Msg("terminating snmptrapd process")
+	_ = cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-exited:
+	case <-time.After(s.conf.Supervisor.StopTimeout.Duration):
+		s.logger.Warn().Msg("snmptrapd doesn't terminate in time, killing it")
+		_ = cmd.Process.Kill()
+		<-exited
+	}
+	s.logger.Info().Msg("snmptrapd terminated")
+	return nil
+}
+
+// Run generates snmptrapd.conf and keeps snmptrapd running until ctx is done
+func (s *Supervisor) Run(ctx context.Context) error {
+	if err := s.conf.Serialize(s.conf.Supervisor.ConfigPath); err != nil {
+		_ = s.writer.CloseWithError(err)
+		return err
+	}
+	defer s.writer.Close()
+	delay := s.conf.Supervisor.MinRestartDelay.Duration
+	for {
+		started := time.Now()
+		err := s.runOnce(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		// a process that stays up longer than the max delay isn't crash looping
+		if time.Since(started) > s.conf.Supervisor.MaxRestartDelay.Duration {
+			delay = s.conf.Supervisor.MinRestartDelay.Duration
+		}
+		s.logger.Error().Err(err).Dur("restart_delay", delay).Msg("snmptrapd stopped, restarting")
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+		metrics.SnmpTrapDRestarts.Inc()
+		delay *= 2
+		if delay > s.conf.Supervisor.MaxRestartDelay.Duration {
+			delay = s.conf.Supervisor.MaxRestartDelay.Duration
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package snmp
+
+import (
+	"bufio"
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bangunindo/trap2json/helper"
+	"github.com/bangunindo/trap2json/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSupervisor(t *testing.T) {
+	// the appended -c <config_path> becomes $0 and $1 of the script
+	s := NewSupervisor(Config{
+		Supervisor: SupervisorConfig{
+			Command:         "sh",
+			Args:            []string{"-c", `echo "trap $(head -1 "$1")"; echo crashed >&2; exit 1`},
+			ConfigPath:      filepath.Join(t.TempDir(), "snmptrapd.conf"),
+			MinRestartDelay: helper.Duration{Duration: 10 * time.Millisecond},
+			MaxRestartDelay: helper.Duration{Duration: 20 * time.Millisecond},
+		},
+	})
+	restarts := testutil.ToFloat64(metrics.SnmpTrapDRestarts)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+	scanner := bufio.NewScanner(s.Reader())
+	for i := 0; i < 3; i++ {
+		if assert.True(t, scanner.Scan()) {
+			assert.Equal(t, "trap pidFile "+PidFilePath, scanner.Text())
+		}
+	}
+	cancel()
+	// output is drained until the supervisor stops
+	for scanner.Scan() {
+	}
+	assert.NoError(t, <-done)
+	assert.GreaterOrEqual(t, testutil.ToFloat64(metrics.SnmpTrapDRestarts)-restarts, float64(2))
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.SnmpTrapDUp))
+}
+
+func TestSupervisorTerminate(t *testing.T) {
+	s := NewSupervisor(Config{
+		Supervisor: SupervisorConfig{
+			Command:    "sh",
+			Args:       []string{"-c", `echo started; exec sleep 60`},
+			ConfigPath: filepath.Join(t.TempDir(), "snmptrapd.conf"),
+		},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- s.Run(ctx)
+	}()
+	scanner := bufio.NewScanner(s.Reader())
+	if assert.True(t, scanner.Scan()) {
+		assert.Equal(t, "started", scanner.Text())
+	}
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.SnmpTrapDUp))
+	cancel()
+	assert.False(t, scanner.Scan())
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		assert.Fail(t, "snmptrapd is not terminated")
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/bangunindo/trap2json/forwarder"
+	"github.com/bangunindo/trap2json/snmp"
+	"github.com/go-json-experiment/json"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// testCasePattern follows test_files naming convention, NNNN_name.yml
+var testCasePattern = regexp.MustCompile(`^[0-9]{4}_.+\.yml$`)
+
+// testIgnoredKeys are not compared since they're different on every run
+var testIgnoredKeys = []string{"time", "correlate"}
+
+type testCase struct {
+	Name   string
+	Config string
+	Log    string
+	// Expected is the expected output for all forwarders
+	Expected string
+	// ExpectedForwarder overrides Expected for a specific forwarder index (starts from 1)
+	ExpectedForwarder map[int]string
+}
+
+// findTestCases looks for NNNN_name.yml files along with NNNN_name.log and NNNN_name.ndjson.
+// NNNN_name.<index>.ndjson can be used when forwarders have different expected output
+func findTestCases(dir string) ([]testCase, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed reading test directory")
+	}
+	var cases []testCase
+	for _, entry := range entries {
+		if entry.IsDir() || !testCasePattern.MatchString(entry.Name()) {
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), ".yml")
+		tc := testCase{
+			Name:              name,
+			Config:            filepath.Join(dir, entry.Name()),
+			Log:               filepath.Join(dir, name+".log"),
+			ExpectedForwarder: make(map[int]string),
+		}
+		if _, err = os.Stat(tc.Log); err != nil {
+			return nil, errors.Wrapf(err, "missing trap log for %s", name)
+		}
+		if _, err = os.Stat(filepath.Join(dir, name+".ndjson")); err == nil {
+			tc.Expected = filepath.Join(dir, name+".ndjson")
+		}
+		fwdExpected, _ := filepath.Glob(filepath.Join(dir, name+".*.ndjson"))
+		for _, f := range fwdExpected {
+			idxStr := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(f), name+"."), ".ndjson")
+			if idx, err := strconv.Atoi(idxStr); err == nil {
+				tc.ExpectedForwarder[idx] = f
+			}
+		}
+		cases = append(cases, tc)
+	}
+	sort.Slice(cases, func(i, j int) bool {
+		return cases[i].Name < cases[j].Name
+	})
+	return cases, nil
+}
+
+// normalizeJSON removes testIgnoredKeys and returns a deterministic json representation
+func normalizeJSON(raw []byte) (string, error) {
+	var js any
+	if err := json.Unmarshal(raw, &js); err != nil {
+		return "", errors.Wrap(err, "invalid json")
+	}
+	if m, ok := js.(map[string]any); ok {
+		for _, k := range testIgnoredKeys {
+			delete(m, k)
+		}
+	}
+	out, err := json.Marshal(js, json.Deterministic(true))
+	if err != nil {
+		return "", errors.Wrap(err, "failed marshalling json")
+	}
+	return string(out), nil
+}
+
+func readNDJSON(path string) ([]string, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed reading expected output")
+	}
+	var lines []string
+	for i, line := range bytes.Split(raw, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		normalized, err := normalizeJSON(line)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s line %d", path, i+1)
+		}
+		lines = append(lines, normalized)
+	}
+	return lines, nil
+}
+
+// diffLines compares expected and actual line by line, returns an empty string if they're equal
+func diffLines(expected, actual []string) string {
+	var diff strings.Builder
+	for i := 0; i < len(expected) || i < len(actual); i++ {
+		var exp, act string
+		if i < len(expected) {
+			exp = expected[i]
+		}
+		if i < len(actual) {
+			act = actual[i]
+		}
+		if exp == act {
+			continue
+		}
+		if exp != "" {
+			fmt.Fprintf(&diff, "-%s\n", exp)
+		}
+		if act != "" {
+			fmt.Fprintf(&diff, "+%s\n", act)
+		}
+	}
+	return diff.String()
+}
+
+// collectMessages runs the trap log through parser and correlate, forwarders are replaced
+// with a mock so nothing is sent anywhere
+func collectMessages(c config, r io.Reader) []*snmp.Message {
+	// correlate state must not leak between test cases, nor the state of a live instance
+	c = isolate(c)
+	c.SnmpTrapD.Mode = snmp.ModeSnmpTrapD
+	// keep the message order
+	c.ParseWorkers = 1
+	c.Correlate.Workers = 1
+	out := make(chan *snmp.Message)
+	c.Forwarders = []forwarder.Config{{
+		ID:   "test",
+		Mock: &forwarder.MockConfig{OutChannel: out},
+	}}
+	var messages []*snmp.Message
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for m := range out {
+			messages = append(messages, m)
+		}
+	}()
+	Run(context.Background(), c, r, true)
+	close(out)
+	<-done
+	return messages
+}
+
+// runTestCase writes the test report to w and returns whether the test case passed
+func runTestCase(tc testCase, w io.Writer) bool {
+	fmt.Fprintf(w, "=== RUN   %s\n", tc.Name)
+	fail := func(format string, args ...any) bool {
+		fmt.Fprintf(w, "    "+format+"\n", args...)
+		fmt.Fprintf(w, "--- FAIL: %s\n", tc.Name)
+		return false
+	}
+	c, err := parseConfig(tc.Config)
+	if err != nil {
+		return fail("invalid config: %v", err)
+	}
+	f, err := os.Open(tc.Log)
+	if err != nil {
+		return fail("failed opening trap log: %v", err)
+	}
+	defer f.Close()
+	messages := collectMessages(c, f)
+	for i, m := range messages {
+		corr, _ := json.Marshal(m.Payload.Correlate)
+		fmt.Fprintf(w, "    trap %d: correlate: %s\n", i+1, corr)
+	}
+
+	passed := true
+	for i, fwdConf := range c.Forwarders {
+		fmt.Fprintf(w, "    forwarder %d (id: %s, type: %s)\n", i+1, fwdConf.ID, fwdConf.Type())
+		compiler, err := forwarder.NewMessageCompiler(fwdConf, log.Logger)
+		if err != nil {
+			fmt.Fprintf(w, "        %v\n", err)
+			passed = false
+			continue
+		}
+		var actual []string
+		for j, msg := range messages {
+			m := msg.Copy()
+			m.Metadata = snmp.Metadata{
+				TimeAsTimezone: fwdConf.TimeAsTimezone,
+				TimeFormat:     fwdConf.TimeFormat,
+			}
+			m.Compile(compiler)
+			if m.Metadata.Skip {
+				fmt.Fprintf(w, "        trap %d: dropped by filter\n", j+1)
+				continue
+			}
+			fmt.Fprintf(w, "        trap %d: kept: %s\n", j+1, m.Metadata.MessageJSON)
+			normalized, err := normalizeJSON(m.Metadata.MessageJSON)
+			if err != nil {
+				normalized = string(m.Metadata.MessageJSON)
+			}
+			actual = append(actual, normalized)
+		}
+		expectedPath := tc.Expected
+		if p, ok := tc.ExpectedForwarder[i+1]; ok {
+			expectedPath = p
+		}
+		if expectedPath == "" {
+			fmt.Fprintf(w, "        no expected output\n")
+			continue
+		}
+		expected, err := readNDJSON(expectedPath)
+		if err != nil {
+			fmt.Fprintf(w, "        %v\n", err)
+			passed = false
+			continue
+		}
+		if diff := diffLines(expected, actual); diff != "" {
+			passed = false
+			fmt.Fprintf(w, "        output differs from %s\n", expectedPath)
+			for _, line := range strings.Split(strings.TrimSuffix(diff, "\n"), "\n") {
+				fmt.Fprintf(w, "        %s\n", line)
+			}
+		}
+	}
+	if passed {
+		fmt.Fprintf(w, "--- PASS: %s\n", tc.Name)
+	} else {
+		fmt.Fprintf(w, "--- FAIL: %s\n", tc.Name)
+	}
+	return passed
+}
+
+// RunTests runs every test case in dir, returns false if any of them failed
+func RunTests(dir string, w io.Writer) (bool, error) {
+	cases, err := findTestCases(dir)
+	if err != nil {
+		return false, err
+	}
+	if len(cases) == 0 {
+		return false, errors.Errorf("no test case found in %s", dir)
+	}
+	var failed int
+	for _, tc := range cases {
+		if !runTestCase(tc, w) {
+			failed++
+		}
+	}
+	if failed > 0 {
+		fmt.Fprintf(w, "FAIL\t%d of %d test cases failed\n", failed, len(cases))
+		return false, nil
+	}
+	fmt.Fprintf(w, "ok\t%d test cases passed\n", len(cases))
+	return true, nil
+}
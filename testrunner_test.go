@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testRunnerLog = "--TFWDBEGIN--0.0.0.0|UDP: [192.168.215.1]:56983->[192.168.215.2]:10162|1689145835|0|Cold Start|.|" +
+	"TRAP2, SNMP v2c, community public|0|0|.1.3.6.1.2.1.1.3.0 = Timeticks: (1000) 0:00:10.00--TFWDEND--\n" +
+	"--TFWDBEGIN--0.0.0.0|UDP: [192.168.215.1]:56983->[192.168.215.2]:10162|1689145836|0|Cold Start|.|" +
+	"TRAP2, SNMP v2c, community private|0|0|.1.3.6.1.2.1.1.3.0 = Timeticks: (1000) 0:00:10.00--TFWDEND--\n"
+
+const testRunnerConfig = `
+forwarders:
+  - id: all
+    json_format: '{"community": community, "time": time}'
+    kafka:
+      hosts:
+        - localhost:9092
+  - id: public only
+    filter: community == "public"
+    json_format: '{"community": community, "src": src_address}'
+    mock:
+      timeout: 0s
+`
+
+func writeTestFile(t *testing.T, path, content string) {
+	if !assert.NoError(t, os.WriteFile(path, []byte(content), 0644)) {
+		t.FailNow()
+	}
+}
+
+func TestFindTestCases(t *testing.T) {
+	cases, err := findTestCases("test_files")
+	if assert.NoError(t, err) && assert.Len(t, cases, 4) {
+		assert.Equal(t, "0000_regular_message", cases[0].Name)
+		assert.Equal(t, filepath.Join("test_files", "0000_regular_message.log"), cases[0].Log)
+		assert.Equal(t, filepath.Join("test_files", "0000_regular_message.ndjson"), cases[0].Expected)
+		assert.Equal(t, "0003_correlate", cases[3].Name)
+	}
+}
+
+func TestRunTests(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "0000_pass.yml"), testRunnerConfig)
+	writeTestFile(t, filepath.Join(dir, "0000_pass.log"), testRunnerLog)
+	writeTestFile(t, filepath.Join(dir, "0000_pass.ndjson"), `{"community":"public"}
+{"community":"private"}
+`)
+	writeTestFile(t, filepath.Join(dir, "0000_pass.2.ndjson"), `{"community":"public","src":"192.168.215.1"}`)
+
+	var out bytes.Buffer
+	passed, err := RunTests(dir, &out)
+	assert.NoError(t, err)
+	assert.True(t, passed, out.String())
+	assert.Contains(t, out.String(), "trap 2: dropped by filter")
+	assert.Contains(t, out.String(), "--- PASS: 0000_pass")
+
+	writeTestFile(t, filepath.Join(dir, "0001_fail.yml"), testRunnerConfig)
+	writeTestFile(t, filepath.Join(dir, "0001_fail.log"), testRunnerLog)
+	writeTestFile(t, filepath.Join(dir, "0001_fail.ndjson"), `{"community":"public"}`)
+	out.Reset()
+	passed, err = RunTests(dir, &out)
+	assert.NoError(t, err)
+	assert.False(t, passed)
+	assert.Contains(t, out.String(), `+{"community":"private"}`)
+	assert.Contains(t, out.String(), "--- FAIL: 0001_fail")
+	assert.Contains(t, out.String(), "1 of 2 test cases failed")
+}
+
+func TestRunTestsDiskQueue(t *testing.T) {
+	dir := t.TempDir()
+	queueDir := filepath.Join(t.TempDir(), "correlate")
+	writeTestFile(t, filepath.Join(dir, "0000_disk.yml"), `
+correlate:
+  enable: true
+  conditions:
+    - match: src_address in ["192.168.215.1"]
+      identifiers:
+        - src_address
+      clear: "false"
+  queue_type: disk
+  queue_disk:
+    path: `+queueDir+`
+forwarders:
+  - id: mock
+    json_format: '{"community": community}'
+    mock:
+      timeout: 0s
+`)
+	writeTestFile(t, filepath.Join(dir, "0000_disk.log"), testRunnerLog)
+	writeTestFile(t, filepath.Join(dir, "0000_disk.ndjson"), `{"community":"public"}
+{"community":"private"}
+`)
+	var out bytes.Buffer
+	passed, err := RunTests(dir, &out)
+	assert.NoError(t, err)
+	assert.True(t, passed, out.String())
+	// the queue directory of a live instance is left alone
+	assert.NoDirExists(t, queueDir)
+}
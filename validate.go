@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"github.com/bangunindo/trap2json/helper"
+	"github.com/bangunindo/trap2json/queue"
+	"github.com/bangunindo/trap2json/snmp"
+	"github.com/pkg/errors"
+	"path/filepath"
+)
+
+// validateConfig compiles every expression and checks forwarder specific configs
+// without starting anything, so all problems can be reported at once
+func validateConfig(c config) []helper.ConfigError {
+	var errs []helper.ConfigError
+	if c.SnmpTrapD.Mode == snmp.ModeSupervised {
+		errs = append(errs, helper.PrefixConfigErrors("snmptrapd.supervisor", c.SnmpTrapD.Supervisor.Validate())...)
+	}
+	if c.Correlate.Enable {
+		errs = append(errs, helper.PrefixConfigErrors("correlate", c.Correlate.Validate())...)
+	}
+	for i, fwd := range c.Forwarders {
+		errs = append(errs, helper.PrefixConfigErrors(fmt.Sprintf("forwarders[%d]", i), fwd.Validate())...)
+	}
+	errs = append(errs, validateQueuePaths(c)...)
+	errs = append(errs, validateDeadLetters(c)...)
+	return errs
+}
+
+// validateDeadLetters makes sure dead_letter.forwarder refers to another forwarder
+func validateDeadLetters(c config) []helper.ConfigError {
+	var errs []helper.ConfigError
+	ids := make(map[string]bool)
+	for _, fwd := range c.Forwarders {
+		ids[fwd.ID] = true
+	}
+	for i, fwd := range c.Forwarders {
+		if fwd.DeadLetter == nil || fwd.DeadLetter.Forwarder == "" {
+			continue
+		}
+		path := fmt.Sprintf("forwarders[%d].dead_letter.forwarder", i)
+		switch {
+		case fwd.DeadLetter.Forwarder == fwd.ID:
+			errs = append(errs, helper.ConfigError{Path: path, Err: errors.New("forwarder can't be its own dead letter")})
+		case !ids[fwd.DeadLetter.Forwarder]:
+			errs = append(errs, helper.ConfigError{
+				Path: path,
+				Err:  errors.Errorf("forwarder %s is not found", fwd.DeadLetter.Forwarder),
+			})
+		}
+	}
+	return errs
+}
+
+// validateQueuePaths makes sure every disk queue has its own directory
+func validateQueuePaths(c config) []helper.ConfigError {
+	var errs []helper.ConfigError
+	used := make(map[string]string)
+	check := func(path string, queueType queue.Type, disk queue.DiskConfig, policy queue.OverflowPolicy) {
+		conf := queue.Config{Type: queueType, Disk: disk, OverflowPolicy: policy}
+		if !conf.UsesDisk() || disk.Path == "" {
+			return
+		}
+		dir := filepath.Clean(disk.Path)
+		if other, exists := used[dir]; exists {
+			errs = append(errs, helper.ConfigError{
+				Path: path + ".queue_disk.path",
+				Err:  errors.Errorf("%s is already used by %s", disk.Path, other),
+			})
+			return
+		}
+		used[dir] = path
+	}
+	if c.Correlate.Enable {
+		check("correlate", c.Correlate.QueueType, c.Correlate.QueueDisk, c.Correlate.OverflowPolicy)
+	}
+	for i, fwd := range c.Forwarders {
+		check(fmt.Sprintf("forwarders[%d]", i), fwd.QueueType, fwd.QueueDisk, fwd.OverflowPolicy)
+	}
+	return errs
+}
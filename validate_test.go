@@ -0,0 +1,184 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"path/filepath"
+	"testing"
+)
+
+func TestValidateConfig(t *testing.T) {
+	for _, f := range []string{"config.yml", "config-minimal.yml"} {
+		c, err := parseConfig(f)
+		if assert.NoError(t, err, f) {
+			assert.Empty(t, validateConfig(c), f)
+		}
+	}
+
+	confPath := filepath.Join(t.TempDir(), "config.yml")
+	writeTestFile(t, confPath, `
+correlate:
+  enable: true
+  backend_url: memcached://localhost
+  conditions:
+    - match: unknown_field == 1
+      clear: "true"
+forwarders:
+  - id: broken filter
+    filter: community ==
+    json_format: '"not a map"'
+    file:
+      path: ""
+  - id: kafka
+    kafka:
+      key_field: src_address +
+  - id: mqtt
+    mqtt:
+      hosts:
+        - tcp://127.0.0.1:1883
+  - id: trap
+    trap:
+      version: v2c
+  - id: zabbix
+    zabbix_trapper:
+      hostname_lookup_strategy: oid
+  - id: nothing
+  - id: disk without path
+    queue_type: disk
+    file:
+      path: /tmp/a.ndjson
+  - id: disk
+    queue_type: disk
+    queue_disk:
+      path: /tmp/queue
+    file:
+      path: /tmp/a.ndjson
+  - id: same disk
+    queue_type: disk
+    queue_disk:
+      path: /tmp/queue/
+    file:
+      path: /tmp/b.ndjson
+  - id: spill to same disk
+    overflow_policy: spill_to_disk
+    queue_disk:
+      path: /tmp/queue
+    file:
+      path: /tmp/c.ndjson
+  - id: spill from disk
+    queue_type: disk
+    overflow_policy: spill_to_disk
+    queue_disk:
+      path: /tmp/spill
+    file:
+      path: /tmp/d.ndjson
+  - id: dead letter to itself
+    dead_letter:
+      forwarder: dead letter to itself
+    file:
+      path: /tmp/e.ndjson
+  - id: dead letter to nothing
+    dead_letter:
+      forwarder: missing
+    file:
+      path: /tmp/f.ndjson
+  - id: dead letter without destination
+    dead_letter: {}
+    file:
+      path: /tmp/g.ndjson
+  - id: http templates
+    http:
+      url: http://localhost/devices/{src_address/events
+      method_template: "{src_address ==}"
+  - id: alertmanager without labels
+    alertmanager:
+      url: http://localhost:9093
+  - id: incident without routing key
+    incident:
+      severity: "{src_address ==}"
+  - id: elasticsearch bad index
+    elasticsearch:
+      url: http://localhost:9200
+      index: traps-%Y.%b
+      document_id: "src_address =="
+  - id: loki bad label
+    loki:
+      url: http://localhost:3100
+      labels:
+        src-address: "{src_address}"
+  - id: splunk without token
+    splunk_hec:
+      url: http://localhost:8088
+      ack:
+        channel: not-a-uuid
+  - id: syslog without address
+    syslog:
+      severity: "trap_type =="
+  - id: nats without servers
+    nats:
+      subject: traps.{src_address
+      username: user
+      token: secret
+  - id: amqp with http url
+    amqp:
+      url: http://localhost:5672
+      routing_key: traps.{src_address
+  - id: redis without key
+    redis:
+      url: mysql://localhost
+      max_len: -1
+`)
+	c, err := parseConfig(confPath)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var paths []string
+	for _, e := range validateConfig(c) {
+		paths = append(paths, e.Path)
+	}
+	assert.Equal(t, []string{
+		"correlate.backend_url",
+		"correlate.conditions[0].match",
+		"correlate.conditions[0].identifiers",
+		"forwarders[0].filter",
+		"forwarders[0].json_format",
+		"forwarders[1].kafka.hosts",
+		"forwarders[1].kafka.topic",
+		"forwarders[1].kafka.key_field",
+		"forwarders[2].mqtt.topic",
+		"forwarders[3].trap.host",
+		"forwarders[3].trap.community",
+		"forwarders[4].zabbix_trapper.item_key",
+		"forwarders[4].zabbix_trapper.default_address",
+		"forwarders[4].zabbix_trapper.default_port",
+		"forwarders[4].zabbix_trapper.oid_lookup",
+		"forwarders[5].id",
+		"forwarders[6].queue_disk.path",
+		"forwarders[10].overflow_policy",
+		"forwarders[13].dead_letter.path",
+		"forwarders[14].http.url",
+		"forwarders[14].http.method_template",
+		"forwarders[15].alertmanager.labels",
+		"forwarders[16].incident.routing_key",
+		"forwarders[16].incident.summary",
+		"forwarders[16].incident.severity",
+		"forwarders[17].elasticsearch.index",
+		"forwarders[17].elasticsearch.document_id",
+		"forwarders[18].loki.labels.src-address",
+		"forwarders[19].splunk_hec.token",
+		"forwarders[19].splunk_hec.ack.channel",
+		"forwarders[20].syslog.address",
+		"forwarders[20].syslog.severity",
+		"forwarders[21].nats.servers",
+		"forwarders[21].nats.subject",
+		"forwarders[21].nats.credentials",
+		"forwarders[22].amqp.url",
+		"forwarders[22].amqp.routing_key",
+		"forwarders[23].redis.url",
+		"forwarders[23].redis.key",
+		"forwarders[23].redis.max_len",
+		"forwarders[8].queue_disk.path",
+		"forwarders[9].queue_disk.path",
+		"forwarders[11].dead_letter.forwarder",
+		"forwarders[12].dead_letter.forwarder",
+	}, paths)
+}